@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// allOrNothingTicket returns a ticket of org1 requesting tasks, which asks
+// to be dispatched all or nothing.
+func allOrNothingTicket(t *testing.T, tasks ...tasking.Task) string {
+	ticket := tasking.Ticket{
+		Expiration:   time.Now().Add(time.Hour),
+		Tasks:        tasks,
+		SignerKeyId:  "org1",
+		AllOrNothing: true}
+	if err := tasking.SignTicket(&ticket, ticketKey(t), ""); err != nil {
+		t.Fatal(err)
+	}
+	x, _ := json.Marshal(ticket)
+	return string(x)
+}
+
+func TestAllOrNothing(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO", "YARA"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit:        map[string]RabbitConf{"YARA": {Exchange: "yara", RoutingKey: "work.yara"}},
+		TaskQuotas:    map[string]QuotaConf{"org1": {Tasks: 10, Window: 3600}},
+	})
+	invalid := newTask("PEINFO")
+	invalid.PrimaryURI = ""
+
+	// requested by the ticket
+	answer := handleDecrypted(allOrNothingTicket(t, newTask("PEINFO", "YARA", "CUCKOO"), newTask("YARA"), invalid))
+	if answer.Error != nil || len(answer.Accepted) != 0 || len(answer.Withheld) != 3 {
+		t.Fatalf("expected the ticket withheld as a whole: %+v", answer)
+	}
+	if len(answer.TskErrors) != 2 || answer.DryRun {
+		t.Errorf("expected the rejected services reported: %+v", answer.TskErrors)
+	}
+	if len(ch.messages()) != 0 {
+		t.Errorf("expected nothing published, got %d messages", len(ch.messages()))
+	}
+	if answer := handleDecrypted(allOrNothingTicket(t, newTask("PEINFO", "YARA"))); answer.Error != nil || len(answer.Accepted) != 2 || len(answer.Withheld) != 0 || len(ch.messages()) != 2 {
+		t.Fatalf("expected a ticket without rejections dispatched: %+v", answer)
+	}
+
+	// configured for the organization
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "CUCKOO")))
+	if answer.Error != nil || len(answer.Accepted) != 1 || len(ch.messages()) != 3 {
+		t.Fatalf("expected partial acceptance by default: %+v", answer)
+	}
+	conf.AllOrNothing = []string{"org1"}
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "CUCKOO")))
+	if answer.Error != nil || len(answer.Withheld) != 1 || len(ch.messages()) != 3 {
+		t.Fatalf("expected the ticket withheld as a whole: %+v", answer)
+	}
+
+	// only the dispatched services count against the quota
+	used := 0
+	for _, r := range quotaUsage["org1"] {
+		used += r.n
+	}
+	if used != 3 {
+		t.Errorf("expected 3 services counted against the quota, got %d", used)
+	}
+}
+
+func TestAllOrNothingChecksOnce(t *testing.T) {
+	checked := 0
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checked++
+	}))
+	defer storage.Close()
+	ch := setupGateway(t, &config{
+		AllowedTasks:     map[string][]string{"org1": []string{"PEINFO", "YARA"}},
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		SampleStorageURI: storage.URL + "/samples/",
+		VerifySamples:    true,
+		TicketSequences:  true,
+		TaskRateLimits:   map[string]RateConf{"PEINFO": {Rate: 0.001, Burst: 1}},
+	})
+	sequenced := func(sequence uint64, tasks ...tasking.Task) string {
+		ticket := tasking.Ticket{
+			Expiration:   time.Now().Add(time.Hour),
+			Tasks:        tasks,
+			SignerKeyId:  "org1",
+			Sequence:     sequence,
+			AllOrNothing: true}
+		if err := tasking.SignTicket(&ticket, ticketKey(t), ""); err != nil {
+			t.Fatal(err)
+		}
+		x, _ := json.Marshal(ticket)
+		return string(x)
+	}
+
+	// a withheld ticket takes no rate limit tokens and keeps its sequence
+	answer := handleDecrypted(sequenced(1, newTask("PEINFO", "CUCKOO")))
+	if answer.Error != nil || len(answer.Withheld) != 1 || len(ch.messages()) != 0 {
+		t.Fatalf("expected the ticket withheld: %+v", answer)
+	}
+	answer = handleDecrypted(sequenced(1, newTask("PEINFO", "YARA"), newTask("YARA")))
+	if answer.Error != nil || len(answer.TskErrors) != 0 || len(answer.Accepted) != 3 || len(ch.messages()) != 2 {
+		t.Fatalf("expected the ticket dispatched with the same sequence: %+v", answer)
+	}
+	// every sample is checked once, while the ticket is checked
+	if checked != 3 {
+		t.Errorf("expected 3 sample checks, got %d", checked)
+	}
+	if answer.Accepted[0].PrimaryURI != newTask().PrimaryURI {
+		t.Errorf("summary has the resolved URI: %+v", answer.Accepted[0])
+	}
+}
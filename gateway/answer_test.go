@@ -0,0 +1,256 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func plainAnswer(t *testing.T, w *httptest.ResponseRecorder) tasking.PlainAnswer {
+	if h := w.Header().Get(tasking.EncryptedHeader); h != "false" {
+		t.Fatalf("expected %s: false, got %q", tasking.EncryptedHeader, h)
+	}
+	var answer tasking.PlainAnswer
+	if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("%s: %s", err, w.Body.String())
+	}
+	if answer.Encrypted || answer.Error == nil {
+		t.Fatalf("expected a plain error, got %s", w.Body.String())
+	}
+	return answer
+}
+
+func TestPlainErrorBeforeDecryption(t *testing.T) {
+	setupGateway(t, &config{})
+
+	// malformed base64
+	r, _ := http.NewRequest("POST", "/task/?IV=%25%25%25", nil)
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a malformed request, got %d", w.Code)
+	}
+	plainAnswer(t, w)
+
+	// unknown key, the symmetric key can't be extracted
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	enc.KeyFingerprint = "unknown"
+	w = httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if answer := plainAnswer(t, w); answer.Error.Code != tasking.ERR_KEY_UNKNOWN {
+		t.Errorf("expected ERR_KEY_UNKNOWN, got %v", answer.Error.Code)
+	}
+}
+
+func TestEncryptedErrorAfterDecryption(t *testing.T) {
+	setupGateway(t, &config{})
+
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(-time.Hour), newTask("PEINFO")))
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if h := w.Header().Get(tasking.EncryptedHeader); h != "true" {
+		t.Fatalf("expected %s: true, got %q", tasking.EncryptedHeader, h)
+	}
+	if answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey); answer.Error == nil {
+		t.Errorf("expected an error for an expired ticket")
+	}
+}
+
+func TestEncryptedAnswerGCM(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ticket := signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"))
+	enc, symKey := encryptTicket(t, ticket)
+	enc.IV = enc.IV[:tasking.AES_GCM_NONCE_SIZE]
+	encrypted, err := tasking.AesGcmEncrypt([]byte(ticket), symKey, enc.IV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Encrypted = encrypted
+	enc.Encryption = tasking.ENCRYPTION_AES_GCM
+
+	// the answer to a GCM ticket is encrypted with GCM and a fresh nonce
+	var nonces []string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		httpRequestIncoming(w, taskRequest(enc))
+		if h := w.Header().Get(tasking.EncryptionHeader); h != tasking.ENCRYPTION_AES_GCM {
+			t.Fatalf("expected %s: %s, got %q", tasking.EncryptionHeader, tasking.ENCRYPTION_AES_GCM, h)
+		}
+		body := w.Body.Bytes()
+		if answer := decryptAnswer(t, body, enc, symKey); answer.Error != nil || len(answer.Accepted) != 1 {
+			t.Fatalf("unexpected answer: %+v", answer)
+		}
+		nonce := body[:tasking.AES_GCM_NONCE_SIZE]
+		if bytes.Equal(nonce, enc.IV) {
+			t.Errorf("the nonce of the ticket was reused")
+		}
+		nonces = append(nonces, string(nonce))
+
+		// a modified answer fails to decrypt
+		body[len(body)-1] ^= 1
+		if _, err := tasking.AesGcmDecrypt(body[tasking.AES_GCM_NONCE_SIZE:], symKey, nonce); err == nil {
+			t.Errorf("modified answer decrypted")
+		}
+	}
+	if nonces[0] == nonces[1] {
+		t.Errorf("the nonce was reused for two answers")
+	}
+}
+
+func TestDecryptionFailureEncoding(t *testing.T) {
+	c := &config{}
+	setupGateway(t, c)
+	ticket := signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"))
+
+	// RSA fails, no symmetric key
+	enc, _ := encryptTicket(t, ticket)
+	enc.EncryptedKey = append([]byte(nil), enc.EncryptedKey...)
+	enc.EncryptedKey[0] ^= 0xff
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if answer := plainAnswer(t, w); answer.Error.Code != tasking.ERR_ENCRYPTION {
+		t.Errorf("expected ERR_ENCRYPTION, got %v", answer.Error.Code)
+	}
+
+	// RSA succeeds, but yields no valid AES key
+	enc, _ = encryptTicket(t, ticket)
+	shortKey, err := tasking.RsaEncrypt([]byte("short"), &sourceKey(t).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.EncryptedKey = shortKey
+	w = httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if answer := plainAnswer(t, w); answer.Error.Code != tasking.ERR_ENCRYPTION {
+		t.Errorf("expected ERR_ENCRYPTION, got %v", answer.Error.Code)
+	}
+
+	// AES fails with a valid symmetric key
+	enc, symKey := encryptTicket(t, ticket)
+	enc.Encrypted = enc.Encrypted[:len(enc.Encrypted)-1]
+	w = httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if h := w.Header().Get(tasking.EncryptedHeader); h != "true" {
+		t.Fatalf("expected %s: true, got %q", tasking.EncryptedHeader, h)
+	}
+	if answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey); answer.Error == nil || answer.Error.Code != tasking.ERR_ENCRYPTION {
+		t.Errorf("expected ERR_ENCRYPTION, got %+v", answer.Error)
+	}
+
+	// AES fails, but the IV is broken, so the answer can't be encrypted
+	enc, _ = encryptTicket(t, ticket)
+	enc.IV = enc.IV[:8]
+	w = httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	plainAnswer(t, w)
+
+	// AES fails with PlainDecryptErrors
+	c.PlainDecryptErrors = true
+	enc, _ = encryptTicket(t, ticket)
+	enc.Encrypted = enc.Encrypted[:len(enc.Encrypted)-1]
+	w = httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if answer := plainAnswer(t, w); answer.Error.Code != tasking.ERR_ENCRYPTION {
+		t.Errorf("expected ERR_ENCRYPTION, got %v", answer.Error.Code)
+	}
+}
+
+func TestEncryptedKeyWrongSize(t *testing.T) {
+	setupGateway(t, &config{})
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+
+	for _, size := range []int{0, len(enc.EncryptedKey) - 1, len(enc.EncryptedKey) + 1, 2 * len(enc.EncryptedKey)} {
+		wrong := *enc
+		wrong.EncryptedKey = make([]byte, size)
+		copy(wrong.EncryptedKey, enc.EncryptedKey)
+		_, _, err, symKey := decryptTicket(&wrong)
+		if err == nil || err.Code != tasking.ERR_ENCRYPTION || err.Error.Error() != "EncryptedKey wrong size for key" || symKey != nil {
+			t.Errorf("size %d: expected a size error, got %v", size, err)
+		}
+	}
+
+	if _, _, err, _ := decryptTicket(enc); err != nil {
+		t.Errorf("correctly sized key rejected: %v", err.Error)
+	}
+}
+
+func TestFallbackSourceKeys(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	// the ticket names a key which was rotated out, the key itself is
+	// still present as src2
+	keys = map[string]*rsa.PrivateKey{"other": ticketKey(t), "src2": sourceKey(t)}
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+
+	if _, _, err, _ := decryptTicket(enc); err == nil || err.Code != tasking.ERR_KEY_UNKNOWN {
+		t.Fatalf("expected ERR_KEY_UNKNOWN without fallback keys, got %v", err)
+	}
+
+	conf.FallbackSourceKeys = []string{"missing", "other", "src2"}
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+	if answer.Error != nil || len(answer.Accepted) != 1 {
+		t.Errorf("ticket not decrypted with the fallback key: %+v", answer)
+	}
+}
+
+func TestSymKeyDebugLogging(t *testing.T) {
+	setupGateway(t, &config{})
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func(allowed bool) { debugCryptoAllowed = allowed }(debugCryptoAllowed)
+
+	decrypt := func() []byte {
+		buf.Reset()
+		enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+		if _, _, err, _ := decryptTicket(enc); err != nil {
+			t.Fatal(err.Error)
+		}
+		return symKey
+	}
+	leaked := func(symKey []byte) bool {
+		out := buf.String()
+		return strings.Contains(out, string(symKey)) || strings.Contains(out, fmt.Sprintf("%x", symKey)) ||
+			strings.Contains(out, base64.StdEncoding.EncodeToString(symKey)) || strings.Contains(out, fmt.Sprint(symKey))
+	}
+	hashed := func(symKey []byte) bool {
+		return strings.Contains(buf.String(), fmt.Sprintf("%x", sha256.Sum256(symKey)))
+	}
+
+	// by default, nothing about the key is logged
+	debugCryptoAllowed = true
+	if symKey := decrypt(); leaked(symKey) || hashed(symKey) {
+		t.Errorf("key logged by default")
+	}
+
+	// a production build ignores the flag
+	conf.DebugCrypto = true
+	debugCryptoAllowed = false
+	if symKey := decrypt(); leaked(symKey) || hashed(symKey) {
+		t.Errorf("key logged in a production build")
+	}
+
+	// in a debug build, only the hash is logged
+	debugCryptoAllowed = true
+	if symKey := decrypt(); leaked(symKey) || !hashed(symKey) {
+		t.Errorf("expected only the hash of the key in the log: %s", buf.String())
+	}
+}
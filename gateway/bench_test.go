@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchGateway sets up a gateway with a realistic configuration: a partial
+// ACL, aliases, and some services routed to their own exchanges.
+func benchGateway(b *testing.B) {
+	setupGateway(b, &config{
+		SampleStorageURI: "http://storage/samples/",
+		AllowedTasks:     map[string][]string{"org1": []string{"PEINFO", "YARA", "PEID", "RICHHEADER", "CUCKOO", "VIRUSTOTAL"}},
+		TaskAliases:      map[string]string{"SANDBOX": "CUCKOO"},
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit: map[string]RabbitConf{
+			"CUCKOO":     RabbitConf{Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"},
+			"VIRUSTOTAL": RabbitConf{Exchange: "totem_external", RoutingKey: "work.external.totem"}},
+	})
+	log.SetOutput(ioutil.Discard)
+}
+
+func BenchmarkHandleDecrypted(b *testing.B) {
+	benchGateway(b)
+	defer log.SetOutput(os.Stderr)
+
+	tasks := newTask("PEINFO", "YARA", "PEID", "RICHHEADER", "SANDBOX", "VIRUSTOTAL", "OBJDUMP")
+	tasks.Tasks["YARA"] = []string{"rules/index.yar"}
+	ticket := signTicket(b, "org1", time.Now().Add(time.Hour), tasks, tasks, tasks, tasks, tasks)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rabbitChannel = &fakeChannel{}
+		handleDecrypted(ticket)
+	}
+}
+
+func BenchmarkPushToTransport(b *testing.B) {
+	benchGateway(b)
+	defer log.SetOutput(os.Stderr)
+
+	task := newTask("PEINFO", "YARA", "PEID", "RICHHEADER", "CUCKOO", "VIRUSTOTAL")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rabbitChannel = &fakeChannel{}
+		pushToTransport(task, "", "", time.Time{})
+	}
+}
+
+// BenchmarkUnknownTasks measures rejecting services of a ticket in a
+// deployment with many organizations, whose ACLs all have to be consulted
+// to tell unknown task types apart.
+func BenchmarkUnknownTasks(b *testing.B) {
+	benchGateway(b)
+	defer log.SetOutput(os.Stderr)
+	conf.ReportUnknownTasks = true
+	conf.AllowedTasks["org1"] = []string{"PEINFO"}
+	for i := 2; i <= 1000; i++ {
+		conf.AllowedTasks["org"+strconv.Itoa(i)] = []string{"PEINFO", "YARA", "PEID", "RICHHEADER", "CUCKOO", "VIRUSTOTAL"}
+	}
+	allowedTasks = buildAllowedTasks(conf)
+	knownTasks = buildKnownTasks(conf, allowedTasks)
+
+	tasks := newTask("PEINFO", "OBJDUMP", "PEIFNO", "YAARA", "PEID")
+	ticket := signTicket(b, "org1", time.Now().Add(time.Hour), tasks, tasks, tasks, tasks, tasks)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rabbitChannel = &fakeChannel{}
+		handleDecrypted(ticket)
+	}
+}
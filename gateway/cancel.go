@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"github.com/streadway/amqp"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An organization can cancel a ticket it submitted by sending
+// "DELETE /task/<TraceID>". The gateway then publishes a Cancellation to
+// conf.CancelExchange, so consumers can abort their work. For this, the
+// services dispatched for each ticket are remembered for
+// conf.CancelWindow seconds.
+
+// dispatchRecord remembers the services dispatched for a ticket.
+type dispatchRecord struct {
+	tasks []tasking.TaskSummary
+	at    time.Time
+}
+
+var (
+	dispatchRecords = make(map[ticketRef]*dispatchRecord)
+	dispatchMutex   = &sync.Mutex{}
+)
+
+// cancelWindow returns the time a dispatched ticket can be cancelled.
+func cancelWindow() time.Duration {
+	if conf.CancelWindow <= 0 {
+		return time.Hour
+	}
+	return time.Duration(conf.CancelWindow) * time.Second
+}
+
+// recordDispatch remembers the services dispatched for the ticket ref, if
+// cancellations are enabled.
+func recordDispatch(ref ticketRef, dispatched []tasking.TaskSummary) {
+	if conf.CancelExchange == "" {
+		return
+	}
+	now := timeNow()
+	window := cancelWindow()
+	dispatchMutex.Lock()
+	defer dispatchMutex.Unlock()
+	for seen, r := range dispatchRecords {
+		if now.Sub(r.at) >= window {
+			delete(dispatchRecords, seen)
+		}
+	}
+	dispatchRecords[ref] = &dispatchRecord{tasks: dispatched, at: now}
+}
+
+var errUnknownTraceID = errors.New("Unknown trace ID")
+
+// cancelTicket publishes the cancellation of the ticket ref. Only tickets
+// dispatched within the cancel window can be cancelled, and each only
+// once.
+func cancelTicket(ref ticketRef) (*tasking.Cancellation, *tasking.MyError) {
+	dispatchMutex.Lock()
+	record, exists := dispatchRecords[ref]
+	if !exists || timeNow().Sub(record.at) >= cancelWindow() {
+		dispatchMutex.Unlock()
+		return nil, &tasking.MyError{Error: errUnknownTraceID, Code: tasking.ERR_OTHER_UNRECOVERABLE}
+	}
+	delete(dispatchRecords, ref)
+	dispatchMutex.Unlock()
+
+	cancellation := &tasking.Cancellation{
+		TraceID:      ref.traceID,
+		Organization: ref.org,
+		Tenant:       ref.tenant,
+		Tasks:        record.tasks,
+		Timestamp:    timeNow()}
+	msgBody, err := json.Marshal(cancellation)
+	if err != nil {
+		return nil, &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+	pub := amqp.Publishing{DeliveryMode: amqp.Persistent, ContentType: "application/json", Body: msgBody}
+	log.Printf("Cancelling ticket %s of '%s'", ref.traceID, ref.org)
+	if myerr := publishReliably(&RabbitConf{Exchange: conf.CancelExchange, RoutingKey: conf.CancelRoutingKey}, pub); myerr != nil {
+		// let the organization retry
+		dispatchMutex.Lock()
+		dispatchRecords[ref] = record
+		dispatchMutex.Unlock()
+		return nil, myerr
+	}
+	return cancellation, nil
+}
+
+// httpRequestCancel cancels the ticket named in the path for the
+// organization authenticated by orgAuthMiddleware at the tenant addressed
+// by r.
+func httpRequestCancel(w http.ResponseWriter, r *http.Request) {
+	if conf.CancelExchange == "" {
+		http.Error(w, "Cancellation not supported", http.StatusNotImplemented)
+		return
+	}
+	traceID := strings.TrimPrefix(r.URL.Path, "/task/")
+	if traceID == "" || !stringPrintable(traceID) {
+		http.Error(w, "Invalid trace ID", http.StatusBadRequest)
+		return
+	}
+	cancellation, err := cancelTicket(newTicketRef(tenantFor(r), orgFromContext(r), traceID))
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		if err.Error == errUnknownTraceID {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error.Error(), status)
+		return
+	}
+	x, _ := json.Marshal(cancellation)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(x)
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func cancelRequest(t *testing.T, org, traceID string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, signedNonceRequest(t, "DELETE", "/task/"+traceID, org, time.Now()))
+	return w
+}
+
+func TestCancelTicket(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:     map[string][]string{"org1": []string{"*"}, "org2": []string{"*"}},
+		CancelExchange:   "holmes_control",
+		CancelRoutingKey: "cancel",
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA")))
+	if answer.Error != nil || answer.TraceID == "" {
+		t.Fatalf("unexpected answer: %+v", answer)
+	}
+
+	// other organizations can't cancel the ticket
+	if w := cancelRequest(t, "org2", answer.TraceID); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a ticket of another organization, got %d", w.Code)
+	}
+
+	w := cancelRequest(t, "org1", answer.TraceID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	msgs := ch.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected the task and the cancellation to be published, got %d messages", len(msgs))
+	}
+	if msgs[1].Exchange != "holmes_control" || msgs[1].RoutingKey != "cancel" {
+		t.Errorf("cancellation published to %s/%s", msgs[1].Exchange, msgs[1].RoutingKey)
+	}
+	var cancellation tasking.Cancellation
+	if err := json.Unmarshal(msgs[1].Publishing.Body, &cancellation); err != nil {
+		t.Fatal(err)
+	}
+	if cancellation.TraceID != answer.TraceID || cancellation.Organization != "org1" || len(cancellation.Tasks) != 2 {
+		t.Errorf("unexpected cancellation: %+v", cancellation)
+	}
+
+	// a ticket is only cancelled once
+	if w := cancelRequest(t, "org1", answer.TraceID); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a cancelled ticket, got %d", w.Code)
+	}
+}
+
+func TestCancelWindow(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:   map[string][]string{"org1": []string{"*"}},
+		CancelExchange: "holmes_control",
+		CancelWindow:   60,
+		RabbitDefault:  RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	now = now.Add(time.Minute)
+	if _, err := cancelTicket(newTicketRef(nil, "org1", answer.TraceID)); err == nil || err.Error != errUnknownTraceID {
+		t.Errorf("ticket cancelled after the cancel window")
+	}
+}
+
+func TestCancelDisabled(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if w := cancelRequest(t, "org1", answer.TraceID); w.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501 without CancelExchange, got %d", w.Code)
+	}
+}
@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The maximum age of a signed nonce used for authenticating an organization.
+var nonceMaxAge = 5 * time.Minute
+
+// The encryption and signature schemes supported by the gateway.
+var (
+	supportedEncryptionModes     = []string{"RSA-OAEP-SHA256/AES-CBC", "RSA-OAEP-SHA256/AES-GCM"}
+	supportedSignatureAlgorithms = []string{"RSA-PKCS1v15-SHA256"}
+)
+
+// The maximum size of the body of a request authenticated by an
+// organization.
+const maxAuthenticatedBody = 1 << 20
+
+var (
+	nonceMutex = &sync.Mutex{}
+	// signature digest -> time the nonce is no longer accepted anyway
+	seenNonces = make(map[[32]byte]time.Time)
+)
+
+// authenticateOrg verifies the identity of the organization issuing the
+// request r. The request has to carry the query parameters
+// "Organization", "Nonce", and "Signature". The nonce is the current time
+// in RFC3339 format and the signature is computed over
+// "<Organization>\n<Nonce>\n<Method>\n<Path>\n<Body>" using the
+// ticket signing key the organization has at the tenant addressed by r,
+// where <Path> includes the prefix of a tenant addressed by the path and
+// <Body> is the hex-encoded SHA256 digest of the request body.
+// Every signature is only accepted once. The body is left readable for
+// the handler.
+func authenticateOrg(r *http.Request) (string, error) {
+	q := r.URL.Query()
+	org := q.Get("Organization")
+	nonce := q.Get("Nonce")
+	signature, err := base64.StdEncoding.DecodeString(q.Get("Signature"))
+	if err != nil {
+		return "", errors.New("Invalid signature encoding")
+	}
+
+	issued, err := time.Parse(time.RFC3339, nonce)
+	if err != nil {
+		return "", errors.New("Invalid nonce")
+	}
+	if age := time.Since(issued); age > nonceMaxAge || age < -nonceMaxAge {
+		return "", errors.New("Nonce expired")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxAuthenticatedBody+1))
+		r.Body.Close()
+		if err != nil {
+			return "", errors.New("Failed to read the body")
+		}
+		if len(body) > maxAuthenticatedBody {
+			return "", errors.New("Body too large")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	bodyDigest := sha256.Sum256(body)
+
+	key, found := tenantFor(r).ticketKey(org)
+	if !found {
+		return "", errors.New("Organization unknown")
+	}
+	if ticketKeyExpired(org) {
+		return "", errTicketKeyExpired
+	}
+	signed := org + "\n" + nonce + "\n" + r.Method + "\n" + requestedPath(r) + "\n" + hex.EncodeToString(bodyDigest[:])
+	if err := tasking.Verify(signature, []byte(signed), key); err != nil {
+		return "", errors.New("Invalid signature")
+	}
+
+	digest := sha256.Sum256(signature)
+	now := time.Now()
+	nonceMutex.Lock()
+	defer nonceMutex.Unlock()
+	for d, expires := range seenNonces {
+		if now.After(expires) {
+			delete(seenNonces, d)
+		}
+	}
+	if _, seen := seenNonces[digest]; seen {
+		return "", errors.New("Nonce replayed")
+	}
+	seenNonces[digest] = issued.Add(nonceMaxAge)
+	return org, nil
+}
+
+// capabilitiesFor returns the capabilities of the tenant tn for org.
+func capabilitiesFor(tn *tenant, org string) tasking.Capabilities {
+	allowedTasks, _, disabled := tn.policy()
+	allowed := make([]string, 0, len(allowedTasks[org]))
+	for t := range allowedTasks[org] {
+		if _, isDisabled := disabled[t]; !isDisabled {
+			allowed = append(allowed, t)
+		}
+	}
+	sort.Strings(allowed)
+
+	return tasking.Capabilities{
+		Organization:        org,
+		AllowedTasks:        allowed,
+		EncryptionModes:     supportedEncryptionModes,
+		SignatureAlgorithms: supportedSignatureAlgorithms,
+	}
+}
+
+// httpRequestCapabilities must be wrapped by orgAuthMiddleware.
+func httpRequestCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	x, _ := json.Marshal(capabilitiesFor(tenantFor(r), orgFromContext(r)))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(x)
+}
@@ -0,0 +1,136 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedNonceRequest builds a request to path authenticated as org.
+func signedNonceRequest(t *testing.T, method, path, org string, issued time.Time) *http.Request {
+	return signedBodyRequest(t, method, path, org, issued, "")
+}
+
+// signedBodyRequest builds a request to path with the form-encoded body
+// authenticated as org. The nonce has fractional seconds, so requests
+// issued within the same second differ.
+func signedBodyRequest(t *testing.T, method, path, org string, issued time.Time, body string) *http.Request {
+	nonce := issued.Format(time.RFC3339Nano)
+	digest := sha256.Sum256([]byte(body))
+	signed := org + "\n" + nonce + "\n" + method + "\n" + path + "\n" + hex.EncodeToString(digest[:])
+	signature, err := tasking.Sign([]byte(signed), ticketKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := url.Values{}
+	q.Set("Organization", org)
+	q.Set("Nonce", nonce)
+	q.Set("Signature", base64.StdEncoding.EncodeToString(signature))
+	r, _ := http.NewRequest(method, path+"?"+q.Encode(), strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return r
+}
+
+func capabilitiesHandler() http.Handler {
+	return orgAuthMiddleware(http.HandlerFunc(httpRequestCapabilities))
+}
+
+func TestCapabilities(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks: map[string][]string{"org1": []string{"YARA", "PEINFO"}, "org2": []string{"*"}},
+	})
+
+	w := httptest.NewRecorder()
+	capabilitiesHandler().ServeHTTP(w, signedNonceRequest(t, "GET", "/capabilities", "org1", time.Now()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var caps tasking.Capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &caps); err != nil {
+		t.Fatal(err)
+	}
+	if caps.Organization != "org1" {
+		t.Errorf("wrong organization %s", caps.Organization)
+	}
+	if !reflect.DeepEqual(caps.AllowedTasks, []string{"PEINFO", "YARA"}) {
+		t.Errorf("capabilities do not match the ACL: %v", caps.AllowedTasks)
+	}
+	if len(caps.EncryptionModes) == 0 || len(caps.SignatureAlgorithms) == 0 {
+		t.Errorf("supported algorithms are missing")
+	}
+}
+
+func TestCapabilitiesUnauthenticated(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks: map[string][]string{"org1": []string{"PEINFO"}, "org2": []string{"*"}},
+	})
+
+	// org2's key is unknown, so the signature cannot be verified
+	w := httptest.NewRecorder()
+	capabilitiesHandler().ServeHTTP(w, signedNonceRequest(t, "GET", "/capabilities", "org2", time.Now()))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown organization, got %d", w.Code)
+	}
+
+	// replaying an old nonce is not possible
+	w = httptest.NewRecorder()
+	capabilitiesHandler().ServeHTTP(w, signedNonceRequest(t, "GET", "/capabilities", "org1", time.Now().Add(-time.Hour)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an expired nonce, got %d", w.Code)
+	}
+
+	// the signature must match the organization
+	r := signedNonceRequest(t, "GET", "/capabilities", "org1", time.Now())
+	q := r.URL.Query()
+	q.Set("Organization", "org2")
+	r.URL.RawQuery = q.Encode()
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+	w = httptest.NewRecorder()
+	capabilitiesHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a signature of a different organization, got %d", w.Code)
+	}
+
+	// the signature covers the method, the path, and the body
+	for name, r := range map[string]*http.Request{
+		"method": signedNonceRequest(t, "POST", "/capabilities", "org1", time.Now()),
+		"path":   signedNonceRequest(t, "GET", "/admin", "org1", time.Now()),
+		"body":   signedBodyRequest(t, "GET", "/capabilities", "org1", time.Now(), "a=1"),
+	} {
+		if name == "method" {
+			r.Method = "GET"
+		} else if name == "path" {
+			r.URL.Path = "/capabilities"
+		} else {
+			r.Body = ioutil.NopCloser(strings.NewReader("a=2"))
+		}
+		w = httptest.NewRecorder()
+		capabilitiesHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 for a different %s, got %d", name, w.Code)
+		}
+	}
+
+	// every signature is only accepted once
+	r = signedNonceRequest(t, "GET", "/capabilities", "org1", time.Now())
+	for i, expected := range []int{http.StatusOK, http.StatusUnauthorized} {
+		replay := *r
+		w = httptest.NewRecorder()
+		capabilitiesHandler().ServeHTTP(w, &replay)
+		if w.Code != expected {
+			t.Errorf("request %d: expected %d, got %d", i, expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package gateway
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"sync"
+	"time"
+)
+
+// In a deployment with several gateways, operators can broadcast signed
+// commands to all of them via the fanout exchange conf.ControlExchange,
+// instead of managing every node on its own. Each gateway consumes the
+// exchange with its own exclusive queue. Commands must be signed by an
+// organization listed in conf.AdminOrganizations, and are only accepted
+// once within nonceMaxAge of being issued.
+
+var (
+	controlMutex = &sync.Mutex{}
+	// signature digest -> time the command is no longer accepted anyway
+	seenCommands = make(map[[32]byte]time.Time)
+)
+
+// startControlConsumer binds an exclusive queue to conf.ControlExchange on
+// channel and executes the commands arriving on it. Once the channel is
+// lost, the management connection is restored.
+func startControlConsumer(channel amqpChannel) error {
+	var err error
+	if conf.RabbitPassive {
+		err = channel.ExchangeDeclarePassive(conf.ControlExchange, "fanout", true, false, false, false, nil)
+	} else {
+		err = channel.ExchangeDeclare(conf.ControlExchange, "fanout", true, false, false, false, nil)
+	}
+	if err != nil {
+		return errors.New("Failed to declare the control exchange: " + err.Error())
+	}
+	queue, err := channel.QueueDeclare(
+		"",    // name, chosen by the broker
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return errors.New("Failed to declare the control queue: " + err.Error())
+	}
+	if err := channel.QueueBind(queue.Name, "", conf.ControlExchange, false, nil); err != nil {
+		return errors.New("Failed to bind the control queue: " + err.Error())
+	}
+	deliveries, err := channel.Consume(
+		queue.Name, // queue
+		"",         // consumer
+		true,       // auto-ack
+		true,       // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		return errors.New("Failed to consume the control queue: " + err.Error())
+	}
+	go func() {
+		for d := range deliveries {
+			if err := handleControlMessage(d.Body); err != nil {
+				log.Println("Rejected control command: ", err)
+			}
+		}
+		restoreManagement(channel)
+	}()
+	return nil
+}
+
+// verifyControlCommand checks that command was recently signed by an
+// administrative organization and was not seen before.
+func verifyControlCommand(command tasking.ControlCommand) error {
+	if !isAdmin(nil, command.SignerKeyId) {
+		return errors.New("Signer is no administrator")
+	}
+	if age := timeNow().Sub(command.Issued); age > nonceMaxAge || age < -nonceMaxAge {
+		return errors.New("Command expired")
+	}
+	keysMutex.Lock()
+	key, found := ticketKeys[command.SignerKeyId]
+	keysMutex.Unlock()
+	if !found {
+		return errors.New("Signer unknown")
+	}
+	if ticketKeyExpired(command.SignerKeyId) {
+		return errTicketKeyExpired
+	}
+	if err := tasking.VerifyControlCommand(command, key); err != nil {
+		return errors.New("Invalid signature")
+	}
+
+	digest := sha256.Sum256(command.Signature)
+	now := timeNow()
+	controlMutex.Lock()
+	defer controlMutex.Unlock()
+	for d, expires := range seenCommands {
+		if now.After(expires) {
+			delete(seenCommands, d)
+		}
+	}
+	if _, seen := seenCommands[digest]; seen {
+		return errors.New("Command replayed")
+	}
+	seenCommands[digest] = command.Issued.Add(nonceMaxAge)
+	return nil
+}
+
+// handleControlMessage verifies and executes the JSON-encoded
+// ControlCommand body.
+func handleControlMessage(body []byte) error {
+	var command tasking.ControlCommand
+	if err := json.Unmarshal(body, &command); err != nil {
+		return err
+	}
+	if err := verifyControlCommand(command); err != nil {
+		return err
+	}
+	log.Printf("Executing control command %s of %s", command.Command, command.SignerKeyId)
+	switch command.Command {
+	case tasking.CONTROL_RELOAD_KEYS:
+		return reloadKeys()
+	case tasking.CONTROL_FLUSH_CACHES:
+		flushCaches()
+	case tasking.CONTROL_ENTER_MAINTENANCE:
+		setMaintenance(true, command.SignerKeyId+" via the control exchange")
+	case tasking.CONTROL_LEAVE_MAINTENANCE:
+		setMaintenance(false, command.SignerKeyId+" via the control exchange")
+	default:
+		return errors.New("Unknown command " + command.Command)
+	}
+	return nil
+}
+
+// reloadKeys loads the source and ticket keys again from the key manifest
+// or the key directories, replacing the loaded ones as a whole. This
+// catches up on changes the watchers of the directories missed.
+func reloadKeys() error {
+	if conf.KeyManifest != "" {
+		return applyKeyManifest(conf.KeyManifest)
+	}
+	sourceKeys := make(map[string]*rsa.PrivateKey)
+	err := walkKeys(conf.SourcesKeysPath, ".priv", func(path string) error {
+		key, name, err := tasking.LoadPrivateKeyFrom(keySource, path)
+		if err != nil {
+			return errors.New("Couldn't load " + path + ": " + err.Error())
+		}
+		sourceKeys[name] = key
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	newTicketKeys := make(map[string]*rsa.PublicKey)
+	err = walkKeys(conf.TicketKeysPath, ".pub", func(path string) error {
+		key, name, err := tasking.LoadPublicKeyFrom(keySource, path)
+		if err != nil {
+			return errors.New("Couldn't load " + path + ": " + err.Error())
+		}
+		newTicketKeys[name] = key
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	replaceKeys("key directories", sourceKeys, newTicketKeys)
+	return nil
+}
+
+// walkKeys calls load for every key file with the extension ext in dir of
+// the key source.
+func walkKeys(dir, ext string, load func(string) error) error {
+	var loadErr error
+	err := keySource.WalkKeys(dir, ext, func(path string) {
+		if loadErr == nil {
+			loadErr = load(path)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return loadErr
+}
+
+// flushCaches forgets the answers remembered for Idempotency-Keys and the
+// IVs remembered for detecting their reuse. Tickets still being handled
+// are kept, so concurrent retries still wait for them.
+func flushCaches() {
+	idempotencyMutex.Lock()
+	for k, e := range idempotencyCache {
+		if e.answer != nil {
+			delete(idempotencyCache, k)
+		}
+	}
+	idempotencyMutex.Unlock()
+	ivReuse.Lock()
+	ivReuse.seen, ivReuse.order, ivReuse.next = nil, nil, 0
+	ivReuse.Unlock()
+	log.Println("Flushed the idempotency and IV reuse caches")
+}
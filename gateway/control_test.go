@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"github.com/streadway/amqp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// signedCommand returns command signed by org with the test ticket key.
+func signedCommand(t *testing.T, command, org string) []byte {
+	c := tasking.ControlCommand{Command: command, Issued: time.Now(), SignerKeyId: org}
+	if err := tasking.SignControlCommand(&c, ticketKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	x, _ := json.Marshal(c)
+	return x
+}
+
+func TestControlReloadKeys(t *testing.T) {
+	setupGateway(t, &config{AdminOrganizations: []string{"org1"}, ControlExchange: "holmes_control"})
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf.SourcesKeysPath = filepath.Join(dir, "sources")
+	conf.TicketKeysPath = filepath.Join(dir, "tickets")
+	os.Mkdir(conf.SourcesKeysPath, 0700)
+	os.Mkdir(conf.TicketKeysPath, 0700)
+	private := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(sourceKey(t))})
+	der, _ := x509.MarshalPKIXPublicKey(&ticketKey(t).PublicKey)
+	ioutil.WriteFile(filepath.Join(conf.SourcesKeysPath, "src2.priv"), private, 0600)
+	ioutil.WriteFile(filepath.Join(conf.TicketKeysPath, "org1.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+
+	control := &fakeChannel{}
+	if err := startControlConsumer(control); err != nil {
+		t.Fatal(err)
+	}
+	if len(control.exchanges) != 1 || control.exchanges[0] != "holmes_control" || control.bindings != 1 {
+		t.Fatalf("control queue not bound to the exchange: %v", control.exchanges)
+	}
+	control.deliveries <- amqp.Delivery{Body: signedCommand(t, tasking.CONTROL_RELOAD_KEYS, "org1")}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sources, tickets := loadedKeyNames()
+		if reflect.DeepEqual(sources, []string{"src2"}) && reflect.DeepEqual(tickets, []string{"org1"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("keys not reloaded: %v and %v", sources, tickets)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestControlCommandAuthentication(t *testing.T) {
+	setupGateway(t, &config{AdminOrganizations: []string{"org1"}})
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+
+	enter := signedCommand(t, tasking.CONTROL_ENTER_MAINTENANCE, "org1")
+	if err := handleControlMessage(enter); err != nil || !inMaintenance() {
+		t.Fatalf("signed command not executed: %v", err)
+	}
+	setMaintenance(false, "the test")
+	if err := handleControlMessage(enter); err == nil || inMaintenance() {
+		t.Errorf("replayed command executed")
+	}
+
+	if err := handleControlMessage(signedCommand(t, tasking.CONTROL_ENTER_MAINTENANCE, "org2")); err == nil || inMaintenance() {
+		t.Errorf("command of a non-administrator executed")
+	}
+
+	var forged tasking.ControlCommand
+	json.Unmarshal(signedCommand(t, tasking.CONTROL_FLUSH_CACHES, "org1"), &forged)
+	forged.Command = tasking.CONTROL_ENTER_MAINTENANCE
+	x, _ := json.Marshal(forged)
+	if err := handleControlMessage(x); err == nil || inMaintenance() {
+		t.Errorf("forged command executed")
+	}
+
+	old := tasking.ControlCommand{Command: tasking.CONTROL_ENTER_MAINTENANCE, Issued: time.Now().Add(-time.Hour), SignerKeyId: "org1"}
+	tasking.SignControlCommand(&old, ticketKey(t))
+	x, _ = json.Marshal(old)
+	if err := handleControlMessage(x); err == nil || inMaintenance() {
+		t.Errorf("expired command executed")
+	}
+}
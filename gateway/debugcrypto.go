@@ -0,0 +1,7 @@
+//go:build debugcrypto
+// +build debugcrypto
+
+package gateway
+
+// Built with the tag "debugcrypto", the DebugCrypto option is honored.
+var debugCryptoAllowed = true
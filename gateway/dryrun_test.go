@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func dryRunRequest(t *testing.T, ticket string) tasking.GatewayAnswer {
+	enc, symKey := encryptTicket(t, ticket)
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	r := taskRequest(enc)
+	r.URL.Path = "/task/dryrun"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+}
+
+func TestDryRunRouting(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:     map[string][]string{"org1": []string{"PEINFO", "YARA", "CUCKOO"}},
+		SourceRoutingKey: "append",
+		TaskQuotas:       map[string]QuotaConf{"org1": {Tasks: 4, Window: 3600}},
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit: map[string]RabbitConf{
+			"CUCKOO": RabbitConf{Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"}},
+	})
+	addReceiptKey("gw1", sourceKey(t))
+
+	ticket := signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA", "CUCKOO", "SANDBOX"))
+	answer := dryRunRequest(t, ticket)
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if !answer.DryRun {
+		t.Errorf("answer not marked as dry run")
+	}
+	expected := map[string]string{
+		"PEINFO": "totem work.static.totem.src1",
+		"YARA":   "totem work.static.totem.src1",
+		"CUCKOO": "totem_dynamic work.dynamic.totem",
+	}
+	if len(answer.Accepted) != len(expected) {
+		t.Fatalf("expected %d routed services, got %+v", len(expected), answer.Accepted)
+	}
+	for _, a := range answer.Accepted {
+		if route := a.Exchange + " " + a.RoutingKey; route != expected[a.Task] {
+			t.Errorf("%s routed to %q instead of %q", a.Task, route, expected[a.Task])
+		}
+	}
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_TASK_NOT_ALLOWED {
+		t.Errorf("expected SANDBOX to be rejected, got %+v", answer.TskErrors)
+	}
+	if answer.Receipt != nil {
+		t.Errorf("receipt issued for a dry run")
+	}
+	if len(ch.messages()) != 0 {
+		t.Errorf("dry run published %d messages", len(ch.messages()))
+	}
+
+	// the dry runs did not count against the quota
+	dryRunRequest(t, ticket)
+	answer = *handleDecrypted(ticket)
+	if answer.Error != nil {
+		t.Fatalf("dry runs counted against the quota: %s", answer.Error.Error)
+	}
+	if len(ch.messages()) != 2 {
+		t.Errorf("expected 2 published messages, got %d", len(ch.messages()))
+	}
+}
+
+func TestPlaintextDiagnostics(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:         map[string][]string{"org1": []string{"PEINFO"}},
+		PlaintextDiagnostics: []string{"dryrun", "echo"},
+		RabbitDefault:        RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	send := func(path string) *httptest.ResponseRecorder {
+		enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA")))
+		r := taskRequest(enc)
+		r.URL.Path = path
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("/task/dryrun")
+	var answer tasking.GatewayAnswer
+	if w.Header().Get(tasking.EncryptedHeader) != "false" || json.Unmarshal(w.Body.Bytes(), &answer) != nil {
+		t.Fatalf("expected a plaintext dry run answer, got %q", w.Body.String())
+	}
+	if !answer.DryRun || len(answer.Accepted) != 1 || len(answer.TskErrors) != 1 {
+		t.Errorf("unexpected dry run answer: %+v", answer)
+	}
+
+	w = send("/task/echo")
+	var echo tasking.EchoAnswer
+	if w.Header().Get(tasking.EncryptedHeader) != "false" || json.Unmarshal(w.Body.Bytes(), &echo) != nil {
+		t.Fatalf("expected a plaintext echo answer, got %q", w.Body.String())
+	}
+	if echo.Organization != "org1" || len(echo.Tasks) != 2 {
+		t.Errorf("unexpected echo answer: %+v", echo)
+	}
+
+	// the production path stays encrypted
+	if w := send("/task/"); w.Header().Get(tasking.EncryptedHeader) != "true" {
+		t.Errorf("expected an encrypted answer of /task/")
+	}
+
+	// disabled by default
+	conf.PlaintextDiagnostics = nil
+	if w := send("/task/dryrun"); w.Header().Get(tasking.EncryptedHeader) != "true" {
+		t.Errorf("expected an encrypted dry run answer by default")
+	}
+}
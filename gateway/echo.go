@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// handleEcho verifies the decrypted ticket like handleDecrypted, but
+// instead of checking the ACL and dispatching its tasks, it only reports
+// the verified organization and the requested task types.
+func handleEcho(tn *tenant, ticketStr string) *tasking.EchoAnswer {
+	ticket, err := verifyTicketFor(tn, ticketStr)
+	if err != nil {
+		return &tasking.EchoAnswer{Error: err}
+	}
+	seen := make(map[string]struct{})
+	requested := make([]string, 0)
+	for _, task := range ticket.Tasks {
+		for t := range canonicalTasks(task.Tasks) {
+			if _, exists := seen[t]; !exists {
+				seen[t] = struct{}{}
+				requested = append(requested, t)
+			}
+		}
+	}
+	sort.Strings(requested)
+	return &tasking.EchoAnswer{Organization: ticket.SignerKeyId, Tasks: requested}
+}
+
+// httpRequestEcho lets new integrations test their tickets. The ticket
+// passes the decryption and signature verification, but is never
+// dispatched.
+func httpRequestEcho(w http.ResponseWriter, r *http.Request) {
+	task, err := decodeTask(r)
+	if err != nil {
+		log.Println("Error while decoding: ", err)
+		writePlainError(w, http.StatusBadRequest, err)
+		return
+	}
+	encoding, err := negotiateEncoding(r)
+	if err != nil {
+		writePlainError(w, http.StatusNotAcceptable, err)
+		return
+	}
+
+	tn := tenantFor(r)
+	decTicket, _, err, symKey := decryptTicketFor(tn, task)
+	if err != nil && err.Code == tasking.ERR_BUSY {
+		writePlainError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if symKey == nil {
+		writePlainError(w, http.StatusOK, err)
+		return
+	}
+	answer := &tasking.EchoAnswer{Error: err}
+	if err == nil {
+		answer = handleEcho(tn, decTicket)
+	}
+	if plaintextDiagnostics("echo") {
+		writePlain(w, answer)
+		return
+	}
+	writeEncrypted(w, task, symKey, encoding, http.StatusOK, answer)
+}
@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func echoRequest(t *testing.T, ticket string) tasking.EchoAnswer {
+	enc, symKey := encryptTicket(t, ticket)
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	r := taskRequest(enc)
+	r.URL.Path = "/task/echo"
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	iv := append([]byte(nil), enc.IV...)
+	iv[0] ^= 1
+	plain, err := tasking.AesDecrypt(w.Body.Bytes(), symKey, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer tasking.EchoAnswer
+	if err := json.Unmarshal(plain, &answer); err != nil {
+		t.Fatalf("%s: %s", err, plain)
+	}
+	return answer
+}
+
+func TestEcho(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		TaskAliases:   map[string]string{"SANDBOX": "CUCKOO"},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	// the ACL is not evaluated, so CUCKOO is reported although not allowed
+	answer := echoRequest(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "SANDBOX"), newTask("PEINFO")))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if answer.Organization != "org1" || len(answer.Tasks) != 2 || answer.Tasks[0] != "CUCKOO" || answer.Tasks[1] != "PEINFO" {
+		t.Errorf("unexpected echo: %+v", answer)
+	}
+	if len(ch.messages()) != 0 {
+		t.Errorf("echo dispatched tasks")
+	}
+}
+
+func TestEchoInvalidSignature(t *testing.T) {
+	setupGateway(t, &config{})
+	var ticket tasking.Ticket
+	json.Unmarshal([]byte(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"))), &ticket)
+	ticket.Tasks[0].Filename = "tampered"
+	x, _ := json.Marshal(ticket)
+
+	answer := echoRequest(t, string(x))
+	if answer.Error == nil || answer.Organization != "" {
+		t.Errorf("tampered ticket echoed: %+v", answer)
+	}
+}
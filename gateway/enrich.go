@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+)
+
+// A TaskEnricher can attach derived metadata (e.g. a routing hint or a
+// normalized source) to a task before it is dispatched. Enrich is called
+// for every task that passed the ACL. The enriched task is validated
+// again, and it must still request the same services, since the ACL is
+// not evaluated a second time.
+type TaskEnricher interface {
+	Enrich(task *tasking.Task) error
+}
+
+// noopEnricher is the default TaskEnricher, which leaves tasks unchanged.
+type noopEnricher struct{}
+
+func (noopEnricher) Enrich(task *tasking.Task) error {
+	return nil
+}
+
+var taskEnricher TaskEnricher = noopEnricher{}
+
+// SetTaskEnricher installs e as the TaskEnricher. It must be called before
+// Start. Passing nil restores the default, which does not modify tasks.
+func SetTaskEnricher(e TaskEnricher) {
+	if e == nil {
+		e = noopEnricher{}
+	}
+	taskEnricher = e
+}
+
+// enrichTask applies the installed TaskEnricher to task and validates the
+// result. Tasks without any accepted services are left untouched.
+func enrichTask(task *tasking.Task) error {
+	if len(task.Tasks) == 0 {
+		return nil
+	}
+	services := make([]string, 0, len(task.Tasks))
+	for t := range task.Tasks {
+		services = append(services, t)
+	}
+
+	if err := taskEnricher.Enrich(task); err != nil {
+		return err
+	}
+
+	if len(task.Tasks) != len(services) {
+		return errors.New("Invalid Task (Enrichment changed the requested services)")
+	}
+	for _, t := range services {
+		if _, exists := task.Tasks[t]; !exists {
+			return errors.New("Invalid Task (Enrichment changed the requested services)")
+		}
+	}
+	return checkTask(task)
+}
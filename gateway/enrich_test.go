@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"testing"
+	"time"
+)
+
+type tagEnricher struct {
+	tag string
+}
+
+func (e tagEnricher) Enrich(task *tasking.Task) error {
+	task.Tags = append(task.Tags, e.tag)
+	return nil
+}
+
+type serviceEnricher struct{}
+
+func (serviceEnricher) Enrich(task *tasking.Task) error {
+	task.Tasks["CUCKOO"] = []string{}
+	return nil
+}
+
+func TestTaskEnricher(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	SetTaskEnricher(tagEnricher{tag: "enriched"})
+	defer SetTaskEnricher(nil)
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(answer.TskErrors) != 0 {
+		t.Fatalf("unexpected task errors: %+v", answer.TskErrors)
+	}
+	msgs := ch.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 published message, got %d", len(msgs))
+	}
+	tags := msgs[0].Task.Tags
+	if len(tags) != 2 || tags[1] != "enriched" {
+		t.Errorf("dispatched task does not carry the enriched tag: %v", tags)
+	}
+}
+
+func TestTaskEnricherCannotBypassACL(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	SetTaskEnricher(serviceEnricher{})
+	defer SetTaskEnricher(nil)
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID {
+		t.Fatalf("expected the enriched task to be invalid, got %+v", answer.TskErrors)
+	}
+	if len(ch.messages()) != 0 {
+		t.Errorf("invalid enriched task was published")
+	}
+}
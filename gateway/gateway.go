@@ -1,69 +1,461 @@
 package gateway
 
 import (
+	"crypto/aes"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"github.com/HolmesProcessing/Holmes-Gateway/utils"
-	"github.com/streadway/amqp"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type RabbitConf struct {
-	Queue      string
-	Exchange   string
-	RoutingKey string
+	Queue          string
+	Exchange       string
+	RoutingKey     string
+	PublishTimeout int    // Overrides the global PublishTimeout for this destination
+	Webhook        string // If set, tasks are POSTed to this URL instead of being published (optional)
+}
+
+// RabbitTLSConf configures TLS for the connection to RabbitMQ.
+type RabbitTLSConf struct {
+	CACertPath             string // CA certificate used to verify the broker
+	CertPath               string // Client certificate
+	KeyPath                string // Key of the client certificate
+	ServerName             string // Expected name of the broker, if it differs from the host in RabbitURI
+	AllowPlaintextFallback bool   // Use plaintext, if the TLS-connection fails
 }
 
 type config struct {
-	HTTP             string
-	SourcesKeysPath  string
-	TicketKeysPath   string
-	SampleStorageURI string
-	AllowedTasks     map[string][]string
-	RabbitURI        string
-	RabbitUser       string
-	RabbitPassword   string
-	RabbitDefault    RabbitConf
-	Rabbit           map[string]RabbitConf
+	HTTP                  string // TCP-address or "unix:/path/to.sock"
+	HTTPSocketMode        string // Permissions of the Unix domain socket in octal (default: "0660")
+	SourcesKeysPath       string
+	FallbackSourceKeys    []string            // Keys tried, if the key of a ticket is not found (e.g. during a rotation)
+	PlainDecryptErrors    bool                // Answer all failures to decrypt a ticket unencrypted, even if its symmetric key is known
+	MultipleRecipients    bool                // Accept tickets whose symmetric key is encrypted for several source keys
+	KeyRemovalGrace       int                 // Time in seconds a removed source key is still used for decryption (0: none)
+	KeyManifest           string              // File listing the source and ticket keys, instead of the key directories (optional)
+	SourceKeyBindings     map[string][]string // Source keys an organization may encrypt its tickets for (reloadable)
+	TicketEncryptions     map[string][]string // Encryptions an organization may use for its tickets (default: all)
+	TicketKeysPath        string
+	ReceiptKeysPath       string // Private keys signing the receipts for accepted tasks (optional)
+	ForceKeyPolling       bool   // Poll the key directories instead of watching them with inotify
+	KeyPollInterval       int    // Time in seconds between polls of a key directory (default: 10)
+	MaxKeyWatchers        int    // Maximum number of key directories watched with inotify, the others are polled (0: no limit)
+	KeyEventWorkers       int    // Number of keys of a directory loaded concurrently (default: 1)
+	SampleStorageURI      string
+	TaskStorageURIs       map[string]string // Storage prefixes of task types, used instead of SampleStorageURI
+	VerifySamples         bool              // Check with a HEAD request that the sample exists before dispatching
+	SampleCheckTimeout    int               // Time in milliseconds the check of a sample may take (default: 2000)
+	SampleCheckBudget     int               // Time in milliseconds the checks of all samples of a ticket may take (default: 5000)
+	AllowedTasks          map[string][]string
+	TaskAliases           map[string]string
+	TaskQuotas            map[string]QuotaConf // Maximum number of tasks per organization and time window
+	DisabledTasks         []string             // Tasks temporarily not accepted from any organization (reloadable)
+	RequireSecondaryURI   []string             // Task types which are only accepted with a SecondaryURI
+	RequireArguments      []string             // Task types which are only accepted with arguments
+	RequireSource         []string             // Task types which are only accepted with a printable Source
+	ReportUnknownTasks    bool                 // Reject task types not found anywhere in the configuration as unknown instead of not allowed
+	SummarizeRejections   bool                 // Add a summary of TskErrors grouped by reason to answers
+	MaxAnswerSize         int                  // Size in bytes of an answer, above which TskErrors are truncated (0: unlimited)
+	ExplainACL            bool                 // Name the ACL rule allowing each accepted service in answers (for debugging)
+	UniqueTraceIDs        bool                 // Reject client-supplied trace IDs used within TraceIDWindow
+	TraceIDWindow         int                  // Time in seconds a used trace ID is remembered (default: 3600)
+	AllowedDownloads      map[string][]string  // Sources an organization may request downloads from ("*": any; unset: no restriction)
+	DefaultTicketLifetime int                  // Lifetime in seconds for tickets without expiration (0: reject them)
+	MaxTicketLifetime     int                  // Maximum time in seconds a ticket may expire in the future (0: unlimited)
+	TaskTicketLifetimes   map[string]int       // MaxTicketLifetime of tickets requesting a task type, instead of the global one
+	ExpirationTTL         bool                 // Publish tasks with a TTL of the time remaining until their ticket expires
+	TaskRateLimits        map[string]RateConf  // Maximum rate of dispatching per canonical task type, across all organizations
+	IdempotencyWindow     int                  // Time in seconds answers are remembered for an Idempotency-Key (0: disabled)
+	TicketSequences       bool                 // Reject tickets whose Sequence was already seen from their organization
+	AllOrNothing          []string             // Organizations whose tickets are only dispatched, if no service is rejected
+	SequenceWindow        int                  // Number of sequences below the highest seen, which are still accepted out of order (at most 64)
+	MaxConcurrentRequests int                  // Maximum number of requests handled concurrently (0: unlimited)
+	IVReuseWindow         int                  // Number of recent IVs checked for reuse by clients (0: disabled)
+	DebugCrypto           bool                 // Log hashes of symmetric keys (only in builds with the tag "debugcrypto")
+	StrictTickets         bool                 // Reject tickets containing unknown fields
+	Canonicalization      string               // Serialization of signed tickets: "legacy" (default) or "canonical"
+	MaxArgumentLength     int                  // Maximum length in bytes of a single task argument (0: unlimited)
+	MaxTicketSize         int                  // Maximum size in bytes of a decrypted ticket (0: unlimited)
+	MaxTicketTasks        int                  // Maximum number of tasks of a ticket (0: unlimited)
+	TicketLimits          map[string]LimitConf // Overrides of MaxTicketSize and MaxTicketTasks per organization
+	MaxTicketArguments    int                  // Maximum number of arguments of all tasks of a ticket (0: unlimited)
+	MaxArgumentsLength    int                  // Maximum total length in bytes of all arguments of a task (0: unlimited)
+	MaxTicketArgsLength   int                  // Maximum total length in bytes of all arguments of all tasks of a ticket (0: unlimited)
+	MaxTicketExchanges    int                  // Maximum number of distinct exchanges the services of a ticket are published to (0: unlimited)
+	MaxIdentifierLength   int                  // Maximum length of KeyFingerprint and SignerKeyId (default: 256)
+	RequireSingleSource   bool                 // Reject tickets whose tasks have different Sources
+	RequireFilenameMatch  bool                 // Reject tasks whose Filename is neither the basename of the PrimaryURI nor matches FilenamePattern
+	FilenamePattern       string               // Regular expression for Filenames differing from the basename of the PrimaryURI
+	AllowedURISchemes     []string             // Schemes of PrimaryURIs and SecondaryURIs accepted ("": relative; unset: any)
+	MinAttempts           int                  // Minimum number of attempts of a task
+	MaxAttempts           int                  // Maximum number of attempts of a task (0: unlimited)
+	AcceptedContentTypes  []string             // Content-Types accepted for task requests (default: form encodings)
+	PlaintextDiagnostics  []string             // Diagnostic endpoints ("echo", "dryrun") answering unencrypted
+	RSAWorkers            int                  // Maximum number of concurrent RSA decryptions (default: number of CPUs)
+	RSAQueueTimeout       int                  // Time in milliseconds a request waits for an RSA worker (default: 100)
+	MetricsBackend        string               // "expvar" (default), "prometheus" or "none"
+	RequestLogSampling    int                  // Log every Nth successful request, errors and rejections always (0: none) (reloadable)
+	SlowRequestThreshold  int                  // Time in milliseconds after which submitting a ticket is logged as slow (0: never)
+	Maintenance           bool                 // Reject new tickets with 503 (reloadable, see /admin/maintenance)
+	AdminOrganizations    []string             // Organizations allowed to use /admin/maintenance and /admin/selftest
+	RabbitURI             string
+	RabbitUser            string
+	RabbitPassword        string
+	RabbitTLS             *RabbitTLSConf // If set, the connection to RabbitMQ uses TLS
+	RabbitPassive         bool           // Only assert that the configured queues and exchanges exist
+	RabbitDefault         RabbitConf
+	SourceRoutingKey      string // "append" or "substitute" the source into the default routing key (optional)
+	SourceFallback        string // Used instead of an empty source in routing keys (default: "unknown")
+	PublishTimeout        int    // Maximum time in milliseconds a single publish may take (0: unlimited)
+	MandatoryPublish      bool   // Reject tasks routed to no queue instead of losing them (serializes publishing)
+	WebhookRetries        int    // Times a failed POST to a webhook destination is retried (default: 3, -1: none)
+	WebhookTimeout        int    // Time in milliseconds a single POST to a webhook destination may take (default: 5000)
+	MaxRabbitDowntime     int    // Time in seconds RabbitMQ may be unreachable before the gateway exits (0: never)
+	CancelExchange        string // Exchange cancellations of dispatched tickets are published to (optional)
+	CancelRoutingKey      string // Routing key of cancellations
+	CancelWindow          int    // Time in seconds a dispatched ticket can be cancelled (default: 3600)
+	ControlExchange       string // Fanout exchange of signed commands to all gateways (optional)
+	Rabbit                map[string]RabbitConf
+	QuarantineRabbit      *RabbitConf           // Destination of services unknown to the configuration (optional)
+	SyncTasks             []string              // Services the gateway waits for the result of, before it answers
+	SyncTimeout           int                   // Time in milliseconds to wait for the result of a synchronous service (default: 5000)
+	ResultQueue           string                // Queue the results of asynchronous services are sent to (optional)
+	StatusWindow          int                   // Time in seconds the results of a ticket are kept (default: 3600)
+	AsyncTickets          bool                  // Dispatch tickets in the background for clients sending "Prefer: respond-async"
+	SpoolDir              string                // Directory buffering tasks while RabbitMQ is unreachable (optional)
+	SpoolMaxTasks         int                   // Maximum number of buffered tasks (default: 10000)
+	SpoolDrainInterval    int                   // Time in seconds between attempts to republish buffered tasks (default: 10)
+	SpoolShutdownTimeout  int                   // Time in seconds to republish buffered tasks on shutdown (0: none)
+	TopologyCheckInterval int                   // Time in seconds between checks that the configured queues exist (0: disabled)
+	TLSCertFile           string                // Certificate for serving HTTPS (optional)
+	TLSKeyFile            string                // Private key of TLSCertFile
+	Tenants               map[string]TenantConf // Keys and ACL per TLS server name (optional)
 }
 
 var conf *config
 var keys map[string]*rsa.PrivateKey
 var ticketKeys map[string]*rsa.PublicKey
 var keysMutex = &sync.Mutex{}
-var rabbitChannel *amqp.Channel
 var allowedTasks map[string](map[string]struct{}) // map Organization-Name -> map task
+var knownTasks map[string]struct{}                // task types appearing anywhere in the configuration
+var disabledTasks map[string]struct{}             // tasks not accepted from any organization
+var policyMutex = &sync.RWMutex{}                 // guards allowedTasks, knownTasks, disabledTasks, sourceKeyBindings and ticketEncryptions
+
+// canonicalTaskName resolves a task-type alias (e.g. an old service name
+// still used by clients) to the name the task is known by in the ACL and
+// in the routing configuration.
+func canonicalTaskName(name string) string {
+	if canonical, exists := conf.TaskAliases[name]; exists {
+		return canonical
+	}
+	return name
+}
+
+// canonicalTasks returns a copy of tasks with all aliases resolved. If both
+// an alias and its canonical name are present, their arguments are merged.
+func canonicalTasks(tasks map[string][]string) map[string][]string {
+	canonical := make(map[string][]string, len(tasks))
+	for name, args := range tasks {
+		name = canonicalTaskName(name)
+		if merged, exists := canonical[name]; exists {
+			// copy, so the arguments of the ticket are not modified
+			canonical[name] = append(append([]string(nil), merged...), args...)
+		} else {
+			canonical[name] = args
+		}
+	}
+	return canonical
+}
+
+// storageGroup is a set of services reading their samples from the same
+// storage, whose URIs are rewritten by the same URIRewriter.
+type storageGroup struct {
+	prefix   string
+	rewriter string // task type of the URIRewriter, "" for the default one
+	tasks    map[string][]string
+}
+
+// storageGroups groups tasks by the storage prefix of their URIs, which is
+// configured in conf.TaskStorageURIs or conf.SampleStorageURI by default,
+// and by their URIRewriter. The groups are ordered by their prefixes.
+func storageGroups(tasks map[string][]string) []storageGroup {
+	if len(conf.TaskStorageURIs) == 0 && len(uriRewriters) == 0 {
+		return []storageGroup{{conf.SampleStorageURI, "", tasks}}
+	}
+	type groupKey struct{ prefix, rewriter string }
+	byGroup := make(map[groupKey]map[string][]string)
+	for t, args := range tasks {
+		prefix, exists := conf.TaskStorageURIs[t]
+		if !exists {
+			prefix = conf.SampleStorageURI
+		}
+		key := groupKey{prefix: prefix}
+		if _, exists := uriRewriters[t]; exists {
+			key.rewriter = t
+		}
+		if byGroup[key] == nil {
+			byGroup[key] = make(map[string][]string)
+		}
+		byGroup[key][t] = args
+	}
+	groups := make([]storageGroup, 0, len(byGroup))
+	for key, group := range byGroup {
+		groups = append(groups, storageGroup{key.prefix, key.rewriter, group})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].prefix != groups[j].prefix {
+			return groups[i].prefix < groups[j].prefix
+		}
+		return groups[i].rewriter < groups[j].rewriter
+	})
+	return groups
+}
+
+// buildKnownTasks returns the task types appearing anywhere in the
+// configuration, i.e. in the ACL allowed of any organization or in the
+// options of c for specific task types. It is built along with the ACL, so
+// checking a task type doesn't need to scan the lists of all
+// organizations.
+func buildKnownTasks(c *config, allowed map[string](map[string]struct{})) map[string]struct{} {
+	known := make(map[string]struct{})
+	for _, allowedForOrg := range allowed {
+		for t := range allowedForOrg {
+			known[t] = struct{}{}
+		}
+	}
+	for t := range c.Rabbit {
+		known[t] = struct{}{}
+	}
+	for t := range c.TaskStorageURIs {
+		known[t] = struct{}{}
+	}
+	for _, list := range [][]string{c.SyncTasks, c.RequireSecondaryURI, c.RequireArguments, c.RequireSource} {
+		for _, name := range list {
+			if canonical, exists := c.TaskAliases[name]; exists {
+				name = canonical
+			}
+			known[name] = struct{}{}
+		}
+	}
+	return known
+}
+
+// splitUnknownTasks moves the task types not in known from the rejected
+// tasks into the returned map, if conf.ReportUnknownTasks is set. The map
+// is nil, if no task type was moved.
+func splitUnknownTasks(rejected map[string][]string, known map[string]struct{}) map[string][]string {
+	if !conf.ReportUnknownTasks {
+		return nil
+	}
+	var unknown map[string][]string
+	for t, args := range rejected {
+		if _, exists := known[t]; !exists {
+			if unknown == nil {
+				unknown = make(map[string][]string)
+			}
+			unknown[t] = args
+			delete(rejected, t)
+		}
+	}
+	return unknown
+}
+
+// downloadAllowed reports whether org may request tasks with the Download
+// flag set, instructing the services to fetch the sample from source.
+func downloadAllowed(org, source string) bool {
+	if conf.AllowedDownloads == nil {
+		return true
+	}
+	for _, s := range conf.AllowedDownloads[org] {
+		if s == "*" || s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMissingSecondary moves the services requiring a SecondaryURI from
+// tasks into the returned map, if the task has none. The map is nil, if
+// no service was moved.
+func splitMissingSecondary(task *tasking.Task, tasks map[string][]string) map[string][]string {
+	var missing map[string][]string
+	if task.SecondaryURI != "" {
+		return missing
+	}
+	for _, name := range conf.RequireSecondaryURI {
+		name = canonicalTaskName(name)
+		if args, exists := tasks[name]; exists {
+			if missing == nil {
+				missing = make(map[string][]string)
+			}
+			missing[name] = args
+			delete(tasks, name)
+		}
+	}
+	return missing
+}
+
+// splitMissingArguments moves the services requiring arguments from tasks
+// into the returned map, if they have none. The map is nil, if no service
+// was moved.
+func splitMissingArguments(tasks map[string][]string) map[string][]string {
+	var missing map[string][]string
+	for _, name := range conf.RequireArguments {
+		name = canonicalTaskName(name)
+		if args, exists := tasks[name]; exists && len(args) == 0 {
+			if missing == nil {
+				missing = make(map[string][]string)
+			}
+			missing[name] = args
+			delete(tasks, name)
+		}
+	}
+	return missing
+}
+
+// splitMissingSource moves the services requiring a Source from tasks into
+// the returned map, if the task has no printable one. The map is nil, if
+// no service was moved.
+func splitMissingSource(task *tasking.Task, tasks map[string][]string) map[string][]string {
+	var missing map[string][]string
+	if task.Source != "" && stringPrintable(task.Source) {
+		return missing
+	}
+	for _, name := range conf.RequireSource {
+		name = canonicalTaskName(name)
+		if args, exists := tasks[name]; exists {
+			if missing == nil {
+				missing = make(map[string][]string)
+			}
+			missing[name] = args
+			delete(tasks, name)
+		}
+	}
+	return missing
+}
 
-func decryptTicket(enc *tasking.Encrypted) (string, *tasking.MyError, []byte) {
+func decryptTicket(enc *tasking.Encrypted) (string, string, *tasking.MyError, []byte) {
+	return decryptTicketFor(nil, enc)
+}
+
+// decryptTicketFor decrypts enc with a source key of the tenant tn. It
+// returns the ticket and the name of the key that was used.
+func decryptTicketFor(tn *tenant, enc *tasking.Encrypted) (string, string, *tasking.MyError, []byte) {
+	enc = selectRecipient(tn, enc)
 	// Fetch private key corresponding to enc.keyFingerprint
-	keysMutex.Lock()
-	asymKey, exists := keys[enc.KeyFingerprint]
-	keysMutex.Unlock()
+	asymKey, exists := tn.sourceKey(enc.KeyFingerprint)
 	if !exists {
-		return "", &tasking.MyError{Error: errors.New("Private key " + enc.KeyFingerprint + " not found"), Code: tasking.ERR_KEY_UNKNOWN}, nil
+		return decryptWithFallbackKeys(tn, enc)
+	}
+	decrypted, err, symKey := decryptWithKey(enc, asymKey)
+	return decrypted, enc.KeyFingerprint, err, symKey
+}
+
+// selectRecipient returns enc with the KeyFingerprint and EncryptedKey of
+// the first of its recipients, whose source key is held by the tenant tn.
+// This lets clients encrypt a ticket for all keys a gateway might hold,
+// e.g. during a rotation. Without such a recipient, enc is returned as
+// it is, and the fallback keys are tried.
+func selectRecipient(tn *tenant, enc *tasking.Encrypted) *tasking.Encrypted {
+	for _, r := range enc.Recipients {
+		if _, exists := tn.sourceKey(r.KeyFingerprint); exists {
+			selected := *enc
+			selected.KeyFingerprint = r.KeyFingerprint
+			selected.EncryptedKey = r.EncryptedKey
+			return &selected
+		}
+	}
+	return enc
+}
+
+// decryptWithFallbackKeys tries the configured fallback keys on a ticket
+// whose key is unknown, e.g. because the client still uses a key that was
+// rotated out. The name of the key that was used is returned, too.
+func decryptWithFallbackKeys(tn *tenant, enc *tasking.Encrypted) (string, string, *tasking.MyError, []byte) {
+	for _, name := range conf.FallbackSourceKeys {
+		asymKey, exists := tn.sourceKey(name)
+		if !exists {
+			continue
+		}
+		decrypted, err, symKey := decryptWithKey(enc, asymKey)
+		if symKey != nil || (err != nil && err.Code == tasking.ERR_BUSY) {
+			if symKey != nil {
+				log.Printf("Private key %s not found, decrypted with fallback key %s", enc.KeyFingerprint, name)
+			}
+			return decrypted, name, err, symKey
+		}
+	}
+	return "", "", &tasking.MyError{Error: errors.New("Private key " + enc.KeyFingerprint + " not found"), Code: tasking.ERR_KEY_UNKNOWN}, nil
+}
+
+func decryptWithKey(enc *tasking.Encrypted, asymKey *rsa.PrivateKey) (string, *tasking.MyError, []byte) {
+	// A single RSA block is exactly as long as the modulus. Anything else
+	// was not encrypted for this key (or with a different scheme) and would
+	// only produce an opaque decryption error.
+	if len(enc.EncryptedKey) != (asymKey.N.BitLen()+7)/8 {
+		return "", &tasking.MyError{Error: errors.New("EncryptedKey wrong size for key"), Code: tasking.ERR_ENCRYPTION}, nil
 	}
 
 	// Decrypt symmetric key using the asymmetric key
-	symKey, err := tasking.RsaDecrypt(enc.EncryptedKey, asymKey)
+	symKey, err := rsaDecrypt(enc.EncryptedKey, asymKey)
 	if err != nil {
+		if err == errRSABusy {
+			return "", &tasking.MyError{Error: err, Code: tasking.ERR_BUSY}, nil
+		}
 		return "", &tasking.MyError{Error: err, Code: tasking.ERR_ENCRYPTION}, nil
 	}
-	//log.Printf("Symmetric Key: %s\n", symKey)
+	// A key of the wrong size is most likely garbage from decrypting with
+	// the wrong key and can't be used for the answer either
+	if _, err := aes.NewCipher(symKey); err != nil {
+		return "", &tasking.MyError{Error: errors.New("Symmetric key has invalid size"), Code: tasking.ERR_ENCRYPTION}, nil
+	}
+	logSymKeyDebug(symKey)
 
-	// Decrypt using the symmetric key
-	decrypted, err := tasking.AesDecrypt(enc.Encrypted, symKey, enc.IV)
+	// Decrypt using the symmetric key. From here on, the symmetric key is
+	// returned even on errors, so the client gets an encrypted answer.
+	var decrypted []byte
+	if enc.Encryption == tasking.ENCRYPTION_AES_GCM {
+		decrypted, err = tasking.AesGcmDecrypt(enc.Encrypted, symKey, enc.IV)
+	} else {
+		decrypted, err = tasking.AesDecrypt(enc.Encrypted, symKey, enc.IV)
+	}
 	if err != nil {
-		return string(decrypted), &tasking.MyError{Error: err, Code: tasking.ERR_ENCRYPTION}, symKey
+		return "", &tasking.MyError{Error: err, Code: tasking.ERR_ENCRYPTION}, symKey
 	}
+	detectIVReuse(enc.KeyFingerprint, enc.IV, enc.Encrypted)
 	return string(decrypted), nil, symKey
 }
 
+// logSymKeyDebug logs a hash of the symmetric key of a ticket, to allow
+// matching it with the client's side while debugging. The raw key is never
+// logged. This requires the DebugCrypto option and a build with the tag
+// "debugcrypto".
+func logSymKeyDebug(symKey []byte) {
+	if !debugCryptoAllowed || !conf.DebugCrypto {
+		return
+	}
+	hash := sha256.Sum256(symKey)
+	log.Printf("Symmetric key SHA256: %x", hash)
+}
+
 func stringPrintable(s string) bool {
 	for i := 0; i < len(s); i++ {
 		c := int(s[i])
@@ -74,71 +466,519 @@ func stringPrintable(s string) bool {
 	return true
 }
 
+// invalidTaskError is returned by checkTask. Besides the message, it
+// carries the reason reported in the TaskError.
+type invalidTaskError struct {
+	reason string
+	msg    string
+}
+
+func (e *invalidTaskError) Error() string {
+	return e.msg
+}
+
+// invalidTaskReason returns the reason of an error returned by checkTask.
+func invalidTaskReason(err error) string {
+	if e, ok := err.(*invalidTaskError); ok {
+		return e.reason
+	}
+	return tasking.REASON_TASK_NAME_INVALID
+}
+
 func checkTask(task *tasking.Task) error {
 	log.Printf("Validating %+v\n", task)
 	if task.PrimaryURI == "" || !stringPrintable(task.PrimaryURI) {
-		return errors.New("Invalid Task (PrimaryURI invalid)")
+		return &invalidTaskError{tasking.REASON_PRIMARY_URI_INVALID, "Invalid Task (PrimaryURI invalid)"}
 	}
 	if !stringPrintable(task.SecondaryURI) {
-		return errors.New("Invalid Task (SecondaryURI invalid)")
+		return &invalidTaskError{tasking.REASON_SECONDARY_URI_INVALID, "Invalid Task (SecondaryURI invalid)"}
 	}
 	if task.Filename == "" || !stringPrintable(task.Filename) {
-		return errors.New("Invalid Task (Filename invalid)")
+		return &invalidTaskError{tasking.REASON_FILENAME_INVALID, "Invalid Task (Filename invalid)"}
+	}
+	if conf.RequireFilenameMatch && !filenameMatches(task) {
+		return &invalidTaskError{tasking.REASON_FILENAME_MISMATCH, "Invalid Task (Filename does not match PrimaryURI)"}
 	}
 	if len(task.Tasks) == 0 {
-		return errors.New("Invalid Task")
+		return &invalidTaskError{tasking.REASON_NO_TASKS, "Invalid Task"}
 	}
-	for k := range task.Tasks {
+	total := 0
+	for k, args := range task.Tasks {
 		if k == "" || !stringPrintable(k) {
-			return errors.New("Invalid Task")
+			return &invalidTaskError{tasking.REASON_TASK_NAME_INVALID, "Invalid Task"}
+		}
+		for _, arg := range args {
+			if conf.MaxArgumentLength > 0 && len(arg) > conf.MaxArgumentLength {
+				return &invalidTaskError{tasking.REASON_ARGUMENT_TOO_LONG, "Invalid Task (Argument of " + k + " too long)"}
+			}
+			total += len(arg)
 		}
 	}
+	if conf.MaxArgumentsLength > 0 && total > conf.MaxArgumentsLength {
+		return &invalidTaskError{tasking.REASON_ARGUMENTS_TOO_LONG, "Invalid Task (Arguments too long)"}
+	}
 	for j := 0; j < len(task.Tags); j++ {
 		if !stringPrintable(task.Tags[j]) {
-			return errors.New("Invalid Task (Tag invalid)")
+			return &invalidTaskError{tasking.REASON_TAG_INVALID, "Invalid Task (Tag invalid)"}
 		}
 	}
 	if task.Attempts < 0 {
-		return errors.New("Invalid Task (Negative number of attempts)")
+		return &invalidTaskError{tasking.REASON_NEGATIVE_ATTEMPTS, "Invalid Task (Negative number of attempts)"}
+	}
+	if task.Attempts < conf.MinAttempts || (conf.MaxAttempts > 0 && task.Attempts > conf.MaxAttempts) {
+		return &invalidTaskError{tasking.REASON_ATTEMPTS_OUT_OF_RANGE, "Invalid Task (Number of attempts out of range)"}
 	}
 	if !stringPrintable(task.Comment) {
-		return errors.New("Invalid Task (Comment invalid)")
+		return &invalidTaskError{tasking.REASON_COMMENT_INVALID, "Invalid Task (Comment invalid)"}
 	}
 	return nil
 }
 
-func handleDecrypted(ticketStr string) (*tasking.MyError, []tasking.TaskError) {
-	tskerrors := make([]tasking.TaskError, 0)
+// filenamePattern is the compiled conf.FilenamePattern, or nil if unset.
+var filenamePattern *regexp.Regexp
+
+// compileFilenamePattern compiles the FilenamePattern of c.
+func compileFilenamePattern(c *config) (*regexp.Regexp, error) {
+	if c.FilenamePattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + c.FilenamePattern + ")$")
+}
+
+// filenameMatches reports whether the Filename of task is the basename of
+// its PrimaryURI, or matches the configured pattern.
+func filenameMatches(task *tasking.Task) bool {
+	if task.Filename == path.Base(task.PrimaryURI) {
+		return true
+	}
+	return filenamePattern != nil && filenamePattern.MatchString(task.Filename)
+}
+
+// uriSchemeAllowed reports whether the scheme of uri is one of
+// conf.AllowedURISchemes, where "" stands for relative URIs.
+func uriSchemeAllowed(uri string) bool {
+	if conf.AllowedURISchemes == nil {
+		return true
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	for _, scheme := range conf.AllowedURISchemes {
+		if strings.EqualFold(scheme, u.Scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkURISchemes checks the schemes of the URIs of task, after they were
+// possibly rewritten by the enrichment.
+func checkURISchemes(task *tasking.Task) error {
+	if !uriSchemeAllowed(task.PrimaryURI) {
+		return errors.New("Invalid Task (Scheme of PrimaryURI not allowed)")
+	}
+	if task.SecondaryURI != "" && !uriSchemeAllowed(task.SecondaryURI) {
+		return errors.New("Invalid Task (Scheme of SecondaryURI not allowed)")
+	}
+	return nil
+}
+
+// verifyTicket parses the decrypted ticket and verifies its signature.
+func verifyTicket(ticketStr string) (*tasking.Ticket, *tasking.MyError) {
+	return verifyTicketFor(nil, ticketStr)
+}
+
+// verifyTicketFor verifies the ticket with a ticket key of the tenant tn.
+func verifyTicketFor(tn *tenant, ticketStr string) (*tasking.Ticket, *tasking.MyError) {
 	var ticket tasking.Ticket
-	err := json.Unmarshal([]byte(ticketStr), &ticket)
+	dec := json.NewDecoder(strings.NewReader(ticketStr))
+	if conf.StrictTickets {
+		// report typos like "primary_uri" instead of a missing field
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(&ticket)
 	if err != nil {
-		return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}, tskerrors
+		return nil, &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
 	}
 
 	// Check ticket for validity
-	signKey, found := ticketKeys[ticket.SignerKeyId]
+	if !validIdentifier(ticket.SignerKeyId) {
+		log.Printf("Ticket has an invalid SignerKeyId of %d bytes", len(ticket.SignerKeyId))
+		return nil, &tasking.MyError{Error: errors.New("Ticket malformed (Invalid SignerKeyId)"), Code: tasking.ERR_TASK_INVALID}
+	}
+	signKey, found := tn.ticketKey(ticket.SignerKeyId)
 	if !found {
-		return &tasking.MyError{Error: errors.New("Couldn't verify signature: Key unknown"), Code: tasking.ERR_KEY_UNKNOWN}, tskerrors
+		return nil, &tasking.MyError{Error: errors.New("Couldn't verify signature: Key unknown"), Code: tasking.ERR_KEY_UNKNOWN}
+	}
+	if conf.Canonicalization == tasking.CANONICALIZATION_CANONICAL {
+		err = tasking.VerifyCanonicalTicket([]byte(ticketStr), ticket.Signature, signKey)
+	} else {
+		err = tasking.VerifyTicket(ticket, signKey)
 	}
-	err = tasking.VerifyTicket(ticket, signKey)
 	if err != nil {
 		log.Println("Ticket invalid!")
-		return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}, tskerrors
+		return nil, &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
 	}
 	log.Println("Signature OK!")
 	// Signature is OK
+	if ticketKeyExpired(ticket.SignerKeyId) {
+		log.Printf("Ticket key of '%s' expired", ticket.SignerKeyId)
+		return nil, &tasking.MyError{Error: errTicketKeyExpired, Code: tasking.ERR_KEY_UNKNOWN}
+	}
+	return &ticket, nil
+}
+
+// maxRejectionExamples is the number of services named per reason in the
+// summary of the rejections.
+const maxRejectionExamples = 5
+
+// summarizeRejections groups tskerrors by their reason. The summaries are
+// sorted by reason and name the first services of each in sorted order.
+func summarizeRejections(tskerrors []tasking.TaskError) []tasking.RejectionSummary {
+	byReason := make(map[string]*tasking.RejectionSummary)
+	services := make(map[string]map[string]struct{})
+	for _, e := range tskerrors {
+		summary, exists := byReason[e.Reason]
+		if !exists {
+			summary = &tasking.RejectionSummary{Reason: e.Reason}
+			byReason[e.Reason] = summary
+			services[e.Reason] = make(map[string]struct{})
+		}
+		summary.Errors++
+		summary.Services += len(e.TaskStruct.Tasks)
+		for t := range e.TaskStruct.Tasks {
+			services[e.Reason][t] = struct{}{}
+		}
+	}
+
+	summaries := make([]tasking.RejectionSummary, 0, len(byReason))
+	for reason, summary := range byReason {
+		examples := make([]string, 0, len(services[reason]))
+		for t := range services[reason] {
+			examples = append(examples, t)
+		}
+		sort.Strings(examples)
+		if len(examples) > maxRejectionExamples {
+			examples = examples[:maxRejectionExamples]
+		}
+		summary.Examples = examples
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Reason < summaries[j].Reason })
+	return summaries
+}
+
+// truncateAnswer drops the last entries of TskErrors, until the JSON of
+// answer fits into conf.MaxAnswerSize. The dropped rejections are still
+// counted in Rejections, which is then set regardless of
+// conf.SummarizeRejections.
+func truncateAnswer(answer *tasking.GatewayAnswer) {
+	if conf.MaxAnswerSize <= 0 || len(answer.TskErrors) == 0 {
+		return
+	}
+	fits := func() bool {
+		x, _ := json.Marshal(answer)
+		return len(x) <= conf.MaxAnswerSize
+	}
+	if fits() {
+		return
+	}
+	all := answer.TskErrors
+	answer.Rejections = summarizeRejections(all)
+	answer.TskErrorsTruncated = true
+	// the largest number of entries that fits
+	kept := sort.Search(len(all)+1, func(n int) bool {
+		answer.TskErrors = all[:n]
+		return !fits()
+	}) - 1
+	if kept < 0 {
+		kept = 0
+	}
+	answer.TskErrors = all[:kept]
+	log.Printf("Answer %s too large, truncated TskErrors from %d to %d entries", answer.TraceID, len(all), kept)
+}
+
+// maxTicketLifetime returns the maximum lifetime in seconds of ticket,
+// which is the strictest limit of the task types it requests. Task types
+// without a limit of their own are limited by conf.MaxTicketLifetime.
+// 0 means unlimited.
+func maxTicketLifetime(ticket *tasking.Ticket) int {
+	limits := make([]int, 0, 1)
+	for _, task := range ticket.Tasks {
+		for t := range task.Tasks {
+			limit, exists := conf.TaskTicketLifetimes[canonicalTaskName(t)]
+			if !exists {
+				limit = conf.MaxTicketLifetime
+			}
+			limits = append(limits, limit)
+		}
+	}
+	if len(limits) == 0 {
+		return conf.MaxTicketLifetime
+	}
+	lifetime := 0
+	for _, limit := range limits {
+		if limit > 0 && (lifetime == 0 || limit < lifetime) {
+			lifetime = limit
+		}
+	}
+	return lifetime
+}
+
+// handleDecrypted verifies the decrypted ticket, checks its tasks against
+// the ACL and dispatches the accepted ones. Problems concerning the whole
+// ticket are reported in the Error field of the answer.
+func handleDecrypted(ticketStr string) *tasking.GatewayAnswer {
+	return handleTicket(nil, ticketStr, false, false, nil)
+}
+
+// handleTicket implements handleDecrypted for the tenant tn. In a dry run,
+// the accepted tasks are only routed, but neither published nor counted
+// against the quota, and no receipt is issued. If async is set, only the
+// ticket is validated, and its tasks are dispatched in the background.
+// Their answer is available from the status of the ticket. The time spent
+// is recorded in timings, if not nil.
+func handleTicket(tn *tenant, ticketStr string, dryRun, async bool, timings *requestTimings) (answer *tasking.GatewayAnswer) {
+	org := "" // known once the ticket is verified
+	if !dryRun {
+		defer func() { countTicket(org, answer.Error != nil) }()
+	}
+	if timings != nil {
+		start := time.Now()
+		defer func() { timings.verify = time.Since(start) - timings.publish }()
+	}
+	ticket, myerr := verifyTicketFor(tn, ticketStr)
+	if myerr != nil {
+		return &tasking.GatewayAnswer{Error: myerr}
+	}
+	org = ticket.SignerKeyId
+	traceID, myerr := ticketTraceID(ticket)
+	if myerr != nil {
+		return &tasking.GatewayAnswer{Error: myerr}
+	}
+	if !validCorrelationID(ticket.CorrelationId) {
+		return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Ticket malformed (Invalid correlation ID)"), Code: tasking.ERR_TASK_INVALID}}
+	}
+	log.Printf("Ticket of '%s' has trace ID %s", ticket.SignerKeyId, traceID)
+	if timings != nil {
+		timings.traceID, timings.org, timings.tasks = traceID, ticket.SignerKeyId, len(ticket.Tasks)
+	}
+	ref := newTicketRef(tn, ticket.SignerKeyId, traceID)
+	background := false // the tasks are dispatched by a goroutine
+	if conf.UniqueTraceIDs && ticket.TraceID != "" {
+		if !claimTraceID(ref, !dryRun) {
+			log.Printf("Ticket of '%s' reuses the trace ID %s", ticket.SignerKeyId, traceID)
+			return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errTraceIDReused, Code: tasking.ERR_OTHER_UNRECOVERABLE}}
+		}
+		if !dryRun {
+			defer func() {
+				if !background && len(answer.Accepted) == 0 {
+					releaseTraceID(ref)
+				}
+			}()
+		}
+	}
+	if !dryRun {
+		startStatus(ref)
+		defer func() {
+			if !background {
+				finishStatus(ref)
+			}
+		}()
+	}
+
+	// Rejections due to the clock name the gateway's time, so clients
+	// can detect a drift of their own clock.
+	now := time.Now()
+	serverTime := " (server time " + now.UTC().Format(time.RFC3339) + ")"
 
-	if time.Now().After(ticket.Expiration) {
-		return &tasking.MyError{Error: errors.New("Ticket expired"), Code: tasking.ERR_OTHER_RECOVERABLE}, tskerrors
+	// The zero time is always in the past, so a missing expiration would
+	// otherwise be reported as "expired", which is misleading.
+	if ticket.Expiration.IsZero() {
+		if conf.DefaultTicketLifetime <= 0 {
+			log.Printf("Ticket of '%s' has no expiration, rejecting", ticket.SignerKeyId)
+			return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Ticket has no expiration"), Code: tasking.ERR_OTHER_RECOVERABLE}}
+		}
+		ticket.Expiration = now.Add(time.Duration(conf.DefaultTicketLifetime) * time.Second)
+		log.Printf("Ticket of '%s' has no expiration, applying default of %d seconds", ticket.SignerKeyId, conf.DefaultTicketLifetime)
+	}
+
+	// An expiration far in the future (e.g. year 9999) would create an
+	// effectively non-expiring ticket and is treated as malformed.
+	if lifetime := maxTicketLifetime(ticket); lifetime > 0 {
+		horizon := now.Add(time.Duration(lifetime) * time.Second)
+		if ticket.Expiration.After(horizon) {
+			log.Printf("Ticket of '%s' expires too far in the future: %s", ticket.SignerKeyId, ticket.Expiration)
+			return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Ticket malformed (Expiration too far in the future)" + serverTime), Code: tasking.ERR_TASK_INVALID}}
+		}
+	}
+
+	if now.After(ticket.Expiration) {
+		return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Ticket expired" + serverTime), Code: tasking.ERR_OTHER_RECOVERABLE}}
 	}
 
 	// Check ACL
-	allowedForOrg, exists := allowedTasks[ticket.SignerKeyId]
-	if !exists {
+	allowed, known, disabled := tn.policy()
+	if _, exists := allowed[ticket.SignerKeyId]; !exists {
 		log.Printf("Organization '%s' not allowed", ticket.SignerKeyId)
-		return &tasking.MyError{Error: errors.New("Organization '" + ticket.SignerKeyId + "' not allowed"), Code: tasking.ERR_OTHER_RECOVERABLE}, tskerrors
+		return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Organization '" + ticket.SignerKeyId + "' not allowed"), Code: tasking.ERR_OTHER_RECOVERABLE}}
+	}
+
+	// Dry runs don't dispatch anything, so they don't use up their
+	// sequence. Neither does a ticket withheld as a whole.
+	sequenceScope := ""
+	if tn != nil {
+		sequenceScope = tn.name
+	}
+	releaseWithheld := func(answer *tasking.GatewayAnswer) {
+		if conf.TicketSequences && len(answer.Withheld) != 0 {
+			releaseSequence(sequenceScope, ticket.SignerKeyId, ticket.Sequence)
+		}
+	}
+	if conf.TicketSequences && !dryRun {
+		if myerr := claimSequence(sequenceScope, ticket.SignerKeyId, ticket.Sequence); myerr != nil {
+			log.Printf("Ticket of '%s' rejected: %s", ticket.SignerKeyId, myerr.Error)
+			return &tasking.GatewayAnswer{Error: myerr}
+		}
+	}
+
+	// Otherwise, neither an error nor a rejected task would be reported
+	if len(ticket.Tasks) == 0 {
+		return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Ticket malformed (No tasks)"), Code: tasking.ERR_TASK_INVALID}}
+	}
+
+	if myerr := checkTicketLimits(ticket.SignerKeyId, ticketStr, ticket); myerr != nil {
+		return &tasking.GatewayAnswer{Error: myerr}
+	}
+
+	// Huge argument arrays are rejected before anything is dispatched
+	if conf.MaxTicketArguments > 0 {
+		arguments := 0
+		for _, task := range ticket.Tasks {
+			for _, args := range task.Tasks {
+				arguments += len(args)
+			}
+		}
+		if arguments > conf.MaxTicketArguments {
+			log.Printf("Ticket of '%s' has %d arguments", ticket.SignerKeyId, arguments)
+			return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Ticket malformed (Too many arguments)"), Code: tasking.ERR_TASK_INVALID}}
+		}
+	}
+
+	// Many small arguments can bloat a ticket as much as a few huge ones
+	if conf.MaxTicketArgsLength > 0 {
+		length := 0
+		for _, task := range ticket.Tasks {
+			for _, args := range task.Tasks {
+				for _, arg := range args {
+					length += len(arg)
+				}
+			}
+		}
+		if length > conf.MaxTicketArgsLength {
+			log.Printf("Ticket of '%s' has %d bytes of arguments", ticket.SignerKeyId, length)
+			return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Ticket too large (" + strconv.Itoa(length) + " bytes of arguments, at most " + strconv.Itoa(conf.MaxTicketArgsLength) + " allowed)"), Code: tasking.ERR_OTHER_RECOVERABLE}}
+		}
 	}
 
+	// Some deployments audit tickets per source, so mixing them is refused
+	if conf.RequireSingleSource {
+		for _, task := range ticket.Tasks {
+			if task.Source != ticket.Tasks[0].Source {
+				log.Printf("Ticket of '%s' mixes the sources '%s' and '%s'", ticket.SignerKeyId, ticket.Tasks[0].Source, task.Source)
+				return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Ticket malformed (Tasks of different sources)"), Code: tasking.ERR_TASK_INVALID}}
+			}
+		}
+	}
+
+	// A ticket fanning out to many exchanges amplifies the load on the broker
+	if conf.MaxTicketExchanges > 0 {
+		if exchanges := ticketExchanges(ticket, allowed[ticket.SignerKeyId], disabled); exchanges > conf.MaxTicketExchanges {
+			log.Printf("Ticket of '%s' is published to %d exchanges", ticket.SignerKeyId, exchanges)
+			return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Ticket fans out to too many exchanges (" + strconv.Itoa(exchanges) + ", at most " + strconv.Itoa(conf.MaxTicketExchanges) + " allowed)"), Code: tasking.ERR_OTHER_RECOVERABLE}}
+		}
+	}
+
+	// Count the requested services against the organization's quota. The
+	// ones which are not dispatched are returned afterwards.
+	requested := 0
+	for _, task := range ticket.Tasks {
+		requested += len(task.Tasks)
+	}
+	reservation, quotaErr := reserveQuota(ticket.SignerKeyId, requested)
+	if quotaErr != nil {
+		log.Printf("Organization '%s' exceeded its quota: %s", ticket.SignerKeyId, quotaErr.Error)
+		return &tasking.GatewayAnswer{Error: quotaErr}
+	}
+
+	if async {
+		background = true
+		go func() {
+			answer := dispatchTicket(ticket, ref, allowed, known, disabled, reservation, false)
+			if conf.UniqueTraceIDs && ticket.TraceID != "" && len(answer.Accepted) == 0 {
+				releaseTraceID(ref)
+			}
+			releaseWithheld(answer)
+			finishAsyncStatus(ref, answer)
+		}()
+		log.Printf("Dispatching ticket %s of '%s' in the background", traceID, ticket.SignerKeyId)
+		return &tasking.GatewayAnswer{TraceID: traceID, Async: true}
+	}
+	start := time.Now()
+	answer = dispatchTicket(ticket, ref, allowed, known, disabled, reservation, dryRun)
+	if timings != nil {
+		timings.publish = time.Since(start)
+	}
+	if !dryRun {
+		releaseWithheld(answer)
+	}
+	return answer
+}
+
+// allOrNothing reports whether ticket is only dispatched, if none of its
+// services is rejected.
+func allOrNothing(ticket *tasking.Ticket) bool {
+	if ticket.AllOrNothing {
+		return true
+	}
+	for _, org := range conf.AllOrNothing {
+		if org == ticket.SignerKeyId {
+			return true
+		}
+	}
+	return false
+}
+
+// heldTask is a checked task of a ticket dispatched all or nothing, which
+// is only published once no other service of the ticket was rejected.
+type heldTask struct {
+	task         tasking.Task
+	primaryURI   string // of the ticket, before it was rewritten
+	secondaryURI string
+}
+
+// dispatchTicket checks the tasks of the valid ticket ref one by one, and
+// dispatches the services allowed by the ACL allowed and not disabled.
+// Rejected services not in known are reported as unknown. If the ticket is
+// dispatched all or nothing, the checked tasks are held back, and only
+// published if no service was rejected. Otherwise they are reported as
+// Withheld. Afterwards, the quota reservation is released for the
+// services not dispatched.
+func dispatchTicket(ticket *tasking.Ticket, ref ticketRef, allowed map[string](map[string]struct{}), known, disabled map[string]struct{}, reservation *quotaReservation, dryRun bool) *tasking.GatewayAnswer {
+	traceID := ref.traceID
+	correlationID := ticket.CorrelationId
+	if correlationID == "" {
+		correlationID = traceID
+	}
+	tskerrors := make([]tasking.TaskError, 0)
+	accepted := make([]tasking.TaskSummary, 0)
+	allowedForOrg := allowed[ticket.SignerKeyId]
+	_, allAllowed := allowedForOrg["*"]
+	atomic := allOrNothing(ticket)
+	var held []heldTask
+	checks := newSampleBudget()
+
 	// Check for required fields; Check whether strings are in printable ascii-range
 	for i := 0; i < len(ticket.Tasks); i++ {
 		task := ticket.Tasks[i]
@@ -147,59 +987,286 @@ func handleDecrypted(ticketStr string) (*tasking.MyError, []tasking.TaskError) {
 			e2 := tasking.MyError{Error: e, Code: tasking.ERR_TASK_INVALID}
 			tskerrors = append(tskerrors, tasking.TaskError{
 				TaskStruct: task,
-				Error:      e2})
+				Error:      e2,
+				Reason:     invalidTaskReason(e)})
+		} else if task.Download && !downloadAllowed(ticket.SignerKeyId, task.Source) {
+			e2 := tasking.MyError{Error: errors.New("Download not allowed"), Code: tasking.ERR_NOT_ALLOWED}
+			tskerrors = append(tskerrors, tasking.TaskError{
+				TaskStruct: task,
+				Error:      e2,
+				Reason:     tasking.REASON_DOWNLOAD_NOT_ALLOWED})
 		} else {
+			task.Tasks = canonicalTasks(task.Tasks)
+
+			// Globally disabled tasks are rejected regardless of the ACL
+			var disabledForNow map[string][]string
+			for tsk, arg := range task.Tasks {
+				if _, isDisabled := disabled[tsk]; isDisabled {
+					if disabledForNow == nil {
+						disabledForNow = make(map[string][]string)
+					}
+					disabledForNow[tsk] = arg
+					delete(task.Tasks, tsk)
+				}
+			}
+
 			// Check whether the corresponding tasks are allowed in ACL:
-			acceptedTasks := make(map[string][]string)
-			rejectedTasks := make(map[string][]string)
+			var acceptedTasks map[string][]string
+			var rejectedTasks map[string][]string // only allocated if needed
 
-			_, allAllowed := allowedForOrg["*"]
 			if allAllowed {
 				acceptedTasks = task.Tasks
 			} else {
+				acceptedTasks = make(map[string][]string, len(task.Tasks))
 				for tsk, arg := range task.Tasks {
 					_, tAllowed := allowedForOrg[tsk]
 					if tAllowed {
 						acceptedTasks[tsk] = arg
 					} else {
+						if rejectedTasks == nil {
+							rejectedTasks = make(map[string][]string)
+						}
 						rejectedTasks[tsk] = arg
 					}
 
 				}
 			}
+			missingSecondary := splitMissingSecondary(&task, acceptedTasks)
+			missingArguments := splitMissingArguments(acceptedTasks)
+			missingSource := splitMissingSource(&task, acceptedTasks)
+			unknownTasks := splitUnknownTasks(rejectedTasks, known)
+			var rateLimited map[string][]string
+			if !dryRun {
+				rateLimited = takeTaskTokens(acceptedTasks)
+			}
 			log.Printf("Allowed: %+v\n", acceptedTasks)
 			log.Printf("Rejected: %+v\n", rejectedTasks)
 			savedPrimaryURI := task.PrimaryURI
 			savedSecondaryURI := task.SecondaryURI
-			task.PrimaryURI = conf.SampleStorageURI + task.PrimaryURI
-			if task.SecondaryURI != "" {
-				task.SecondaryURI = conf.SampleStorageURI + task.SecondaryURI
-			}
 			task.Tasks = acceptedTasks
-			myerr := pushToTransport(task)
+			var myerr *tasking.MyError
+			reason := tasking.REASON_DISPATCH_FAILED
+			if len(acceptedTasks) == 0 {
+				// every service was rejected, there is nothing to dispatch
+				log.Println("No service of the task is allowed, not dispatching it")
+			} else if e := enrichTask(&task); e != nil {
+				log.Println("Enriched task invalid: ", e)
+				myerr = &tasking.MyError{Error: e, Code: tasking.ERR_TASK_INVALID}
+				reason = tasking.REASON_ENRICHMENT_FAILED
+			} else if e := checkURISchemes(&task); e != nil {
+				log.Println("Task rejected: ", e)
+				myerr = &tasking.MyError{Error: e, Code: tasking.ERR_TASK_INVALID}
+				reason = tasking.REASON_URI_SCHEME_NOT_ALLOWED
+			} else {
+				// services reading from different storages are sent
+				// separately, each with its own URIs
+				for _, group := range storageGroups(task.Tasks) {
+					sub := task
+					sub.Tasks = group.tasks
+					sub.PrimaryURI = group.prefix + task.PrimaryURI
+					if sub.SecondaryURI != "" {
+						sub.SecondaryURI = group.prefix + task.SecondaryURI
+					}
+					if e := rewriteURIs(&sub, group.rewriter); e != nil {
+						log.Println("Task rejected: ", e)
+						myerr = &tasking.MyError{Error: e, Code: tasking.ERR_TASK_INVALID}
+						reason = tasking.REASON_URI_REWRITE_FAILED
+						break
+					}
+					if conf.VerifySamples {
+						if e, r := checkSample(checks, sub.PrimaryURI); e != nil {
+							myerr, reason = e, r
+							break
+						}
+					}
+					var dispatched []tasking.TaskSummary
+					if dryRun || atomic {
+						dispatched, myerr = routeSummaries(sub)
+					} else {
+						dispatched, myerr = pushToTransport(sub, ref.resultID(), correlationID, ticket.Expiration)
+					}
+					if atomic && !dryRun && myerr == nil {
+						// the services are removed from acceptedTasks below,
+						// which may be the same map
+						h := heldTask{task: sub, primaryURI: savedPrimaryURI, secondaryURI: savedSecondaryURI}
+						h.task.Tasks = make(map[string][]string, len(sub.Tasks))
+						for t, args := range sub.Tasks {
+							h.task.Tasks[t] = args
+						}
+						held = append(held, h)
+					}
+					for _, d := range dispatched {
+						d.PrimaryURI = savedPrimaryURI
+						if conf.ExplainACL {
+							d.MatchedRule = matchedRule(d.Task, allAllowed)
+						}
+						accepted = append(accepted, d)
+						delete(acceptedTasks, d.Task)
+					}
+					if myerr != nil {
+						break
+					}
+				}
+			}
 			if myerr != nil {
+				// only the services which were not dispatched failed
+				if !dryRun {
+					returnTaskTokens(acceptedTasks)
+				}
 				task.PrimaryURI = savedPrimaryURI
 				task.SecondaryURI = savedSecondaryURI
 				task.Tasks = acceptedTasks
 				tskerrors = append(tskerrors, tasking.TaskError{
 					TaskStruct: task,
-					Error:      *myerr})
+					Error:      *myerr,
+					Reason:     reason})
+			}
+			if len(disabledForNow) != 0 {
+				task.PrimaryURI = savedPrimaryURI
+				task.SecondaryURI = savedSecondaryURI
+				task.Tasks = disabledForNow
+				e2 := tasking.MyError{Error: errors.New("Temporarily disabled"), Code: tasking.ERR_NOT_ALLOWED}
+				tskerrors = append(tskerrors, tasking.TaskError{
+					TaskStruct: task,
+					Error:      e2,
+					Reason:     tasking.REASON_TASK_DISABLED})
+			}
+			if len(missingSecondary) != 0 {
+				task.PrimaryURI = savedPrimaryURI
+				task.SecondaryURI = savedSecondaryURI
+				task.Tasks = missingSecondary
+				e2 := tasking.MyError{Error: errors.New("Invalid Task (SecondaryURI required)"), Code: tasking.ERR_TASK_INVALID}
+				tskerrors = append(tskerrors, tasking.TaskError{
+					TaskStruct: task,
+					Error:      e2,
+					Reason:     tasking.REASON_SECONDARY_URI_REQUIRED})
+			}
+			if len(rateLimited) != 0 {
+				task.PrimaryURI = savedPrimaryURI
+				task.SecondaryURI = savedSecondaryURI
+				task.Tasks = rateLimited
+				e2 := tasking.MyError{Error: errors.New("Rate limit of the task type exceeded, try again later"), Code: tasking.ERR_OTHER_RECOVERABLE}
+				tskerrors = append(tskerrors, tasking.TaskError{
+					TaskStruct: task,
+					Error:      e2,
+					Reason:     tasking.REASON_TASK_RATE_LIMITED})
+			}
+			if len(missingArguments) != 0 {
+				task.PrimaryURI = savedPrimaryURI
+				task.SecondaryURI = savedSecondaryURI
+				task.Tasks = missingArguments
+				e2 := tasking.MyError{Error: errors.New("Invalid Task (Arguments required)"), Code: tasking.ERR_TASK_INVALID}
+				tskerrors = append(tskerrors, tasking.TaskError{
+					TaskStruct: task,
+					Error:      e2,
+					Reason:     tasking.REASON_ARGUMENTS_REQUIRED})
+			}
+			if len(missingSource) != 0 {
+				task.PrimaryURI = savedPrimaryURI
+				task.SecondaryURI = savedSecondaryURI
+				task.Tasks = missingSource
+				e2 := tasking.MyError{Error: errors.New("Invalid Task (Source required)"), Code: tasking.ERR_TASK_INVALID}
+				tskerrors = append(tskerrors, tasking.TaskError{
+					TaskStruct: task,
+					Error:      e2,
+					Reason:     tasking.REASON_SOURCE_REQUIRED})
+			}
+			if len(unknownTasks) != 0 {
+				task.PrimaryURI = savedPrimaryURI
+				task.SecondaryURI = savedSecondaryURI
+				task.Tasks = unknownTasks
+				e2 := tasking.MyError{Error: errors.New("Unknown task type"), Code: tasking.ERR_TASK_INVALID}
+				tskerrors = append(tskerrors, tasking.TaskError{
+					TaskStruct: task,
+					Error:      e2,
+					Reason:     tasking.REASON_TASK_UNKNOWN})
 			}
 			if len(rejectedTasks) != 0 {
 				task.PrimaryURI = savedPrimaryURI
 				task.SecondaryURI = savedSecondaryURI
 				task.Tasks = rejectedTasks
 				e2 := tasking.MyError{Error: errors.New("Rejected"), Code: tasking.ERR_NOT_ALLOWED}
+				rejection := tasking.REASON_TASK_NOT_ALLOWED
+				// an empty list in the ACL is most likely a misconfiguration
+				if len(allowedForOrg) == 0 {
+					log.Printf("Organization '%s' has no permitted tasks", ticket.SignerKeyId)
+					e2.Error = errors.New("Organization has no permitted tasks")
+					rejection = tasking.REASON_NO_PERMITTED_TASKS
+				}
+				tskerrors = append(tskerrors, tasking.TaskError{
+					TaskStruct: task,
+					Error:      e2,
+					Reason:     rejection})
+			}
+		}
+	}
+
+	var withheld []tasking.TaskSummary
+	if atomic && len(tskerrors) != 0 {
+		if len(accepted) != 0 {
+			log.Printf("Ticket %s of '%s' is dispatched all or nothing, withholding %d services due to %d rejected tasks", traceID, ticket.SignerKeyId, len(accepted), len(tskerrors))
+		}
+		for _, h := range held {
+			returnTaskTokens(h.task.Tasks)
+		}
+		withheld, accepted = accepted, make([]tasking.TaskSummary, 0)
+	} else if len(held) != 0 {
+		// Publishing can still fail, but what was published before can't
+		// be withdrawn anymore.
+		accepted = make([]tasking.TaskSummary, 0, len(accepted))
+		for _, h := range held {
+			dispatched, myerr := pushToTransport(h.task, ref.resultID(), correlationID, ticket.Expiration)
+			for _, d := range dispatched {
+				d.PrimaryURI = h.primaryURI
+				if conf.ExplainACL {
+					d.MatchedRule = matchedRule(d.Task, allAllowed)
+				}
+				accepted = append(accepted, d)
+				delete(h.task.Tasks, d.Task)
+			}
+			if myerr != nil {
+				returnTaskTokens(h.task.Tasks)
+				task := h.task
+				task.PrimaryURI = h.primaryURI
+				task.SecondaryURI = h.secondaryURI
 				tskerrors = append(tskerrors, tasking.TaskError{
 					TaskStruct: task,
-					Error:      e2})
+					Error:      *myerr,
+					Reason:     tasking.REASON_DISPATCH_FAILED})
 			}
 		}
 	}
 
-	return nil, tskerrors
+	answer := &tasking.GatewayAnswer{
+		TraceID:   traceID,
+		TskErrors: tskerrors,
+		Accepted:  accepted,
+		Withheld:  withheld,
+		DryRun:    dryRun,
+	}
+	if conf.SummarizeRejections && len(tskerrors) != 0 {
+		answer.Rejections = summarizeRejections(tskerrors)
+	}
+	if dryRun {
+		releaseQuota(reservation, 0)
+		truncateAnswer(answer)
+		return answer
+	}
+	releaseQuota(reservation, len(accepted))
+	if len(accepted) != 0 {
+		var err error
+		answer.Receipt, err = issueReceipt(traceID, ticket.SignerKeyId, accepted)
+		if err != nil {
+			log.Println("Couldn't issue receipt: ", err)
+		}
+		recordDispatch(ref, accepted)
+	}
+	truncateAnswer(answer)
+	return answer
 }
 
+var errInvalidFingerprint = &tasking.MyError{Error: errors.New("Invalid KeyFingerprint"), Code: tasking.ERR_OTHER_RECOVERABLE}
+
 func decodeTask(r *http.Request) (*tasking.Encrypted, *tasking.MyError) {
 	ek, err := base64.StdEncoding.DecodeString(r.FormValue("EncryptedKey"))
 	if err != nil {
@@ -214,250 +1281,605 @@ func decodeTask(r *http.Request) (*tasking.Encrypted, *tasking.MyError) {
 		return nil, &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
 	}
 
+	fingerprint := r.FormValue("KeyFingerprint")
+	if !validIdentifier(fingerprint) {
+		return nil, errInvalidFingerprint
+	}
+
+	encryption := r.FormValue("Encryption")
+	switch encryption {
+	case "", tasking.ENCRYPTION_AES_CBC, tasking.ENCRYPTION_AES_GCM:
+	default:
+		return nil, &tasking.MyError{Error: errors.New("Unknown Encryption (supported: " + tasking.ENCRYPTION_AES_CBC + ", " + tasking.ENCRYPTION_AES_GCM + ")"), Code: tasking.ERR_ENCRYPTION}
+	}
+
 	task := tasking.Encrypted{
-		KeyFingerprint: r.FormValue("KeyFingerprint"),
+		KeyFingerprint: fingerprint,
 		EncryptedKey:   ek,
 		Encrypted:      en,
-		IV:             iv}
+		IV:             iv,
+		Encryption:     encryption}
+	if conf.MultipleRecipients {
+		recipients, myerr := decodeRecipients(r)
+		if myerr != nil {
+			return nil, myerr
+		}
+		task.Recipients = recipients
+	}
 	// log.Printf("New task request:\n%+v\n", task);
 	return &task, nil
 }
 
-func pushToAMQP(task *tasking.Task, rconf *RabbitConf) *tasking.MyError {
-	msgBody, err := json.Marshal(task)
-	if err != nil {
-		log.Println("Error while Marshalling: ", err)
-		return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
-	}
-	pub := amqp.Publishing{DeliveryMode: amqp.Persistent, ContentType: "text/plain", Body: msgBody}
-	log.Printf("Pushing to %s: \x1b[0;32m%s\x1b[0m\n", rconf.Exchange, msgBody)
-	err = rabbitChannel.Publish(rconf.Exchange, rconf.RoutingKey, false, false, pub)
+// maxRecipients limits the recipients of a ticket, since each of them is
+// looked up.
+const maxRecipients = 16
 
-	if err != nil {
-		log.Println("Error while pushing to transport: ", err)
-		// try to recover three times
-		try := 0
-		for try < 3 {
-			try++
-			log.Println("Trying to restore the connection... #", try)
-			err = connectRabbit()
-			if err == nil {
-				break
-			}
-			// sleep 3 seconds
-			time.Sleep(time.Duration(3000000000))
+// decodeRecipients decodes the recipients of a ticket, which are sent as
+// pairs of the repeated form fields KeyFingerprint and EncryptedKey. A
+// ticket with a single recipient has none.
+func decodeRecipients(r *http.Request) ([]tasking.Recipient, *tasking.MyError) {
+	fingerprints := r.Form["KeyFingerprint"]
+	encryptedKeys := r.Form["EncryptedKey"]
+	if len(fingerprints) <= 1 && len(encryptedKeys) <= 1 {
+		return nil, nil
+	}
+	if len(fingerprints) != len(encryptedKeys) {
+		return nil, &tasking.MyError{Error: errors.New("Number of KeyFingerprints and EncryptedKeys differs"), Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+	if len(fingerprints) > maxRecipients {
+		return nil, &tasking.MyError{Error: errors.New("Too many recipients"), Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+	recipients := make([]tasking.Recipient, len(fingerprints))
+	for i := range fingerprints {
+		if !validIdentifier(fingerprints[i]) {
+			return nil, errInvalidFingerprint
 		}
+		ek, err := base64.StdEncoding.DecodeString(encryptedKeys[i])
 		if err != nil {
-			// could not recover the connection after third try => give up
-			return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+			return nil, &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
 		}
-		log.Println("Connection restored")
+		recipients[i] = tasking.Recipient{KeyFingerprint: fingerprints[i], EncryptedKey: ek}
+	}
+	return recipients, nil
+}
 
-		// retry pushing
-		err = rabbitChannel.Publish(rconf.Exchange, rconf.RoutingKey, false, false, pub)
-		if err != nil {
-			return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+// taskRoute is the destination of a single service of a task.
+type taskRoute struct {
+	Task   string
+	Conf   RabbitConf
+	Sync   bool // The service is answered synchronously
+	Shared bool // The service is sent together with the others using the default destination
+}
+
+// quarantined reports whether the service t is sent to the quarantine
+// destination, because it appears nowhere in the configuration. This can
+// only happen for organizations allowed to request all services.
+func quarantined(t string) bool {
+	if conf.QuarantineRabbit == nil {
+		return false
+	}
+	policyMutex.RLock()
+	_, known := knownTasks[t]
+	policyMutex.RUnlock()
+	if known {
+		return false
+	}
+	for _, tn := range tenants {
+		if _, known := tn.knownTasks[t]; known {
+			return false
 		}
 	}
-	return nil
+	return true
+}
+
+// matchedRule returns the ACL rule which allowed the service t: "*", if
+// all services are allowed, otherwise the (canonical) name of t itself.
+func matchedRule(t string, allAllowed bool) string {
+	if allAllowed {
+		return "*"
+	}
+	return t
+}
+
+// routeTask determines the destination of every service of task. Since
+// each service (e.g. CUCKOO, PEID, ...) can have a special destination
+// defined in the config, they are sent separately. Services without one
+// are sent together to the default destination, except for synchronous
+// ones, whose results have to be told apart.
+func routeTask(task tasking.Task) ([]taskRoute, *tasking.MyError) {
+	routes := make([]taskRoute, 0, len(task.Tasks))
+	for t := range task.Tasks {
+		rconf, special := conf.Rabbit[t]
+		if !special && quarantined(t) {
+			log.Printf("Quarantining unknown task type %s", t)
+			rconf, special = *conf.QuarantineRabbit, true
+		}
+		if !special {
+			var err error
+			if rconf, err = defaultDestination(task.Source); err != nil {
+				return nil, &tasking.MyError{Error: err, Code: tasking.ERR_TASK_INVALID}
+			}
+		}
+		// the result of a task sent to a webhook can't be awaited
+		sync := isSyncTask(t) && rconf.Webhook == ""
+		routes = append(routes, taskRoute{
+			Task:   t,
+			Conf:   rconf,
+			Sync:   sync,
+			Shared: !special && !sync})
+	}
+	return routes, nil
+}
+
+// routeSummaries returns the summaries pushToTransport would return for
+// task, without publishing it.
+func routeSummaries(task tasking.Task) ([]tasking.TaskSummary, *tasking.MyError) {
+	routes, err := routeTask(task)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]tasking.TaskSummary, 0, len(routes))
+	for _, r := range routes {
+		summaries = append(summaries, tasking.TaskSummary{
+			Task:       r.Task,
+			Exchange:   r.Conf.Exchange,
+			RoutingKey: r.Conf.RoutingKey})
+	}
+	return summaries, nil
 }
 
-func pushToTransport(task tasking.Task) *tasking.MyError {
+// pushToTransport publishes the task and returns a summary for every
+// service that was dispatched. Services with a special destination in the
+// configuration are sent separately. If an error occurs, the summaries of
+// the services that were dispatched before are returned along with it.
+// resultID is the ID the results of the ticket are received by, and
+// expiration is the expiration of the ticket.
+func pushToTransport(task tasking.Task, resultID, correlationID string, expiration time.Time) ([]tasking.TaskSummary, *tasking.MyError) {
 	log.Printf("%+v\n", task)
+	dispatched := make([]tasking.TaskSummary, 0, len(task.Tasks))
+	routes, err := routeTask(task)
+	if err != nil {
+		return dispatched, err
+	}
 
-	// split task:
+	// the services are already canonical, but task.Tasks is replaced
+	// below, so the original map is kept
 	tasks := task.Tasks
-
-	// since each task (e.g. CUCKOO, PEID, ...) can have a special destination defined
-	// in the config we go trough all tasks in this task struct and check it.
-	// If the task had a special destination we cut it out of the original task struct and
-	// send it seperately.
-	// If the task is sent using RabbitDefault we just leave it in the struct and send the
-	// whole task struct after we went trough it completly.
-	for t := range tasks {
-		log.Println(t)
-
-		// check if special routing is defined in the config
-		rconf, exists := conf.Rabbit[t]
-		if !exists {
+	var shared map[string][]string // only allocated if needed
+	var sharedConf RabbitConf
+	for _, r := range routes {
+		if r.Shared {
+			if shared == nil {
+				shared = make(map[string][]string, len(tasks))
+			}
+			shared[r.Task] = tasks[r.Task]
+			sharedConf = r.Conf
 			continue
 		}
 
 		// build a seperate task struct
-		task.Tasks = map[string][]string{t: tasks[t]}
-		if err := pushToAMQP(&task, &rconf); err != nil {
-			return err
+		rconf := r.Conf
+		task.Tasks = map[string][]string{r.Task: tasks[r.Task]}
+		summary := tasking.TaskSummary{
+			Task:       r.Task,
+			Exchange:   rconf.Exchange,
+			RoutingKey: rconf.RoutingKey}
+		if r.Sync {
+			result, err := pushSync(&task, &rconf, correlationID)
+			if err != nil {
+				return dispatched, err
+			}
+			summary.Result = result
+		} else if err := pushForResult(&task, &rconf, resultID, correlationID, expiration); err != nil {
+			return dispatched, err
 		}
-
-		// delete the task from the tasks list of the struct
-		delete(tasks, t)
+		dispatched = append(dispatched, summary)
 	}
 
 	// If there are tasks left we send them all as one big pack to the default destination.
-	if len(tasks) == 0 {
-		return nil
+	if len(shared) == 0 {
+		return dispatched, nil
 	}
-
-	task.Tasks = tasks
-	if err := pushToAMQP(&task, &conf.RabbitDefault); err != nil {
-		return err
+	task.Tasks = shared
+	if err := pushForResult(&task, &sharedConf, resultID, correlationID, expiration); err != nil {
+		return dispatched, err
+	}
+	for t := range shared {
+		dispatched = append(dispatched, tasking.TaskSummary{
+			Task:       t,
+			Exchange:   sharedConf.Exchange,
+			RoutingKey: sharedConf.RoutingKey})
 	}
 
-	return nil
+	return dispatched, nil
 }
 
-func handleIncoming(task *tasking.Encrypted) (*tasking.MyError, []tasking.TaskError, []byte) {
-	decTicket, err, symKey := decryptTicket(task)
+func handleIncoming(tn *tenant, task *tasking.Encrypted, idempotencyKey string, dryRun, async bool, timings *requestTimings) (*tasking.GatewayAnswer, []byte) {
+	start := time.Now()
+	decTicket, keyName, err, symKey := decryptTicketFor(tn, task)
+	if timings != nil {
+		timings.decrypt = time.Since(start)
+	}
 	if err != nil {
 		log.Println("Error while decrypting: ", err)
-		return err, nil, symKey
+		// The answer is only encrypted, if the client is able to decrypt
+		// it, i.e. the symmetric key and the IV were recovered intact
+		if conf.PlainDecryptErrors || len(task.IV) != ivSize(task.Encryption) {
+			symKey = nil
+		}
+		return &tasking.GatewayAnswer{Error: err}, symKey
+	}
+	if err := checkSourceKey(keyName, decTicket); err != nil {
+		log.Println("Error: ", err.Error)
+		return &tasking.GatewayAnswer{Error: err}, symKey
+	}
+	if err := checkTicketEncryption(task.Encryption, decTicket); err != nil {
+		log.Println("Error: ", err.Error)
+		return &tasking.GatewayAnswer{Error: err}, symKey
 	}
 	log.Println("Decrypted ticket:", decTicket)
-	err, tskerrors := handleDecrypted(decTicket)
-	if err != nil {
-		log.Println("Error: ", err)
-		return err, nil, symKey
+	var answer *tasking.GatewayAnswer
+	if dryRun {
+		answer = handleTicket(tn, decTicket, true, false, timings)
+	} else {
+		// tenants don't share their Idempotency-Keys
+		scope := ""
+		if tn != nil {
+			scope = tn.name
+		}
+		answer = idempotent(scope, idempotencyKey, decTicket, func() *tasking.GatewayAnswer {
+			return handleTicket(tn, decTicket, false, async, timings)
+		})
+	}
+	if answer.Error != nil {
+		log.Println("Error: ", answer.Error)
 	}
-	// return all the collected errors for individual tasks
-	return nil, tskerrors, symKey
+	return answer, symKey
+}
+
+// writePlainError answers with an unencrypted error. This is only done if
+// the symmetric key of the ticket is not known, so the client can't
+// decrypt the answer anyways.
+func writePlainError(w http.ResponseWriter, status int, err *tasking.MyError) {
+	x, _ := json.Marshal(tasking.PlainAnswer{Encrypted: false, Error: err})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(tasking.EncryptedHeader, "false")
+	w.WriteHeader(status)
+	w.Write(x)
 }
 
 func httpRequestIncoming(w http.ResponseWriter, r *http.Request) {
+	if inMaintenance() {
+		noteRejection(r, "maintenance")
+		writePlainError(w, http.StatusServiceUnavailable, errMaintenance)
+		return
+	}
+	serveTask(w, r, false)
+}
+
+// httpRequestDryRun checks and routes a ticket like httpRequestIncoming,
+// but does not dispatch it. The answer names the destination of every
+// accepted service, so routing changes can be verified safely.
+func httpRequestDryRun(w http.ResponseWriter, r *http.Request) {
+	serveTask(w, r, true)
+}
+
+// serveTask answers a request submitting a ticket.
+func serveTask(w http.ResponseWriter, r *http.Request, dryRun bool) {
 	task, err := decodeTask(r)
 	if err != nil {
 		log.Println("Error while decoding: ", err)
-		x, _ := json.Marshal(err)
-		w.Write(x)
+		writePlainError(w, http.StatusBadRequest, err)
+		return
+	}
+	encoding, err := negotiateEncoding(r)
+	if err != nil {
+		writePlainError(w, http.StatusNotAcceptable, err)
 		return
 	}
 
-	err, tskerrors, symKey := handleIncoming(task)
-	answer := tasking.GatewayAnswer{
-		Error:     err,
-		TskErrors: tskerrors,
+	async := !dryRun && conf.AsyncTickets && preferAsync(r)
+	start := time.Now()
+	timings := &requestTimings{}
+	answer, symKey := handleIncoming(tenantFor(r), task, r.Header.Get("Idempotency-Key"), dryRun, async, timings)
+	logSlowRequest(timings, time.Since(start))
+	if answer.Error != nil {
+		noteRejection(r, answer.Error.Error.Error())
+	} else if len(answer.TskErrors) != 0 {
+		noteRejection(r, strconv.Itoa(len(answer.TskErrors))+" tasks rejected")
 	}
-	// encrypt answer
-	task.IV[0] ^= 1 // Do not reuse the same IV -> modify one bit
+	if answer.Error != nil && answer.Error.Code == tasking.ERR_BUSY {
+		writePlainError(w, http.StatusServiceUnavailable, answer.Error)
+		return
+	}
+	if symKey == nil {
+		writePlainError(w, http.StatusOK, answer.Error)
+		return
+	}
+	// the answer may be shared with other requests by the idempotency
+	// cache, so it is copied before setting the time
+	stamped := *answer
+	stamped.ServerTime = time.Now().UTC()
+	answer = &stamped
+	status := http.StatusOK
+	if answer.Async {
+		w.Header().Set("Preference-Applied", "respond-async")
+		status = http.StatusAccepted
+	}
+	if dryRun && plaintextDiagnostics("dryrun") {
+		writePlain(w, answer)
+		return
+	}
+	writeEncrypted(w, task, symKey, encoding, status, answer)
+}
+
+// preferAsync reports whether the client asked for an asynchronous answer
+// with the header "Prefer: respond-async" (RFC 7240).
+func preferAsync(r *http.Request) bool {
+	for _, header := range r.Header["Prefer"] {
+		for _, pref := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// plaintextDiagnostics reports whether answers of the diagnostic endpoint
+// ("echo" or "dryrun") are sent unencrypted.
+func plaintextDiagnostics(endpoint string) bool {
+	for _, e := range conf.PlaintextDiagnostics {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// writePlain answers with answer as plain JSON.
+func writePlain(w http.ResponseWriter, answer interface{}) {
 	x, _ := json.Marshal(answer)
-	log.Println("Returning: ", string(x))
+	log.Println("Returning unencrypted: ", string(x))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(tasking.EncryptedHeader, "false")
+	w.Write(x)
+}
 
-	enc, _ := tasking.AesEncrypt(x, symKey, task.IV)
-	// TODO: Handle case that symKey could not be extracted
+// writeEncrypted answers with answer encrypted by the symmetric key of the
+// ticket task, after encoding and compressing it as negotiated, and the
+// HTTP status.
+func writeEncrypted(w http.ResponseWriter, task *tasking.Encrypted, symKey []byte, encoding answerEncoding, status int, answer interface{}) {
+	x, format := encoding.marshal(answer)
+	if format == tasking.FORMAT_JSON {
+		log.Println("Returning: ", string(x))
+	} else {
+		log.Printf("Returning %d bytes of %s", len(x), format)
+	}
+
+	enc, encryption, err := encryptAnswer(task, symKey, encoding, encoding.compress(x))
+	if err != nil {
+		log.Println("Couldn't encrypt the answer:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	encoding.Encryption = encryption
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(tasking.EncryptedHeader, "true")
+	w.Header().Set(tasking.EncryptionHeader, encoding.Encryption)
+	w.Header().Set(tasking.CompressionHeader, encoding.Compression)
+	w.Header().Set(tasking.FormatHeader, format)
+	w.WriteHeader(status)
 	w.Write(enc)
 }
 
+// encryptAnswer encrypts the answer to task with its symmetric key, and
+// returns the encryption used. The answer to an aes-gcm ticket is always
+// encrypted with aes-gcm and a fresh nonce, which precedes the ciphertext.
+// Otherwise, the negotiated aes-cbc is used with the IV of the request,
+// whose lowest bit is flipped.
+func encryptAnswer(task *tasking.Encrypted, symKey []byte, encoding answerEncoding, plaintext []byte) ([]byte, string, error) {
+	if ticketEncryption(task.Encryption) == tasking.ENCRYPTION_AES_GCM {
+		nonce := make([]byte, tasking.AES_GCM_NONCE_SIZE)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, "", err
+		}
+		enc, err := tasking.AesGcmEncrypt(plaintext, symKey, nonce)
+		if err != nil {
+			return nil, "", err
+		}
+		return append(nonce, enc...), tasking.ENCRYPTION_AES_GCM, nil
+	}
+	task.IV[0] ^= 1 // Do not reuse the same IV -> modify one bit
+	enc, err := tasking.AesEncrypt(plaintext, symKey, task.IV)
+	return enc, encoding.Encryption, err
+}
+
 func readKeys() {
-	// Load the private keys for the sources
-	tasking.LoadKeysAndWatch(conf.SourcesKeysPath, ".priv",
-		func(name string) {
-			keysMutex.Lock()
-			delete(keys, name)
-			keysMutex.Unlock()
-			log.Println(keys)
-		},
-		func(name string) {
-			key, name, err := tasking.LoadPrivateKey(name)
-			if err != nil {
-				log.Printf("Error reading key (%s):%s\n", name, err)
-				return
-			}
+	if conf.KeyManifest != "" {
+		err := applyKeyManifest(conf.KeyManifest)
+		tasking.FailOnError(err, "Couldn't apply the key manifest")
+	} else {
+		// Load the private keys for the sources
+		tasking.LoadKeysFromAndWatch(keySource, conf.SourcesKeysPath, ".priv",
+			removeSourceKey,
+			func(name string) {
+				key, name, err := tasking.LoadPrivateKeyFrom(keySource, name)
+				if err != nil {
+					log.Printf("Error reading key (%s):%s\n", name, err)
+					return
+				}
+				addSourceKey(name, key)
+				log.Printf("Added source key %s", name)
+			})
 
-			keysMutex.Lock()
-			keys[name] = key
-			keysMutex.Unlock()
-			log.Println(keys)
-		})
+		// Load the public keys for the tickets
+		tasking.LoadKeysFromAndWatch(keySource, conf.TicketKeysPath, ".pub",
+			func(name string) {
+				keysMutex.Lock()
+				delete(ticketKeys, name)
+				log.Println(ticketKeys)
+				keysMutex.Unlock()
+			},
+			func(name string) {
+				key, name, err := tasking.LoadPublicKeyFrom(keySource, name)
+				if err != nil {
+					log.Printf("Error reading key (%s):%s\n", name, err)
+					return
+				}
+				keysMutex.Lock()
+				ticketKeys[name] = key
+				log.Println(ticketKeys)
+				keysMutex.Unlock()
+			})
+	}
 
-	// Load the public keys for the tickets
-	tasking.LoadKeysAndWatch(conf.TicketKeysPath, ".pub",
+	// Load the optional metadata (e.g. expiry) of the ticket keys
+	tasking.LoadKeysFromAndWatch(keySource, conf.TicketKeysPath, ".meta",
+		removeKeyMeta,
 		func(name string) {
-			keysMutex.Lock()
-			delete(ticketKeys, name)
-			keysMutex.Unlock()
-			log.Println(ticketKeys)
-		},
-		func(name string) {
-			key, name, err := tasking.LoadPublicKey(name)
-			if err != nil {
-				log.Printf("Error reading key (%s):%s\n", name, err)
-				return
+			if err := addKeyMeta(name); err != nil {
+				log.Printf("Error reading key metadata (%s):%s\n", name, err)
 			}
-			keysMutex.Lock()
-			ticketKeys[name] = key
-			keysMutex.Unlock()
-			log.Println(ticketKeys)
 		})
 
+	// Load the private keys signing the receipts
+	if conf.ReceiptKeysPath != "" {
+		tasking.LoadKeysFromAndWatch(keySource, conf.ReceiptKeysPath, ".priv",
+			removeReceiptKey,
+			func(name string) {
+				key, name, err := tasking.LoadPrivateKeyFrom(keySource, name)
+				if err != nil {
+					log.Printf("Error reading key (%s):%s\n", name, err)
+					return
+				}
+				addReceiptKey(name, key)
+				current, _ := currentReceiptKey()
+				log.Printf("Added receipt key %s, signing with %s", name, current)
+			})
+	}
 }
 
-func addRabbitConf(r RabbitConf) error {
-	queue, err := rabbitChannel.QueueDeclare(
-		r.Queue, //name
-		true,    // durable
-		false,   // delete when unused
-		false,   // exclusive
-		false,   // no-wait
-		nil,     // arguments
-	)
-	if err != nil {
-		return errors.New("Failed to declare a queue: " + err.Error())
-	}
-
-	err = rabbitChannel.ExchangeDeclare(
-		r.Exchange, // name
-		"topic",    // type
-		true,       // durable
-		false,      // auto-deleted
-		false,      // internal
-		false,      // no-wait
-		nil,        // arguments
-	)
-	if err != nil {
-		return errors.New("Failed to declare an exchange: " + err.Error())
+// listen creates the listener for the HTTP-server. Addresses of the form
+// "unix:/path/to.sock" bind to a Unix domain socket, everything else is
+// treated as a TCP address.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
 	}
+	path := strings.TrimPrefix(addr, "unix:")
 
-	err = rabbitChannel.QueueBind(
-		queue.Name,   // queue name
-		r.RoutingKey, // routing key
-		r.Exchange,   // exchange
-		false,        // nowait
-		nil,          // arguments
-	)
-	if err != nil {
-		return errors.New("Failed to bind queue: " + err.Error())
+	mode := uint64(0660)
+	if conf.HTTPSocketMode != "" {
+		var err error
+		mode, err = strconv.ParseUint(conf.HTTPSocketMode, 8, 32)
+		if err != nil {
+			return nil, errors.New("Invalid HTTPSocketMode: " + err.Error())
+		}
 	}
-	return nil
-}
 
-func connectRabbit() error {
-	conn, err := amqp.Dial("amqp://" + conf.RabbitUser + ":" + conf.RabbitPassword + "@" + conf.RabbitURI)
-	if err != nil {
-		return errors.New("Failed to connect to RabbitMQ: " + err.Error())
+	// remove a stale socket left behind by a previous run
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
 	}
-	//defer conn.Close()
+	// the socket gets its mode from the umask as it is created, instead of
+	// being accessible to others until a later chmod
+	umask := syscall.Umask(int(0777 &^ mode))
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	return listener, err
+}
 
-	rabbitChannel, err = conn.Channel()
-	if err != nil {
-		return errors.New("Failed to open a channel: " + err.Error())
+// registerHandlers registers the handlers of the gateway at mux. Every
+// handler is wrapped in the common middleware chain.
+func registerHandlers(mux *http.ServeMux) {
+	common := []middleware{
+		recoverMiddleware,
+		logMiddleware,
+		metricsMiddleware,
+		limitMiddleware(conf.MaxConcurrentRequests),
+	}
+	handle := func(pattern string, h http.HandlerFunc, extra ...middleware) {
+		mux.Handle(pattern, chain(h, append(common, extra...)...))
 	}
-	//defer rabbitChannel.Close()
-	addRabbitConf(conf.RabbitDefault)
 
-	for r := range conf.Rabbit {
-		err = addRabbitConf(conf.Rabbit[r])
-		if err != nil {
-			return err
+	submit := chain(http.HandlerFunc(httpRequestIncoming), contentTypeMiddleware(conf.AcceptedContentTypes))
+	cancel := chain(http.HandlerFunc(httpRequestCancel), orgAuthMiddleware)
+	handle("/task/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			cancel.ServeHTTP(w, r)
+		} else {
+			submit.ServeHTTP(w, r)
 		}
+	})
+	handle("/task/status/", httpRequestStatus, orgAuthMiddleware)
+	handle("/task/echo", httpRequestEcho, contentTypeMiddleware(conf.AcceptedContentTypes))
+	handle("/task/dryrun", httpRequestDryRun, contentTypeMiddleware(conf.AcceptedContentTypes))
+	handle("/capabilities", httpRequestCapabilities, orgAuthMiddleware)
+	handle("/receiptkeys", httpRequestReceiptKeys)
+	handle("/admin/maintenance", httpRequestMaintenance, orgAuthMiddleware)
+	handle("/admin/selftest", httpRequestSelfTest, orgAuthMiddleware)
+	handle("/admin/stats", httpRequestStats, orgAuthMiddleware)
+	handle("/health", httpRequestHealth)
+	if h, ok := metrics.(http.Handler); ok {
+		handle("/metrics", h.ServeHTTP)
 	}
-
-	log.Println("Connected to Rabbit")
-	return nil
+	// the middlewares are applied by the handler of the tenant's endpoint
+	mux.Handle("/tenants/", tenantPathHandler(mux))
 }
 
 func initHTTP() {
-	http.HandleFunc("/task/", httpRequestIncoming)
+	registerHandlers(http.DefaultServeMux)
+
+	listener, err := listen(conf.HTTP)
+	tasking.FailOnError(err, "Couldn't set up the HTTP-listener")
+
+	// Closing the listener on shutdown also removes the socket file,
+	// if listening on a Unix domain socket.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	shutdown := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s, shutting down\n", sig)
+		close(shutdown)
+		listener.Close()
+	}()
+
 	log.Printf("Listening on %s\n", conf.HTTP)
-	log.Fatal(http.ListenAndServe(conf.HTTP, nil))
+	if conf.TLSCertFile != "" {
+		err = http.ServeTLS(listener, nil, conf.TLSCertFile, conf.TLSKeyFile)
+	} else {
+		err = http.Serve(listener, nil)
+	}
+	select {
+	case <-shutdown:
+		if conf.SpoolDir != "" {
+			drainSpoolOnShutdown()
+		}
+	default:
+		log.Fatal(err)
+	}
+}
+
+// buildAllowedTasks brings the ACL of the configuration into a map, since
+// this is more efficient in our case. Aliases used in the ACL are resolved
+// to their canonical task names.
+func buildAllowedTasks(c *config) map[string](map[string]struct{}) {
+	allowed := make(map[string](map[string]struct{}))
+	for org, tasks := range c.AllowedTasks {
+		allowedForOrg := make(map[string]struct{})
+		for _, t := range tasks {
+			if canonical, exists := c.TaskAliases[t]; exists {
+				t = canonical
+			}
+			// struct{}{} is just an empty placeholder.
+			// we are only interested in whether the key exists in the map
+			allowedForOrg[t] = struct{}{}
+		}
+		allowed[org] = allowedForOrg
+	}
+	return allowed
 }
 
 func Start(confPath string) {
@@ -466,27 +1888,58 @@ func Start(confPath string) {
 	err := json.NewDecoder(cfile).Decode(&conf)
 	tasking.FailOnError(err, "Couldn't read config file")
 
+	tasking.ForceKeyPolling = conf.ForceKeyPolling
+	if conf.KeyPollInterval > 0 {
+		tasking.KeyPollInterval = time.Duration(conf.KeyPollInterval) * time.Second
+	}
+	tasking.MaxKeyWatchers = conf.MaxKeyWatchers
+	if conf.KeyEventWorkers > 0 {
+		tasking.KeyEventWorkers = conf.KeyEventWorkers
+	}
+
 	// Parse the private keys
 	keys = make(map[string]*rsa.PrivateKey)
 	ticketKeys = make(map[string]*rsa.PublicKey)
 	readKeys()
+	readTenantKeys()
 
-	// bring the keys into a map, since this is more
-	// efficient in our case
-	allowedTasks = make(map[string](map[string]struct{}))
-	for org, tasks := range conf.AllowedTasks {
-		allowed := make(map[string]struct{})
-		for _, t := range tasks {
-			// struct{}{} is just an empty placeholder.
-			// we are only interested in whether the key exists in the map
-			allowed[t] = struct{}{}
-		}
-		allowedTasks[org] = allowed
+	tasking.FailOnError(validateConfig(conf), "Invalid configuration")
+	metrics, err = newMetrics(conf.MetricsBackend)
+	tasking.FailOnError(err, "Invalid metrics configuration")
+
+	initRSAWorkers(conf.RSAWorkers)
+	if conf.RSAQueueTimeout > 0 {
+		rsaQueueTimeout = time.Duration(conf.RSAQueueTimeout) * time.Millisecond
 	}
 
+	setRequestLogSampling(conf.RequestLogSampling)
+	configureMaintenance(conf.Maintenance)
+	allowedTasks = buildAllowedTasks(conf)
+	knownTasks = buildKnownTasks(conf, allowedTasks)
+	disabledTasks = buildDisabledTasks(conf)
+	sourceKeyBindings = buildSourceKeyBindings(conf)
+	ticketEncryptions = conf.TicketEncryptions
+	filenamePattern, _ = compileFilenamePattern(conf)
+	go reloadOnSignal(confPath)
+	_, err = defaultDestination("")
+	tasking.FailOnError(err, "Invalid routing configuration")
+
 	// Connect to rabbitmq
+	err = connectRabbitManagement()
+	tasking.FailOnError(err, "Failed while connecting to Rabbit")
 	err = connectRabbit()
 	tasking.FailOnError(err, "Failed while connecting to Rabbit")
+	if conf.TopologyCheckInterval > 0 {
+		go verifyTopologyForever()
+	}
+	if conf.MaxRabbitDowntime > 0 {
+		go superviseRabbit()
+	}
+	if conf.SpoolDir != "" {
+		err = initSpool()
+		tasking.FailOnError(err, "Couldn't initialize the spool")
+		go drainSpoolForever()
+	}
 
 	// Setup the HTTP-listener
 	initHTTP()
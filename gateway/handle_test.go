@@ -0,0 +1,1305 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskAliases(t *testing.T) {
+	ch := setupGateway(t, &config{
+		SampleStorageURI: "http://storage/samples/",
+		AllowedTasks:     map[string][]string{"org1": []string{"SANDBOX"}},
+		TaskAliases:      map[string]string{"CUCKOO": "SANDBOX"},
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit: map[string]RabbitConf{
+			"SANDBOX": RabbitConf{Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"}},
+	})
+
+	ticket := signTicket(t, "org1", time.Now().Add(time.Hour), newTask("CUCKOO"))
+	answer := handleDecrypted(ticket)
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(answer.TskErrors) != 0 {
+		t.Fatalf("aliased task was rejected: %+v", answer.TskErrors)
+	}
+
+	msgs := ch.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 published message, got %d", len(msgs))
+	}
+	if msgs[0].Exchange != "totem_dynamic" {
+		t.Errorf("aliased task routed to %s instead of totem_dynamic", msgs[0].Exchange)
+	}
+	if _, ok := msgs[0].Task.Tasks["SANDBOX"]; !ok || len(msgs[0].Task.Tasks) != 1 {
+		t.Errorf("published task should carry the canonical name: %+v", msgs[0].Task.Tasks)
+	}
+}
+
+func TestTaskAliasesACL(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		TaskAliases:   map[string]string{"CUCKOO": "SANDBOX"},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	ticket := signTicket(t, "org1", time.Now().Add(time.Hour), newTask("CUCKOO"))
+	answer := handleDecrypted(ticket)
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(answer.TskErrors) != 1 {
+		t.Fatalf("expected the aliased task to be rejected, got %+v", answer.TskErrors)
+	}
+	if _, ok := answer.TskErrors[0].TaskStruct.Tasks["SANDBOX"]; !ok {
+		t.Errorf("rejection should name the canonical task: %+v", answer.TskErrors[0].TaskStruct.Tasks)
+	}
+	if len(ch.messages()) != 0 {
+		t.Errorf("rejected task was published")
+	}
+}
+
+func TestZeroExpirationRejected(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	err := handleDecrypted(signTicket(t, "org1", time.Time{}, newTask("PEINFO"))).Error
+	if err == nil {
+		t.Fatal("ticket without expiration was accepted")
+	}
+	if err.Error.Error() != "Ticket has no expiration" {
+		t.Errorf("unexpected error: %s", err.Error)
+	}
+	if len(ch.messages()) != 0 {
+		t.Errorf("rejected ticket was published")
+	}
+}
+
+func TestZeroExpirationDefaultLifetime(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:          map[string][]string{"org1": []string{"*"}},
+		DefaultTicketLifetime: 60,
+		RabbitDefault:         RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Time{}, newTask("PEINFO")))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(answer.TskErrors) != 0 {
+		t.Fatalf("unexpected task errors: %+v", answer.TskErrors)
+	}
+	if len(ch.messages()) != 1 {
+		t.Errorf("expected the task to be published")
+	}
+}
+
+func TestAcceptedTasks(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO", "YARA", "CUCKOO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit: map[string]RabbitConf{
+			"CUCKOO": RabbitConf{Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"}},
+	})
+
+	task := newTask("PEINFO", "YARA", "CUCKOO", "VIRUSTOTAL")
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+
+	published := make(map[string]string)
+	for _, m := range ch.messages() {
+		for service := range m.Task.Tasks {
+			published[service] = m.Exchange
+		}
+	}
+	if len(answer.Accepted) != len(published) {
+		t.Fatalf("accepted %+v, but published %+v", answer.Accepted, published)
+	}
+	for _, a := range answer.Accepted {
+		if published[a.Task] != a.Exchange {
+			t.Errorf("%s accepted for %s, but published to %s", a.Task, a.Exchange, published[a.Task])
+		}
+		if a.PrimaryURI != task.PrimaryURI {
+			t.Errorf("accepted task has PrimaryURI %s", a.PrimaryURI)
+		}
+	}
+	if _, ok := published["VIRUSTOTAL"]; ok {
+		t.Errorf("disallowed service was published")
+	}
+}
+
+func TestMaxTicketLifetime(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:      map[string][]string{"org1": []string{"*"}},
+		MaxTicketLifetime: 24 * 3600,
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	farFuture := time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := handleDecrypted(signTicket(t, "org1", farFuture, newTask("PEINFO"))).Error
+	if err == nil {
+		t.Fatal("ticket expiring in year 9999 was accepted")
+	}
+	if err.Code != tasking.ERR_TASK_INVALID {
+		t.Errorf("expected ERR_TASK_INVALID, got %d: %s", err.Code, err.Error)
+	}
+	if len(ch.messages()) != 0 {
+		t.Errorf("malformed ticket was published")
+	}
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(3*time.Hour), newTask("PEINFO")))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(ch.messages()) != 1 {
+		t.Errorf("ticket with a reasonable expiration was not published")
+	}
+}
+
+func TestArgumentLengthLimits(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"YARA", "PEINFO"}},
+		MaxArgumentLength:  8,
+		MaxArgumentsLength: 12,
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	for _, c := range []struct {
+		args  map[string][]string
+		valid bool
+	}{
+		{map[string][]string{"YARA": {"12345678"}}, true},
+		{map[string][]string{"YARA": {"123456789"}}, false},
+		{map[string][]string{"YARA": {"12345678"}, "PEINFO": {"1234"}}, true},
+		{map[string][]string{"YARA": {"12345678"}, "PEINFO": {"12345"}}, false},
+		{map[string][]string{"YARA": {"1234567", "123456"}}, false},
+	} {
+		task := newTask()
+		task.Tasks = c.args
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+		if answer.Error != nil {
+			t.Fatal(answer.Error.Error)
+		}
+		if c.valid && len(answer.TskErrors) != 0 {
+			t.Errorf("%v: arguments within the limits rejected: %+v", c.args, answer.TskErrors)
+		}
+		if !c.valid && (len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID) {
+			t.Errorf("%v: expected ERR_TASK_INVALID, got %+v", c.args, answer.TskErrors)
+		}
+	}
+}
+
+func TestAttemptsLimits(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		MinAttempts:   1,
+		MaxAttempts:   5,
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	for _, c := range []struct {
+		attempts int
+		reason   string // "" if valid
+	}{
+		{-1, tasking.REASON_NEGATIVE_ATTEMPTS},
+		{0, tasking.REASON_ATTEMPTS_OUT_OF_RANGE},
+		{1, ""},
+		{5, ""},
+		{6, tasking.REASON_ATTEMPTS_OUT_OF_RANGE},
+		{1 << 30, tasking.REASON_ATTEMPTS_OUT_OF_RANGE},
+	} {
+		task := newTask("PEINFO")
+		task.Attempts = c.attempts
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+		if answer.Error != nil {
+			t.Fatal(answer.Error.Error)
+		}
+		if c.reason == "" && len(answer.TskErrors) != 0 {
+			t.Errorf("%d attempts within the limits rejected: %+v", c.attempts, answer.TskErrors)
+		}
+		if c.reason != "" && (len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID ||
+			answer.TskErrors[0].Reason != c.reason) {
+			t.Errorf("%d attempts: expected ERR_TASK_INVALID (%s), got %+v", c.attempts, c.reason, answer.TskErrors)
+		}
+	}
+}
+
+func TestAllServicesRejected(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit: map[string]RabbitConf{
+			"CUCKOO": RabbitConf{Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"}},
+	})
+	// a publish would fail, so an attempt to dispatch shows up as an error
+	ch.publishErr = errors.New("should not publish")
+	rabbitReconnectDelay = 0
+	fakeDialer()
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA", "CUCKOO")))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(ch.messages()) != 0 {
+		t.Errorf("task without allowed services was published")
+	}
+	if len(answer.Accepted) != 0 {
+		t.Errorf("nothing should be accepted: %+v", answer.Accepted)
+	}
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_NOT_ALLOWED {
+		t.Fatalf("expected a single rejection, got %+v", answer.TskErrors)
+	}
+	if len(answer.TskErrors[0].TaskStruct.Tasks) != 2 {
+		t.Errorf("rejection should name all services: %+v", answer.TskErrors[0].TaskStruct.Tasks)
+	}
+}
+
+func TestRequireSecondaryURI(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:        map[string][]string{"org1": []string{"*"}},
+		TaskAliases:         map[string]string{"SANDBOX": "CUCKOO"},
+		RequireSecondaryURI: []string{"CUCKOO"},
+		RabbitDefault:       RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	// PEINFO does not need a SecondaryURI, CUCKOO (requested by its alias) does
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "SANDBOX")))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID {
+		t.Fatalf("expected CUCKOO to be invalid, got %+v", answer.TskErrors)
+	}
+	if _, ok := answer.TskErrors[0].TaskStruct.Tasks["CUCKOO"]; !ok || len(answer.TskErrors[0].TaskStruct.Tasks) != 1 {
+		t.Errorf("only CUCKOO should be invalid: %+v", answer.TskErrors[0].TaskStruct.Tasks)
+	}
+	msgs := ch.messages()
+	if len(msgs) != 1 || len(msgs[0].Task.Tasks) != 1 {
+		t.Fatalf("expected only PEINFO to be published: %+v", msgs)
+	}
+
+	// with a SecondaryURI, both are accepted
+	task := newTask("PEINFO", "CUCKOO")
+	task.SecondaryURI = "http://example.com/sample"
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if len(answer.TskErrors) != 0 || len(answer.Accepted) != 2 {
+		t.Errorf("task with SecondaryURI rejected: %+v", answer.TskErrors)
+	}
+
+	// the requirement may also name the service by its alias
+	conf.RequireSecondaryURI = []string{"SANDBOX"}
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "CUCKOO")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID {
+		t.Fatalf("expected CUCKOO to be invalid, got %+v", answer.TskErrors)
+	}
+	if _, ok := answer.TskErrors[0].TaskStruct.Tasks["CUCKOO"]; !ok || len(answer.TskErrors[0].TaskStruct.Tasks) != 1 {
+		t.Errorf("only CUCKOO should be invalid: %+v", answer.TskErrors[0].TaskStruct.Tasks)
+	}
+}
+
+func TestRequireArguments(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:     map[string][]string{"org1": []string{"*"}},
+		RequireArguments: []string{"YARA"},
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	// PEINFO runs with its defaults, YARA needs arguments
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA")))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID || answer.TskErrors[0].Reason != tasking.REASON_ARGUMENTS_REQUIRED {
+		t.Fatalf("expected YARA to be invalid, got %+v", answer.TskErrors)
+	}
+	if _, ok := answer.TskErrors[0].TaskStruct.Tasks["YARA"]; !ok || len(answer.TskErrors[0].TaskStruct.Tasks) != 1 {
+		t.Errorf("only YARA should be invalid: %+v", answer.TskErrors[0].TaskStruct.Tasks)
+	}
+	if len(answer.Accepted) != 1 || answer.Accepted[0].Task != "PEINFO" || len(ch.messages()) != 1 {
+		t.Fatalf("expected only PEINFO to be published: %+v", answer.Accepted)
+	}
+
+	// with arguments, both are accepted
+	task := newTask()
+	task.Tasks = map[string][]string{"PEINFO": {}, "YARA": {"rules.yar"}}
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if len(answer.TskErrors) != 0 || len(answer.Accepted) != 2 {
+		t.Errorf("task with arguments rejected: %+v", answer.TskErrors)
+	}
+}
+
+func TestRequireSource(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		TaskAliases:   map[string]string{"SANDBOX": "CUCKOO"},
+		RequireSource: []string{"CUCKOO"},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	// PEINFO does not need a Source, CUCKOO (requested by its alias) does
+	for _, source := range []string{"", "honey\x00pot"} {
+		task := newTask("PEINFO", "SANDBOX")
+		task.Source = source
+		published := len(ch.messages())
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+		if answer.Error != nil {
+			t.Fatal(answer.Error.Error)
+		}
+		if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID || answer.TskErrors[0].Reason != tasking.REASON_SOURCE_REQUIRED {
+			t.Fatalf("expected CUCKOO to be invalid with the source %q, got %+v", source, answer.TskErrors)
+		}
+		if _, ok := answer.TskErrors[0].TaskStruct.Tasks["CUCKOO"]; !ok || len(answer.TskErrors[0].TaskStruct.Tasks) != 1 {
+			t.Errorf("only CUCKOO should be invalid: %+v", answer.TskErrors[0].TaskStruct.Tasks)
+		}
+		if len(answer.Accepted) != 1 || answer.Accepted[0].Task != "PEINFO" || len(ch.messages()) != published+1 {
+			t.Fatalf("expected only PEINFO to be published: %+v", answer.Accepted)
+		}
+	}
+
+	// with a Source, both are accepted
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "CUCKOO")))
+	if len(answer.TskErrors) != 0 || len(answer.Accepted) != 2 {
+		t.Errorf("task with a Source rejected: %+v", answer.TskErrors)
+	}
+}
+
+func TestCanonicalTasksKeepsTicket(t *testing.T) {
+	setupGateway(t, &config{TaskAliases: map[string]string{"CUCKOO": "SANDBOX"}})
+	args := make([]string, 1, 4)
+	args[0] = "a"
+	other := []string{"b"}
+	tasks := map[string][]string{"SANDBOX": args, "CUCKOO": other, "PEINFO": {"c"}}
+
+	canonical := canonicalTasks(tasks)
+	if len(canonical) != 2 || len(canonical["SANDBOX"]) != 2 || len(canonical["PEINFO"]) != 1 {
+		t.Fatalf("aliases not merged: %v", canonical)
+	}
+	canonical["SANDBOX"][0] = "changed"
+	if args[0] != "a" || other[0] != "b" || args[:2][1] != "" {
+		t.Errorf("merging modified the arguments of the ticket: %v %v", args, other)
+	}
+}
+
+func TestStrictTickets(t *testing.T) {
+	ticket := `{"Expiration": "` + time.Now().Add(time.Hour).Format(time.RFC3339) +
+		`", "Tasks": [{"primary_uri": "abc", "filename": "x", "tasks": {"PEINFO": []}}], "SignerKeyId": "org1"}`
+
+	// lenient: the unknown field is ignored, the ticket fails later
+	setupGateway(t, &config{AllowedTasks: map[string][]string{"org1": []string{"*"}}})
+	answer := handleDecrypted(ticket)
+	if answer.Error == nil || strings.Contains(answer.Error.Error.Error(), "primary_uri") {
+		t.Errorf("lenient mode should ignore the unknown field: %+v", answer.Error)
+	}
+
+	// strict: the unknown field is named
+	setupGateway(t, &config{AllowedTasks: map[string][]string{"org1": []string{"*"}}, StrictTickets: true})
+	answer = handleDecrypted(ticket)
+	if answer.Error == nil || !strings.Contains(answer.Error.Error.Error(), `"primary_uri"`) {
+		t.Errorf("strict mode should name the unknown field: %+v", answer.Error)
+	}
+
+	// valid tickets pass in strict mode
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Error != nil {
+		t.Errorf("valid ticket rejected in strict mode: %s", answer.Error.Error)
+	}
+}
+
+// canonicalTicket returns a ticket of org serialized with a field order
+// and whitespace differing from json.Marshal, signed in canonical form.
+func canonicalTicket(t *testing.T, org string, extra string) string {
+	unsigned := `{"SignerKeyId": "` + org + `",  "Tasks": [{"tasks": {"YARA": [], "PEINFO": []},` +
+		` "primaryURI": "3a12f43eeb0c45d241a8f447d4661d9746d6ea35990953334f5ec675f60e36c5", "filename": "sample.exe"}],` +
+		` "Expiration": "` + time.Now().Add(time.Hour).Format("2006-01-02T15:04:05-07:00") + `"` + extra + `}`
+	msg, err := tasking.CanonicalJSON([]byte(unsigned))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := tasking.Sign(msg, ticketKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := json.Marshal(signature)
+	return unsigned[:len(unsigned)-1] + `, "Signature": ` + string(sig) + `}`
+}
+
+func TestCanonicalization(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:     map[string][]string{"org1": []string{"*"}},
+		Canonicalization: tasking.CANONICALIZATION_CANONICAL,
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ticket := canonicalTicket(t, "org1", "")
+	for i := 0; i < 3; i++ {
+		if answer := handleDecrypted(ticket); answer.Error != nil || len(answer.Accepted) != 2 {
+			t.Fatalf("canonically signed ticket rejected: %+v", answer)
+		}
+	}
+
+	// unknown fields can't be added after signing
+	tampered := strings.Replace(ticket, `"Signature"`, `"Comment": "x", "Signature"`, 1)
+	if answer := handleDecrypted(tampered); answer.Error == nil {
+		t.Errorf("expected a tampered ticket to be rejected")
+	}
+
+	// the legacy serialization doesn't match the signer's
+	conf.Canonicalization = tasking.CANONICALIZATION_LEGACY
+	if answer := handleDecrypted(canonicalTicket(t, "org1", "")); answer.Error == nil {
+		t.Errorf("expected the canonical signature to fail in legacy mode")
+	}
+}
+
+func TestMaxTicketArguments(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"*"}},
+		MaxTicketArguments: 4,
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	task := newTask()
+	task.Tasks = map[string][]string{"YARA": {"a", "b"}, "PEINFO": {"c"}}
+	other := newTask()
+	other.Tasks = map[string][]string{"YARA": {"d"}}
+
+	// at the cap
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task, other))
+	if answer.Error != nil || len(answer.TskErrors) != 0 {
+		t.Fatalf("ticket at the cap rejected: %+v", answer)
+	}
+
+	// above the cap, nothing is dispatched
+	published := len(ch.messages())
+	other.Tasks["YARA"] = []string{"d", "e"}
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task, other))
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_TASK_INVALID {
+		t.Fatalf("ticket above the cap accepted: %+v", answer)
+	}
+	if len(ch.messages()) != published {
+		t.Errorf("tasks of a ticket above the cap were dispatched")
+	}
+}
+
+func TestTicketLimits(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:   map[string][]string{"org1": []string{"*"}, "org2": []string{"*"}, "org3": []string{"*"}},
+		MaxTicketSize:  1 << 20,
+		MaxTicketTasks: 2,
+		TicketLimits: map[string]LimitConf{
+			"org2": LimitConf{MaxTicketSize: 100, MaxTicketTasks: 1},
+			"org3": LimitConf{MaxTicketTasks: -1}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+	ticketKeys["org3"] = &ticketKey(t).PublicKey
+
+	for _, c := range []struct {
+		org     string
+		tasks   int
+		allowed bool
+	}{
+		{"org1", 2, true},
+		{"org1", 3, false},
+		{"org2", 2, false}, // stricter
+		{"org3", 3, true},  // looser
+	} {
+		var tasks []tasking.Task
+		for i := 0; i < c.tasks; i++ {
+			tasks = append(tasks, newTask("PEINFO"))
+		}
+		answer := handleDecrypted(signTicket(t, c.org, time.Now().Add(time.Hour), tasks...))
+		if c.allowed && (answer.Error != nil || len(answer.Accepted) != c.tasks) {
+			t.Errorf("%+v: ticket rejected: %+v", c, answer)
+		}
+		if !c.allowed && (answer.Error == nil || answer.Error.Code != tasking.ERR_TASK_INVALID) {
+			t.Errorf("%+v: ticket accepted: %+v", c, answer)
+		}
+	}
+
+	// a single task exceeds org2's size, but not the global one
+	answer := handleDecrypted(signTicket(t, "org2", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_TASK_INVALID {
+		t.Errorf("ticket above the size of org2 accepted: %+v", answer)
+	}
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Error != nil {
+		t.Errorf("ticket below the global size rejected: %+v", answer)
+	}
+}
+
+func TestMaxTicketArgsLength(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:        map[string][]string{"org1": []string{"*"}},
+		MaxTicketArgsLength: 10,
+		RabbitDefault:       RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	task := newTask()
+	task.Tasks = map[string][]string{"YARA": {"ab", "cd"}, "PEINFO": {"efg"}}
+	other := newTask()
+	other.Tasks = map[string][]string{"YARA": {"hij"}}
+
+	// at the cap
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task, other))
+	if answer.Error != nil || len(answer.TskErrors) != 0 {
+		t.Fatalf("ticket at the cap rejected: %+v", answer)
+	}
+
+	// above the cap, nothing is dispatched
+	published := len(ch.messages())
+	other.Tasks["YARA"] = []string{"hij", "k"}
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task, other))
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_OTHER_RECOVERABLE {
+		t.Fatalf("ticket above the cap accepted: %+v", answer)
+	}
+	if msg := answer.Error.Error.Error(); !strings.Contains(msg, "11 bytes") || !strings.Contains(msg, "at most 10") {
+		t.Errorf("expected the lengths in the error, got %q", msg)
+	}
+	if len(ch.messages()) != published {
+		t.Errorf("tasks of a ticket above the cap were dispatched")
+	}
+}
+
+func TestMaxTicketExchanges(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"PEINFO", "YARA", "CUCKOO", "OBJDUMP"}},
+		DisabledTasks:      []string{"OBJDUMP"},
+		MaxTicketExchanges: 2,
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit: map[string]RabbitConf{
+			"YARA":       {Exchange: "yara", RoutingKey: "work.yara"},
+			"CUCKOO":     {Exchange: "cuckoo", RoutingKey: "work.cuckoo"},
+			"OBJDUMP":    {Exchange: "objdump", RoutingKey: "work.objdump"},
+			"VIRUSTOTAL": {Exchange: "vt", RoutingKey: "work.vt"},
+		},
+	})
+
+	// disabled and forbidden services don't count
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA", "OBJDUMP", "VIRUSTOTAL")))
+	if answer.Error != nil || len(answer.Accepted) != 2 {
+		t.Fatalf("ticket at the cap rejected: %+v", answer)
+	}
+
+	// the exchanges of all tasks count
+	published := len(ch.messages())
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA"), newTask("CUCKOO")))
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_OTHER_RECOVERABLE {
+		t.Fatalf("ticket above the cap accepted: %+v", answer)
+	}
+	if msg := answer.Error.Error.Error(); !strings.Contains(msg, "(3, at most 2") {
+		t.Errorf("expected the number of exchanges in the error, got %q", msg)
+	}
+	if len(answer.Accepted) != 0 || len(ch.messages()) != published {
+		t.Errorf("tasks of a ticket above the cap were dispatched")
+	}
+}
+
+func TestMaxIdentifierLength(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:        map[string][]string{"org1": []string{"*"}},
+		MaxIdentifierLength: 32,
+		RabbitDefault:       RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if _, myerr := decodeTask(taskRequest(enc)); myerr != nil {
+		t.Fatalf("valid fingerprint rejected: %+v", myerr.Error)
+	}
+	for _, fingerprint := range []string{strings.Repeat("a", 33), "src1\n"} {
+		enc.KeyFingerprint = fingerprint
+		_, myerr := decodeTask(taskRequest(enc))
+		if myerr == nil || myerr.Code != tasking.ERR_OTHER_RECOVERABLE {
+			t.Errorf("fingerprint %q accepted", fingerprint)
+		} else if strings.Contains(myerr.Error.Error(), fingerprint) {
+			t.Errorf("fingerprint %q echoed in the error", fingerprint)
+		}
+	}
+
+	// the signer is checked before its key is looked up
+	signer := strings.Repeat("o", 33)
+	answer := handleDecrypted(signTicket(t, signer, time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_TASK_INVALID {
+		t.Fatalf("over-length signer accepted: %+v", answer)
+	}
+	if strings.Contains(answer.Error.Error.Error(), signer) {
+		t.Errorf("signer echoed in the error")
+	}
+}
+
+func TestRequireSingleSource(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:        map[string][]string{"org1": []string{"*"}},
+		RequireSingleSource: true,
+		RabbitDefault:       RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	task := newTask("PEINFO")
+	task.Source = "honeypot"
+	other := newTask("YARA")
+	other.Source = "honeypot"
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task, other))
+	if answer.Error != nil || len(answer.Accepted) != 2 {
+		t.Fatalf("single-source ticket rejected: %+v", answer)
+	}
+
+	published := len(ch.messages())
+	other.Source = "upload"
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task, other))
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_TASK_INVALID {
+		t.Fatalf("mixed-source ticket accepted: %+v", answer)
+	}
+	if len(ch.messages()) != published {
+		t.Errorf("tasks of a mixed-source ticket were dispatched")
+	}
+
+	// without the policy, mixed sources are fine
+	conf.RequireSingleSource = false
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task, other))
+	if answer.Error != nil || len(answer.Accepted) != 2 {
+		t.Errorf("mixed-source ticket rejected without the policy: %+v", answer)
+	}
+}
+
+func TestErrorPlacement(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	valid := func() string {
+		return signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"))
+	}
+	invalidTask := newTask("PEINFO")
+	invalidTask.PrimaryURI = ""
+
+	ticketLevel := map[string]func() *tasking.GatewayAnswer{
+		"unknown key": func() *tasking.GatewayAnswer {
+			enc, _ := encryptTicket(t, valid())
+			enc.KeyFingerprint = "src9"
+			answer, _ := handleIncoming(nil, enc, "", false, false, nil)
+			return answer
+		},
+		"corrupted encryption": func() *tasking.GatewayAnswer {
+			enc, _ := encryptTicket(t, valid())
+			enc.Encrypted = enc.Encrypted[:len(enc.Encrypted)-1]
+			answer, _ := handleIncoming(nil, enc, "", false, false, nil)
+			return answer
+		},
+		"IV size": func() *tasking.GatewayAnswer {
+			enc, _ := encryptTicket(t, valid())
+			enc.IV = enc.IV[:8]
+			answer, _ := handleIncoming(nil, enc, "", false, false, nil)
+			return answer
+		},
+		"signature": func() *tasking.GatewayAnswer {
+			return handleDecrypted(strings.Replace(valid(), "myfile", "yourfile", 1))
+		},
+		"expiration": func() *tasking.GatewayAnswer {
+			return handleDecrypted(signTicket(t, "org1", time.Now().Add(-time.Hour), newTask("PEINFO")))
+		},
+		"unknown organization": func() *tasking.GatewayAnswer {
+			ticketKeys["org2"] = &ticketKey(t).PublicKey
+			return handleDecrypted(signTicket(t, "org2", time.Now().Add(time.Hour), newTask("PEINFO")))
+		},
+		"no tasks": func() *tasking.GatewayAnswer {
+			return handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour)))
+		},
+	}
+	for kind, submit := range ticketLevel {
+		answer := submit()
+		if answer.Error == nil || len(answer.TskErrors) != 0 || len(answer.Accepted) != 0 {
+			t.Errorf("%s: expected only a ticket-level error, got %+v", kind, answer)
+		}
+	}
+
+	taskLevel := map[string]struct {
+		tasks []tasking.Task
+		code  tasking.ErrCode
+	}{
+		"ACL":        {[]tasking.Task{newTask("PEINFO"), newTask("YARA")}, tasking.ERR_NOT_ALLOWED},
+		"validation": {[]tasking.Task{newTask("PEINFO"), invalidTask}, tasking.ERR_TASK_INVALID},
+	}
+	for kind, c := range taskLevel {
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), c.tasks...))
+		if answer.Error != nil || len(answer.Accepted) != 1 || len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != c.code {
+			t.Errorf("%s: expected only a task-level error, got %+v", kind, answer)
+		}
+	}
+}
+
+func TestRejectionSummary(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:        map[string][]string{"org1": []string{"PEINFO"}},
+		SummarizeRejections: true,
+		RabbitDefault:       RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	invalid := newTask("PEINFO")
+	invalid.PrimaryURI = ""
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour),
+		newTask("PEINFO", "YARA", "CUCKOO"), invalid, newTask("ZIP")))
+	if answer.Error != nil || len(answer.TskErrors) != 3 {
+		t.Fatalf("unexpected answer: %+v", answer)
+	}
+
+	errors, services := make(map[string]int), make(map[string]int)
+	for _, e := range answer.TskErrors {
+		errors[e.Reason]++
+		services[e.Reason] += len(e.TaskStruct.Tasks)
+	}
+	if len(answer.Rejections) != len(errors) {
+		t.Fatalf("expected %d reasons, got %+v", len(errors), answer.Rejections)
+	}
+	for _, r := range answer.Rejections {
+		if r.Errors != errors[r.Reason] || r.Services != services[r.Reason] {
+			t.Errorf("summary %+v doesn't match the errors: %d errors, %d services", r, errors[r.Reason], services[r.Reason])
+		}
+		if r.Reason == tasking.REASON_TASK_NOT_ALLOWED && strings.Join(r.Examples, ",") != "CUCKOO,YARA,ZIP" {
+			t.Errorf("unexpected examples: %v", r.Examples)
+		}
+	}
+
+	// the summary is only added if configured
+	conf.SummarizeRejections = false
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA")))
+	if len(answer.TskErrors) != 1 || answer.Rejections != nil {
+		t.Errorf("unexpected answer: %+v", answer)
+	}
+}
+
+func TestMaxAnswerSize(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		MaxAnswerSize: 4096,
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	tasks := []tasking.Task{newTask("PEINFO")}
+	for i := 0; i < 50; i++ {
+		tasks = append(tasks, newTask("YARA"))
+	}
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), tasks...))
+	if answer.Error != nil || len(answer.Accepted) != 1 {
+		t.Fatalf("unexpected answer: %+v", answer)
+	}
+	if !answer.TskErrorsTruncated || len(answer.TskErrors) == 0 || len(answer.TskErrors) >= 50 {
+		t.Errorf("expected TskErrors truncated, got %d entries", len(answer.TskErrors))
+	}
+	if x, _ := json.Marshal(answer); len(x) > 4096 {
+		t.Errorf("answer of %d bytes exceeds the cap", len(x))
+	}
+	if len(answer.Rejections) != 1 || answer.Rejections[0].Errors != 50 {
+		t.Errorf("expected all 50 rejections summarized, got %+v", answer.Rejections)
+	}
+
+	// answers below the cap are complete
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"), newTask("YARA")))
+	if answer.TskErrorsTruncated || len(answer.TskErrors) != 1 || answer.Rejections != nil {
+		t.Errorf("answer below the cap truncated: %+v", answer)
+	}
+}
+
+func TestTaskErrorReasons(t *testing.T) {
+	modify := func(services []string, f func(*tasking.Task)) tasking.Task {
+		task := newTask(services...)
+		f(&task)
+		return task
+	}
+	tests := []struct {
+		name   string
+		task   tasking.Task
+		reason string
+	}{
+		{"primary", modify([]string{"PEINFO"}, func(t *tasking.Task) { t.PrimaryURI = "" }), tasking.REASON_PRIMARY_URI_INVALID},
+		{"secondary", modify([]string{"PEINFO"}, func(t *tasking.Task) { t.SecondaryURI = "\x01" }), tasking.REASON_SECONDARY_URI_INVALID},
+		{"filename", modify([]string{"PEINFO"}, func(t *tasking.Task) { t.Filename = "" }), tasking.REASON_FILENAME_INVALID},
+		{"no tasks", newTask(), tasking.REASON_NO_TASKS},
+		{"task name", newTask("PE\x01INFO"), tasking.REASON_TASK_NAME_INVALID},
+		{"argument", modify([]string{"PEINFO"}, func(t *tasking.Task) { t.Tasks["PEINFO"] = []string{strings.Repeat("a", 11)} }), tasking.REASON_ARGUMENT_TOO_LONG},
+		{"arguments", modify([]string{"PEINFO"}, func(t *tasking.Task) { t.Tasks["PEINFO"] = []string{"aaaaaaaaaa", "aaaaaaaaaa", "a"} }), tasking.REASON_ARGUMENTS_TOO_LONG},
+		{"tag", modify([]string{"PEINFO"}, func(t *tasking.Task) { t.Tags = []string{"\x01"} }), tasking.REASON_TAG_INVALID},
+		{"attempts", modify([]string{"PEINFO"}, func(t *tasking.Task) { t.Attempts = -1 }), tasking.REASON_NEGATIVE_ATTEMPTS},
+		{"comment", modify([]string{"PEINFO"}, func(t *tasking.Task) { t.Comment = "\x01" }), tasking.REASON_COMMENT_INVALID},
+		{"disabled", newTask("OFF"), tasking.REASON_TASK_DISABLED},
+		{"secondary required", newTask("DIFF"), tasking.REASON_SECONDARY_URI_REQUIRED},
+		{"not allowed", newTask("SANDBOX"), tasking.REASON_TASK_NOT_ALLOWED},
+	}
+
+	for _, test := range tests {
+		setupGateway(t, &config{
+			AllowedTasks:        map[string][]string{"org1": []string{"PEINFO", "OFF", "DIFF", "PE\x01INFO"}},
+			DisabledTasks:       []string{"OFF"},
+			RequireSecondaryURI: []string{"DIFF"},
+			MaxArgumentLength:   10,
+			MaxArgumentsLength:  20,
+			RabbitDefault:       RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		})
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), test.task))
+		if answer.Error != nil {
+			t.Fatalf("%s: %s", test.name, answer.Error.Error)
+		}
+		if len(answer.TskErrors) != 1 {
+			t.Errorf("%s: expected 1 task error, got %+v", test.name, answer.TskErrors)
+			continue
+		}
+		if reason := answer.TskErrors[0].Reason; reason != test.reason {
+			t.Errorf("%s: expected reason %s, got %s", test.name, test.reason, reason)
+		}
+	}
+}
+
+func TestTaskErrorReasonEnrichment(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	SetTaskEnricher(serviceEnricher{})
+	defer SetTaskEnricher(nil)
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_ENRICHMENT_FAILED {
+		t.Fatalf("expected reason %s, got %+v", tasking.REASON_ENRICHMENT_FAILED, answer.TskErrors)
+	}
+}
+
+func TestTaskErrorReasonDispatch(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ch.publishErr = errors.New("channel closed")
+	savedDial := dialRabbit
+	defer func() { dialRabbit = savedDial }()
+	dialRabbit = func() (amqpChannel, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_DISPATCH_FAILED {
+		t.Fatalf("expected reason %s, got %+v", tasking.REASON_DISPATCH_FAILED, answer.TskErrors)
+	}
+}
+
+func TestAllowedURISchemes(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:      map[string][]string{"org1": []string{"*"}},
+		AllowedURISchemes: []string{"", "https"},
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	for _, c := range []struct {
+		primary   string
+		secondary string
+		allowed   bool
+	}{
+		{"samples/3a12f43e", "", true},
+		{"https://storage.example/3a12f43e", "", true},
+		{"HTTPS://storage.example/3a12f43e", "", true},
+		{"file:///etc/passwd", "", false},
+		{"ftp://storage.example/3a12f43e", "", false},
+		{"samples/3a12f43e", "file:///etc/shadow", false},
+	} {
+		task := newTask("PEINFO")
+		task.PrimaryURI = c.primary
+		task.SecondaryURI = c.secondary
+		published := len(ch.messages())
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+		if answer.Error != nil {
+			t.Fatal(answer.Error.Error)
+		}
+		if c.allowed && (len(answer.TskErrors) != 0 || len(ch.messages()) != published+1) {
+			t.Errorf("%+v: task rejected: %+v", c, answer.TskErrors)
+		}
+		if !c.allowed {
+			if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_URI_SCHEME_NOT_ALLOWED || answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID {
+				t.Errorf("%+v: expected reason %s, got %+v", c, tasking.REASON_URI_SCHEME_NOT_ALLOWED, answer.TskErrors)
+			}
+			if len(ch.messages()) != published {
+				t.Errorf("%+v: task dispatched", c)
+			}
+		}
+	}
+
+	// without a policy, any scheme is accepted
+	conf.AllowedURISchemes = nil
+	task := newTask("PEINFO")
+	task.PrimaryURI = "file:///etc/passwd"
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if answer.Error != nil || len(answer.Accepted) != 1 {
+		t.Errorf("task rejected without a policy: %+v", answer)
+	}
+}
+
+func TestTaskTicketLifetimes(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:        map[string][]string{"org1": []string{"*"}},
+		TaskAliases:         map[string]string{"SANDBOX": "CUCKOO"},
+		MaxTicketLifetime:   3600,
+		TaskTicketLifetimes: map[string]int{"CUCKOO": 86400, "VIRUSTOTAL": 300},
+		RabbitDefault:       RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	for _, c := range []struct {
+		lifetime time.Duration
+		services []string
+		allowed  bool
+	}{
+		{2 * time.Hour, []string{"CUCKOO"}, true},
+		{2 * time.Hour, []string{"SANDBOX"}, true}, // alias
+		{2 * time.Hour, []string{"PEINFO"}, false},
+		{2 * time.Hour, []string{"CUCKOO", "PEINFO"}, false},
+		{30 * time.Minute, []string{"CUCKOO", "PEINFO"}, true},
+		{30 * time.Minute, []string{"CUCKOO", "VIRUSTOTAL"}, false},
+		{time.Minute, []string{"CUCKOO", "PEINFO", "VIRUSTOTAL"}, true},
+		{2 * 24 * time.Hour, []string{"CUCKOO"}, false},
+	} {
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(c.lifetime), newTask(c.services...)))
+		if c.allowed && answer.Error != nil {
+			t.Errorf("%v for %v rejected: %s", c.lifetime, c.services, answer.Error.Error)
+		}
+		if !c.allowed && (answer.Error == nil || answer.Error.Code != tasking.ERR_TASK_INVALID) {
+			t.Errorf("%v for %v accepted: %+v", c.lifetime, c.services, answer)
+		}
+	}
+
+	// the limits of different tasks of a ticket are combined, too
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(30*time.Minute), newTask("CUCKOO"), newTask("VIRUSTOTAL")))
+	if answer.Error == nil {
+		t.Errorf("ticket exceeding the limit of its second task accepted")
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:      map[string][]string{"org1": []string{"*"}},
+		MaxTicketLifetime: 3600,
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	before := time.Now().Add(-time.Second)
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Minute), newTask("PEINFO")))
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+	if answer.ServerTime.Before(before) || answer.ServerTime.After(time.Now()) {
+		t.Errorf("expected the server time in the answer, got %s", answer.ServerTime)
+	}
+
+	for _, expiration := range []time.Time{time.Now().Add(-time.Minute), time.Now().Add(2 * time.Hour)} {
+		answer := handleDecrypted(signTicket(t, "org1", expiration, newTask("PEINFO")))
+		if answer.Error == nil {
+			t.Fatalf("ticket expiring at %s accepted", expiration)
+		}
+		msg := answer.Error.Error.Error()
+		i := strings.Index(msg, "(server time ")
+		if i < 0 {
+			t.Fatalf("expected the server time in %q", msg)
+		}
+		serverTime, err := time.Parse(time.RFC3339, strings.TrimSuffix(msg[i+len("(server time "):], ")"))
+		if err != nil || serverTime.Before(before) || serverTime.After(time.Now()) {
+			t.Errorf("unexpected server time in %q", msg)
+		}
+	}
+}
+
+func TestDownloadPolicy(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks: map[string][]string{"org1": []string{"*"}, "org2": []string{"*"}, "org3": []string{"*"}},
+		AllowedDownloads: map[string][]string{
+			"org1": []string{"src1"},
+			"org2": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+	ticketKeys["org3"] = &ticketKey(t).PublicKey
+
+	for _, c := range []struct {
+		org      string
+		source   string
+		download bool
+		allowed  bool
+	}{
+		{"org1", "src1", true, true},
+		{"org1", "src2", true, false},
+		{"org1", "src2", false, true},
+		{"org2", "src2", true, true},
+		{"org3", "src1", true, false},
+		{"org3", "src1", false, true},
+	} {
+		task := newTask("PEINFO")
+		task.Source = c.source
+		task.Download = c.download
+		published := len(ch.messages())
+		answer := handleDecrypted(signTicket(t, c.org, time.Now().Add(time.Hour), task))
+		if answer.Error != nil {
+			t.Fatal(answer.Error.Error)
+		}
+		if c.allowed && (len(answer.TskErrors) != 0 || len(ch.messages()) != published+1) {
+			t.Errorf("%+v: task rejected: %+v", c, answer.TskErrors)
+		}
+		if !c.allowed {
+			if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_NOT_ALLOWED ||
+				answer.TskErrors[0].Reason != tasking.REASON_DOWNLOAD_NOT_ALLOWED {
+				t.Errorf("%+v: expected the download to be rejected, got %+v", c, answer.TskErrors)
+			}
+			if len(ch.messages()) != published {
+				t.Errorf("%+v: rejected download was published", c)
+			}
+		}
+	}
+
+	// without AllowedDownloads, downloads are not restricted
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	task := newTask("PEINFO")
+	task.Download = true
+	if answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task)); len(answer.TskErrors) != 0 {
+		t.Errorf("download rejected without policy: %+v", answer.TskErrors)
+	}
+}
+
+func TestTaskStorageURIs(t *testing.T) {
+	ch := setupGateway(t, &config{
+		SampleStorageURI: "http://storage/raw/",
+		TaskStorageURIs:  map[string]string{"YARA": "http://storage/unpacked/", "CUCKOO": "http://storage/unpacked/"},
+		AllowedTasks:     map[string][]string{"org1": []string{"*"}},
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit: map[string]RabbitConf{
+			"CUCKOO": RabbitConf{Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"}},
+	})
+
+	task := newTask("PEINFO", "YARA", "CUCKOO")
+	task.SecondaryURI = "secondary"
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if answer.Error != nil || len(answer.TskErrors) != 0 {
+		t.Fatalf("unexpected errors: %+v %+v", answer.Error, answer.TskErrors)
+	}
+	if len(answer.Accepted) != 3 {
+		t.Fatalf("expected 3 accepted services, got %+v", answer.Accepted)
+	}
+	for _, a := range answer.Accepted {
+		if a.PrimaryURI != task.PrimaryURI {
+			t.Errorf("%s: the answer should carry the requested PrimaryURI, got %s", a.Task, a.PrimaryURI)
+		}
+	}
+
+	expected := map[string]string{
+		"PEINFO": "http://storage/raw/",
+		"YARA":   "http://storage/unpacked/",
+		"CUCKOO": "http://storage/unpacked/",
+	}
+	msgs := ch.messages()
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 published messages, got %d", len(msgs))
+	}
+	for _, m := range msgs {
+		for service := range m.Task.Tasks {
+			if m.Task.PrimaryURI != expected[service]+task.PrimaryURI {
+				t.Errorf("%s published with PrimaryURI %s", service, m.Task.PrimaryURI)
+			}
+			if m.Task.SecondaryURI != expected[service]+"secondary" {
+				t.Errorf("%s published with SecondaryURI %s", service, m.Task.SecondaryURI)
+			}
+		}
+	}
+}
+
+func TestFilenameMatch(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:         map[string][]string{"org1": []string{"*"}},
+		RequireFilenameMatch: true,
+		FilenamePattern:      `[0-9a-f]{64}\.(exe|dll)`,
+		RabbitDefault:        RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	hash := "3a12f43eeb0c45d241a8f447d4661d9746d6ea35990953334f5ec675f60e36c5"
+	for _, c := range []struct {
+		primaryURI string
+		filename   string
+		valid      bool
+	}{
+		{"samples/malware.exe", "malware.exe", true},
+		{"samples/malware.exe", "invoice.pdf", false},
+		{"malware.exe", "malware.exe", true},
+		{hash, hash + ".exe", true},
+		{hash, hash + ".exe.pdf", false},
+		{hash, "x" + hash + ".exe", false},
+	} {
+		task := newTask("PEINFO")
+		task.PrimaryURI = c.primaryURI
+		task.Filename = c.filename
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+		if answer.Error != nil {
+			t.Fatal(answer.Error.Error)
+		}
+		if c.valid && len(answer.TskErrors) != 0 {
+			t.Errorf("%s/%s: matching filename rejected: %+v", c.primaryURI, c.filename, answer.TskErrors)
+		}
+		if !c.valid && (len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID ||
+			answer.TskErrors[0].Reason != tasking.REASON_FILENAME_MISMATCH) {
+			t.Errorf("%s/%s: expected a mismatch, got %+v", c.primaryURI, c.filename, answer.TskErrors)
+		}
+	}
+}
+
+func TestReportUnknownTasks(t *testing.T) {
+	c := &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"PEINFO"}, "org2": []string{"YARA"}},
+		Rabbit:             map[string]RabbitConf{"CUCKOO": RabbitConf{Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"}},
+		ReportUnknownTasks: true,
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	}
+	setupGateway(t, c)
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA", "CUCKOO", "PEIFNO")))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	reasons := map[string]string{}
+	for _, e := range answer.TskErrors {
+		for service := range e.TaskStruct.Tasks {
+			reasons[service] = e.Reason
+		}
+	}
+	expected := map[string]string{
+		"YARA":   tasking.REASON_TASK_NOT_ALLOWED,
+		"CUCKOO": tasking.REASON_TASK_NOT_ALLOWED,
+		"PEIFNO": tasking.REASON_TASK_UNKNOWN,
+	}
+	if len(reasons) != len(expected) {
+		t.Fatalf("expected %d rejected services, got %+v", len(expected), answer.TskErrors)
+	}
+	for service, reason := range expected {
+		if reasons[service] != reason {
+			t.Errorf("%s: expected reason %s, got %s", service, reason, reasons[service])
+		}
+	}
+
+	// without the option, unknown task types are just not allowed
+	c.ReportUnknownTasks = false
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEIFNO")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_TASK_NOT_ALLOWED {
+		t.Errorf("expected the unknown task to be not allowed, got %+v", answer.TskErrors)
+	}
+}
+
+func TestNoPermittedTasks(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA")))
+	if answer.Error != nil || len(answer.TskErrors) != 1 {
+		t.Fatalf("expected the services rejected: %+v", answer)
+	}
+	e := answer.TskErrors[0]
+	if e.Reason != tasking.REASON_NO_PERMITTED_TASKS || e.Error.Code != tasking.ERR_NOT_ALLOWED || e.Error.Error.Error() != "Organization has no permitted tasks" {
+		t.Errorf("expected the empty ACL to be reported: %s %+v", e.Reason, e.Error)
+	}
+
+	// a task merely missing from the ACL is not allowed as before
+	conf.AllowedTasks["org1"] = []string{"YARA"}
+	allowedTasks = buildAllowedTasks(conf)
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_TASK_NOT_ALLOWED || answer.TskErrors[0].Error.Error.Error() != "Rejected" {
+		t.Errorf("expected PEINFO not to be allowed: %+v", answer.TskErrors)
+	}
+}
+
+func TestMultipleRecipients(t *testing.T) {
+	c := &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"*"}},
+		MultipleRecipients: true,
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	}
+	ch := setupGateway(t, c)
+	// The symmetric key is encrypted for an unknown key first, and for
+	// src1 second, which is the only one held locally
+	envelope := func() (*tasking.Encrypted, []byte) {
+		enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+		unknownKey, err := tasking.RsaEncrypt(symKey, &ticketKey(t).PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.Recipients = []tasking.Recipient{
+			{KeyFingerprint: "src9", EncryptedKey: unknownKey},
+			{KeyFingerprint: "src1", EncryptedKey: enc.EncryptedKey},
+		}
+		enc.KeyFingerprint, enc.EncryptedKey = "src9", unknownKey
+		return enc, symKey
+	}
+
+	enc, symKey := envelope()
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+	if answer.Error != nil || len(answer.TskErrors) != 0 {
+		t.Fatalf("multi-recipient ticket rejected: %+v", answer)
+	}
+	if len(ch.messages()) != 1 {
+		t.Fatalf("expected 1 published task, got %d", len(ch.messages()))
+	}
+
+	// Without a recipient held locally, the ticket is rejected
+	enc, _ = envelope()
+	enc.Recipients = enc.Recipients[:1]
+	enc.Recipients = append(enc.Recipients, tasking.Recipient{KeyFingerprint: "src8", EncryptedKey: enc.EncryptedKey})
+	w = httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if len(ch.messages()) != 1 {
+		t.Error("ticket without a recipient held locally accepted")
+	}
+
+	// Mismatched pairs are rejected
+	enc, _ = envelope()
+	r := taskRequest(enc)
+	r.ParseForm()
+	r.Form.Add("KeyFingerprint", "src1")
+	if _, myerr := decodeTask(r); myerr == nil {
+		t.Error("mismatched KeyFingerprints and EncryptedKeys accepted")
+	}
+
+	// If disabled, only the first pair is used
+	c.MultipleRecipients = false
+	enc, _ = envelope()
+	w = httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if len(ch.messages()) != 1 {
+		t.Error("multi-recipient ticket accepted although disabled")
+	}
+}
+
+func TestExplainACL(t *testing.T) {
+	c := &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO", "YARA"}, "org2": []string{"*", "PEINFO"}},
+		ExplainACL:    true,
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	}
+	setupGateway(t, c)
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+	rules := func(org string) map[string]string {
+		answer := handleDecrypted(signTicket(t, org, time.Now().Add(time.Hour), newTask("PEINFO", "YARA", "CUCKOO")))
+		matched := make(map[string]string)
+		for _, a := range answer.Accepted {
+			matched[a.Task] = a.MatchedRule
+		}
+		return matched
+	}
+
+	if matched := rules("org1"); !reflect.DeepEqual(matched, map[string]string{"PEINFO": "PEINFO", "YARA": "YARA"}) {
+		t.Errorf("unexpected rules for exact names: %v", matched)
+	}
+	if matched := rules("org2"); !reflect.DeepEqual(matched, map[string]string{"PEINFO": "*", "YARA": "*", "CUCKOO": "*"}) {
+		t.Errorf("unexpected rules for the wildcard: %v", matched)
+	}
+
+	// without ExplainACL, the rules are not revealed
+	c.ExplainACL = false
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	x, _ := json.Marshal(answer)
+	if len(answer.Accepted) != 1 || strings.Contains(string(x), "MatchedRule") {
+		t.Errorf("ACL rule revealed: %s", x)
+	}
+}
@@ -0,0 +1,381 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"github.com/streadway/amqp"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// publishedMsg records a single message sent through a fakeChannel.
+type publishedMsg struct {
+	Exchange   string
+	RoutingKey string
+	Publishing amqp.Publishing
+	Task       tasking.Task
+}
+
+// fakeChannel is an in-memory replacement for the RabbitMQ channel.
+type fakeChannel struct {
+	sync.Mutex
+	published   []publishedMsg
+	publishErr  error
+	queues      []string
+	exchanges   []string
+	existing    map[string]bool // queues and exchanges known to passive declarations
+	bindings    int
+	closed      bool
+	deliveries  chan amqp.Delivery        // consumed reply queue
+	respond     func(publishedMsg) []byte // if set, answers messages with a ReplyTo
+	replies     *fakeChannel              // consumes the answers, if not this channel
+	block       chan struct{}             // if set, Publish blocks until it is closed
+	unroutable  map[string]bool           // routing keys bound to no queue
+	returns     chan amqp.Return          // set in confirm mode
+	confirms    chan amqp.Confirmation    // set in confirm mode
+	unconfirmed bool                      // if set, published messages are never confirmed
+
+	publishedAfterClose int
+}
+
+func (f *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if f.block != nil {
+		<-f.block
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		f.publishedAfterClose++
+		return amqp.ErrClosed
+	}
+	if f.publishErr != nil {
+		return f.publishErr
+	}
+	if f.confirms != nil {
+		// the broker returns mandatory messages it can't route
+		if f.unroutable[key] {
+			if mandatory && f.returns != nil {
+				f.returns <- amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE", Exchange: exchange, RoutingKey: key}
+			}
+			f.confirms <- amqp.Confirmation{Ack: true}
+			return nil
+		}
+		if !f.unconfirmed {
+			f.confirms <- amqp.Confirmation{Ack: true}
+		}
+	}
+	var task tasking.Task
+	json.Unmarshal(msg.Body, &task)
+	published := publishedMsg{
+		Exchange:   exchange,
+		RoutingKey: key,
+		Publishing: msg,
+		Task:       task}
+	f.published = append(f.published, published)
+	replies := f
+	if f.replies != nil {
+		replies = f.replies
+		replies.Lock()
+		defer replies.Unlock()
+	}
+	if f.respond != nil && msg.ReplyTo != "" && replies.deliveries != nil {
+		if result := f.respond(published); result != nil {
+			go func(d chan amqp.Delivery) {
+				d <- amqp.Delivery{CorrelationId: msg.CorrelationId, Body: result}
+			}(replies.deliveries)
+		}
+	}
+	return nil
+}
+
+func (f *fakeChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (f *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	f.Lock()
+	defer f.Unlock()
+	f.confirms = confirm
+	return confirm
+}
+
+func (f *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	f.Lock()
+	defer f.Unlock()
+	f.returns = c
+	return c
+}
+
+func (f *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	f.Lock()
+	defer f.Unlock()
+	if name == "" {
+		name = "amq.gen-" + strconv.Itoa(len(f.queues))
+	}
+	f.queues = append(f.queues, name)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.deliveries = make(chan amqp.Delivery)
+	return f.deliveries, nil
+}
+
+func (f *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	f.Lock()
+	defer f.Unlock()
+	f.exchanges = append(f.exchanges, name)
+	return nil
+}
+
+func (f *fakeChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	f.Lock()
+	defer f.Unlock()
+	if !f.existing[name] {
+		return amqp.Queue{}, &amqp.Error{Code: 404, Reason: "NOT_FOUND - no queue '" + name + "'"}
+	}
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	f.Lock()
+	defer f.Unlock()
+	if !f.existing[name] {
+		return &amqp.Error{Code: 404, Reason: "NOT_FOUND - no exchange '" + name + "'"}
+	}
+	return nil
+}
+
+func (f *fakeChannel) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	f.Lock()
+	defer f.Unlock()
+	f.bindings++
+	return nil
+}
+
+// messages returns a copy of all messages published so far.
+func (f *fakeChannel) messages() []publishedMsg {
+	f.Lock()
+	defer f.Unlock()
+	return append([]publishedMsg(nil), f.published...)
+}
+
+var testKeysOnce sync.Once
+var testTicketKey, testSourceKey *rsa.PrivateKey
+
+func generateTestKeys(t testing.TB) {
+	testKeysOnce.Do(func() {
+		var err error
+		testTicketKey, err = rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testSourceKey, err = rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// ticketKey returns the RSA key used by the tests to sign tickets.
+func ticketKey(t testing.TB) *rsa.PrivateKey {
+	generateTestKeys(t)
+	return testTicketKey
+}
+
+// sourceKey returns the RSA key of the source "src1".
+func sourceKey(t testing.TB) *rsa.PrivateKey {
+	generateTestKeys(t)
+	return testSourceKey
+}
+
+// setupGateway installs c as the active configuration, trusts the test
+// ticket key for the organization "org1", loads the key of the source
+// "src1" and replaces the RabbitMQ channel
+// by a fake, which is returned.
+func setupGateway(t testing.TB, c *config) *fakeChannel {
+	conf = c
+	allowedTasks = buildAllowedTasks(c)
+	knownTasks = buildKnownTasks(c, allowedTasks)
+	disabledTasks = buildDisabledTasks(c)
+	sourceKeyBindings = buildSourceKeyBindings(c)
+	ticketEncryptions = c.TicketEncryptions
+	filenamePattern, _ = compileFilenamePattern(c)
+	ticketKeys = map[string]*rsa.PublicKey{"org1": &ticketKey(t).PublicKey}
+	keys = map[string]*rsa.PrivateKey{"src1": sourceKey(t)}
+	ticketKeyExpiry = make(map[string]time.Time)
+	retiredKeys = make(map[string]time.Time)
+	rabbitDownSince = time.Time{}
+	dispatchRecords = make(map[ticketRef]*dispatchRecord)
+	ticketStatuses = make(map[string]*ticketResults)
+	metrics = expvarMetrics{}
+	seenTraceIDs = make(map[ticketRef]time.Time)
+	ivReuse = &ivReuseDetector{}
+	stats = newGatewayStats()
+	tenants = nil
+	quotaUsage = make(map[string][]*quotaReservation)
+	taskBuckets = make(map[string]*tokenBucket)
+	sequenceStates = make(map[string]*sequenceState)
+	timeNow = time.Now
+	initRSAWorkers(0)
+	ch := &fakeChannel{}
+	// abandoned publishes of earlier tests read these under the lock
+	rabbitMutex.Lock()
+	rabbitChannel = ch
+	rabbitReturns, rabbitConfirms, rabbitConfirmsLost = nil, nil, false
+	rabbitMutex.Unlock()
+	mandatorySlot = make(chan struct{}, 1)
+	rabbitMgmtChannel = &fakeChannel{}
+	rabbitReconnectDelay = 0
+	secretProvider = refSecrets{}
+	setRequestLogSampling(c.RequestLogSampling)
+	maintenance, maintenanceConfigured = c.Maintenance, c.Maintenance
+	receiptKeys = make(map[string]*rsa.PrivateKey)
+	return ch
+}
+
+// fakeDialer replaces dialRabbit and hands out fake channels. The returned
+// slice pointer collects every channel that was dialed.
+func fakeDialer() *[]*fakeChannel {
+	dialed := &[]*fakeChannel{}
+	var mutex sync.Mutex
+	dialRabbit = func() (amqpChannel, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ch := &fakeChannel{}
+		*dialed = append(*dialed, ch)
+		return ch, nil
+	}
+	return dialed
+}
+
+// newTask returns a valid task requesting the given services.
+func newTask(services ...string) tasking.Task {
+	tasks := make(map[string][]string)
+	for _, s := range services {
+		tasks[s] = []string{}
+	}
+	return tasking.Task{
+		PrimaryURI: "3a12f43eeb0c45d241a8f447d4661d9746d6ea35990953334f5ec675f60e36c5",
+		Filename:   "myfile",
+		Tasks:      tasks,
+		Tags:       []string{"test1"},
+		Source:     "src1"}
+}
+
+// signTicket creates a ticket for tasks, signed by signer with the test
+// ticket key, and returns its JSON representation.
+func signTicket(t testing.TB, signer string, expiration time.Time, tasks ...tasking.Task) string {
+	ticket := tasking.Ticket{
+		Expiration:  expiration,
+		Tasks:       tasks,
+		SignerKeyId: signer}
+	msg, err := json.Marshal(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket.Signature, err = tasking.Sign(msg, ticketKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticketM, err := json.Marshal(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(ticketM)
+}
+
+// encryptTicket encrypts ticket for the source "src1", the way the
+// master-gateway does. It returns the envelope and the symmetric key.
+func encryptTicket(t testing.TB, ticket string) (*tasking.Encrypted, []byte) {
+	symKey := make([]byte, 16)
+	iv := make([]byte, 16)
+	rand.Read(symKey)
+	rand.Read(iv)
+	encKey, err := tasking.RsaEncrypt(symKey, &sourceKey(t).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := tasking.AesEncrypt([]byte(ticket), symKey, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tasking.Encrypted{
+		KeyFingerprint: "src1",
+		EncryptedKey:   encKey,
+		Encrypted:      encrypted,
+		IV:             iv}, symKey
+}
+
+// taskRequest builds the form-encoded HTTP request submitting enc.
+func taskRequest(enc *tasking.Encrypted) *http.Request {
+	form := url.Values{}
+	form.Set("KeyFingerprint", enc.KeyFingerprint)
+	form.Set("EncryptedKey", base64.StdEncoding.EncodeToString(enc.EncryptedKey))
+	if len(enc.Recipients) > 0 {
+		form.Del("KeyFingerprint")
+		form.Del("EncryptedKey")
+		for _, r := range enc.Recipients {
+			form.Add("KeyFingerprint", r.KeyFingerprint)
+			form.Add("EncryptedKey", base64.StdEncoding.EncodeToString(r.EncryptedKey))
+		}
+	}
+	form.Set("IV", base64.StdEncoding.EncodeToString(enc.IV))
+	form.Set("Encrypted", base64.StdEncoding.EncodeToString(enc.Encrypted))
+	if enc.Encryption != "" {
+		form.Set("Encryption", enc.Encryption)
+	}
+	r, _ := http.NewRequest("POST", "/task/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// decryptAnswer decrypts the response to a request submitting enc.
+func decryptAnswer(t testing.TB, body []byte, enc *tasking.Encrypted, symKey []byte) tasking.GatewayAnswer {
+	var plain []byte
+	var err error
+	if enc.Encryption == tasking.ENCRYPTION_AES_GCM {
+		if len(body) < tasking.AES_GCM_NONCE_SIZE {
+			t.Fatalf("answer too short for a nonce: %d bytes", len(body))
+		}
+		plain, err = tasking.AesGcmDecrypt(body[tasking.AES_GCM_NONCE_SIZE:], symKey, body[:tasking.AES_GCM_NONCE_SIZE])
+	} else {
+		iv := append([]byte(nil), enc.IV...)
+		iv[0] ^= 1
+		plain, err = tasking.AesDecrypt(body, symKey, iv)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer tasking.GatewayAnswer
+	if err := json.Unmarshal(plain, &answer); err != nil {
+		t.Fatalf("%s: %s", err, plain)
+	}
+	return answer
+}
+
+// metricValue returns the current value of the counter key in m.
+func metricValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:   map[string][]string{"org1": []string{"*"}},
+		RabbitDefault:  RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		HTTPSocketMode: "0600",
+	})
+
+	dir, err := ioutil.TempDir("", "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gateway.sock")
+
+	umask := syscall.Umask(0022)
+	defer syscall.Umask(umask)
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored := syscall.Umask(0022); restored != 0022 {
+		t.Errorf("umask was not restored: %o", restored)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket has mode %o instead of 0600", fi.Mode().Perm())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/task/", httpRequestIncoming)
+	go http.Serve(listener, mux)
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		}}}
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	req := taskRequest(enc)
+	req.URL.Scheme = "http"
+	req.URL.Host = "gateway"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	answer := decryptAnswer(t, body, enc, symKey)
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(ch.messages()) != 1 {
+		t.Errorf("task was not published")
+	}
+
+	// closing the listener removes the socket
+	listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket was not removed: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"sync"
+	"time"
+)
+
+// The maximum length of an Idempotency-Key.
+const maxIdempotencyKeyLength = 128
+
+// The maximum number of failed concurrent submissions of a ticket with
+// the same Idempotency-Key, which a submission waits for.
+const maxIdempotencyWaits = 3
+
+var errIdempotencyBusy = &tasking.MyError{Error: errors.New("Concurrent submissions with the Idempotency-Key failed, try again"), Code: tasking.ERR_BUSY}
+
+// idempotencyEntry is the remembered outcome of a ticket submitted with an
+// Idempotency-Key. done is closed once answer is available.
+type idempotencyEntry struct {
+	digest  [sha256.Size]byte
+	answer  *tasking.GatewayAnswer
+	expires time.Time
+	done    chan struct{}
+}
+
+var (
+	idempotencyCache = make(map[string]*idempotencyEntry)
+	idempotencyMutex = &sync.Mutex{}
+)
+
+// idempotent calls handle for the decrypted ticket, unless a ticket with
+// the same idempotency key was handled within the configured window. In
+// that case the previous answer is returned and the ticket is not
+// dispatched again. Only answers without ticket-level errors are
+// remembered, so a ticket that failed as a whole can be retried. Keys are
+// only compared within the same scope.
+func idempotent(scope string, key string, ticket string, handle func() *tasking.GatewayAnswer) *tasking.GatewayAnswer {
+	if key == "" || conf.IdempotencyWindow <= 0 {
+		return handle()
+	}
+	if len(key) > maxIdempotencyKeyLength || !stringPrintable(key) {
+		return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Invalid Idempotency-Key"), Code: tasking.ERR_OTHER_UNRECOVERABLE}}
+	}
+	digest := sha256.Sum256([]byte(ticket))
+	cacheKey := scope + "\n" + key
+
+	var entry *idempotencyEntry
+	for attempt := 0; ; attempt++ {
+		idempotencyMutex.Lock()
+		now := time.Now()
+		for k, e := range idempotencyCache {
+			if e.answer != nil && now.After(e.expires) {
+				delete(idempotencyCache, k)
+			}
+		}
+		previous, exists := idempotencyCache[cacheKey]
+		if !exists {
+			entry = &idempotencyEntry{digest: digest, done: make(chan struct{})}
+			idempotencyCache[cacheKey] = entry
+			idempotencyMutex.Unlock()
+			break
+		}
+		idempotencyMutex.Unlock()
+		if previous.digest != digest {
+			log.Printf("Idempotency-Key '%s' reused for a different ticket", key)
+			return &tasking.GatewayAnswer{Error: &tasking.MyError{Error: errors.New("Idempotency-Key was already used for a different ticket"), Code: tasking.ERR_OTHER_UNRECOVERABLE}}
+		}
+		// wait for a concurrent submission of the same ticket
+		<-previous.done
+		if previous.answer != nil {
+			log.Printf("Returning previous answer for Idempotency-Key '%s'", key)
+			return previous.answer
+		}
+		// The previous submission failed and was forgotten, so this one
+		// takes over. Others may be faster, but waiting is bounded.
+		if attempt+1 >= maxIdempotencyWaits {
+			return &tasking.GatewayAnswer{Error: errIdempotencyBusy}
+		}
+	}
+
+	answer := handle()
+
+	idempotencyMutex.Lock()
+	if answer.Error == nil {
+		entry.answer = answer
+		entry.expires = time.Now().Add(time.Duration(conf.IdempotencyWindow) * time.Second)
+	} else if idempotencyCache[cacheKey] == entry {
+		delete(idempotencyCache, cacheKey)
+	}
+	close(entry.done)
+	idempotencyMutex.Unlock()
+	return answer
+}
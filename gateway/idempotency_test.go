@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:      map[string][]string{"org1": []string{"*"}},
+		IdempotencyWindow: 60,
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	ticket := signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"))
+	for i := 0; i < 2; i++ {
+		// the client retries with a fresh envelope, but the same ticket
+		enc, symKey := encryptTicket(t, ticket)
+		r := taskRequest(enc)
+		r.Header.Set("Idempotency-Key", "retry-1")
+		w := httptest.NewRecorder()
+		httpRequestIncoming(w, r)
+		answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+		if answer.Error != nil {
+			t.Fatal(answer.Error.Error)
+		}
+		if len(answer.Accepted) != 1 {
+			t.Errorf("submission %d: expected the previous answer, got %+v", i, answer)
+		}
+	}
+	if n := len(ch.messages()); n != 1 {
+		t.Errorf("expected the ticket to be dispatched once, got %d", n)
+	}
+
+	// a different ticket with the same key is refused
+	other := signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA"))
+	enc, symKey := encryptTicket(t, other)
+	r := taskRequest(enc)
+	r.Header.Set("Idempotency-Key", "retry-1")
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, r)
+	if answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey); answer.Error == nil {
+		t.Errorf("reusing a key for a different ticket was accepted")
+	}
+
+	// without a key, every submission is dispatched
+	for i := 0; i < 2; i++ {
+		enc, _ := encryptTicket(t, ticket)
+		httpRequestIncoming(httptest.NewRecorder(), taskRequest(enc))
+	}
+	if n := len(ch.messages()); n != 3 {
+		t.Errorf("expected 3 dispatched tickets, got %d", n)
+	}
+}
+
+func TestIdempotencyKeyAfterFailure(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:      map[string][]string{},
+		IdempotencyWindow: 60,
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	ticket := signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"))
+	submit := func() tasking.GatewayAnswer {
+		enc, symKey := encryptTicket(t, ticket)
+		r := taskRequest(enc)
+		r.Header.Set("Idempotency-Key", "retry-2")
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			httpRequestIncoming(w, r)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("submission did not return")
+		}
+		return decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+	}
+
+	// the organization is not allowed yet, so the submission fails
+	if answer := submit(); answer.Error == nil {
+		t.Fatalf("expected the first submission to fail, got %+v", answer)
+	}
+
+	// the failed submission is forgotten and the retry is dispatched
+	conf.AllowedTasks = map[string][]string{"org1": []string{"*"}}
+	allowedTasks = buildAllowedTasks(conf)
+	knownTasks = buildKnownTasks(conf, allowedTasks)
+	answer := submit()
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(answer.Accepted) != 1 {
+		t.Errorf("expected the retry to be accepted, got %+v", answer)
+	}
+	if n := len(ch.messages()); n != 1 {
+		t.Errorf("expected the retry to be dispatched once, got %d", n)
+	}
+}
@@ -0,0 +1,58 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"log"
+	"sync"
+)
+
+// A client reusing an IV for different tickets encrypted with the same
+// key weakens the encryption. If conf.IVReuseWindow is set, the gateway
+// remembers this many of the most recent (key fingerprint, IV) pairs and
+// warns, if a pair is seen again with a different ciphertext. Resending
+// exactly the same request, e.g. as a retry, is not a reuse.
+
+type ivReuseDetector struct {
+	sync.Mutex
+	seen  map[[32]byte][32]byte // digest of the pair -> digest of the ciphertext
+	order [][32]byte            // ring buffer of the remembered pairs
+	next  int
+}
+
+var ivReuse = &ivReuseDetector{}
+
+// check records the pair of fingerprint and iv, and reports whether it
+// was already used for another ciphertext. At most size pairs are
+// remembered.
+func (d *ivReuseDetector) check(fingerprint string, iv []byte, ciphertext []byte, size int) bool {
+	pair := sha256.Sum256(append(append([]byte(fingerprint), 0), iv...))
+	digest := sha256.Sum256(ciphertext)
+	d.Lock()
+	defer d.Unlock()
+	if len(d.order) != size {
+		// first use or changed window
+		d.seen = make(map[[32]byte][32]byte, size)
+		d.order = make([][32]byte, size)
+		d.next = 0
+	}
+	if previous, exists := d.seen[pair]; exists {
+		return previous != digest
+	}
+	delete(d.seen, d.order[d.next])
+	d.order[d.next] = pair
+	d.next = (d.next + 1) % size
+	d.seen[pair] = digest
+	return false
+}
+
+// detectIVReuse warns, if iv was already used with the key fingerprint
+// for another ciphertext.
+func detectIVReuse(fingerprint string, iv []byte, ciphertext []byte) {
+	if conf.IVReuseWindow <= 0 {
+		return
+	}
+	if ivReuse.check(fingerprint, iv, ciphertext, conf.IVReuseWindow) {
+		log.Printf("WARNING: IV %x was reused with key %s for a different ticket. The client should use a random IV for every ticket", iv, fingerprint)
+		metrics.Count(metricGroupCrypto, metricIVReused, 1)
+	}
+}
@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"testing"
+	"time"
+)
+
+// encryptWithIV encrypts ticket like encryptTicket, but with the given IV.
+func encryptWithIV(t *testing.T, ticket string, iv []byte) *tasking.Encrypted {
+	enc, symKey := encryptTicket(t, ticket)
+	encrypted, err := tasking.AesEncrypt([]byte(ticket), symKey, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.IV = append([]byte(nil), iv...)
+	enc.Encrypted = encrypted
+	return enc
+}
+
+func TestIVReuseDetected(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		IVReuseWindow: 2,
+	})
+	m := newRecordingMetrics()
+	metrics = m
+	reused := func() int64 {
+		m.Lock()
+		defer m.Unlock()
+		return m.counts[metricGroupCrypto+"."+metricIVReused]
+	}
+
+	iv := make([]byte, 16)
+	first := encryptWithIV(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")), iv)
+	for i := 0; i < 2; i++ {
+		// resending the same request is fine
+		if _, _, err, _ := decryptTicket(first); err != nil {
+			t.Fatal(err.Error)
+		}
+	}
+	if reused() != 0 {
+		t.Fatalf("retry reported as IV reuse")
+	}
+
+	second := encryptWithIV(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA")), iv)
+	if _, _, err, _ := decryptTicket(second); err != nil {
+		t.Fatal(err.Error)
+	}
+	if reused() != 1 {
+		t.Errorf("expected the reused IV to be reported")
+	}
+
+	// the memory is bounded: older pairs are forgotten
+	for i := byte(1); i <= 2; i++ {
+		other := append([]byte(nil), iv...)
+		other[0] = i
+		decryptTicket(encryptWithIV(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")), other))
+	}
+	third := encryptWithIV(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("ZIP")), iv)
+	decryptTicket(third)
+	if reused() != 1 {
+		t.Errorf("expected the forgotten IV not to be reported")
+	}
+}
+
+func TestIVReuseDisabled(t *testing.T) {
+	setupGateway(t, &config{AllowedTasks: map[string][]string{"org1": []string{"*"}}})
+	m := newRecordingMetrics()
+	metrics = m
+	iv := make([]byte, 16)
+	for _, s := range []string{"PEINFO", "YARA"} {
+		decryptTicket(encryptWithIV(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask(s)), iv))
+	}
+	if m.counts[metricGroupCrypto+"."+metricIVReused] != 0 {
+		t.Errorf("IV reuse reported without detection")
+	}
+}
@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"crypto/aes"
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+)
+
+// Organizations can be bound to the source keys they may encrypt their
+// tickets for. This way, a leaked source key can only be used by the
+// organizations it was handed out to. Organizations without a binding may
+// use every source key.
+
+var sourceKeyBindings map[string](map[string]struct{}) // map Organization-Name -> set of source keys
+
+var ticketEncryptions map[string][]string // conf.TicketEncryptions, as last reloaded
+
+// buildSourceKeyBindings returns the bindings configured in c.
+func buildSourceKeyBindings(c *config) map[string](map[string]struct{}) {
+	bindings := make(map[string](map[string]struct{}), len(c.SourceKeyBindings))
+	for org, names := range c.SourceKeyBindings {
+		bound := make(map[string]struct{}, len(names))
+		for _, name := range names {
+			bound[name] = struct{}{}
+		}
+		bindings[org] = bound
+	}
+	return bindings
+}
+
+// sourceKeyAllowed reports whether org may encrypt its tickets for the
+// source key keyName.
+func sourceKeyAllowed(org, keyName string) bool {
+	policyMutex.RLock()
+	defer policyMutex.RUnlock()
+	bound, exists := sourceKeyBindings[org]
+	if !exists {
+		return true
+	}
+	_, allowed := bound[keyName]
+	return allowed
+}
+
+// checkSourceKey rejects the decrypted ticket ticketStr, if its signer
+// may not use the source key keyName. The signature is only verified
+// later, but an unverified signer can at most cause a rejection here.
+func checkSourceKey(keyName, ticketStr string) *tasking.MyError {
+	var ticket struct{ SignerKeyId string }
+	if err := json.Unmarshal([]byte(ticketStr), &ticket); err != nil {
+		// reported by the verification of the ticket
+		return nil
+	}
+	if !sourceKeyAllowed(ticket.SignerKeyId, keyName) {
+		return &tasking.MyError{Error: errors.New("Organization not allowed to use source key " + keyName), Code: tasking.ERR_NOT_ALLOWED}
+	}
+	return nil
+}
+
+// ticketEncryption returns the name of the encryption of a ticket, which
+// is aes-cbc, if the client didn't name it.
+func ticketEncryption(encryption string) string {
+	if encryption == "" {
+		return tasking.ENCRYPTION_AES_CBC
+	}
+	return encryption
+}
+
+// ivSize returns the length of the IV of a ticket with encryption.
+func ivSize(encryption string) int {
+	if ticketEncryption(encryption) == tasking.ENCRYPTION_AES_GCM {
+		return tasking.AES_GCM_NONCE_SIZE
+	}
+	return aes.BlockSize
+}
+
+// checkTicketEncryption rejects the decrypted ticket ticketStr, if its
+// signer may not use the encryption it was encrypted with. Like with the
+// source keys, this lets operators move organizations to a stronger
+// encryption one by one.
+func checkTicketEncryption(encryption, ticketStr string) *tasking.MyError {
+	policyMutex.RLock()
+	encryptions := ticketEncryptions
+	policyMutex.RUnlock()
+	if len(encryptions) == 0 {
+		return nil
+	}
+	var ticket struct{ SignerKeyId string }
+	if err := json.Unmarshal([]byte(ticketStr), &ticket); err != nil {
+		// reported by the verification of the ticket
+		return nil
+	}
+	allowed, exists := encryptions[ticket.SignerKeyId]
+	if !exists {
+		return nil
+	}
+	encryption = ticketEncryption(encryption)
+	for _, e := range allowed {
+		if e == encryption {
+			return nil
+		}
+	}
+	return &tasking.MyError{Error: errors.New("Organization not allowed to use encryption " + encryption), Code: tasking.ERR_ENCRYPTION}
+}
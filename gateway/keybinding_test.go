@@ -0,0 +1,210 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSourceKeyBindingReload(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:      map[string][]string{"org1": []string{"*"}},
+		SourceKeyBindings: map[string][]string{"org1": []string{"src1"}},
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	answer, _ := handleIncoming(nil, enc, "", false, false, nil)
+	if answer.Error != nil {
+		t.Fatalf("bound source key was rejected: %s", answer.Error.Error)
+	}
+
+	// rotate org1 to another source key without restarting
+	f, err := ioutil.TempFile("", "gateway.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"AllowedTasks": {"org1": ["*"]}, "SourceKeyBindings": {"org1": ["src2"]}}`)
+	f.Close()
+	if err := reloadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	answer, answerKey := handleIncoming(nil, enc, "", false, false, nil)
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_NOT_ALLOWED {
+		t.Fatalf("expected the unbound source key to be rejected, got %+v", answer)
+	}
+	if string(answerKey) != string(symKey) {
+		t.Errorf("rejection should be answered encrypted")
+	}
+	if len(ch.messages()) != 1 {
+		t.Errorf("expected only the first ticket to be published, got %d messages", len(ch.messages()))
+	}
+}
+
+func TestSourceKeyBindingFallbackKey(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"*"}},
+		FallbackSourceKeys: []string{"src1"},
+		SourceKeyBindings:  map[string][]string{"org1": []string{"retired"}},
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	// the binding applies to the key that decrypted the ticket, not to the
+	// one the ticket names
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	enc.KeyFingerprint = "retired"
+	answer, _ := handleIncoming(nil, enc, "", false, false, nil)
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_NOT_ALLOWED {
+		t.Fatalf("expected the fallback key to be rejected, got %+v", answer)
+	}
+}
+
+func TestSourceKeyBindingConcurrentReload(t *testing.T) {
+	setupGateway(t, &config{
+		SourceKeyBindings: map[string][]string{"org1": []string{"src1"}},
+	})
+	f, err := ioutil.TempFile("", "gateway.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"SourceKeyBindings": {"org1": ["src1", "src2"]}}`)
+	f.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if !sourceKeyAllowed("org1", "src1") {
+				t.Error("src1 disallowed during reload")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := reloadConfig(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if !sourceKeyAllowed("org1", "src2") {
+		t.Error("reloaded binding not applied")
+	}
+}
+
+func TestTicketEncryptions(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:      map[string][]string{"org1": []string{"*"}},
+		TicketEncryptions: map[string][]string{"org1": []string{tasking.ENCRYPTION_AES_GCM}},
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	encryptGCM := func(ticket string) *tasking.Encrypted {
+		enc, symKey := encryptTicket(t, ticket)
+		enc.IV = enc.IV[:tasking.AES_GCM_NONCE_SIZE]
+		encrypted, err := tasking.AesGcmEncrypt([]byte(ticket), symKey, enc.IV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.Encrypted = encrypted
+		enc.Encryption = tasking.ENCRYPTION_AES_GCM
+		return enc
+	}
+
+	// org1 is restricted to GCM
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	answer, answerKey := handleIncoming(nil, enc, "", false, false, nil)
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_ENCRYPTION {
+		t.Fatalf("expected the CBC ticket of org1 to be rejected, got %+v", answer)
+	}
+	if string(answerKey) != string(symKey) {
+		t.Errorf("rejection should be answered encrypted")
+	}
+	answer, _ = handleIncoming(nil, encryptGCM(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"))), "", false, false, nil)
+	if answer.Error != nil {
+		t.Fatalf("GCM ticket of org1 rejected: %s", answer.Error.Error)
+	}
+
+	// organizations not listed may use both
+	ticketEncryptions = map[string][]string{"org2": []string{tasking.ENCRYPTION_AES_GCM}}
+	enc, _ = encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer, _ := handleIncoming(nil, enc, "", false, false, nil); answer.Error != nil {
+		t.Errorf("CBC ticket of an unlisted organization rejected: %s", answer.Error.Error)
+	}
+	if len(ch.messages()) != 2 {
+		t.Errorf("expected 2 published tickets, got %d", len(ch.messages()))
+	}
+
+	// a modified GCM ticket fails to decrypt
+	enc = encryptGCM(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	enc.Encrypted[0] ^= 1
+	answer, answerKey = handleIncoming(nil, enc, "", false, false, nil)
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_ENCRYPTION {
+		t.Errorf("modified GCM ticket accepted: %+v", answer)
+	}
+	if answerKey == nil {
+		t.Errorf("rejection of a GCM ticket should be answered encrypted")
+	}
+
+	// the nonce must have the standard size of GCM
+	enc = encryptGCM(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	enc.IV = append(enc.IV, 0, 0, 0, 0)
+	if answer, _ := handleIncoming(nil, enc, "", false, false, nil); answer.Error == nil || answer.Error.Code != tasking.ERR_ENCRYPTION {
+		t.Errorf("GCM ticket with a %d byte nonce accepted: %+v", len(enc.IV), answer)
+	}
+
+	// the encryption is sent in a form field
+	enc = encryptGCM(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	r := taskRequest(enc)
+	r.ParseForm()
+	r.Form.Set("Encryption", tasking.ENCRYPTION_AES_GCM)
+	decoded, myerr := decodeTask(r)
+	if myerr != nil || decoded.Encryption != tasking.ENCRYPTION_AES_GCM {
+		t.Errorf("Encryption not decoded: %+v %+v", decoded, myerr)
+	}
+	r.Form.Set("Encryption", "rot13")
+	if _, myerr := decodeTask(r); myerr == nil || myerr.Code != tasking.ERR_ENCRYPTION {
+		t.Errorf("unknown encryption accepted")
+	}
+}
+
+func TestTicketEncryptionsConcurrentReload(t *testing.T) {
+	setupGateway(t, &config{
+		TicketEncryptions: map[string][]string{"org1": []string{tasking.ENCRYPTION_AES_CBC}},
+	})
+	f, err := ioutil.TempFile("", "gateway.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"TicketEncryptions": {"org1": ["aes-cbc", "aes-gcm"]}}`)
+	f.Close()
+
+	ticket := `{"SignerKeyId": "org1"}`
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := checkTicketEncryption(tasking.ENCRYPTION_AES_CBC, ticket); err != nil {
+				t.Error("aes-cbc disallowed during reload")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := reloadConfig(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := checkTicketEncryption(tasking.ENCRYPTION_AES_GCM, ticket); err != nil {
+		t.Error("reloaded ticket encryptions not applied")
+	}
+}
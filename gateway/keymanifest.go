@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Rotating many keys by dropping and deleting files one by one is error
+// prone, and the gateway may act on a half finished rotation. Instead, the
+// source and ticket keys can be listed in a manifest (conf.KeyManifest).
+// It is applied on startup and on every reload of the configuration: the
+// loaded keys are replaced by the listed ones as a whole, or, if any of
+// them can't be loaded, not at all.
+
+// KeyManifest lists the source and ticket keys the gateway holds.
+type KeyManifest struct {
+	SourceKeys []ManifestKey // "<name>.priv" files
+	TicketKeys []ManifestKey // "<name>.pub" files
+}
+
+// ManifestKey is a key file. The name of the key is the name of the file
+// without its extension, like in the key directories.
+type ManifestKey struct {
+	File        string // Path of the key, relative to the manifest
+	Fingerprint string // Hex-encoded SHA256 of the file, to detect a wrong or partially copied key
+}
+
+// readManifestKey reads the file of k relative to dir, if it has the
+// extension ext and matches the fingerprint of k.
+func readManifestKey(dir string, k ManifestKey, ext string) ([]byte, error) {
+	if filepath.Ext(k.File) != ext || len(filepath.Base(k.File)) == len(ext) {
+		return nil, errors.New("Key file " + k.File + " has no name or not the extension " + ext)
+	}
+	path := k.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(f)
+	if !strings.EqualFold(hex.EncodeToString(hash[:]), k.Fingerprint) {
+		return nil, errors.New("Key file " + k.File + " doesn't match its fingerprint")
+	}
+	return f, nil
+}
+
+// loadKeyManifest reads the manifest at path and loads all its keys.
+func loadKeyManifest(path string) (map[string]*rsa.PrivateKey, map[string]*rsa.PublicKey, error) {
+	x, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifest KeyManifest
+	if err := json.Unmarshal(x, &manifest); err != nil {
+		return nil, nil, err
+	}
+	dir := filepath.Dir(path)
+
+	sourceKeys := make(map[string]*rsa.PrivateKey, len(manifest.SourceKeys))
+	for _, k := range manifest.SourceKeys {
+		f, err := readManifestKey(dir, k, ".priv")
+		if err != nil {
+			return nil, nil, err
+		}
+		key, name, err := tasking.ParsePrivateKey(f, filepath.Base(k.File))
+		if err != nil {
+			return nil, nil, errors.New("Couldn't parse " + k.File + ": " + err.Error())
+		}
+		if _, exists := sourceKeys[name]; exists {
+			return nil, nil, errors.New("Source key " + name + " listed twice")
+		}
+		sourceKeys[name] = key
+	}
+
+	ticketKeys := make(map[string]*rsa.PublicKey, len(manifest.TicketKeys))
+	for _, k := range manifest.TicketKeys {
+		f, err := readManifestKey(dir, k, ".pub")
+		if err != nil {
+			return nil, nil, err
+		}
+		key, name, err := tasking.ParsePublicKey(f, filepath.Base(k.File))
+		if err != nil {
+			return nil, nil, errors.New("Couldn't parse " + k.File + ": " + err.Error())
+		}
+		if _, exists := ticketKeys[name]; exists {
+			return nil, nil, errors.New("Ticket key " + name + " listed twice")
+		}
+		ticketKeys[name] = key
+	}
+	return sourceKeys, ticketKeys, nil
+}
+
+// applyKeyManifest replaces the loaded source and ticket keys by those of
+// the manifest at path.
+func applyKeyManifest(path string) error {
+	sourceKeys, newTicketKeys, err := loadKeyManifest(path)
+	if err != nil {
+		return err
+	}
+	replaceKeys("key manifest "+path, sourceKeys, newTicketKeys)
+	return nil
+}
+
+// replaceKeys replaces the loaded source and ticket keys by the given ones,
+// which were loaded from origin. Source keys missing are removed like
+// deleted key files, i.e. after conf.KeyRemovalGrace.
+func replaceKeys(origin string, sourceKeys map[string]*rsa.PrivateKey, newTicketKeys map[string]*rsa.PublicKey) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	added, removed := 0, 0
+	for name := range keys {
+		if _, listed := sourceKeys[name]; !listed {
+			if _, retired := retiredKeys[name]; !retired {
+				removeSourceKeyLocked(name)
+				removed++
+			}
+		}
+	}
+	for name, key := range sourceKeys {
+		if _, exists := keys[name]; !exists {
+			added++
+		}
+		keys[name] = key
+		delete(retiredKeys, name)
+	}
+	for name := range ticketKeys {
+		if _, listed := newTicketKeys[name]; !listed {
+			delete(ticketKeys, name)
+		}
+	}
+	for name, key := range newTicketKeys {
+		ticketKeys[name] = key
+	}
+	log.Printf("Applied %s: %d source keys (%d added, %d removed), %d ticket keys", origin, len(sourceKeys), added, removed, len(newTicketKeys))
+}
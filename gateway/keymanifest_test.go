@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeManifestKey writes data to name in dir and returns its manifest
+// entry.
+func writeManifestKey(t *testing.T, dir, name string, data []byte) ManifestKey {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	return ManifestKey{File: name, Fingerprint: hex.EncodeToString(hash[:])}
+}
+
+func writeManifest(t *testing.T, path string, manifest KeyManifest) {
+	x, _ := json.Marshal(manifest)
+	if err := ioutil.WriteFile(path, x, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadedKeyNames() ([]string, []string) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	var sources, tickets []string
+	for name := range keys {
+		sources = append(sources, name)
+	}
+	for name := range ticketKeys {
+		tickets = append(tickets, name)
+	}
+	sort.Strings(sources)
+	sort.Strings(tickets)
+	return sources, tickets
+}
+
+func TestKeyManifest(t *testing.T) {
+	setupGateway(t, &config{})
+	dir, err := ioutil.TempDir("", "keymanifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	private := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(sourceKey(t))})
+	der, err := x509.MarshalPKIXPublicKey(&ticketKey(t).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	path := filepath.Join(dir, "keys.json")
+
+	// src1 is replaced by src2 and src3
+	manifest := KeyManifest{
+		SourceKeys: []ManifestKey{
+			writeManifestKey(t, dir, "src2.priv", private),
+			writeManifestKey(t, dir, "src3.priv", private)},
+		TicketKeys: []ManifestKey{writeManifestKey(t, dir, "org1.pub", public)}}
+	writeManifest(t, path, manifest)
+	if err := applyKeyManifest(path); err != nil {
+		t.Fatal(err)
+	}
+	sources, tickets := loadedKeyNames()
+	if !reflect.DeepEqual(sources, []string{"src2", "src3"}) || !reflect.DeepEqual(tickets, []string{"org1"}) {
+		t.Fatalf("expected src2, src3 and org1 loaded, got %v and %v", sources, tickets)
+	}
+
+	// a manifest with a broken key is not applied at all
+	broken := manifest
+	broken.SourceKeys = []ManifestKey{manifest.SourceKeys[0], writeManifestKey(t, dir, "src4.priv", private)}
+	broken.SourceKeys[1].Fingerprint = hex.EncodeToString(make([]byte, sha256.Size))
+	broken.TicketKeys = nil
+	writeManifest(t, path, broken)
+	if err := applyKeyManifest(path); err == nil {
+		t.Fatal("manifest with a wrong fingerprint applied")
+	}
+	if s, tk := loadedKeyNames(); !reflect.DeepEqual(s, sources) || !reflect.DeepEqual(tk, tickets) {
+		t.Errorf("keys changed by a failed manifest: %v and %v", s, tk)
+	}
+}
@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A ticket key "<name>.pub" may be accompanied by a metadata file
+// "<name>.meta" in the same directory. Tickets signed with a key after its
+// NotAfter date are rejected, so stale keys of organizations are retired
+// automatically.
+type keyMeta struct {
+	NotAfter time.Time
+}
+
+var ticketKeyExpiry = make(map[string]time.Time) // guarded by keysMutex
+
+var errTicketKeyExpired = errors.New("Ticket key expired")
+
+// loadKeyMeta reads the metadata file at path and returns the name of the
+// key it belongs to.
+func loadKeyMeta(path string) (string, *keyMeta, error) {
+	name := keyMetaName(path)
+	x, err := keySource.ReadKey(path)
+	if err != nil {
+		return name, nil, err
+	}
+	var meta keyMeta
+	if err := json.Unmarshal(x, &meta); err != nil {
+		return name, nil, err
+	}
+	return name, &meta, nil
+}
+
+// keyMetaName strips the directory and the ".meta"-extension from path.
+func keyMetaName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".meta")
+}
+
+func addKeyMeta(path string) error {
+	name, meta, err := loadKeyMeta(path)
+	if err != nil {
+		return err
+	}
+	keysMutex.Lock()
+	if meta.NotAfter.IsZero() {
+		delete(ticketKeyExpiry, name)
+	} else {
+		ticketKeyExpiry[name] = meta.NotAfter
+	}
+	keysMutex.Unlock()
+	return nil
+}
+
+func removeKeyMeta(path string) {
+	keysMutex.Lock()
+	delete(ticketKeyExpiry, keyMetaName(path))
+	keysMutex.Unlock()
+}
+
+// ticketKeyExpired reports whether the ticket key of org is past its
+// NotAfter date.
+func ticketKeyExpired(org string) bool {
+	keysMutex.Lock()
+	notAfter, exists := ticketKeyExpiry[org]
+	keysMutex.Unlock()
+	return exists && time.Now().After(notAfter)
+}
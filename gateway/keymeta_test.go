@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTicketKeyExpiry(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	dir, err := ioutil.TempDir("", "ticketkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	meta := filepath.Join(dir, "org1.meta")
+
+	// a key which is still valid
+	ioutil.WriteFile(meta, []byte(`{"NotAfter": "`+time.Now().Add(time.Hour).Format(time.RFC3339)+`"}`), 0600)
+	if err := addKeyMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Error != nil {
+		t.Fatalf("ticket of a valid key rejected: %s", answer.Error.Error)
+	}
+
+	// the metadata is updated, the key is expired now
+	ioutil.WriteFile(meta, []byte(`{"NotAfter": "`+time.Now().Add(-time.Hour).Format(time.RFC3339)+`"}`), 0600)
+	if err := addKeyMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Error == nil || answer.Error.Error != errTicketKeyExpired || answer.Error.Code != tasking.ERR_KEY_UNKNOWN {
+		t.Fatalf("ticket of an expired key accepted: %+v", answer)
+	}
+	if _, err := authenticateOrg(signedNonceRequest(t, "GET", "/capabilities", "org1", time.Now())); err != errTicketKeyExpired {
+		t.Errorf("expired key authenticated: %v", err)
+	}
+
+	// removing the metadata lifts the expiry
+	removeKeyMeta(meta)
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Error != nil {
+		t.Errorf("ticket rejected after the metadata was removed: %s", answer.Error.Error)
+	}
+}
@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"crypto/rsa"
+	"log"
+	"time"
+)
+
+// Deleting the file of a source key would instantly fail all requests
+// still in flight, which were encrypted for it. Therefore, a removed key
+// can be retained for conf.KeyRemovalGrace seconds, during which it is
+// still used for decryption, but logged as deprecated.
+
+var retiredKeys = make(map[string]time.Time) // source key -> time it is purged, guarded by keysMutex
+
+// addSourceKey adds the source key name, replacing a retired one.
+func addSourceKey(name string, key *rsa.PrivateKey) {
+	keysMutex.Lock()
+	keys[name] = key
+	delete(retiredKeys, name)
+	keysMutex.Unlock()
+}
+
+// removeSourceKey removes the source key name after the grace period.
+func removeSourceKey(name string) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	removeSourceKeyLocked(name)
+}
+
+// removeSourceKeyLocked is removeSourceKey with keysMutex held.
+func removeSourceKeyLocked(name string) {
+	if _, exists := keys[name]; !exists {
+		return
+	}
+	if conf.KeyRemovalGrace <= 0 {
+		delete(keys, name)
+		return
+	}
+	purge := timeNow().Add(time.Duration(conf.KeyRemovalGrace) * time.Second)
+	retiredKeys[name] = purge
+	log.Printf("Source key %s removed, still used for decryption until %s", name, purge.Format(time.RFC3339))
+}
+
+// lookupSourceKey returns the source key name. Retired keys are purged
+// once their grace period is over.
+func lookupSourceKey(name string) (*rsa.PrivateKey, bool) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	key, exists := keys[name]
+	if !exists {
+		return nil, false
+	}
+	if purge, retired := retiredKeys[name]; retired {
+		if !timeNow().Before(purge) {
+			log.Printf("Grace period of source key %s is over, purging it", name)
+			delete(keys, name)
+			delete(retiredKeys, name)
+			return nil, false
+		}
+		log.Printf("Deprecated: ticket encrypted for the removed source key %s", name)
+	}
+	return key, true
+}
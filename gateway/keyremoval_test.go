@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"testing"
+	"time"
+)
+
+func TestKeyRemovalGrace(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:    map[string][]string{"org1": []string{"*"}},
+		KeyRemovalGrace: 60,
+		RabbitDefault:   RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	removeSourceKey("src1")
+
+	// in flight requests still succeed during the grace period
+	now = now.Add(59 * time.Second)
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer, _ := handleIncoming(nil, enc, "", false, false, nil); answer.Error != nil {
+		t.Fatalf("removed key rejected during its grace period: %s", answer.Error.Error)
+	}
+
+	// and fail afterwards
+	now = now.Add(time.Second)
+	enc, _ = encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	answer, symKey := handleIncoming(nil, enc, "", false, false, nil)
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_KEY_UNKNOWN || symKey != nil {
+		t.Fatalf("removed key still used after its grace period: %+v", answer)
+	}
+	if _, exists := keys["src1"]; exists {
+		t.Errorf("removed key not purged")
+	}
+}
+
+func TestKeyRemovalReAdded(t *testing.T) {
+	setupGateway(t, &config{KeyRemovalGrace: 60})
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	removeSourceKey("src1")
+	addSourceKey("src1", sourceKey(t))
+	now = now.Add(time.Hour)
+	if _, exists := lookupSourceKey("src1"); !exists {
+		t.Errorf("key added again was purged")
+	}
+}
+
+func TestKeyRemovalWithoutGrace(t *testing.T) {
+	setupGateway(t, &config{})
+
+	removeSourceKey("src1")
+	if _, exists := lookupSourceKey("src1"); exists {
+		t.Errorf("key not removed immediately")
+	}
+}
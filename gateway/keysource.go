@@ -0,0 +1,22 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+)
+
+// keySource provides the key directories of the configuration
+// (SourcesKeysPath, TicketKeysPath, ReceiptKeysPath, and those of the
+// tenants). By default, they are read from the filesystem of the OS and
+// watched for changes.
+var keySource = tasking.OSKeys
+
+// SetKeySource installs src as the source of the key directories, e.g.
+// tasking.KeysFromFS with an embed.FS for a single-binary deployment. The
+// configured paths are then interpreted within src. It must be called
+// before Start. Passing nil restores the filesystem of the OS.
+func SetKeySource(src tasking.KeySource) {
+	if src == nil {
+		src = tasking.OSKeys
+	}
+	keySource = src
+}
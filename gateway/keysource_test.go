@@ -0,0 +1,44 @@
+//go:build go1.16
+// +build go1.16
+
+package gateway
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestKeySourceFS(t *testing.T) {
+	setupGateway(t, &config{SourcesKeysPath: "keys/sources", TicketKeysPath: "keys/tickets"})
+	keys = make(map[string]*rsa.PrivateKey)
+	ticketKeys = make(map[string]*rsa.PublicKey)
+	der, _ := x509.MarshalPKIXPublicKey(&ticketKey(t).PublicKey)
+	SetKeySource(tasking.KeysFromFS(fstest.MapFS{
+		"keys/sources/src2.priv": {Data: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(sourceKey(t))})},
+		"keys/tickets/org2.pub":  {Data: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})},
+		"keys/tickets/org2.meta": {Data: []byte(`{"NotAfter": "2000-01-01T00:00:00Z"}`)},
+	}))
+	defer SetKeySource(nil)
+
+	readKeys()
+	sources, tickets := loadedKeyNames()
+	if !reflect.DeepEqual(sources, []string{"src2"}) || !reflect.DeepEqual(tickets, []string{"org2"}) {
+		t.Fatalf("keys not loaded from the FS: %v and %v", sources, tickets)
+	}
+	if !ticketKeyExpired("org2") {
+		t.Errorf("metadata of the ticket key not loaded from the FS")
+	}
+
+	keys = make(map[string]*rsa.PrivateKey)
+	if err := reloadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if sources, _ := loadedKeyNames(); !reflect.DeepEqual(sources, []string{"src2"}) {
+		t.Errorf("keys not reloaded from the FS: %v", sources)
+	}
+}
@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+)
+
+// LimitConf overrides the global limits of tickets for an
+// organization, e.g. to trust it more or less than others. A limit of 0
+// uses the global one, a negative limit lifts it. The size of the request
+// can only be limited globally, since the organization is only known
+// after decrypting the ticket.
+type LimitConf struct {
+	MaxTicketSize  int // Maximum size in bytes of a decrypted ticket
+	MaxTicketTasks int // Maximum number of tasks of a ticket
+}
+
+// ticketLimits returns the maximum size and number of tasks of tickets of
+// org. 0 means unlimited.
+func ticketLimits(org string) (int, int) {
+	size, tasks := conf.MaxTicketSize, conf.MaxTicketTasks
+	if limits, exists := conf.TicketLimits[org]; exists {
+		if limits.MaxTicketSize != 0 {
+			size = limits.MaxTicketSize
+		}
+		if limits.MaxTicketTasks != 0 {
+			tasks = limits.MaxTicketTasks
+		}
+	}
+	if size < 0 {
+		size = 0
+	}
+	if tasks < 0 {
+		tasks = 0
+	}
+	return size, tasks
+}
+
+// checkTicketLimits rejects the decrypted ticket ticketStr of org, if it
+// exceeds the limits of the organization.
+func checkTicketLimits(org string, ticketStr string, ticket *tasking.Ticket) *tasking.MyError {
+	size, tasks := ticketLimits(org)
+	if size > 0 && len(ticketStr) > size {
+		log.Printf("Ticket of '%s' has %d bytes, only %d allowed", org, len(ticketStr), size)
+		return &tasking.MyError{Error: errors.New("Ticket malformed (Too large)"), Code: tasking.ERR_TASK_INVALID}
+	}
+	if tasks > 0 && len(ticket.Tasks) > tasks {
+		log.Printf("Ticket of '%s' has %d tasks, only %d allowed", org, len(ticket.Tasks), tasks)
+		return &tasking.MyError{Error: errors.New("Ticket malformed (Too many tasks)"), Code: tasking.ERR_TASK_INVALID}
+	}
+	return nil
+}
+
+// ticketExchanges returns the number of distinct exchanges the services of
+// ticket allowed by allowedForOrg and not disabled are published to.
+// Tasks which can't be routed are rejected later on and not counted.
+func ticketExchanges(ticket *tasking.Ticket, allowedForOrg map[string]struct{}, disabled map[string]struct{}) int {
+	_, allAllowed := allowedForOrg["*"]
+	exchanges := make(map[string]struct{})
+	for _, task := range ticket.Tasks {
+		services := make(map[string][]string, len(task.Tasks))
+		for tsk, args := range canonicalTasks(task.Tasks) {
+			if _, isDisabled := disabled[tsk]; isDisabled {
+				continue
+			}
+			if _, tAllowed := allowedForOrg[tsk]; tAllowed || allAllowed {
+				services[tsk] = args
+			}
+		}
+		task.Tasks = services
+		routes, err := routeTask(task)
+		if err != nil {
+			continue
+		}
+		for _, r := range routes {
+			exchanges[r.Conf.Exchange] = struct{}{}
+		}
+	}
+	return len(exchanges)
+}
+
+// defaultMaxIdentifierLength is used, if conf.MaxIdentifierLength is not
+// set.
+const defaultMaxIdentifierLength = 256
+
+// validIdentifier reports whether the client-supplied key name id (a
+// KeyFingerprint or SignerKeyId) consists of printable ASCII characters
+// and is at most conf.MaxIdentifierLength long. Key names are logged and
+// echoed in errors, so they are checked before being used.
+func validIdentifier(id string) bool {
+	max := defaultMaxIdentifierLength
+	if conf.MaxIdentifierLength > 0 {
+		max = conf.MaxIdentifierLength
+	}
+	if len(id) > max {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x20 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// In maintenance mode, the gateway rejects new tickets with 503, while
+// tickets already accepted are still dispatched, and their status can be
+// queried. Maintenance is switched by the organizations listed in
+// conf.AdminOrganizations with "POST /admin/maintenance", or by changing
+// conf.Maintenance and reloading the configuration.
+
+var (
+	maintenanceMutex = &sync.Mutex{}
+	maintenance      bool
+	// the value of conf.Maintenance in the last loaded configuration
+	maintenanceConfigured bool
+)
+
+var errMaintenance = &tasking.MyError{Error: errors.New("Gateway is in maintenance, no new tickets are accepted"), Code: tasking.ERR_BUSY}
+
+// inMaintenance reports whether new tickets are rejected.
+func inMaintenance() bool {
+	maintenanceMutex.Lock()
+	defer maintenanceMutex.Unlock()
+	return maintenance
+}
+
+// setMaintenance switches the maintenance mode on or off on behalf of by.
+func setMaintenance(on bool, by string) {
+	maintenanceMutex.Lock()
+	defer maintenanceMutex.Unlock()
+	setMaintenanceLocked(on, by)
+}
+
+func setMaintenanceLocked(on bool, by string) {
+	if on == maintenance {
+		return
+	}
+	maintenance = on
+	if on {
+		log.Printf("Maintenance mode switched on by %s, rejecting new tickets", by)
+	} else {
+		log.Printf("Maintenance mode switched off by %s, accepting new tickets", by)
+	}
+}
+
+// configureMaintenance applies the option Maintenance of a loaded
+// configuration. It only switches the mode, if the option changed since
+// the last configuration, so reloading an unrelated change keeps the mode
+// set with /admin/maintenance.
+func configureMaintenance(on bool) {
+	maintenanceMutex.Lock()
+	defer maintenanceMutex.Unlock()
+	if on == maintenanceConfigured {
+		return
+	}
+	maintenanceConfigured = on
+	setMaintenanceLocked(on, "the configuration")
+}
+
+// isAdmin reports whether org of the tenant tn may use the administrative
+// endpoints. Only organizations of the default gateway can be
+// administrators.
+func isAdmin(tn *tenant, org string) bool {
+	if tn != nil {
+		return false
+	}
+	for _, admin := range conf.AdminOrganizations {
+		if admin == org {
+			return true
+		}
+	}
+	return false
+}
+
+// httpRequestMaintenance switches the maintenance mode as requested by
+// the form parameter "Enabled" ("true" or "false") in the body, which is
+// covered by the signature, for an administrative organization
+// authenticated by orgAuthMiddleware. It answers with the resulting mode.
+func httpRequestMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	org := orgFromContext(r)
+	if !isAdmin(tenantFor(r), org) {
+		log.Printf("Request to %s denied: %s is no administrator", r.URL.Path, org)
+		http.Error(w, "Not allowed", http.StatusForbidden)
+		return
+	}
+	on, err := strconv.ParseBool(r.PostFormValue("Enabled"))
+	if err != nil {
+		http.Error(w, "Invalid value of Enabled", http.StatusBadRequest)
+		return
+	}
+	setMaintenance(on, org)
+	x, _ := json.Marshal(struct{ Maintenance bool }{inMaintenance()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(x)
+}
+
+// httpRequestHealth answers 200 as long as the gateway is serving, also
+// in maintenance mode.
+func httpRequestHealth(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
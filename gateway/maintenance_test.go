@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"*"}, "org2": []string{"*"}},
+		AdminOrganizations: []string{"org1"},
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	switchMaintenance := func(org, enabled string) *httptest.ResponseRecorder {
+		r := signedBodyRequest(t, "POST", "/admin/maintenance", org, time.Now(), "Enabled="+enabled)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	submit := func() *httptest.ResponseRecorder {
+		enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+		r := taskRequest(enc)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := switchMaintenance("org2", "true"); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-administrator, got %d", w.Code)
+	}
+	w := switchMaintenance("org1", "true")
+	var state struct{ Maintenance bool }
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil || !state.Maintenance {
+		t.Fatalf("maintenance not switched on: %d %s", w.Code, w.Body.String())
+	}
+
+	w = submit()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 in maintenance, got %d", w.Code)
+	}
+	plainAnswer(t, w)
+	if len(ch.messages()) != 0 {
+		t.Error("task published in maintenance")
+	}
+	r, _ := http.NewRequest("GET", "/health", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected /health to stay up in maintenance, got %d", w.Code)
+	}
+
+	// reloading an unrelated change keeps the mode
+	f, err := ioutil.TempFile("", "gateway.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	ioutil.WriteFile(f.Name(), []byte(`{"AllowedTasks": {"org1": ["*"]}}`), 0600)
+	if err := reloadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if !inMaintenance() {
+		t.Error("maintenance switched off by an unrelated reload")
+	}
+
+	switchMaintenance("org1", "false")
+	if w := submit(); w.Code != http.StatusOK || len(ch.messages()) != 1 {
+		t.Errorf("ticket not accepted after maintenance: %d", w.Code)
+	}
+
+	// the mode can be switched by reloading, too
+	ioutil.WriteFile(f.Name(), []byte(`{"AllowedTasks": {"org1": ["*"]}, "Maintenance": true}`), 0600)
+	if err := reloadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if w := submit(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after reloading maintenance, got %d", w.Code)
+	}
+}
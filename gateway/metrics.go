@@ -0,0 +1,213 @@
+package gateway
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics receives the measurements of the gateway, so they can be passed
+// to the monitoring system in use. Metrics are identified by a group and
+// a key within the group. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Count adds delta to the counter key of group.
+	Count(group, key string, delta int64)
+	// Observe records the duration d in the histogram key of group.
+	Observe(group, key string, d time.Duration)
+}
+
+// metrics is the backend selected by conf.MetricsBackend.
+var metrics Metrics = expvarMetrics{}
+
+// The groups of the metrics.
+const (
+	metricGroupRSA     = "rsa_decrypt"
+	metricGroupRabbit  = "rabbit"
+	metricGroupHTTP    = "http"
+	metricGroupCrypto  = "crypto"
+	metricGroupTickets = "tickets"
+)
+
+// The keys used in metricGroupRSA.
+const (
+	metricRSATotal    = "total"       // Number of RSA decryptions
+	metricRSAFailed   = "failed"      // Number of failed RSA decryptions
+	metricRSANanos    = "nanoseconds" // Duration of the RSA decryptions
+	metricRSARejected = "rejected"    // Number of requests rejected because all workers were busy
+)
+
+// The keys used in metricGroupRabbit.
+const (
+	metricTopologyChecks     = "topology_checks"     // Number of periodic verifications of the topology
+	metricTopologyReasserted = "topology_reasserted" // Number of times a missing queue was declared again
+	metricTopologyFailed     = "topology_failed"     // Number of times the topology couldn't be restored
+	metricPublishFailed      = "publish_failed"      // Number of tasks which couldn't be published
+)
+
+// The keys used in metricGroupCrypto.
+const (
+	metricIVReused = "iv_reused" // Number of tickets reusing an IV with the same key
+)
+
+// The keys used in metricGroupTickets. Additionally, the tickets of every
+// organization are counted as "<key>_<organization>".
+const (
+	metricTicketsProcessed = "processed" // Number of tickets handled without an error
+	metricTicketsRejected  = "rejected"  // Number of tickets rejected as a whole
+)
+
+// The keys used in metricGroupHTTP. Additionally, the requests are
+// counted by their status code as "status_<code>".
+const (
+	metricHTTPRequests = "requests"    // Number of requests
+	metricHTTPNanos    = "nanoseconds" // Duration of the requests
+)
+
+// newMetrics returns the metrics backend named by backend.
+func newMetrics(backend string) (Metrics, error) {
+	switch backend {
+	case "", "expvar":
+		return expvarMetrics{}, nil
+	case "prometheus":
+		return newPrometheusMetrics(), nil
+	case "none":
+		return noMetrics{}, nil
+	}
+	return nil, errors.New("Unknown MetricsBackend '" + backend + "'")
+}
+
+// noMetrics discards all measurements.
+type noMetrics struct{}
+
+func (noMetrics) Count(group, key string, delta int64)       {}
+func (noMetrics) Observe(group, key string, d time.Duration) {}
+
+// Metrics are published via expvar by default and can be inspected at
+// /debug/vars. Each group is a map; durations are accumulated in
+// nanoseconds.
+var (
+	rsaMetrics    = expvar.NewMap(metricGroupRSA)
+	rabbitMetrics = expvar.NewMap(metricGroupRabbit)
+	httpMetrics   = expvar.NewMap(metricGroupHTTP)
+)
+
+type expvarMetrics struct{}
+
+var expvarMutex = &sync.Mutex{}
+
+// expvarGroup returns the map of group, which is created if needed.
+func expvarGroup(group string) *expvar.Map {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+	if m, ok := expvar.Get(group).(*expvar.Map); ok {
+		return m
+	}
+	return expvar.NewMap(group)
+}
+
+func (expvarMetrics) Count(group, key string, delta int64) {
+	expvarGroup(group).Add(key, delta)
+}
+
+func (expvarMetrics) Observe(group, key string, d time.Duration) {
+	expvarGroup(group).Add(key, int64(d))
+}
+
+// prometheusMetrics keeps the metrics in memory and serves them in the
+// Prometheus text format. Counters are named
+// "holmes_gateway_<group>_<key>_total" (the key "total" isn't repeated).
+// The histogram of the key "nanoseconds" is named
+// "holmes_gateway_<group>_seconds" and holds the durations in seconds.
+type prometheusMetrics struct {
+	sync.Mutex
+	counters   map[string]int64
+	histograms map[string]*histogram
+}
+
+// histogram counts observations in buckets with the given upper bounds.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// The upper bounds in seconds of the histogram buckets, like the default
+// buckets of the Prometheus client libraries.
+var histogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		counters:   make(map[string]int64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (p *prometheusMetrics) Count(group, key string, delta int64) {
+	name := "holmes_gateway_" + group + "_" + key
+	if key != "total" {
+		name += "_total"
+	}
+	p.Lock()
+	p.counters[name] += delta
+	p.Unlock()
+}
+
+func (p *prometheusMetrics) Observe(group, key string, d time.Duration) {
+	// the unit is part of the name, so "nanoseconds" is replaced
+	name := "holmes_gateway_" + group + "_seconds"
+	if key = strings.TrimSuffix(strings.TrimSuffix(key, "nanoseconds"), "_"); key != "" {
+		name = "holmes_gateway_" + group + "_" + key + "_seconds"
+	}
+	seconds := d.Seconds()
+	p.Lock()
+	defer p.Unlock()
+	h, exists := p.histograms[name]
+	if !exists {
+		h = &histogram{counts: make([]uint64, len(histogramBuckets))}
+		p.histograms[name] = h
+	}
+	for i, bound := range histogramBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (p *prometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	names := make([]string, 0, len(p.counters))
+	for name := range p.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", name, name, p.counters[name])
+	}
+	names = names[:0]
+	for name := range p.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := p.histograms[name]
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		var cumulative uint64
+		for i, bound := range histogramBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+	}
+}
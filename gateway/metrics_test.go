@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics records the calls of the gateway.
+type recordingMetrics struct {
+	sync.Mutex
+	counts   map[string]int64
+	observed map[string]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{counts: make(map[string]int64), observed: make(map[string]int)}
+}
+
+func (m *recordingMetrics) Count(group, key string, delta int64) {
+	m.Lock()
+	m.counts[group+"."+key] += delta
+	m.Unlock()
+}
+
+func (m *recordingMetrics) Observe(group, key string, d time.Duration) {
+	m.Lock()
+	m.observed[group+"."+key]++
+	m.Unlock()
+}
+
+func TestMetricsPerRequest(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	m := newRecordingMetrics()
+	metrics = m
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	mux.ServeHTTP(httptest.NewRecorder(), taskRequest(enc))
+
+	expectedCounts := map[string]int64{
+		"http.requests":          1,
+		"http.status_200":        1,
+		"rsa_decrypt.total":      1,
+		"tickets.processed":      1,
+		"tickets.processed_org1": 1,
+	}
+	for name, n := range expectedCounts {
+		if m.counts[name] != n {
+			t.Errorf("expected %s to be counted %d times, got %d", name, n, m.counts[name])
+		}
+	}
+	if len(m.counts) != len(expectedCounts) {
+		t.Errorf("unexpected counters: %v", m.counts)
+	}
+	for _, name := range []string{"http.nanoseconds", "rsa_decrypt.nanoseconds"} {
+		if m.observed[name] != 1 {
+			t.Errorf("expected one observation of %s, got %d", name, m.observed[name])
+		}
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	p := newPrometheusMetrics()
+	p.Count(metricGroupRSA, metricRSATotal, 2)
+	p.Observe(metricGroupRSA, metricRSANanos, 30*time.Millisecond)
+	p.Observe(metricGroupRSA, metricRSANanos, time.Minute)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, nil)
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE holmes_gateway_rsa_decrypt_total counter",
+		"holmes_gateway_rsa_decrypt_total 2",
+		"# TYPE holmes_gateway_rsa_decrypt_seconds histogram",
+		`holmes_gateway_rsa_decrypt_seconds_bucket{le="0.025"} 0`,
+		`holmes_gateway_rsa_decrypt_seconds_bucket{le="0.05"} 1`,
+		`holmes_gateway_rsa_decrypt_seconds_bucket{le="10"} 1`,
+		`holmes_gateway_rsa_decrypt_seconds_bucket{le="+Inf"} 2`,
+		"holmes_gateway_rsa_decrypt_seconds_count 2",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestNewMetrics(t *testing.T) {
+	for _, backend := range []string{"", "expvar", "prometheus", "none"} {
+		if _, err := newMetrics(backend); err != nil {
+			t.Errorf("%q: %s", backend, err)
+		}
+	}
+	if _, err := newMetrics("statsd"); err == nil {
+		t.Errorf("expected an unknown backend to be rejected")
+	}
+}
@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"context"
+	"log"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// A middleware wraps an http.Handler to add a single concern, like panic
+// recovery or metrics, to it.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h with the given middlewares. The first middleware is the
+// outermost one, i.e. it sees the request first.
+func chain(h http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// recoverMiddleware turns a panic in a handler into an internal server
+// error instead of tearing down the connection.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("Panic while handling %s: %v\n%s", r.URL.Path, err, debug.Stack())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metricsMiddleware counts the requests by status code and accumulates the
+// time spent handling them.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		metrics.Count(metricGroupHTTP, metricHTTPRequests, 1)
+		metrics.Count(metricGroupHTTP, "status_"+strconv.Itoa(rec.status), 1)
+		metrics.Observe(metricGroupHTTP, metricHTTPNanos, time.Since(start))
+	})
+}
+
+// limitMiddleware rejects requests with 503, if max requests are already
+// being handled. If max is not positive, requests are not limited.
+func limitMiddleware(max int) middleware {
+	if max <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	slots := make(chan struct{}, max)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next.ServeHTTP(w, r)
+			default:
+				http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// defaultContentTypes are accepted, if no Content-Types are configured.
+// These are the encodings understood by http.Request.FormValue.
+var defaultContentTypes = []string{
+	"application/x-www-form-urlencoded",
+	"multipart/form-data",
+}
+
+// contentTypeMiddleware rejects requests carrying a body of a media type
+// not listed in types with 415. Requests without a body, like the GET
+// requests of the master-gateway, don't need a Content-Type.
+func contentTypeMiddleware(types []string) middleware {
+	if len(types) == 0 {
+		types = defaultContentTypes
+	}
+	accepted := make(map[string]struct{}, len(types))
+	for _, t := range types {
+		accepted[t] = struct{}{}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ct := r.Header.Get("Content-Type")
+			if ct == "" && r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			mediaType, _, err := mime.ParseMediaType(ct)
+			if _, ok := accepted[mediaType]; err != nil || !ok {
+				log.Printf("Request to %s with Content-Type %q rejected", r.URL.Path, ct)
+				http.Error(w, "Unsupported Content-Type", http.StatusUnsupportedMediaType)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type contextKey int
+
+const (
+	orgContextKey contextKey = iota
+	rejectionContextKey
+	tenantContextKey
+	tenantPrefixContextKey
+)
+
+// orgAuthMiddleware only lets requests pass, which are authenticated by an
+// organization (see authenticateOrg). The name of the organization is
+// stored in the request's context.
+func orgAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		org, err := authenticateOrg(r)
+		if err != nil {
+			log.Printf("Request to %s denied: %s", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), orgContextKey, org)))
+	})
+}
+
+// orgFromContext returns the organization authenticated by
+// orgAuthMiddleware.
+func orgFromContext(r *http.Request) string {
+	org, _ := r.Context().Value(orgContextKey).(string)
+	return org
+}
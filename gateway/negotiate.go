@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"net/http"
+	"strings"
+)
+
+// The encryptions, compressions and formats of answers supported by the
+// gateway, the most preferred first.
+var (
+	answerEncryptions  = []string{tasking.ENCRYPTION_AES_CBC}
+	answerCompressions = []string{tasking.COMPRESSION_GZIP, tasking.COMPRESSION_IDENTITY}
+	answerFormats      = []string{tasking.FORMAT_BINARY, tasking.FORMAT_JSON}
+)
+
+// answerEncoding describes how an answer is encoded, encrypted and
+// compressed.
+type answerEncoding struct {
+	Encryption  string
+	Compression string
+	Format      string
+}
+
+// acceptedOptions returns the set of options listed in the header name of
+// r, or nil if the header is missing. Parameters like "q=0.5" are ignored.
+func acceptedOptions(r *http.Request, name string) map[string]bool {
+	values := r.Header[http.CanonicalHeaderKey(name)]
+	if len(values) == 0 {
+		return nil
+	}
+	accepted := make(map[string]bool)
+	for _, value := range values {
+		for _, option := range strings.Split(value, ",") {
+			option = strings.SplitN(option, ";", 2)[0]
+			accepted[strings.ToLower(strings.TrimSpace(option))] = true
+		}
+	}
+	return accepted
+}
+
+// negotiate returns the first of supported, which is accepted. If the
+// client didn't send a list, fallback is used.
+func negotiate(accepted map[string]bool, supported []string, fallback string) string {
+	if accepted == nil {
+		return fallback
+	}
+	for _, option := range supported {
+		if accepted[option] {
+			return option
+		}
+	}
+	return ""
+}
+
+// negotiateEncoding picks the encoding of the answer to r. It fails, if
+// the client doesn't accept any supported encryption. Answers can always
+// be sent uncompressed and as JSON.
+func negotiateEncoding(r *http.Request) (answerEncoding, *tasking.MyError) {
+	encoding := answerEncoding{
+		Encryption:  negotiate(acceptedOptions(r, tasking.AcceptEncryptionHeader), answerEncryptions, tasking.ENCRYPTION_AES_CBC),
+		Compression: negotiate(acceptedOptions(r, tasking.AcceptCompressionHeader), answerCompressions, tasking.COMPRESSION_IDENTITY),
+		Format:      negotiate(acceptedOptions(r, tasking.AcceptFormatHeader), answerFormats, tasking.FORMAT_JSON),
+	}
+	if encoding.Encryption == "" {
+		return encoding, &tasking.MyError{Error: errors.New("No supported encryption accepted (supported: " + strings.Join(answerEncryptions, ", ") + ")"), Code: tasking.ERR_ENCRYPTION}
+	}
+	if encoding.Compression == "" {
+		encoding.Compression = tasking.COMPRESSION_IDENTITY
+	}
+	if encoding.Format == "" {
+		encoding.Format = tasking.FORMAT_JSON
+	}
+	return encoding, nil
+}
+
+// marshal encodes answer in the negotiated format, and returns the
+// format used. Only a GatewayAnswer has a binary encoding.
+func (encoding answerEncoding) marshal(answer interface{}) ([]byte, string) {
+	if ga, ok := answer.(*tasking.GatewayAnswer); ok && encoding.Format == tasking.FORMAT_BINARY {
+		if x, err := tasking.EncodeAnswerBinary(ga); err == nil {
+			return x, tasking.FORMAT_BINARY
+		}
+	}
+	x, _ := json.Marshal(answer)
+	return x, tasking.FORMAT_JSON
+}
+
+// compress compresses data as given by the encoding.
+func (encoding answerEncoding) compress(data []byte) []byte {
+	if encoding.Compression != tasking.COMPRESSION_GZIP {
+		return data
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		encryption  []string // nil: header not sent
+		compression []string
+		expected    answerEncoding
+		fails       bool
+	}{
+		{nil, nil, answerEncoding{"aes-cbc", "identity", "json"}, false},
+		{[]string{"aes-cbc"}, []string{"gzip"}, answerEncoding{"aes-cbc", "gzip", "json"}, false},
+		{nil, []string{"identity, gzip;q=0.5"}, answerEncoding{"aes-cbc", "gzip", "json"}, false},
+		{nil, []string{"br", "GZIP"}, answerEncoding{"aes-cbc", "gzip", "json"}, false},
+		{[]string{"aes-gcm, AES-CBC"}, []string{"br"}, answerEncoding{"aes-cbc", "identity", "json"}, false},
+		{[]string{"aes-gcm"}, nil, answerEncoding{}, true},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "/task/", nil)
+		for _, v := range test.encryption {
+			r.Header.Add(tasking.AcceptEncryptionHeader, v)
+		}
+		for _, v := range test.compression {
+			r.Header.Add(tasking.AcceptCompressionHeader, v)
+		}
+		encoding, err := negotiateEncoding(r)
+		if test.fails {
+			if err == nil || err.Code != tasking.ERR_ENCRYPTION {
+				t.Errorf("%v/%v: expected negotiation to fail, got %+v", test.encryption, test.compression, encoding)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v/%v: %s", test.encryption, test.compression, err.Error)
+		} else if encoding != test.expected {
+			t.Errorf("%v/%v: expected %+v, got %+v", test.encryption, test.compression, test.expected, encoding)
+		}
+	}
+}
+
+func TestCompressedAnswer(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	r := taskRequest(enc)
+	r.Header.Set(tasking.AcceptCompressionHeader, "gzip")
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, r)
+
+	if h := w.Header().Get(tasking.EncryptionHeader); h != tasking.ENCRYPTION_AES_CBC {
+		t.Errorf("expected encryption %s, got %q", tasking.ENCRYPTION_AES_CBC, h)
+	}
+	if h := w.Header().Get(tasking.CompressionHeader); h != tasking.COMPRESSION_GZIP {
+		t.Fatalf("expected compression %s, got %q", tasking.COMPRESSION_GZIP, h)
+	}
+	iv := append([]byte(nil), enc.IV...)
+	iv[0] ^= 1
+	compressed, err := tasking.AesDecrypt(w.Body.Bytes(), symKey, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer tasking.GatewayAnswer
+	if err := json.Unmarshal(plain, &answer); err != nil {
+		t.Fatalf("%s: %s", err, plain)
+	}
+	if answer.Error != nil || len(answer.Accepted) != 1 {
+		t.Errorf("unexpected answer: %s", plain)
+	}
+}
+
+func TestUnsupportedEncryptionNotAccepted(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	r := taskRequest(enc)
+	r.Header.Set(tasking.AcceptEncryptionHeader, "aes-gcm")
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, r)
+
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("expected 406, got %d", w.Code)
+	}
+	plainAnswer(t, w)
+	if len(ch.messages()) != 0 {
+		t.Errorf("task was dispatched although its answer can't be encrypted")
+	}
+}
+
+func TestBinaryAnswer(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ticket := signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA"))
+
+	answers := make(map[string]tasking.GatewayAnswer)
+	for _, format := range []string{tasking.FORMAT_JSON, tasking.FORMAT_BINARY} {
+		enc, symKey := encryptTicket(t, ticket)
+		r := taskRequest(enc)
+		r.Header.Set(tasking.AcceptFormatHeader, format)
+		w := httptest.NewRecorder()
+		httpRequestIncoming(w, r)
+		if h := w.Header().Get(tasking.FormatHeader); h != format {
+			t.Fatalf("expected format %s, got %q", format, h)
+		}
+		if format == tasking.FORMAT_JSON {
+			answers[format] = decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+			continue
+		}
+		iv := append([]byte(nil), enc.IV...)
+		iv[0] ^= 1
+		plain, err := tasking.AesDecrypt(w.Body.Bytes(), symKey, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, err := tasking.DecodeAnswerBinary(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers[format] = *answer
+	}
+
+	// the answers only differ in their trace ID and time
+	for format, answer := range answers {
+		if len(answer.Accepted) != 1 || len(answer.TskErrors) != 1 {
+			t.Errorf("unexpected %s answer: %+v", format, answer)
+		}
+		answer.TraceID, answer.ServerTime = "", time.Time{}
+		answers[format] = answer
+	}
+	x, _ := json.Marshal(answers[tasking.FORMAT_JSON])
+	b, _ := json.Marshal(answers[tasking.FORMAT_BINARY])
+	if string(x) != string(b) {
+		t.Errorf("binary answer differs from JSON:\n%s\n%s", b, x)
+	}
+
+	// clients not listing a supported format get JSON
+	enc, _ := encryptTicket(t, ticket)
+	r := taskRequest(enc)
+	r.Header.Set(tasking.AcceptFormatHeader, "msgpack")
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, r)
+	if h := w.Header().Get(tasking.FormatHeader); h != tasking.FORMAT_JSON {
+		t.Errorf("expected format %s, got %q", tasking.FORMAT_JSON, h)
+	}
+}
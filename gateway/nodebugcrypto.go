@@ -0,0 +1,8 @@
+//go:build !debugcrypto
+// +build !debugcrypto
+
+package gateway
+
+// Production builds ignore the DebugCrypto option, so key material can't
+// end up in their logs.
+var debugCryptoAllowed = false
@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuarantineUnknownTasks(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:     map[string][]string{"org1": []string{"*"}, "org2": []string{"YARA"}},
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit:           map[string]RabbitConf{"CUCKOO": RabbitConf{Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"}},
+		QuarantineRabbit: &RabbitConf{Queue: "review", Exchange: "review", RoutingKey: "review"},
+	})
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA", "CUCKOO", "WEIRD")))
+	if answer.Error != nil || len(answer.Accepted) != 3 {
+		t.Fatalf("unexpected answer: %+v", answer)
+	}
+	exchanges := make(map[string]string)
+	for _, msg := range ch.messages() {
+		for task := range msg.Task.Tasks {
+			exchanges[task] = msg.Exchange
+		}
+	}
+	expected := map[string]string{"YARA": "totem", "CUCKOO": "totem_dynamic", "WEIRD": "review"}
+	for task, exchange := range expected {
+		if exchanges[task] != exchange {
+			t.Errorf("%s published to %q, expected %q", task, exchanges[task], exchange)
+		}
+	}
+
+	// without a quarantine, unknown services take the default lane
+	conf.QuarantineRabbit = nil
+	published := len(ch.messages())
+	handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("WEIRD")))
+	msgs := ch.messages()
+	if len(msgs) != published+1 || msgs[published].Exchange != "totem" {
+		t.Errorf("expected the unknown service to be sent to the default exchange, got %+v", msgs[published:])
+	}
+}
@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// QuotaConf limits the number of tasks an organization may dispatch within
+// a sliding time window.
+type QuotaConf struct {
+	Tasks  int // Maximum number of dispatched services
+	Window int // Length of the window in seconds
+}
+
+// A quotaReservation records services counted against a quota at a time.
+type quotaReservation struct {
+	at time.Time
+	n  int
+}
+
+var quotaUsage = make(map[string][]*quotaReservation)
+var quotaMutex = &sync.Mutex{}
+
+// timeNow is replaced by tests to control the time.
+var timeNow = time.Now
+
+// reserveQuota counts n services against the quota of org. If this would
+// exceed the quota, nothing is counted and an error stating the quota and
+// the time it resets is returned. The reservation is nil, if the
+// organization has no quota.
+func reserveQuota(org string, n int) (*quotaReservation, *tasking.MyError) {
+	quota, exists := conf.TaskQuotas[org]
+	if !exists || quota.Tasks <= 0 {
+		return nil, nil
+	}
+	window := time.Duration(quota.Window) * time.Second
+	now := timeNow()
+
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+
+	// forget the reservations which left the window
+	reservations := quotaUsage[org]
+	used := 0
+	first := len(reservations)
+	for i, r := range reservations {
+		if now.Sub(r.at) < window {
+			if i < first {
+				first = i
+			}
+			used += r.n
+		}
+	}
+	reservations = reservations[first:]
+	quotaUsage[org] = reservations
+
+	if used+n > quota.Tasks {
+		// the quota frees up as soon as enough old reservations expire
+		resets := now
+		freed := 0
+		for _, r := range reservations {
+			freed += r.n
+			resets = r.at.Add(window)
+			if used-freed+n <= quota.Tasks {
+				break
+			}
+		}
+		return nil, &tasking.MyError{
+			Error: errors.New("Quota of " + strconv.Itoa(quota.Tasks) + " tasks per " +
+				window.String() + " exceeded, resets at " + resets.UTC().Format(time.RFC3339)),
+			Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+
+	r := &quotaReservation{at: now, n: n}
+	quotaUsage[org] = append(reservations, r)
+	return r, nil
+}
+
+// releaseQuota returns the services of the reservation r, which were not
+// dispatched, so only the dispatched ones count against the quota.
+func releaseQuota(r *quotaReservation, dispatched int) {
+	if r == nil {
+		return
+	}
+	quotaMutex.Lock()
+	if dispatched < r.n {
+		r.n = dispatched
+	}
+	quotaMutex.Unlock()
+}
@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskQuota(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO", "YARA"}, "org2": []string{"*"}},
+		TaskQuotas:    map[string]QuotaConf{"org1": {Tasks: 3, Window: 3600}, "org2": {Tasks: 100, Window: 3600}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+	start := time.Now()
+	now := start
+	timeNow = func() time.Time { return now }
+	submit := func(org string, services ...string) *tasking.GatewayAnswer {
+		return handleDecrypted(signTicket(t, org, start.Add(3*time.Hour), newTask(services...)))
+	}
+
+	// rejected services don't count against the quota
+	if a := submit("org1", "PEINFO", "CUCKOO"); a.Error != nil || len(a.Accepted) != 1 {
+		t.Fatalf("first ticket rejected: %+v", a)
+	}
+	now = start.Add(time.Minute)
+	if a := submit("org1", "PEINFO", "YARA"); a.Error != nil || len(a.Accepted) != 2 {
+		t.Fatalf("second ticket rejected: %+v", a)
+	}
+
+	// the quota is exhausted; it resets when the first ticket leaves the window
+	a := submit("org1", "PEINFO")
+	if a.Error == nil {
+		t.Fatal("ticket exceeding the quota accepted")
+	}
+	msg := a.Error.Error.Error()
+	if !strings.Contains(msg, "Quota of 3 tasks per 1h0m0s") ||
+		!strings.Contains(msg, start.Add(time.Hour).UTC().Format(time.RFC3339)) {
+		t.Errorf("error should state the quota and reset time: %s", msg)
+	}
+
+	// other organizations are unaffected
+	if a := submit("org2", "PEINFO", "YARA", "CUCKOO"); a.Error != nil || len(a.Accepted) != 3 {
+		t.Errorf("quota of org1 affected org2: %+v", a)
+	}
+
+	// the first ticket leaves the window, the second one is still in it
+	now = start.Add(time.Hour)
+	if a := submit("org1", "PEINFO"); a.Error != nil {
+		t.Errorf("quota not freed after the window: %s", a.Error.Error)
+	}
+	if a := submit("org1", "PEINFO"); a.Error == nil {
+		t.Errorf("second ticket should still count against the quota")
+	}
+}
+
+func TestTaskRateLimits(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:   map[string][]string{"org1": []string{"*"}},
+		TaskRateLimits: map[string]RateConf{"CUCKOO": {Rate: 0.1, Burst: 2}},
+		RabbitDefault:  RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	submit := func() *tasking.GatewayAnswer {
+		return handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("CUCKOO", "PEINFO")))
+	}
+
+	// the burst is dispatched, then CUCKOO is limited, but PEINFO is not
+	for i := 0; i < 2; i++ {
+		if answer := submit(); len(answer.TskErrors) != 0 || len(answer.Accepted) != 2 {
+			t.Fatalf("ticket %d within the burst rejected: %+v", i, answer)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		answer := submit()
+		if len(answer.Accepted) != 1 || answer.Accepted[0].Task != "PEINFO" {
+			t.Fatalf("PEINFO affected by the rate limit of CUCKOO: %+v", answer)
+		}
+		if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_TASK_RATE_LIMITED {
+			t.Fatalf("expected CUCKOO to be rate limited: %+v", answer)
+		}
+		if _, cuckoo := answer.TskErrors[0].TaskStruct.Tasks["CUCKOO"]; !cuckoo || answer.TskErrors[0].Error.Code != tasking.ERR_OTHER_RECOVERABLE {
+			t.Errorf("unexpected rejection: %+v", answer.TskErrors[0])
+		}
+	}
+	cuckoo := 0
+	for _, m := range ch.messages() {
+		if _, exists := m.Task.Tasks["CUCKOO"]; exists {
+			cuckoo++
+		}
+	}
+	if cuckoo != 2 {
+		t.Errorf("expected CUCKOO to be dispatched twice, got %d", cuckoo)
+	}
+
+	// a token is added every 10 seconds
+	now = now.Add(10 * time.Second)
+	if answer := submit(); len(answer.TskErrors) != 0 {
+		t.Errorf("CUCKOO still limited after a token was added: %+v", answer)
+	}
+	if answer := submit(); len(answer.TskErrors) != 1 {
+		t.Errorf("more than one token added: %+v", answer)
+	}
+
+	// dry runs don't take tokens
+	now = now.Add(10 * time.Second)
+	if answer := handleTicket(nil, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("CUCKOO")), true, false, nil); len(answer.TskErrors) != 0 {
+		t.Fatalf("dry run rejected: %+v", answer)
+	}
+	if answer := submit(); len(answer.TskErrors) != 0 {
+		t.Errorf("token taken by a dry run: %+v", answer)
+	}
+}
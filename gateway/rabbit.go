@@ -0,0 +1,705 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"github.com/streadway/amqp"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// amqpChannel is the subset of *amqp.Channel used by the gateway.
+// Having it as an interface allows tests to replace the broker.
+type amqpChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Close() error
+}
+
+// rabbitSession bundles a channel with the connection it was opened on,
+// so closing the session closes both of them.
+type rabbitSession struct {
+	*amqp.Channel
+	conn *amqp.Connection
+}
+
+func (s *rabbitSession) Close() error {
+	s.Channel.Close()
+	return s.conn.Close()
+}
+
+// The gateway uses two independent connections to RabbitMQ: one is
+// exclusively used for publishing tasks, the other one for management
+// operations (declaring the topology, consuming replies, results, and
+// control commands). This way slow management calls never block the
+// publishing path and each connection can fail and reconnect without
+// affecting the other one.
+var (
+	rabbitChannel     amqpChannel // The channel used for publishing tasks
+	rabbitGeneration  uint64      // Incremented whenever rabbitChannel is replaced
+	rabbitMutex       = &sync.RWMutex{}
+	reconnectMutex    = &sync.Mutex{}
+	rabbitMgmtChannel amqpChannel // The channel used for management operations
+	rabbitMgmtMutex   = &sync.Mutex{}
+	mgmtRestoreMutex  = &sync.Mutex{}
+)
+
+// With conf.MandatoryPublish, the publishing channel is in confirm mode,
+// and tasks are published with the mandatory flag. The broker then
+// returns a task routed to no queue, instead of silently dropping it, and
+// confirms every task afterwards. The return and the confirmation can only
+// be told apart from the ones of other tasks by their order, so these
+// publishes are serialized by holding mandatorySlot, which can be given up
+// waiting for at a deadline, unlike a mutex. Once the wait for a
+// confirmation was given up, the order is lost, so rabbitConfirmsLost is
+// set and the channel replaced before the next publish. The channels and
+// the flag belong to rabbitChannel and are replaced along with it.
+var (
+	rabbitReturns      chan amqp.Return
+	rabbitConfirms     chan amqp.Confirmation
+	rabbitConfirmsLost bool
+	mandatorySlot      = make(chan struct{}, 1)
+)
+
+var errPublishTimeout = errors.New("Timeout while pushing to transport")
+
+var (
+	errUnroutable    = errors.New("Task not routed to any queue")
+	errPublishNacked = errors.New("Task not accepted by the broker")
+)
+
+// The time to wait between two attempts of restoring a connection.
+var rabbitReconnectDelay = 3 * time.Second
+
+// buildRabbitTLSConfig creates the TLS configuration for connecting to
+// RabbitMQ from the configured certificate paths.
+func buildRabbitTLSConfig(c *RabbitTLSConf) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+	if c.CACertPath != "" {
+		ca, err := ioutil.ReadFile(c.CACertPath)
+		if err != nil {
+			return nil, errors.New("Failed to read CA certificate: " + err.Error())
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("Failed to parse CA certificate " + c.CACertPath)
+		}
+	}
+	if c.CertPath != "" || c.KeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
+		if err != nil {
+			return nil, errors.New("Failed to load client certificate: " + err.Error())
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// dialRabbitConnection connects to RabbitMQ, using TLS if configured. If
+// the TLS-connection fails, plaintext is only tried if this is explicitly
+// allowed in the configuration.
+func dialRabbitConnection() (*amqp.Connection, error) {
+	credentials := conf.RabbitUser + ":" + currentRabbitPassword() + "@" + conf.RabbitURI
+	if conf.RabbitTLS == nil {
+		return amqp.Dial("amqp://" + credentials)
+	}
+
+	cfg, err := buildRabbitTLSConfig(conf.RabbitTLS)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := amqp.DialTLS("amqps://"+credentials, cfg)
+	if err != nil && conf.RabbitTLS.AllowPlaintextFallback {
+		log.Println("TLS-connection to RabbitMQ failed, falling back to plaintext: ", err)
+		return amqp.Dial("amqp://" + credentials)
+	}
+	return conn, err
+}
+
+// dialRabbit opens a new connection to RabbitMQ and returns a channel on it.
+var dialRabbit = func() (amqpChannel, error) {
+	conn, err := dialRabbitConnection()
+	if err != nil {
+		return nil, errors.New("Failed to connect to RabbitMQ: " + err.Error())
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("Failed to open a channel: " + err.Error())
+	}
+	return &rabbitSession{Channel: channel, conn: conn}, nil
+}
+
+func pushToAMQP(task *tasking.Task, rconf *RabbitConf) *tasking.MyError {
+	return pushForResult(task, rconf, "", "", time.Time{})
+}
+
+// pushForResult publishes task to rconf like pushToAMQP, tagged with the
+// correlationID of its ticket. If results are enabled, the service is
+// asked to send its result for the ticket with resultID to the result
+// queue. With conf.ExpirationTTL, the task expires along with its ticket
+// at expiration.
+func pushForResult(task *tasking.Task, rconf *RabbitConf, resultID, correlationID string, expiration time.Time) *tasking.MyError {
+	msgBody, err := json.Marshal(task)
+	if err != nil {
+		log.Println("Error while Marshalling: ", err)
+		return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+	if rconf.Webhook != "" {
+		log.Printf("Posting to %s: \x1b[0;32m%s\x1b[0m\n", rconf.Webhook, msgBody)
+		if myerr := postWebhook(rconf, msgBody, correlationID); myerr != nil {
+			countPublishFailure()
+			return myerr
+		}
+		return nil
+	}
+	pub := amqp.Publishing{DeliveryMode: amqp.Persistent, ContentType: "text/plain", Body: msgBody}
+	if resultID != "" && conf.ResultQueue != "" {
+		pub.CorrelationId = resultID
+		pub.ReplyTo = conf.ResultQueue
+	}
+	tagCorrelation(&pub, correlationID)
+	if conf.ExpirationTTL {
+		pub.Expiration = messageTTL(expiration)
+	}
+	log.Printf("Pushing to %s: \x1b[0;32m%s\x1b[0m\n", rconf.Exchange, msgBody)
+	if myerr := publishReliably(rconf, pub); myerr != nil {
+		countPublishFailure()
+		return myerr
+	}
+	if pub.ReplyTo != "" {
+		expectResult(resultID)
+	}
+	return nil
+}
+
+// messageTTL returns the AMQP expiration of a task of a ticket expiring at
+// expiration, i.e. the milliseconds remaining until then, so the broker
+// drops the task instead of delivering it after the ticket expired. It is
+// empty, if expiration is the zero time.
+func messageTTL(expiration time.Time) string {
+	if expiration.IsZero() {
+		return ""
+	}
+	remaining := expiration.Sub(timeNow()) / time.Millisecond
+	if remaining < 0 {
+		remaining = 0
+	}
+	return strconv.FormatInt(int64(remaining), 10)
+}
+
+// tagCorrelation sets correlationID as the correlation ID of pub. If the
+// gateway already uses the correlation ID to receive the result of pub, it
+// is sent in the header "CorrelationId" instead.
+func tagCorrelation(pub *amqp.Publishing, correlationID string) {
+	if correlationID == "" || correlationID == pub.CorrelationId {
+		return
+	}
+	if pub.CorrelationId == "" {
+		pub.CorrelationId = correlationID
+		return
+	}
+	pub.Headers = amqp.Table{"CorrelationId": correlationID}
+}
+
+// publishReliably publishes pub to rconf. If this fails, the connection is
+// restored and the publish retried. If RabbitMQ stays unreachable, the
+// message is spooled, if a spool is configured.
+func publishReliably(rconf *RabbitConf, pub amqp.Publishing) *tasking.MyError {
+	generation, err := publishWithTimeout(rconf, pub)
+	if err == errPublishTimeout {
+		log.Println("Timeout while pushing to ", rconf.Exchange)
+		return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+
+	if err == errUnroutable || err == errPublishNacked {
+		// the connection is fine, so neither reconnecting nor spooling helps
+		log.Printf("Error while pushing to %s with routing key %s: %s", rconf.Exchange, rconf.RoutingKey, err)
+		return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+
+	if err != nil {
+		log.Println("Error while pushing to transport: ", err)
+		// try to recover three times
+		try := 0
+		for try < 3 {
+			try++
+			log.Println("Trying to restore the connection... #", try)
+			err = reconnectRabbit(generation)
+			if err == nil {
+				break
+			}
+			time.Sleep(rabbitReconnectDelay)
+		}
+		if err != nil {
+			// could not recover the connection after third try => give up
+			markRabbitDown()
+			return spoolOrFail(rconf, pub, err)
+		}
+		log.Println("Connection restored")
+
+		// retry pushing
+		_, err = publishWithTimeout(rconf, pub)
+		if err == errUnroutable || err == errPublishNacked {
+			return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+		}
+		if err != nil {
+			return spoolOrFail(rconf, pub, err)
+		}
+	}
+	return nil
+}
+
+// spoolOrFail buffers a message that could not be published in the spool,
+// if it is enabled. Otherwise, or if the spool fails, err is returned.
+func spoolOrFail(rconf *RabbitConf, pub amqp.Publishing, err error) *tasking.MyError {
+	if conf.SpoolDir == "" {
+		return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+	if spoolErr := spool(rconf, pub); spoolErr != nil {
+		log.Println("Couldn't spool task: ", spoolErr)
+		return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+	log.Println("Broker unreachable, spooled task for ", rconf.Exchange)
+	return nil
+}
+
+func addRabbitConf(channel amqpChannel, r RabbitConf) error {
+	if r.Webhook != "" {
+		return nil
+	}
+	if conf.RabbitPassive {
+		return assertRabbitConf(channel, r)
+	}
+	queue, err := channel.QueueDeclare(
+		r.Queue, //name
+		true,    // durable
+		false,   // delete when unused
+		false,   // exclusive
+		false,   // no-wait
+		nil,     // arguments
+	)
+	if err != nil {
+		return errors.New("Failed to declare a queue: " + err.Error())
+	}
+
+	err = channel.ExchangeDeclare(
+		r.Exchange, // name
+		"topic",    // type
+		true,       // durable
+		false,      // auto-deleted
+		false,      // internal
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		return errors.New("Failed to declare an exchange: " + err.Error())
+	}
+
+	err = channel.QueueBind(
+		queue.Name,   // queue name
+		r.RoutingKey, // routing key
+		r.Exchange,   // exchange
+		false,        // nowait
+		nil,          // arguments
+	)
+	if err != nil {
+		return errors.New("Failed to bind queue: " + err.Error())
+	}
+	return nil
+}
+
+// declareExchange declares the topic exchange name, which has no queue of
+// the gateway bound to it. In passive mode, it is only checked that the
+// exchange exists.
+func declareExchange(channel amqpChannel, name string) error {
+	if conf.RabbitPassive {
+		if err := channel.ExchangeDeclarePassive(name, "topic", true, false, false, false, nil); err != nil {
+			return errors.New("Exchange " + name + " does not exist: " + err.Error())
+		}
+		return nil
+	}
+	if err := channel.ExchangeDeclare(name, "topic", true, false, false, false, nil); err != nil {
+		return errors.New("Failed to declare an exchange: " + err.Error())
+	}
+	return nil
+}
+
+// validRoutingWord reports whether s can be used as a single word of a
+// topic routing key. Dots would split it and wildcards are reserved for
+// bindings.
+func validRoutingWord(s string) bool {
+	return s != "" && stringPrintable(s) && !strings.ContainsAny(s, ".*# \t\r\n")
+}
+
+// sourceRoutingKey applies conf.SourceRoutingKey to key: the source is
+// appended as a new word, or substituted for "{source}".
+func sourceRoutingKey(key string, source string) (string, error) {
+	switch conf.SourceRoutingKey {
+	case "":
+		return key, nil
+	case "append":
+		return key + "." + source, nil
+	case "substitute":
+		return strings.Replace(key, "{source}", source, -1), nil
+	}
+	return "", errors.New("Unknown SourceRoutingKey '" + conf.SourceRoutingKey + "'")
+}
+
+// defaultDestination returns the destination of tasks of the given source
+// sent to the default exchange.
+func defaultDestination(source string) (RabbitConf, error) {
+	rconf := conf.RabbitDefault
+	if source == "" {
+		source = conf.SourceFallback
+		if source == "" {
+			source = "unknown"
+		}
+	}
+	if conf.SourceRoutingKey != "" && !validRoutingWord(source) {
+		return rconf, errors.New("Invalid Task (Source not usable in a routing key)")
+	}
+	key, err := sourceRoutingKey(rconf.RoutingKey, source)
+	if err != nil {
+		return rconf, err
+	}
+	if len(key) > 255 {
+		return rconf, errors.New("Invalid Task (Routing key too long)")
+	}
+	rconf.RoutingKey = key
+	return rconf, nil
+}
+
+// defaultBinding returns the default destination with a routing key that
+// matches the tasks of all sources, so they still reach the default queue.
+func defaultBinding() RabbitConf {
+	rconf := conf.RabbitDefault
+	if key, err := sourceRoutingKey(rconf.RoutingKey, "*"); err == nil {
+		rconf.RoutingKey = key
+	}
+	return rconf
+}
+
+// assertRabbitConf checks that the queue and exchange of r exist, without
+// creating them. It is used if the topology is managed externally.
+func assertRabbitConf(channel amqpChannel, r RabbitConf) error {
+	if r.Webhook != "" {
+		return nil
+	}
+	if r.Queue != "" {
+		_, err := channel.QueueDeclarePassive(
+			r.Queue, //name
+			true,    // durable
+			false,   // delete when unused
+			false,   // exclusive
+			false,   // no-wait
+			nil,     // arguments
+		)
+		if err != nil {
+			return errors.New("Queue " + r.Queue + " does not exist: " + err.Error())
+		}
+	}
+
+	err := channel.ExchangeDeclarePassive(
+		r.Exchange, // name
+		"topic",    // type
+		true,       // durable
+		false,      // auto-deleted
+		false,      // internal
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		return errors.New("Exchange " + r.Exchange + " does not exist: " + err.Error())
+	}
+	return nil
+}
+
+// publish publishes pub on the current publishing channel and returns the
+// generation of the channel that was used. The channel is taken under the
+// read lock, but published on without holding it, so a publish hanging on
+// an unresponsive broker never blocks the replacement of the channel. If
+// the channel is replaced and closed meanwhile, the publish fails and is
+// retried on the new one. If ctx is done before the publish returns,
+// errPublishTimeout is returned; a started publish cannot be aborted and
+// is left to return on its own.
+func publish(ctx context.Context, exchange, key string, pub amqp.Publishing) (uint64, error) {
+	send := func() (uint64, error) {
+		rabbitMutex.RLock()
+		channel := rabbitChannel
+		generation := rabbitGeneration
+		returns, confirms := rabbitReturns, rabbitConfirms
+		rabbitMutex.RUnlock()
+		if ctx.Err() != nil {
+			return generation, errPublishTimeout
+		}
+		if confirms == nil {
+			return generation, channel.Publish(exchange, key, false, false, pub)
+		}
+		return generation, publishMandatory(ctx, generation, channel, returns, confirms, exchange, key, pub)
+	}
+
+	if ctx.Done() == nil {
+		// no timeout, so the publish can't be abandoned
+		return send()
+	}
+
+	type outcome struct {
+		generation uint64
+		err        error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		generation, err := send()
+		done <- outcome{generation, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.generation, o.err
+	case <-ctx.Done():
+		// not used by the callers, since a timeout is not reconnected
+		return 0, errPublishTimeout
+	}
+}
+
+// publishMandatory publishes pub with the mandatory flag on channel of
+// the given generation and waits for its confirmation. It returns
+// errUnroutable, if the broker returned it, and errPublishNacked, if the
+// broker rejected it. If ctx is done before the confirmation arrived, the
+// channel is closed and errPublishTimeout returned.
+func publishMandatory(ctx context.Context, generation uint64, channel amqpChannel, returns chan amqp.Return, confirms chan amqp.Confirmation, exchange, key string, pub amqp.Publishing) error {
+	select {
+	case mandatorySlot <- struct{}{}:
+	case <-ctx.Done():
+		return errPublishTimeout
+	}
+	defer func() { <-mandatorySlot }()
+
+	rabbitMutex.RLock()
+	lost := rabbitConfirmsLost && rabbitGeneration == generation
+	rabbitMutex.RUnlock()
+	if lost {
+		// have the channel replaced
+		return amqp.ErrClosed
+	}
+
+	if err := channel.Publish(exchange, key, true, false, pub); err != nil {
+		return err
+	}
+	var confirmation amqp.Confirmation
+	var ok bool
+	select {
+	case confirmation, ok = <-confirms:
+	case <-ctx.Done():
+		// the late confirmation would be taken for the one of the next task
+		log.Println("Timeout while waiting for the confirmation of a task, replacing the channel")
+		rabbitMutex.Lock()
+		if rabbitGeneration == generation {
+			rabbitConfirmsLost = true
+		}
+		rabbitMutex.Unlock()
+		go channel.Close()
+		return errPublishTimeout
+	}
+	if !ok {
+		return amqp.ErrClosed
+	}
+	// the broker sends the return before the confirmation, and both are
+	// delivered in this order, so a return is already waiting now
+	select {
+	case r := <-returns:
+		log.Printf("Task returned by the broker: %d %s", r.ReplyCode, r.ReplyText)
+		return errUnroutable
+	default:
+	}
+	if !confirmation.Ack {
+		return errPublishNacked
+	}
+	return nil
+}
+
+// publishWithTimeout publishes pub to the destination rconf, honoring the
+// publish timeout configured for it.
+func publishWithTimeout(rconf *RabbitConf, pub amqp.Publishing) (uint64, error) {
+	timeout := conf.PublishTimeout
+	if rconf.PublishTimeout > 0 {
+		timeout = rconf.PublishTimeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+	return publish(ctx, rconf.Exchange, rconf.RoutingKey, pub)
+}
+
+// reconnectRabbit replaces the publishing channel of the given generation
+// by a new one. If the channel was already replaced by a concurrent
+// publisher, nothing is done, so a failing channel is only restored once.
+// Reconnects are serialized by reconnectMutex, while the new channel is
+// established without holding rabbitMutex. Publishers only wait for it
+// while the channels are swapped.
+func reconnectRabbit(generation uint64) error {
+	reconnectMutex.Lock()
+	defer reconnectMutex.Unlock()
+	rabbitMutex.RLock()
+	current := rabbitGeneration
+	rabbitMutex.RUnlock()
+	if generation != current {
+		return nil
+	}
+
+	if err := fetchRabbitPassword(); err != nil {
+		return err
+	}
+	channel, err := dialRabbit()
+	if err != nil {
+		return err
+	}
+	var returns chan amqp.Return
+	var confirms chan amqp.Confirmation
+	if conf.MandatoryPublish {
+		if err := channel.Confirm(false); err != nil {
+			channel.Close()
+			return errors.New("Failed to enable publisher confirms: " + err.Error())
+		}
+		returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+		confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+
+	rabbitMutex.Lock()
+	old := rabbitChannel
+	rabbitChannel = channel
+	rabbitReturns, rabbitConfirms = returns, confirms
+	rabbitConfirmsLost = false
+	rabbitGeneration++
+	rabbitMutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	markRabbitUp()
+
+	log.Println("Connected to Rabbit")
+	return nil
+}
+
+// connectRabbit (re-)establishes the connection used for publishing.
+func connectRabbit() error {
+	rabbitMutex.RLock()
+	generation := rabbitGeneration
+	rabbitMutex.RUnlock()
+	return reconnectRabbit(generation)
+}
+
+// connectRabbitManagement (re-)establishes the management connection and
+// declares the configured topology on it.
+func connectRabbitManagement() error {
+	if err := fetchRabbitPassword(); err != nil {
+		return err
+	}
+	channel, err := dialRabbit()
+	if err != nil {
+		return err
+	}
+
+	err = addRabbitConf(channel, defaultBinding())
+	if err != nil && conf.RabbitPassive {
+		channel.Close()
+		return err
+	}
+	for r := range conf.Rabbit {
+		err = addRabbitConf(channel, conf.Rabbit[r])
+		if err != nil {
+			channel.Close()
+			return err
+		}
+	}
+	if conf.QuarantineRabbit != nil {
+		if err = addRabbitConf(channel, *conf.QuarantineRabbit); err != nil {
+			channel.Close()
+			return err
+		}
+	}
+	if conf.CancelExchange != "" {
+		if err = declareExchange(channel, conf.CancelExchange); err != nil {
+			channel.Close()
+			return err
+		}
+	}
+	queue := ""
+	if len(conf.SyncTasks) != 0 {
+		queue, err = startReplyConsumer(channel)
+		if err != nil {
+			channel.Close()
+			return err
+		}
+	}
+	if conf.ResultQueue != "" {
+		if err := startResultConsumer(channel); err != nil {
+			channel.Close()
+			return err
+		}
+	}
+	if conf.ControlExchange != "" {
+		if err := startControlConsumer(channel); err != nil {
+			channel.Close()
+			return err
+		}
+	}
+
+	rabbitMgmtMutex.Lock()
+	if rabbitMgmtChannel != nil {
+		rabbitMgmtChannel.Close()
+	}
+	rabbitMgmtChannel = channel
+	replyQueue = queue
+	rabbitMgmtMutex.Unlock()
+
+	log.Println("Connected to Rabbit (management)")
+	return nil
+}
+
+// restoreManagement restores the management connection, after a consumer
+// on channel stopped because the connection was lost. Nothing is done, if
+// channel was already replaced, e.g. by verifyTopology. Otherwise, it is
+// retried until RabbitMQ is back, since the consumers are gone until then.
+func restoreManagement(channel amqpChannel) {
+	mgmtRestoreMutex.Lock()
+	defer mgmtRestoreMutex.Unlock()
+	for {
+		rabbitMgmtMutex.Lock()
+		current := rabbitMgmtChannel
+		rabbitMgmtMutex.Unlock()
+		if current != channel {
+			return
+		}
+		log.Println("Trying to restore the management connection...")
+		err := connectRabbitManagement()
+		if err == nil {
+			return
+		}
+		log.Println("Couldn't restore the management connection: ", err)
+		time.Sleep(rabbitReconnectDelay)
+	}
+}
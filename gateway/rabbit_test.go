@@ -0,0 +1,504 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRabbitConnectionsIndependent(t *testing.T) {
+	setupGateway(t, &config{
+		RabbitDefault: RabbitConf{Queue: "totem_input", Exchange: "totem", RoutingKey: "work.static.totem"},
+		ResultQueue:   "results",
+	})
+	dialed := fakeDialer()
+	if err := connectRabbitManagement(); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectRabbit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*dialed) != 2 || rabbitChannel == rabbitMgmtChannel {
+		t.Fatalf("expected two distinct connections, got %d", len(*dialed))
+	}
+	mgmt := (*dialed)[0]
+	publish := (*dialed)[1]
+	if len(mgmt.exchanges) != 1 || len(publish.exchanges) != 0 {
+		t.Errorf("topology should only be declared on the management connection")
+	}
+	if mgmt.deliveries == nil || publish.deliveries != nil {
+		t.Errorf("results should only be consumed on the management connection")
+	}
+
+	// a lost management connection is restored without touching the
+	// publishing connection
+	close(mgmt.deliveries)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		rabbitMgmtMutex.Lock()
+		restored := rabbitMgmtChannel != mgmt
+		rabbitMgmtMutex.Unlock()
+		if restored {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("management connection was not restored")
+		}
+	}
+	if len(*dialed) != 3 || rabbitMgmtChannel != (*dialed)[2] || (*dialed)[2].deliveries == nil {
+		t.Errorf("management connection was not restored with its consumers")
+	}
+	if !mgmt.closed {
+		t.Errorf("broken management connection was not closed")
+	}
+	if rabbitChannel != publish || publish.closed {
+		t.Errorf("publishing connection was affected by a management failure")
+	}
+
+	// a failing publishing connection is restored without touching the
+	// management connection
+	mgmt = (*dialed)[2]
+	publish.publishErr = errors.New("channel closed")
+	task := newTask("PEINFO")
+	if err := pushToAMQP(&task, &conf.RabbitDefault); err != nil {
+		t.Fatal(err.Error)
+	}
+	if len(*dialed) != 4 || rabbitChannel != (*dialed)[3] {
+		t.Errorf("publishing connection was not restored")
+	}
+	if len((*dialed)[3].messages()) != 1 {
+		t.Errorf("task was not published on the restored connection")
+	}
+	if rabbitMgmtChannel != mgmt || mgmt.closed {
+		t.Errorf("management connection was affected by a publishing failure")
+	}
+}
+
+func TestConcurrentPublishDuringReconnect(t *testing.T) {
+	setupGateway(t, &config{
+		RabbitDefault: RabbitConf{Queue: "totem_input", Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	dialed := fakeDialer()
+	if err := connectRabbit(); err != nil {
+		t.Fatal(err)
+	}
+	broken := (*dialed)[0]
+	broken.publishErr = errors.New("channel closed")
+
+	const publishers = 50
+	var wg sync.WaitGroup
+	errs := make(chan *tasking.MyError, publishers)
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task := newTask("PEINFO")
+			if err := pushToAMQP(&task, &conf.RabbitDefault); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err.Error)
+	}
+
+	if len(*dialed) != 2 {
+		t.Errorf("expected exactly one reconnect, got %d", len(*dialed)-1)
+	}
+	if broken.publishedAfterClose != 0 {
+		t.Errorf("%d publishes on a closed channel", broken.publishedAfterClose)
+	}
+	if n := len((*dialed)[1].messages()); n != publishers {
+		t.Errorf("expected %d messages on the new channel, got %d", publishers, n)
+	}
+}
+
+func TestMandatoryPublish(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:     map[string][]string{"org1": []string{"*"}},
+		MandatoryPublish: true,
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit:           map[string]RabbitConf{"YARA": {Exchange: "totem", RoutingKey: "work.nowhere"}},
+	})
+	dialed := fakeDialer()
+	if err := connectRabbit(); err != nil {
+		t.Fatal(err)
+	}
+	broker := (*dialed)[0]
+	broker.unroutable = map[string]bool{"work.nowhere": true}
+
+	task := newTask("YARA")
+	err := pushToAMQP(&task, &RabbitConf{Exchange: "totem", RoutingKey: "work.nowhere"})
+	if err == nil || err.Error != errUnroutable || err.Code != tasking.ERR_OTHER_RECOVERABLE {
+		t.Fatalf("unroutable task not detected: %+v", err)
+	}
+	if len(*dialed) != 1 {
+		t.Errorf("reconnected because of an unroutable task")
+	}
+
+	// the unroutable service is rejected, the others are dispatched
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA"), newTask("PEINFO")))
+	if answer.Error != nil || len(answer.Accepted) != 1 || len(answer.TskErrors) != 1 {
+		t.Fatalf("expected PEINFO accepted and YARA rejected: %+v", answer)
+	}
+	if answer.TskErrors[0].Error.Code != tasking.ERR_OTHER_RECOVERABLE {
+		t.Errorf("expected ERR_OTHER_RECOVERABLE, got %v", answer.TskErrors[0].Error.Code)
+	}
+	if _, yara := answer.TskErrors[0].TaskStruct.Tasks["YARA"]; !yara {
+		t.Errorf("wrong service rejected: %+v", answer.TskErrors[0])
+	}
+	if n := len(broker.messages()); n != 1 {
+		t.Errorf("expected 1 routed message, got %d", n)
+	}
+}
+
+func TestPublishTimeout(t *testing.T) {
+	ch := setupGateway(t, &config{
+		PublishTimeout: 1000,
+		RabbitDefault:  RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem", PublishTimeout: 20},
+	})
+	dialed := fakeDialer()
+	ch.block = make(chan struct{})
+	defer close(ch.block)
+
+	task := newTask("PEINFO")
+	start := time.Now()
+	err := pushToAMQP(&task, &conf.RabbitDefault)
+	if err == nil {
+		t.Fatal("blocked publish did not fail")
+	}
+	if err.Code != tasking.ERR_OTHER_RECOVERABLE {
+		t.Errorf("expected a recoverable error, got %d", err.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("per-exchange timeout did not fire in time (%s)", elapsed)
+	}
+	if len(*dialed) != 0 {
+		t.Errorf("a timeout should not trigger a reconnect")
+	}
+}
+
+func TestPublishDuringSlowReconnect(t *testing.T) {
+	setupGateway(t, &config{
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem", PublishTimeout: 100},
+	})
+	dialed := fakeDialer()
+	if err := connectRabbit(); err != nil {
+		t.Fatal(err)
+	}
+	current := (*dialed)[0]
+
+	// the broker is slow to accept the new connection
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	dialRabbit = func() (amqpChannel, error) {
+		close(dialing)
+		<-release
+		return &fakeChannel{}, nil
+	}
+	reconnected := make(chan error, 1)
+	go func() { reconnected <- connectRabbit() }()
+	<-dialing
+
+	// publishing on the current channel is not held up meanwhile
+	task := newTask("PEINFO")
+	if err := pushToAMQP(&task, &conf.RabbitDefault); err != nil {
+		t.Fatalf("publish blocked by the reconnect: %v", err.Error)
+	}
+	if n := len(current.messages()); n != 1 {
+		t.Errorf("expected the task on the current channel, got %d", n)
+	}
+	close(release)
+	if err := <-reconnected; err != nil {
+		t.Fatal(err)
+	}
+	if rabbitChannel == current || !current.closed {
+		t.Errorf("channel was not replaced")
+	}
+}
+
+func TestPublishTimeoutDoesNotBlockReconnect(t *testing.T) {
+	ch := setupGateway(t, &config{
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem", PublishTimeout: 20},
+	})
+	dialed := fakeDialer()
+	ch.block = make(chan struct{})
+	defer close(ch.block)
+
+	// a publish hanging on the unresponsive broker times out
+	task := newTask("PEINFO")
+	if err := pushToAMQP(&task, &conf.RabbitDefault); err == nil {
+		t.Fatal("blocked publish did not fail")
+	}
+
+	// the channel can still be replaced, and further publishes use the new one
+	reconnected := make(chan error, 1)
+	go func() { reconnected <- connectRabbit() }()
+	select {
+	case err := <-reconnected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reconnect blocked by the hanging publish")
+	}
+	if err := pushToAMQP(&task, &conf.RabbitDefault); err != nil {
+		t.Fatalf("publish on the new channel failed: %v", err.Error)
+	}
+	if len(*dialed) != 1 || len((*dialed)[0].messages()) != 1 {
+		t.Errorf("task was not published on the new channel")
+	}
+}
+
+func TestMandatoryPublishConfirmTimeout(t *testing.T) {
+	setupGateway(t, &config{
+		MandatoryPublish: true,
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem", PublishTimeout: 20},
+	})
+	dialed := fakeDialer()
+	if err := connectRabbit(); err != nil {
+		t.Fatal(err)
+	}
+	silent := (*dialed)[0]
+	silent.unconfirmed = true
+
+	// the wait for a confirmation that never arrives is bounded, too
+	task := newTask("PEINFO")
+	start := time.Now()
+	err := pushToAMQP(&task, &conf.RabbitDefault)
+	if err == nil || err.Error != errPublishTimeout {
+		t.Fatalf("expected a timeout, got %+v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("confirmation was awaited for %s", elapsed)
+	}
+
+	// its late confirmation must not be taken for the one of the next task,
+	// so the next task is published on a new channel
+	if err := pushToAMQP(&task, &conf.RabbitDefault); err != nil {
+		t.Fatalf("publish after the timeout failed: %v", err.Error)
+	}
+	if len(*dialed) != 2 || len((*dialed)[1].messages()) != 1 {
+		t.Fatalf("channel was not replaced after the lost confirmation")
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		silent.Lock()
+		closed := silent.closed
+		silent.Unlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("channel with the lost confirmation was not closed")
+		}
+	}
+}
+
+// writeTestCertificate creates a self-signed certificate and its key in dir.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rabbit.example.com"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	return certPath, keyPath
+}
+
+func TestRabbitTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCertificate(t, dir)
+
+	cfg, err := buildRabbitTLSConfig(&RabbitTLSConf{
+		CACertPath: certPath,
+		CertPath:   certPath,
+		KeyPath:    keyPath,
+		ServerName: "rabbit.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RootCAs == nil {
+		t.Errorf("CA certificate was not loaded")
+	}
+	if len(cfg.Certificates) != 1 {
+		t.Errorf("client certificate was not loaded")
+	}
+	if cfg.ServerName != "rabbit.example.com" {
+		t.Errorf("server name is %q", cfg.ServerName)
+	}
+	if cfg.InsecureSkipVerify {
+		t.Errorf("server verification must not be disabled")
+	}
+
+	if _, err := buildRabbitTLSConfig(&RabbitTLSConf{CACertPath: keyPath}); err == nil {
+		t.Errorf("invalid CA certificate was accepted")
+	}
+	if _, err := buildRabbitTLSConfig(&RabbitTLSConf{CertPath: certPath}); err == nil {
+		t.Errorf("client certificate without key was accepted")
+	}
+}
+
+func TestRabbitTopologyModes(t *testing.T) {
+	c := &config{
+		RabbitDefault: RabbitConf{Queue: "totem_input", Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit: map[string]RabbitConf{
+			"CUCKOO": RabbitConf{Queue: "totem_dynamic_input", Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"}},
+	}
+
+	// active mode creates the topology
+	setupGateway(t, c)
+	dialed := fakeDialer()
+	if err := connectRabbitManagement(); err != nil {
+		t.Fatal(err)
+	}
+	mgmt := (*dialed)[0]
+	if len(mgmt.queues) != 2 || len(mgmt.exchanges) != 2 || mgmt.bindings != 2 {
+		t.Errorf("active mode should declare and bind the topology: %v %v", mgmt.queues, mgmt.exchanges)
+	}
+
+	// passive mode only asserts the existence
+	c.RabbitPassive = true
+	setupGateway(t, c)
+	existing := map[string]bool{"totem_input": true, "totem": true, "totem_dynamic_input": true, "totem_dynamic": true}
+	var passive *fakeChannel
+	dialRabbit = func() (amqpChannel, error) {
+		passive = &fakeChannel{existing: existing}
+		return passive, nil
+	}
+	if err := connectRabbitManagement(); err != nil {
+		t.Fatal(err)
+	}
+	if len(passive.queues) != 0 || len(passive.exchanges) != 0 || passive.bindings != 0 {
+		t.Errorf("passive mode should not modify the topology")
+	}
+
+	// a missing exchange fails the startup, also for the default
+	for _, missing := range []string{"totem_dynamic", "totem", "totem_input"} {
+		delete(existing, missing)
+		if err := connectRabbitManagement(); err == nil {
+			t.Errorf("missing %s was not detected", missing)
+		}
+		if !passive.closed {
+			t.Errorf("channel was not closed after a failed assertion")
+		}
+		existing[missing] = true
+	}
+}
+
+func TestSourceRoutingKey(t *testing.T) {
+	for _, c := range []struct {
+		mode, key, source, expected string
+	}{
+		{"", "work.static.totem", "src1", "work.static.totem"},
+		{"append", "work.static.totem", "src1", "work.static.totem.src1"},
+		{"append", "work.static.totem", "", "work.static.totem.nosource"},
+		{"substitute", "work.{source}.totem", "src1", "work.src1.totem"},
+		{"append", "work.static.totem", "src.1", ""},
+		{"append", "work.static.totem", "src#", ""},
+		{"wrong", "work.static.totem", "src1", ""},
+	} {
+		ch := setupGateway(t, &config{
+			AllowedTasks:     map[string][]string{"org1": []string{"*"}},
+			SourceRoutingKey: c.mode,
+			SourceFallback:   "nosource",
+			RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: c.key},
+		})
+		task := newTask("PEINFO")
+		task.Source = c.source
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+		if c.expected == "" {
+			if len(answer.TskErrors) != 1 || len(ch.messages()) != 0 {
+				t.Errorf("%s/%q: expected the task to be rejected", c.mode, c.source)
+			}
+			continue
+		}
+		msgs := ch.messages()
+		if len(msgs) != 1 || msgs[0].RoutingKey != c.expected {
+			t.Errorf("%s/%q: expected routing key %s, got %+v", c.mode, c.source, c.expected, msgs)
+			continue
+		}
+		if answer.Accepted[0].RoutingKey != c.expected {
+			t.Errorf("%s/%q: answer reports routing key %s", c.mode, c.source, answer.Accepted[0].RoutingKey)
+		}
+	}
+}
+
+func TestSourceRoutingKeyBinding(t *testing.T) {
+	setupGateway(t, &config{
+		SourceRoutingKey: "substitute",
+		RabbitDefault:    RabbitConf{Queue: "totem_input", Exchange: "totem", RoutingKey: "work.{source}.totem"},
+	})
+	if b := defaultBinding(); b.RoutingKey != "work.*.totem" {
+		t.Errorf("default queue bound with %s", b.RoutingKey)
+	}
+}
+
+func TestExpirationTTL(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		ExpirationTTL: true,
+	})
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	for _, c := range []struct {
+		lifetime time.Duration
+		ttl      string
+	}{
+		{time.Hour, "3600000"},
+		{2 * time.Second, "2000"},
+	} {
+		answer := handleDecrypted(signTicket(t, "org1", now.Add(c.lifetime), newTask("PEINFO")))
+		if answer.Error != nil || len(answer.Accepted) != 1 {
+			t.Fatalf("expected the task accepted: %+v", answer)
+		}
+		msgs := ch.messages()
+		if ttl := msgs[len(msgs)-1].Publishing.Expiration; ttl != c.ttl {
+			t.Errorf("expected a TTL of %s ms for a ticket expiring in %s, got %q", c.ttl, c.lifetime, ttl)
+		}
+	}
+
+	// an already expired ticket is dropped unless it can be delivered at once
+	if ttl := messageTTL(now.Add(-time.Second)); ttl != "0" {
+		t.Errorf("expected a TTL of 0 after the expiration, got %q", ttl)
+	}
+
+	conf.ExpirationTTL = false
+	handleDecrypted(signTicket(t, "org1", now.Add(time.Hour), newTask("PEINFO")))
+	msgs := ch.messages()
+	if ttl := msgs[len(msgs)-1].Publishing.Expiration; ttl != "" {
+		t.Errorf("expected no TTL if disabled, got %q", ttl)
+	}
+}
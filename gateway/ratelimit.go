@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// RateConf limits how often a task type is dispatched across all
+// organizations, e.g. to protect an expensive service. It is a token
+// bucket: every dispatched service takes a token, and Rate tokens are
+// added per second, up to Burst tokens.
+type RateConf struct {
+	Rate  float64 // Services dispatched per second on average
+	Burst int     // Services dispatched at once at most (default: 1)
+}
+
+// tokenBucket holds the tokens left for a task type at the time last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	taskBuckets      = make(map[string]*tokenBucket) // canonical task name -> bucket
+	taskBucketsMutex = &sync.Mutex{}
+)
+
+// burst returns the size of the bucket of r.
+func (r RateConf) burst() float64 {
+	if r.Burst < 1 {
+		return 1
+	}
+	return float64(r.Burst)
+}
+
+// bucketLocked returns the bucket of the rate limited task type t, filled
+// up to now. taskBucketsMutex must be held.
+func bucketLocked(t string, limit RateConf, now time.Time) *tokenBucket {
+	b, exists := taskBuckets[t]
+	if !exists {
+		b = &tokenBucket{tokens: limit.burst(), last: now}
+		taskBuckets[t] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * limit.Rate
+		if b.tokens > limit.burst() {
+			b.tokens = limit.burst()
+		}
+		b.last = now
+	}
+	return b
+}
+
+// takeTaskTokens takes a token for every rate limited service of tasks.
+// The services without a token left are removed from tasks and returned.
+func takeTaskTokens(tasks map[string][]string) map[string][]string {
+	if len(conf.TaskRateLimits) == 0 {
+		return nil
+	}
+	now := timeNow()
+	taskBucketsMutex.Lock()
+	defer taskBucketsMutex.Unlock()
+	var limited map[string][]string // only allocated if needed
+	for t, args := range tasks {
+		limit, exists := conf.TaskRateLimits[t]
+		if !exists || limit.Rate <= 0 {
+			continue
+		}
+		b := bucketLocked(t, limit, now)
+		if b.tokens < 1 {
+			if limited == nil {
+				limited = make(map[string][]string)
+			}
+			limited[t] = args
+			delete(tasks, t)
+			continue
+		}
+		b.tokens--
+	}
+	return limited
+}
+
+// returnTaskTokens returns the tokens of the services of tasks, which were
+// not dispatched after all.
+func returnTaskTokens(tasks map[string][]string) {
+	if len(conf.TaskRateLimits) == 0 {
+		return
+	}
+	now := timeNow()
+	taskBucketsMutex.Lock()
+	defer taskBucketsMutex.Unlock()
+	for t := range tasks {
+		limit, exists := conf.TaskRateLimits[t]
+		if !exists || limit.Rate <= 0 {
+			continue
+		}
+		b := bucketLocked(t, limit, now)
+		if b.tokens++; b.tokens > limit.burst() {
+			b.tokens = limit.burst()
+		}
+	}
+}
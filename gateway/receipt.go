@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// receiptKeys are the keys of the gateway signing the receipts returned to
+// the clients, mapped by their names. The key with the greatest name is the
+// current one and signs new receipts, so a key is rotated by adding a key
+// with a greater name (e.g. named by date). Older keys stay loaded, and
+// their public keys published, until they are removed. If there is no key,
+// no receipts are issued.
+var receiptKeys = make(map[string]*rsa.PrivateKey)
+var receiptKeysMutex = &sync.Mutex{}
+
+func addReceiptKey(name string, key *rsa.PrivateKey) {
+	receiptKeysMutex.Lock()
+	receiptKeys[name] = key
+	receiptKeysMutex.Unlock()
+}
+
+func removeReceiptKey(name string) {
+	receiptKeysMutex.Lock()
+	delete(receiptKeys, strings.TrimSuffix(filepath.Base(name), ".priv"))
+	receiptKeysMutex.Unlock()
+}
+
+// currentReceiptKey returns the key signing new receipts and its name.
+func currentReceiptKey() (string, *rsa.PrivateKey) {
+	receiptKeysMutex.Lock()
+	defer receiptKeysMutex.Unlock()
+	current := ""
+	for name := range receiptKeys {
+		if name > current {
+			current = name
+		}
+	}
+	return current, receiptKeys[current]
+}
+
+// newTraceID returns a random identifier for a ticket.
+func newTraceID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// issueReceipt returns a receipt stating that the gateway accepted the
+// given tasks of org, signed with the current receipt key. If there is no
+// receipt key, nil is returned.
+func issueReceipt(traceID string, org string, accepted []tasking.TaskSummary) (*tasking.Receipt, error) {
+	keyId, key := currentReceiptKey()
+	if key == nil {
+		return nil, nil
+	}
+	x, err := json.Marshal(accepted)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(x)
+	receipt := &tasking.Receipt{
+		TraceID:      traceID,
+		Timestamp:    time.Now().UTC(),
+		Organization: org,
+		TaskDigest:   digest[:],
+		KeyId:        keyId,
+	}
+	if err := tasking.SignReceipt(receipt, key); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// httpRequestReceiptKeys answers with the DER-encoded public keys of all
+// loaded receipt keys, so clients can verify receipts during a rollover.
+func httpRequestReceiptKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	receiptKeysMutex.Lock()
+	pubs := make(map[string][]byte, len(receiptKeys))
+	for name, key := range receiptKeys {
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			log.Printf("Couldn't encode receipt key %s: %s", name, err)
+			continue
+		}
+		pubs[name] = der
+	}
+	receiptKeysMutex.Unlock()
+
+	x, _ := json.Marshal(pubs)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(x)
+}
@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReceipt(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+
+	// without a key, no receipts are issued
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer.Receipt != nil {
+		t.Errorf("receipt issued without a receipt key")
+	}
+
+	receiptKey := sourceKey(t)
+	addReceiptKey("gw1", receiptKey)
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	receipt := answer.Receipt
+	if receipt == nil {
+		t.Fatal("no receipt for accepted tasks")
+	}
+	if err := tasking.VerifyReceipt(*receipt, &receiptKey.PublicKey); err != nil {
+		t.Fatalf("receipt signature invalid: %s", err)
+	}
+	if receipt.Organization != "org1" || receipt.KeyId != "gw1" || receipt.TraceID == "" || time.Since(receipt.Timestamp) > time.Minute {
+		t.Errorf("receipt incomplete: %+v", receipt)
+	}
+	x, _ := json.Marshal(answer.Accepted)
+	if digest := sha256.Sum256(x); string(digest[:]) != string(receipt.TaskDigest) {
+		t.Errorf("receipt digest does not match the accepted tasks")
+	}
+
+	// the receipt survives the way to the client
+	x, _ = json.Marshal(answer)
+	var decoded tasking.GatewayAnswer
+	json.Unmarshal(x, &decoded)
+	if err := tasking.VerifyReceipt(*decoded.Receipt, &receiptKey.PublicKey); err != nil {
+		t.Errorf("decoded receipt signature invalid: %s", err)
+	}
+
+	tampered := *receipt
+	tampered.Organization = "org2"
+	if tasking.VerifyReceipt(tampered, &receiptKey.PublicKey) == nil {
+		t.Errorf("tampered receipt verified")
+	}
+
+	// nothing accepted, nothing to prove
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA")))
+	if answer.Receipt != nil {
+		t.Errorf("receipt issued without accepted tasks")
+	}
+}
+
+func TestReceiptKeyRotation(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	oldKey, newKey := sourceKey(t), ticketKey(t)
+	addReceiptKey("2026-01", oldKey)
+	before := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"))).Receipt
+
+	// rollover: the new key signs, the old one stays published
+	addReceiptKey("2026-02", newKey)
+	after := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO"))).Receipt
+	if before.KeyId != "2026-01" || after.KeyId != "2026-02" {
+		t.Fatalf("receipts signed with the wrong keys: %s, %s", before.KeyId, after.KeyId)
+	}
+
+	w := httptest.NewRecorder()
+	httpRequestReceiptKeys(w, httptest.NewRequest("GET", "/receiptkeys", nil))
+	var pubs map[string][]byte
+	if err := json.Unmarshal(w.Body.Bytes(), &pubs); err != nil {
+		t.Fatal(err)
+	}
+	for _, receipt := range []*tasking.Receipt{before, after} {
+		pub, err := x509.ParsePKIXPublicKey(pubs[receipt.KeyId])
+		if err != nil {
+			t.Fatalf("public key %s not published: %s", receipt.KeyId, err)
+		}
+		if err := tasking.VerifyReceipt(*receipt, pub.(*rsa.PublicKey)); err != nil {
+			t.Errorf("receipt signed by %s invalid: %s", receipt.KeyId, err)
+		}
+	}
+
+	// the old key is retired
+	removeReceiptKey("2026-01")
+	if current, _ := currentReceiptKey(); current != "2026-02" {
+		t.Errorf("removing the old key changed the current key to %s", current)
+	}
+	if tasking.VerifyReceipt(*before, &newKey.PublicKey) == nil {
+		t.Errorf("receipt verified with the wrong key")
+	}
+}
@@ -0,0 +1,130 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// The task policy (the ACL and the globally disabled tasks), the bindings
+// of organizations to source keys and encryptions, the sampling of the
+// request log, and the maintenance mode can be reloaded from the
+// configuration file at runtime by sending SIGHUP to the gateway. All
+// other options require a restart. A reload is applied as a whole or not
+// at all: the complete file is validated like on startup, including the
+// options requiring a restart, so a file accepted by a reload can also be
+// started with.
+
+// buildDisabledTasks returns the set of the canonical names of all tasks
+// disabled in c.
+func buildDisabledTasks(c *config) map[string]struct{} {
+	disabled := make(map[string]struct{}, len(c.DisabledTasks))
+	for _, t := range c.DisabledTasks {
+		if canonical, exists := c.TaskAliases[t]; exists {
+			t = canonical
+		}
+		disabled[t] = struct{}{}
+	}
+	return disabled
+}
+
+// taskPolicy returns the current ACL and the set of disabled tasks. Both
+// must not be modified.
+func taskPolicy() (map[string](map[string]struct{}), map[string]struct{}) {
+	policyMutex.RLock()
+	defer policyMutex.RUnlock()
+	return allowedTasks, disabledTasks
+}
+
+// reloadConfig reads the configuration file at path and applies its task
+// policy, source key bindings and ticket encryptions.
+func reloadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c := &config{}
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return err
+	}
+	// aliases can't be reloaded, so the running ones are used
+	c.TaskAliases = conf.TaskAliases
+	if err := validateConfig(c); err != nil {
+		return err
+	}
+	if err := checkTopology(c); err != nil {
+		return err
+	}
+	// the path of the manifest can't be reloaded, but its content can
+	if conf.KeyManifest != "" {
+		if err := applyKeyManifest(conf.KeyManifest); err != nil {
+			return err
+		}
+	}
+
+	allowed := buildAllowedTasks(c)
+	// the other options naming task types can't be reloaded
+	known := buildKnownTasks(conf, allowed)
+	disabled := buildDisabledTasks(c)
+	bindings := buildSourceKeyBindings(c)
+	policyMutex.Lock()
+	allowedTasks = allowed
+	knownTasks = known
+	disabledTasks = disabled
+	sourceKeyBindings = bindings
+	ticketEncryptions = c.TicketEncryptions
+	policyMutex.Unlock()
+	setRequestLogSampling(c.RequestLogSampling)
+	configureMaintenance(c.Maintenance)
+	log.Printf("Reloaded task policy: %d organizations, disabled tasks: %v, %d source key bindings, request log sampling: %d, maintenance: %t", len(allowed), c.DisabledTasks, len(bindings), c.RequestLogSampling, inMaintenance())
+	return nil
+}
+
+// validateConfig checks the options of c which can't be checked while
+// decoding it.
+func validateConfig(c *config) error {
+	if _, err := compileFilenamePattern(c); err != nil {
+		return errors.New("Invalid FilenamePattern: " + err.Error())
+	}
+	switch c.Canonicalization {
+	case "", tasking.CANONICALIZATION_LEGACY, tasking.CANONICALIZATION_CANONICAL:
+	default:
+		return errors.New("Unknown Canonicalization '" + c.Canonicalization + "'")
+	}
+	if c.AsyncTickets && c.ResultQueue == "" {
+		return errors.New("AsyncTickets requires a ResultQueue")
+	}
+	if _, err := newMetrics(c.MetricsBackend); err != nil {
+		return err
+	}
+	if c.RequestLogSampling < 0 {
+		return errors.New("RequestLogSampling must not be negative")
+	}
+	for org, encryptions := range c.TicketEncryptions {
+		for _, e := range encryptions {
+			if e != tasking.ENCRYPTION_AES_CBC && e != tasking.ENCRYPTION_AES_GCM {
+				return errors.New("Unknown encryption '" + e + "' in TicketEncryptions of " + org)
+			}
+		}
+	}
+	if err := validateWebhooks(c); err != nil {
+		return err
+	}
+	return nil
+}
+
+// reloadOnSignal reloads the configuration file at path on every SIGHUP.
+func reloadOnSignal(path string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if err := reloadConfig(path); err != nil {
+			log.Println("Couldn't reload the configuration, keeping the old one: ", err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDisabledTasks(t *testing.T) {
+	c := &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		TaskAliases:   map[string]string{"SANDBOX": "CUCKOO"},
+		DisabledTasks: []string{"CUCKOO"},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	}
+	ch := setupGateway(t, c)
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "SANDBOX")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_NOT_ALLOWED ||
+		answer.TskErrors[0].Error.Error.Error() != "Temporarily disabled" {
+		t.Fatalf("expected CUCKOO to be disabled, got %+v", answer.TskErrors)
+	}
+	if _, ok := answer.TskErrors[0].TaskStruct.Tasks["CUCKOO"]; !ok {
+		t.Errorf("rejection should name the disabled task: %+v", answer.TskErrors[0].TaskStruct.Tasks)
+	}
+	if len(answer.Accepted) != 1 || answer.Accepted[0].Task != "PEINFO" || len(ch.messages()) != 1 {
+		t.Errorf("enabled task should still be dispatched: %+v", answer.Accepted)
+	}
+	if caps := capabilitiesFor(nil, "org1"); len(caps.AllowedTasks) != 1 {
+		t.Errorf("disabled task listed in capabilities: %v", caps.AllowedTasks)
+	}
+
+	// enable it again by reloading the configuration
+	f, err := ioutil.TempFile("", "gateway.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"AllowedTasks": {"org1": ["*"]}, "DisabledTasks": ["YARA"]}`)
+	f.Close()
+	if err := reloadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("SANDBOX", "YARA")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_NOT_ALLOWED {
+		t.Fatalf("expected only YARA to be disabled, got %+v", answer.TskErrors)
+	}
+	if _, ok := answer.TskErrors[0].TaskStruct.Tasks["YARA"]; !ok {
+		t.Errorf("wrong task disabled: %+v", answer.TskErrors[0].TaskStruct.Tasks)
+	}
+	if len(answer.Accepted) != 1 || answer.Accepted[0].Task != "CUCKOO" {
+		t.Errorf("re-enabled task not dispatched: %+v", answer.Accepted)
+	}
+
+	// a broken file keeps the old policy
+	ioutil.WriteFile(f.Name(), []byte("{"), 0600)
+	if err := reloadConfig(f.Name()); err == nil {
+		t.Errorf("broken configuration reloaded")
+	}
+	if _, disabled := taskPolicy(); len(disabled) != 1 {
+		t.Errorf("policy changed by a broken configuration")
+	}
+}
+
+func TestReloadIsTransactional(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		DisabledTasks: []string{"YARA"},
+		RabbitPassive: true,
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	broker := &fakeChannel{existing: map[string]bool{"totem": true, "yara": true}}
+	dialRabbit = func() (amqpChannel, error) { return broker, nil }
+	f, err := ioutil.TempFile("", "gateway.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	for _, broken := range []string{
+		// semantically broken options
+		`{"AllowedTasks": {"org1": ["*"]}, "DisabledTasks": ["PEINFO"], "Canonicalization": "sorted"}`,
+		`{"AllowedTasks": {"org1": ["*"]}, "DisabledTasks": ["PEINFO"], "FilenamePattern": "("}`,
+		`{"AllowedTasks": {"org1": ["*"]}, "DisabledTasks": ["PEINFO"], "RequestLogSampling": -1}`,
+		// an exchange missing on the broker
+		`{"AllowedTasks": {"org1": ["*"]}, "DisabledTasks": ["PEINFO"], "RabbitPassive": true,
+		  "RabbitDefault": {"Exchange": "totem"}, "Rabbit": {"CUCKOO": {"Exchange": "cuckoo"}}}`,
+	} {
+		ioutil.WriteFile(f.Name(), []byte(broken), 0600)
+		if err := reloadConfig(f.Name()); err == nil {
+			t.Errorf("broken configuration reloaded: %s", broken)
+		}
+		_, disabled := taskPolicy()
+		if _, yara := disabled["YARA"]; len(disabled) != 1 || !yara {
+			t.Fatalf("policy changed by a broken configuration: %v", disabled)
+		}
+	}
+
+	ioutil.WriteFile(f.Name(), []byte(`{"AllowedTasks": {"org1": ["*"]}, "DisabledTasks": ["PEINFO"], "RabbitPassive": true,
+	  "RabbitDefault": {"Exchange": "totem"}, "Rabbit": {"YARA": {"Exchange": "yara"}}}`), 0600)
+	if err := reloadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	_, disabled := taskPolicy()
+	if _, peinfo := disabled["PEINFO"]; len(disabled) != 1 || !peinfo {
+		t.Errorf("valid configuration not applied: %v", disabled)
+	}
+}
+
+func TestReloadKnownTasks(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"PEINFO"}},
+		ReportUnknownTasks: true,
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	f, err := ioutil.TempFile("", "gateway.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	reason := func() string {
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("OBJDUMP")))
+		if len(answer.TskErrors) != 1 {
+			t.Fatalf("expected OBJDUMP to be rejected: %+v", answer)
+		}
+		return answer.TskErrors[0].Reason
+	}
+
+	if r := reason(); r != tasking.REASON_TASK_UNKNOWN {
+		t.Fatalf("expected OBJDUMP to be unknown, got %s", r)
+	}
+	// another organization may request it now
+	ioutil.WriteFile(f.Name(), []byte(`{"AllowedTasks": {"org1": ["PEINFO"], "org2": ["OBJDUMP"]}}`), 0600)
+	if err := reloadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if r := reason(); r != tasking.REASON_TASK_NOT_ALLOWED {
+		t.Errorf("expected OBJDUMP to be known after reloading, got %s", r)
+	}
+	ioutil.WriteFile(f.Name(), []byte(`{"AllowedTasks": {"org1": ["PEINFO"]}}`), 0600)
+	if err := reloadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if r := reason(); r != tasking.REASON_TASK_UNKNOWN {
+		t.Errorf("expected OBJDUMP to be unknown again after reloading, got %s", r)
+	}
+}
@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Every request is logged by logMiddleware, if it failed or its ticket
+// was rejected. Of the other requests, only every RequestLogSampling-th
+// one is logged, to keep the log readable in steady state. The rate can
+// be reloaded, e.g. to log everything during an incident.
+
+var (
+	requestLogSampling int    // log every n-th successful request, none if 0
+	requestLogCount    uint64 // number of successful requests
+	requestLogMutex    = &sync.Mutex{}
+
+	// logRequest is replaced in tests to capture the request log
+	logRequest = log.Printf
+)
+
+// setRequestLogSampling sets the sampling rate of successful requests.
+func setRequestLogSampling(n int) {
+	requestLogMutex.Lock()
+	requestLogSampling = n
+	requestLogCount = 0
+	requestLogMutex.Unlock()
+}
+
+// sampleRequest reports whether the next successful request is logged.
+func sampleRequest() bool {
+	requestLogMutex.Lock()
+	defer requestLogMutex.Unlock()
+	if requestLogSampling <= 0 {
+		return false
+	}
+	requestLogCount++
+	return requestLogCount%uint64(requestLogSampling) == 0
+}
+
+// requestRejection is stored in the context of a request, so handlers can
+// report the rejection of a ticket answered with 200.
+type requestRejection struct {
+	reason string
+}
+
+// noteRejection records that the ticket of r was rejected for reason, so
+// the request is logged regardless of the sampling.
+func noteRejection(r *http.Request, reason string) {
+	if rejection, ok := r.Context().Value(rejectionContextKey).(*requestRejection); ok {
+		rejection.reason = reason
+	}
+}
+
+// logMiddleware logs failed and rejected requests, and a sample of the
+// successful ones.
+func logMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		rejection := &requestRejection{}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), rejectionContextKey, rejection)))
+		switch {
+		case rejection.reason != "":
+			logRequest("Request %s %s from %s: %d in %s, rejected: %s", r.Method, r.URL.Path, r.RemoteAddr, rec.status, time.Since(start), rejection.reason)
+		case rec.status >= http.StatusBadRequest || sampleRequest():
+			logRequest("Request %s %s from %s: %d in %s", r.Method, r.URL.Path, r.RemoteAddr, rec.status, time.Since(start))
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureRequestLog replaces logRequest. It returns a function returning
+// the logged lines, and one restoring logRequest.
+func captureRequestLog() (func() []string, func()) {
+	var mutex sync.Mutex
+	var lines []string
+	saved := logRequest
+	logRequest = func(format string, v ...interface{}) {
+		mutex.Lock()
+		lines = append(lines, fmt.Sprintf(format, v...))
+		mutex.Unlock()
+	}
+	logged := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, lines...)
+	}
+	return logged, func() { logRequest = saved }
+}
+
+func TestRequestLogSampling(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"PEINFO"}},
+		RequestLogSampling: 5,
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	logged, restore := captureRequestLog()
+	defer restore()
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	submit := func(expiration time.Time, services ...string) {
+		enc, _ := encryptTicket(t, signTicket(t, "org1", expiration, newTask(services...)))
+		mux.ServeHTTP(httptest.NewRecorder(), taskRequest(enc))
+	}
+
+	for i := 0; i < 10; i++ {
+		submit(time.Now().Add(time.Hour), "PEINFO")
+	}
+	if lines := logged(); len(lines) != 2 {
+		t.Fatalf("expected 2 of 10 requests to be logged, got %v", lines)
+	}
+
+	// errors and rejections are always logged
+	r := httptest.NewRequest("POST", "/task/", strings.NewReader("ticket"))
+	r.Header.Set("Content-Type", "text/plain")
+	mux.ServeHTTP(httptest.NewRecorder(), r)
+	submit(time.Now().Add(-time.Hour), "PEINFO")
+	submit(time.Now().Add(time.Hour), "PEINFO", "YARA")
+	lines := logged()
+	if len(lines) != 5 {
+		t.Fatalf("expected the failed and rejected requests to be logged, got %v", lines)
+	}
+	if !strings.Contains(lines[2], ": 415 in ") {
+		t.Errorf("expected the failed request to be logged, got %q", lines[2])
+	}
+	if !strings.Contains(lines[3], "rejected: Ticket expired") || !strings.Contains(lines[4], "rejected: 1 tasks rejected") {
+		t.Errorf("expected the rejections to be logged, got %q and %q", lines[3], lines[4])
+	}
+
+	// the rate can be reloaded
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gateway.conf")
+	ioutil.WriteFile(path, []byte(`{"AllowedTasks": {"org1": ["PEINFO"]}, "RequestLogSampling": 1}`), 0600)
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		submit(time.Now().Add(time.Hour), "PEINFO")
+	}
+	if lines := logged(); len(lines) != 8 {
+		t.Errorf("expected all requests to be logged after the reload, got %d", len(lines))
+	}
+}
@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+)
+
+// A URIRewriter transforms the URIs of a task into the form the services of
+// a task type expect, e.g. a relative path into an S3 URI. RewriteURI is
+// called for the PrimaryURI and the SecondaryURI (if set) of every
+// dispatched task, after the storage prefix of the task type was applied.
+type URIRewriter interface {
+	RewriteURI(uri string) (string, error)
+}
+
+// identityRewriter is the default URIRewriter, which leaves URIs unchanged.
+type identityRewriter struct{}
+
+func (identityRewriter) RewriteURI(uri string) (string, error) {
+	return uri, nil
+}
+
+var (
+	defaultURIRewriter URIRewriter = identityRewriter{}
+	uriRewriters                   = make(map[string]URIRewriter) // canonical task type -> rewriter
+)
+
+// SetURIRewriter installs r for the canonical task type taskType, or for
+// all task types without their own URIRewriter, if taskType is empty. It
+// must be called before Start. Passing nil removes the URIRewriter of
+// taskType, or restores the default, which does not modify URIs.
+func SetURIRewriter(taskType string, r URIRewriter) {
+	if taskType == "" {
+		if r == nil {
+			r = identityRewriter{}
+		}
+		defaultURIRewriter = r
+		return
+	}
+	if r == nil {
+		delete(uriRewriters, taskType)
+		return
+	}
+	uriRewriters[taskType] = r
+}
+
+// uriRewriterFor returns the URIRewriter of the group of task types named
+// by taskType, as chosen by storageGroups.
+func uriRewriterFor(taskType string) URIRewriter {
+	if r, exists := uriRewriters[taskType]; exists {
+		return r
+	}
+	return defaultURIRewriter
+}
+
+// rewriteURIs applies the URIRewriter of taskType to the URIs of task.
+func rewriteURIs(task *tasking.Task, taskType string) error {
+	r := uriRewriterFor(taskType)
+	uri, err := r.RewriteURI(task.PrimaryURI)
+	if err != nil {
+		return errors.New("Invalid Task (Rewriting the PrimaryURI failed: " + err.Error() + ")")
+	}
+	task.PrimaryURI = uri
+	if task.SecondaryURI != "" {
+		if uri, err = r.RewriteURI(task.SecondaryURI); err != nil {
+			return errors.New("Invalid Task (Rewriting the SecondaryURI failed: " + err.Error() + ")")
+		}
+		task.SecondaryURI = uri
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+// s3Rewriter converts relative paths into URIs of the bucket.
+type s3Rewriter struct {
+	bucket string
+}
+
+func (r s3Rewriter) RewriteURI(uri string) (string, error) {
+	if strings.Contains(uri, "://") {
+		return "", errors.New("not a relative path: " + uri)
+	}
+	return "s3://" + r.bucket + "/" + uri, nil
+}
+
+func TestURIRewriter(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:     map[string][]string{"org1": []string{"*"}},
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		SampleStorageURI: "samples/",
+	})
+	SetURIRewriter("YARA", s3Rewriter{bucket: "holmes"})
+	defer SetURIRewriter("YARA", nil)
+
+	task := newTask("YARA", "PEINFO")
+	task.SecondaryURI = "secondary"
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if answer.Error != nil || len(answer.TskErrors) != 0 || len(answer.Accepted) != 2 {
+		t.Fatalf("expected both services accepted: %+v", answer)
+	}
+	msgs := ch.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected the services published separately, got %d messages", len(msgs))
+	}
+	for _, msg := range msgs {
+		if _, yara := msg.Task.Tasks["YARA"]; yara {
+			if msg.Task.PrimaryURI != "s3://holmes/samples/"+task.PrimaryURI || msg.Task.SecondaryURI != "s3://holmes/samples/secondary" {
+				t.Errorf("URIs of YARA not rewritten: %s %s", msg.Task.PrimaryURI, msg.Task.SecondaryURI)
+			}
+		} else if msg.Task.PrimaryURI != "samples/"+task.PrimaryURI {
+			t.Errorf("URI of PEINFO rewritten: %s", msg.Task.PrimaryURI)
+		}
+	}
+	if answer.Accepted[0].PrimaryURI != task.PrimaryURI {
+		t.Errorf("the answer should carry the submitted URI, got %s", answer.Accepted[0].PrimaryURI)
+	}
+
+	// a failing rewriter rejects only the services of its task type
+	conf.SampleStorageURI = "http://storage/"
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_URI_REWRITE_FAILED {
+		t.Fatalf("expected the task rejected: %+v", answer)
+	}
+	if answer.TskErrors[0].TaskStruct.PrimaryURI != task.PrimaryURI {
+		t.Errorf("the rejected task should carry the submitted URI, got %s", answer.TskErrors[0].TaskStruct.PrimaryURI)
+	}
+	if len(ch.messages()) != 2 {
+		t.Errorf("rejected task was published")
+	}
+}
@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"crypto/rsa"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"runtime"
+	"time"
+)
+
+// RSA-decryption is by far the most expensive operation performed for a
+// request. To prevent a flood of bogus keys from occupying all cores, the
+// number of concurrent decryptions is limited. Each decryption needs to
+// acquire a slot from rsaSlots. Requests that cannot acquire a slot within
+// rsaQueueTimeout are rejected.
+var (
+	rsaSlots        chan struct{}
+	rsaQueueTimeout = 100 * time.Millisecond
+)
+
+var errRSABusy = errors.New("Gateway busy, try again later")
+
+// initRSAWorkers sets the number of concurrent RSA decryptions. If workers
+// is not positive, the number of CPUs is used.
+func initRSAWorkers(workers int) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	rsaSlots = make(chan struct{}, workers)
+}
+
+// rsaDecrypt decrypts ciphertext using one of the RSA workers. It returns
+// errRSABusy, if no worker became available in time.
+func rsaDecrypt(ciphertext []byte, key *rsa.PrivateKey) ([]byte, error) {
+	timer := time.NewTimer(rsaQueueTimeout)
+	select {
+	case rsaSlots <- struct{}{}:
+		timer.Stop()
+	case <-timer.C:
+		metrics.Count(metricGroupRSA, metricRSARejected, 1)
+		return nil, errRSABusy
+	}
+	defer func() { <-rsaSlots }()
+
+	start := time.Now()
+	plaintext, err := tasking.RsaDecrypt(ciphertext, key)
+	metrics.Observe(metricGroupRSA, metricRSANanos, time.Since(start))
+	metrics.Count(metricGroupRSA, metricRSATotal, 1)
+	if err != nil {
+		metrics.Count(metricGroupRSA, metricRSAFailed, 1)
+	}
+	return plaintext, err
+}
@@ -0,0 +1,50 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRSAAdmissionControl(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	initRSAWorkers(1)
+	rsaQueueTimeout = 10 * time.Millisecond
+	defer func() { rsaQueueTimeout = 100 * time.Millisecond }()
+
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	rejected := metricValue(rsaMetrics, metricRSARejected)
+
+	// occupy the only worker
+	rsaSlots <- struct{}{}
+	w := httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while the RSA stage is saturated, got %d", w.Code)
+	}
+	if len(ch.messages()) != 0 {
+		t.Errorf("task was published although it was not decrypted")
+	}
+	if metricValue(rsaMetrics, metricRSARejected) != rejected+1 {
+		t.Errorf("rejection was not counted")
+	}
+
+	// free the worker
+	<-rsaSlots
+	w = httptest.NewRecorder()
+	httpRequestIncoming(w, taskRequest(enc))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 after the worker was freed, got %d", w.Code)
+	}
+	answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if len(ch.messages()) != 1 {
+		t.Errorf("task was not published")
+	}
+}
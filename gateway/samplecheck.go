@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// If conf.VerifySamples is set, the gateway sends a HEAD request to the
+// resolved PrimaryURI of every task before dispatching it, so no work is
+// queued for samples missing from the storage. Only http(s) URIs on the
+// hosts of the configured storages are checked, so clients can't make the
+// gateway send requests elsewhere; other URIs are dispatched as before.
+// Redirects are not followed for the same reason. All checks of a ticket
+// share the time of conf.SampleCheckBudget.
+
+var sampleCheckClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var errSampleNotFound = errors.New("Invalid Task (Sample not found)")
+
+// sampleBudget is the time left for checking the samples of a ticket.
+type sampleBudget struct {
+	left time.Duration
+}
+
+// newSampleBudget returns the time for checking the samples of a ticket.
+func newSampleBudget() *sampleBudget {
+	budget := 5000
+	if conf.SampleCheckBudget > 0 {
+		budget = conf.SampleCheckBudget
+	}
+	return &sampleBudget{left: time.Duration(budget) * time.Millisecond}
+}
+
+// storageHost reports whether u is on the host of one of the configured
+// storages.
+func storageHost(u *url.URL) bool {
+	matches := func(prefix string) bool {
+		p, err := url.Parse(prefix)
+		return err == nil && strings.EqualFold(p.Scheme, u.Scheme) && strings.EqualFold(p.Host, u.Host)
+	}
+	if matches(conf.SampleStorageURI) {
+		return true
+	}
+	for _, prefix := range conf.TaskStorageURIs {
+		if matches(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSample checks that the sample at uri exists, within the time left
+// in budget. A missing sample is reported with the reason
+// tasking.REASON_SAMPLE_NOT_FOUND, other failures of the storage with
+// tasking.REASON_DISPATCH_FAILED.
+func checkSample(budget *sampleBudget, uri string) (*tasking.MyError, string) {
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, ""
+	}
+	if !storageHost(u) {
+		log.Printf("Not checking the sample %s outside of the storage", uri)
+		return nil, ""
+	}
+	if budget.left <= 0 {
+		return &tasking.MyError{Error: errors.New("Couldn't check the sample: time for checking the samples of the ticket exceeded"), Code: tasking.ERR_OTHER_RECOVERABLE}, tasking.REASON_DISPATCH_FAILED
+	}
+	req, err := http.NewRequest("HEAD", uri, nil)
+	if err != nil {
+		return &tasking.MyError{Error: err, Code: tasking.ERR_TASK_INVALID}, tasking.REASON_PRIMARY_URI_INVALID
+	}
+	timeout := 2000 * time.Millisecond
+	if conf.SampleCheckTimeout > 0 {
+		timeout = time.Duration(conf.SampleCheckTimeout) * time.Millisecond
+	}
+	if timeout > budget.left {
+		timeout = budget.left
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := sampleCheckClient.Do(req.WithContext(ctx))
+	budget.left -= time.Since(start)
+	if err != nil {
+		log.Println("Error while checking the sample: ", err)
+		return &tasking.MyError{Error: errors.New("Couldn't check the sample: " + err.Error()), Code: tasking.ERR_OTHER_RECOVERABLE}, tasking.REASON_DISPATCH_FAILED
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil, ""
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return &tasking.MyError{Error: errSampleNotFound, Code: tasking.ERR_TASK_INVALID}, tasking.REASON_SAMPLE_NOT_FOUND
+	}
+	log.Printf("Storage answered %s for the sample %s", resp.Status, uri)
+	return &tasking.MyError{Error: errors.New("Couldn't check the sample: storage answered " + resp.Status), Code: tasking.ERR_OTHER_RECOVERABLE}, tasking.REASON_DISPATCH_FAILED
+}
@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifySamples(t *testing.T) {
+	var checked []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checked = append(checked, r.Method+" "+r.URL.Path)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/samples/"):
+		case strings.HasPrefix(r.URL.Path, "/broken/"):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer storage.Close()
+	ch := setupGateway(t, &config{
+		AllowedTasks:     map[string][]string{"org1": []string{"*"}},
+		RabbitDefault:    RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		SampleStorageURI: storage.URL + "/samples/",
+		VerifySamples:    true,
+	})
+	task := newTask("PEINFO")
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if answer.Error != nil || len(answer.TskErrors) != 0 || len(ch.messages()) != 1 {
+		t.Fatalf("expected the existing sample dispatched: %+v", answer)
+	}
+	if len(checked) != 1 || checked[0] != "HEAD /samples/"+task.PrimaryURI {
+		t.Errorf("expected a HEAD request for the sample, got %v", checked)
+	}
+
+	conf.SampleStorageURI = storage.URL + "/missing/"
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_SAMPLE_NOT_FOUND ||
+		answer.TskErrors[0].Error.Code != tasking.ERR_TASK_INVALID {
+		t.Fatalf("expected the missing sample rejected: %+v", answer)
+	}
+	if len(ch.messages()) != 1 {
+		t.Errorf("task of a missing sample was dispatched")
+	}
+
+	// errors of the storage don't mean the sample is missing
+	conf.SampleStorageURI = storage.URL + "/broken/"
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Reason != tasking.REASON_DISPATCH_FAILED ||
+		answer.TskErrors[0].Error.Code != tasking.ERR_OTHER_RECOVERABLE {
+		t.Fatalf("expected a recoverable error: %+v", answer)
+	}
+
+	// without the option, nothing is checked
+	conf.SampleStorageURI = storage.URL + "/missing/"
+	conf.VerifySamples = false
+	checked = nil
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), task))
+	if len(answer.TskErrors) != 0 || len(checked) != 0 || len(ch.messages()) != 2 {
+		t.Errorf("expected the task dispatched unchecked: %v %+v", checked, answer)
+	}
+}
+
+func TestVerifySamplesOnlyAtStorage(t *testing.T) {
+	var elsewhere []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elsewhere = append(elsewhere, r.URL.Path)
+	}))
+	defer other.Close()
+	var mutex sync.Mutex
+	var checked []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		checked = append(checked, r.URL.Path)
+		mutex.Unlock()
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/moved/"):
+			http.Redirect(w, r, other.URL+r.URL.Path, http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, "/slow/"):
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer storage.Close()
+	ch := setupGateway(t, &config{
+		AllowedTasks:      map[string][]string{"org1": []string{"*"}},
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		SampleStorageURI:  storage.URL + "/moved/",
+		VerifySamples:     true,
+		SampleCheckBudget: 30,
+	})
+
+	// redirects are not followed
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_OTHER_RECOVERABLE || len(ch.messages()) != 0 {
+		t.Fatalf("expected the redirected check to fail: %+v", answer)
+	}
+	if len(elsewhere) != 0 {
+		t.Errorf("redirect was followed to %v", elsewhere)
+	}
+
+	// other hosts are not checked
+	if myerr, _ := checkSample(newSampleBudget(), other.URL+"/internal"); myerr != nil || len(elsewhere) != 0 {
+		t.Errorf("sample outside of the storage was checked: %v %v", myerr, elsewhere)
+	}
+
+	// the checks of a ticket share their time
+	mutex.Lock()
+	checked = nil
+	mutex.Unlock()
+	conf.SampleStorageURI = storage.URL + "/slow/"
+	first, second := newTask("PEINFO"), newTask("PEINFO")
+	second.PrimaryURI = strings.Repeat("b", 64)
+	start := time.Now()
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), first, second))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("checks took %s", elapsed)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(answer.TskErrors) != 2 || len(checked) != 1 {
+		t.Errorf("expected the budget exhausted after the first check: %v %+v", checked, answer)
+	}
+}
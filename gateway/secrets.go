@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A SecretProvider fetches secrets like the RabbitPassword from an
+// external store, e.g. Vault or AWS Secrets Manager. It is passed the
+// configured value, and decides itself how this refers to the secret.
+// Secrets are fetched again before every connection to RabbitMQ, so
+// rotated ones are picked up on the next reconnect.
+type SecretProvider interface {
+	Secret(ref string) (string, error)
+}
+
+// refSecrets is the default SecretProvider. It reads "env:NAME" from the
+// environment variable NAME and "file:PATH" from the file PATH, without
+// a trailing newline. Any other value is the secret itself.
+type refSecrets struct{}
+
+func (refSecrets) Secret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		secret, exists := os.LookupEnv(name)
+		if !exists {
+			return "", errors.New("Environment variable " + name + " not set")
+		}
+		return secret, nil
+	case strings.HasPrefix(ref, "file:"):
+		secret, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(secret), "\r\n"), nil
+	}
+	return ref, nil
+}
+
+var (
+	secretProvider SecretProvider = refSecrets{}
+
+	rabbitPassword      string // the RabbitPassword fetched last
+	rabbitPasswordMutex = &sync.Mutex{}
+)
+
+// SetSecretProvider installs p as the SecretProvider. It must be called
+// before Start. Passing nil restores the default, which understands
+// "env:" and "file:" references.
+func SetSecretProvider(p SecretProvider) {
+	if p == nil {
+		p = refSecrets{}
+	}
+	secretProvider = p
+}
+
+// fetchRabbitPassword fetches the RabbitPassword from the SecretProvider
+// for the next connection.
+func fetchRabbitPassword() error {
+	password, err := secretProvider.Secret(conf.RabbitPassword)
+	if err != nil {
+		return errors.New("Failed to fetch the RabbitPassword: " + err.Error())
+	}
+	rabbitPasswordMutex.Lock()
+	rabbitPassword = password
+	rabbitPasswordMutex.Unlock()
+	return nil
+}
+
+// currentRabbitPassword returns the RabbitPassword fetched last.
+func currentRabbitPassword() string {
+	rabbitPasswordMutex.Lock()
+	defer rabbitPasswordMutex.Unlock()
+	return rabbitPassword
+}
@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// rotatingSecrets is a SecretProvider handing out a new password every
+// time it is asked.
+type rotatingSecrets struct {
+	sync.Mutex
+	fetched []string
+	err     error
+}
+
+func (p *rotatingSecrets) Secret(ref string) (string, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.err != nil {
+		return "", p.err
+	}
+	p.fetched = append(p.fetched, ref)
+	return ref + "-" + strconv.Itoa(len(p.fetched)), nil
+}
+
+func TestReconnectFetchesRotatedPassword(t *testing.T) {
+	setupGateway(t, &config{
+		RabbitPassword: "vault:rabbit",
+		RabbitDefault:  RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	provider := &rotatingSecrets{}
+	SetSecretProvider(provider)
+	var dialedWith []string
+	dialRabbit = func() (amqpChannel, error) {
+		dialedWith = append(dialedWith, currentRabbitPassword())
+		return &fakeChannel{}, nil
+	}
+
+	if err := connectRabbit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectRabbit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(dialedWith) != 2 || dialedWith[0] != "vault:rabbit-1" || dialedWith[1] != "vault:rabbit-2" {
+		t.Errorf("expected the reconnect to use the rotated password, got %v", dialedWith)
+	}
+
+	// without the password, no connection is attempted
+	provider.err = errors.New("vault sealed")
+	if err := connectRabbit(); err == nil {
+		t.Errorf("expected an error if the password can't be fetched")
+	}
+	if len(dialedWith) != 2 {
+		t.Errorf("connected without a password")
+	}
+}
+
+func TestRefSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rabbit")
+	ioutil.WriteFile(path, []byte("from-file\n"), 0600)
+	os.Setenv("HOLMES_TEST_RABBIT_PASSWORD", "from-env")
+	defer os.Unsetenv("HOLMES_TEST_RABBIT_PASSWORD")
+
+	for ref, expected := range map[string]string{
+		"literal":                         "literal",
+		"env:HOLMES_TEST_RABBIT_PASSWORD": "from-env",
+		"file:" + path:                    "from-file",
+	} {
+		if secret, err := (refSecrets{}).Secret(ref); err != nil || secret != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", ref, expected, secret, err)
+		}
+	}
+	for _, ref := range []string{"env:HOLMES_TEST_UNSET", "file:" + filepath.Join(dir, "missing")} {
+		if _, err := (refSecrets{}).Secret(ref); err == nil {
+			t.Errorf("%s: expected an error", ref)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// The self-test lets monitoring detect a broken crypto subsystem, e.g. a
+// corrupted source key, before clients do. Administrative organizations
+// (see conf.AdminOrganizations) run it with "GET /admin/selftest".
+
+// SelfTestCheck is the result of testing a single primitive.
+type SelfTestCheck struct {
+	Name   string // "aes" or "rsa:<name of the source key>"
+	Passed bool
+	Error  string `json:",omitempty"`
+}
+
+// SelfTestResult is the answer of /admin/selftest.
+type SelfTestResult struct {
+	Passed bool // true, if all checks passed
+	Checks []SelfTestCheck
+}
+
+var selfTestPayload = []byte("Holmes-Gateway self-test")
+
+// selfTestAES encrypts and decrypts selfTestPayload with a throwaway key.
+func selfTestAES() error {
+	symKey := make([]byte, 16)
+	iv := make([]byte, 16)
+	if _, err := rand.Read(symKey); err != nil {
+		return err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+	encrypted, err := tasking.AesEncrypt(selfTestPayload, symKey, iv)
+	if err != nil {
+		return err
+	}
+	decrypted, err := tasking.AesDecrypt(encrypted, symKey, iv)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(decrypted, selfTestPayload) {
+		return errors.New("Decrypted payload differs")
+	}
+	return nil
+}
+
+// selfTestRSA encrypts selfTestPayload with the public part of key and
+// decrypts it again like the symmetric key of a ticket.
+func selfTestRSA(key *rsa.PrivateKey) error {
+	if err := key.Validate(); err != nil {
+		return err
+	}
+	encrypted, err := tasking.RsaEncrypt(selfTestPayload, &key.PublicKey)
+	if err != nil {
+		return err
+	}
+	decrypted, err := rsaDecrypt(encrypted, key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(decrypted, selfTestPayload) {
+		return errors.New("Decrypted payload differs")
+	}
+	return nil
+}
+
+// runSelfTest tests AES and every loaded source key.
+func runSelfTest() SelfTestResult {
+	keysMutex.Lock()
+	sourceKeys := make(map[string]*rsa.PrivateKey, len(keys))
+	for name, key := range keys {
+		sourceKeys[name] = key
+	}
+	keysMutex.Unlock()
+	names := make([]string, 0, len(sourceKeys))
+	for name := range sourceKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := SelfTestResult{Passed: true}
+	add := func(name string, err error) {
+		check := SelfTestCheck{Name: name, Passed: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+			result.Passed = false
+			log.Printf("Self-test of %s failed: %s", name, err)
+		}
+		result.Checks = append(result.Checks, check)
+	}
+	add("aes", selfTestAES())
+	for _, name := range names {
+		add("rsa:"+name, selfTestRSA(sourceKeys[name]))
+	}
+	return result
+}
+
+// httpRequestSelfTest runs the self-test for an administrative
+// organization authenticated by orgAuthMiddleware. It answers with 500,
+// if a check failed.
+func httpRequestSelfTest(w http.ResponseWriter, r *http.Request) {
+	org := orgFromContext(r)
+	if !isAdmin(tenantFor(r), org) {
+		log.Printf("Request to %s denied: %s is no administrator", r.URL.Path, org)
+		http.Error(w, "Not allowed", http.StatusForbidden)
+		return
+	}
+	result := runSelfTest()
+	x, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Passed {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write(x)
+}
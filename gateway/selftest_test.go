@@ -0,0 +1,54 @@
+package gateway
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	setupGateway(t, &config{AdminOrganizations: []string{"org1"}})
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	selfTest := func() (int, SelfTestResult) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, signedNonceRequest(t, "GET", "/admin/selftest", "org1", time.Now()))
+		var result SelfTestResult
+		if w.Code != http.StatusForbidden {
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatalf("%s: %s", err, w.Body.String())
+			}
+		}
+		return w.Code, result
+	}
+
+	status, result := selfTest()
+	if status != http.StatusOK || !result.Passed || len(result.Checks) != 2 {
+		t.Fatalf("self-test with good keys failed: %d %+v", status, result)
+	}
+	if result.Checks[0].Name != "aes" || result.Checks[1].Name != "rsa:src1" {
+		t.Errorf("unexpected checks: %+v", result.Checks)
+	}
+
+	// a private key not matching its public key
+	broken := *sourceKey(t)
+	broken.PublicKey = rsa.PublicKey{N: ticketKey(t).N, E: ticketKey(t).E}
+	keys["src2"] = &broken
+	status, result = selfTest()
+	if status != http.StatusInternalServerError || result.Passed {
+		t.Fatalf("self-test with a broken key passed: %d %+v", status, result)
+	}
+	for _, check := range result.Checks {
+		if check.Passed != (check.Name != "rsa:src2") {
+			t.Errorf("unexpected result of %s: %+v", check.Name, check)
+		}
+	}
+
+	conf.AdminOrganizations = nil
+	if status, _ := selfTest(); status != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-administrator, got %d", status)
+	}
+}
@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"strconv"
+	"sync"
+)
+
+// With conf.TicketSequences, every ticket carries a Sequence, which an
+// organization increments for each ticket. A ticket is rejected, if its
+// sequence was already seen, so a captured ticket can't be replayed. This
+// takes a single counter and a bitmap per organization, instead of
+// remembering every ticket. To tolerate tickets overtaking each other on
+// their way to the gateway, sequences up to conf.SequenceWindow below the
+// highest one seen are still accepted once.
+
+// maxSequenceWindow is the number of bits of sequenceState.seen.
+const maxSequenceWindow = 64
+
+// sequenceState is the replay state of an organization. Bit i of seen is
+// set, if the sequence highest-i was seen.
+type sequenceState struct {
+	highest uint64
+	seen    uint64
+}
+
+var (
+	sequenceStates = make(map[string]*sequenceState) // scope + "\n" + organization -> state
+	sequenceMutex  = &sync.Mutex{}
+)
+
+// claimSequence records the sequence of a ticket of org in scope. It fails,
+// if the sequence was already seen, or is too far below the highest one.
+func claimSequence(scope, org string, sequence uint64) *tasking.MyError {
+	if sequence == 0 {
+		return &tasking.MyError{Error: errors.New("Ticket malformed (Sequence missing)"), Code: tasking.ERR_TASK_INVALID}
+	}
+	window := uint64(conf.SequenceWindow)
+	if window > maxSequenceWindow {
+		window = maxSequenceWindow
+	}
+	sequenceMutex.Lock()
+	defer sequenceMutex.Unlock()
+	key := scope + "\n" + org
+	state, exists := sequenceStates[key]
+	if !exists {
+		state = &sequenceState{}
+		sequenceStates[key] = state
+	}
+	if sequence > state.highest {
+		if shift := sequence - state.highest; shift < maxSequenceWindow {
+			state.seen <<= shift
+		} else {
+			state.seen = 0
+		}
+		state.seen |= 1
+		state.highest = sequence
+		return nil
+	}
+	distance := state.highest - sequence
+	if distance >= window && distance != 0 {
+		return &tasking.MyError{Error: errors.New("Ticket too old (Sequence " + strconv.FormatUint(sequence, 10) + ", highest seen " + strconv.FormatUint(state.highest, 10) + ")"), Code: tasking.ERR_OTHER_UNRECOVERABLE}
+	}
+	if state.seen&(1<<distance) != 0 {
+		return &tasking.MyError{Error: errors.New("Ticket replayed (Sequence " + strconv.FormatUint(sequence, 10) + " already seen)"), Code: tasking.ERR_OTHER_UNRECOVERABLE}
+	}
+	state.seen |= 1 << distance
+	return nil
+}
+
+// releaseSequence forgets the sequence of a ticket of org in scope, which
+// was claimed, but of which nothing was dispatched, so the ticket can be
+// submitted again with the same sequence. The highest sequence is kept.
+func releaseSequence(scope, org string, sequence uint64) {
+	sequenceMutex.Lock()
+	defer sequenceMutex.Unlock()
+	state, exists := sequenceStates[scope+"\n"+org]
+	if !exists || sequence > state.highest {
+		return
+	}
+	if distance := state.highest - sequence; distance < maxSequenceWindow {
+		state.seen &^= 1 << distance
+	}
+}
@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"testing"
+	"time"
+)
+
+// sequencedTicket returns a ticket of org1 with the given sequence.
+func sequencedTicket(t *testing.T, sequence uint64) string {
+	ticket := tasking.Ticket{
+		Expiration:  time.Now().Add(time.Hour),
+		Tasks:       []tasking.Task{newTask("PEINFO")},
+		SignerKeyId: "org1",
+		Sequence:    sequence}
+	if err := tasking.SignTicket(&ticket, ticketKey(t), ""); err != nil {
+		t.Fatal(err)
+	}
+	x, _ := json.Marshal(ticket)
+	return string(x)
+}
+
+func TestTicketSequences(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:    map[string][]string{"org1": []string{"*"}},
+		TicketSequences: true,
+		SequenceWindow:  4,
+		RabbitDefault:   RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	tests := []struct {
+		sequence uint64
+		accepted bool
+	}{
+		{1, true}, {2, true}, {3, true}, // in order
+		{3, false}, {1, false}, // replayed
+		{10, true}, {8, true}, {9, true}, {7, true}, // slightly out of order
+		{8, false},             // replayed within the window
+		{6, false},             // below the window
+		{75, true}, {74, true}, // far ahead
+		{10, false},
+	}
+	for _, test := range tests {
+		published := len(ch.messages())
+		answer := handleDecrypted(sequencedTicket(t, test.sequence))
+		if test.accepted && answer.Error != nil {
+			t.Errorf("sequence %d rejected: %s", test.sequence, answer.Error.Error)
+		}
+		if !test.accepted && (answer.Error == nil || answer.Error.Code != tasking.ERR_OTHER_UNRECOVERABLE || len(ch.messages()) != published) {
+			t.Errorf("sequence %d accepted", test.sequence)
+		}
+	}
+
+	// dry runs don't use up a sequence
+	if answer := handleTicket(nil, sequencedTicket(t, 76), true, false, nil); answer.Error != nil {
+		t.Fatalf("dry run rejected: %s", answer.Error.Error)
+	}
+	if answer := handleDecrypted(sequencedTicket(t, 76)); answer.Error != nil {
+		t.Errorf("sequence of a dry run used up: %s", answer.Error.Error)
+	}
+
+	answer := handleDecrypted(sequencedTicket(t, 0))
+	if answer.Error == nil || answer.Error.Code != tasking.ERR_TASK_INVALID {
+		t.Errorf("ticket without a sequence accepted: %+v", answer)
+	}
+}
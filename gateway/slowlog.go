@@ -0,0 +1,31 @@
+package gateway
+
+import (
+	"time"
+)
+
+// If conf.SlowRequestThreshold is set, every request submitting a ticket
+// which takes longer is logged as a warning, along with the time spent in
+// its phases. This points at the cause of latency outliers, which the
+// metrics only show in aggregate.
+
+// requestTimings records where the time of a request submitting a ticket
+// was spent. A nil *requestTimings records nothing.
+type requestTimings struct {
+	decrypt time.Duration // decrypting the ticket
+	verify  time.Duration // verifying the signature, ACL, and limits
+	publish time.Duration // dispatching the accepted services
+	traceID string
+	org     string
+	tasks   int
+}
+
+// logSlowRequest warns, if the request of timings took the time total,
+// which exceeds conf.SlowRequestThreshold.
+func logSlowRequest(timings *requestTimings, total time.Duration) {
+	if conf.SlowRequestThreshold <= 0 || total < time.Duration(conf.SlowRequestThreshold)*time.Millisecond {
+		return
+	}
+	logRequest("WARNING: Slow request of ticket %s of '%s' with %d tasks: %s (decrypt %s, verify %s, publish %s)",
+		timings.traceID, timings.org, timings.tasks, total, timings.decrypt, timings.verify, timings.publish)
+}
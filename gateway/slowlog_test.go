@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowRequestLog(t *testing.T) {
+	// a slow service delays publishing
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer hook.Close()
+	setupGateway(t, &config{
+		AllowedTasks:         map[string][]string{"org1": []string{"*"}},
+		RabbitDefault:        RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit:               map[string]RabbitConf{"YARA": {Webhook: hook.URL}},
+		SlowRequestThreshold: 40,
+	})
+	lines, restore := captureRequestLog()
+	defer restore()
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	slow := func() []string {
+		var warnings []string
+		for _, line := range lines() {
+			if strings.Contains(line, "Slow request") {
+				warnings = append(warnings, line)
+			}
+		}
+		return warnings
+	}
+
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	mux.ServeHTTP(httptest.NewRecorder(), taskRequest(enc))
+	if warnings := slow(); len(warnings) != 0 {
+		t.Fatalf("fast request logged as slow: %v", warnings)
+	}
+
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA"), newTask("PEINFO")))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, taskRequest(enc))
+	answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+	warnings := slow()
+	if len(warnings) != 1 {
+		t.Fatalf("expected one slow request logged, got %v", warnings)
+	}
+	for _, part := range []string{"WARNING", "ticket " + answer.TraceID + " ", "'org1'", "2 tasks", "decrypt ", "verify "} {
+		if !strings.Contains(warnings[0], part) {
+			t.Errorf("warning lacks %q: %s", part, warnings[0])
+		}
+	}
+	// the delay is attributed to publishing
+	i := strings.Index(warnings[0], "publish ")
+	if i < 0 {
+		t.Fatalf("warning lacks the publish phase: %s", warnings[0])
+	}
+	publish, err := time.ParseDuration(strings.TrimSuffix(warnings[0][i+len("publish "):], ")"))
+	if err != nil || publish < 50*time.Millisecond {
+		t.Errorf("expected at least 50ms spent publishing, got %s: %v", publish, err)
+	}
+}
@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The spool buffers tasks on disk, which could not be published because
+// the broker is unreachable. A background drainer republishes them once
+// the broker is back. Every spooled task is a file in conf.SpoolDir, so
+// the spool survives restarts of the gateway.
+
+// spooledMsg is the content of a spool file. Expires is the absolute time
+// the message expires, if it has an expiration, since the remaining TTL
+// shrinks while the message waits in the spool.
+type spooledMsg struct {
+	Exchange      string
+	RoutingKey    string
+	Body          []byte
+	CorrelationId string     `json:",omitempty"`
+	ReplyTo       string     `json:",omitempty"`
+	Headers       amqp.Table `json:",omitempty"`
+	Expires       *time.Time `json:",omitempty"`
+}
+
+var spoolMutex = &sync.Mutex{}
+var drainMutex = &sync.Mutex{}
+var spoolCount int  // number of files in the spool
+var spoolSeq uint64 // distinguishes files spooled in the same nanosecond
+var errSpoolFull = errors.New("Spool is full")
+
+const spoolExt = ".task"
+const defaultSpoolMaxTasks = 10000
+
+// initSpool creates the spool directory, if necessary, and counts the
+// tasks left over from a previous run.
+func initSpool() error {
+	if err := os.MkdirAll(conf.SpoolDir, 0700); err != nil {
+		return err
+	}
+	files, err := spoolFiles()
+	if err != nil {
+		return err
+	}
+	spoolMutex.Lock()
+	spoolCount = len(files)
+	spoolMutex.Unlock()
+	if len(files) != 0 {
+		log.Printf("Found %d spooled tasks", len(files))
+	}
+	return nil
+}
+
+// spoolFiles returns the paths of all spooled tasks, oldest first.
+func spoolFiles() ([]string, error) {
+	infos, err := ioutil.ReadDir(conf.SpoolDir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), spoolExt) {
+			files = append(files, filepath.Join(conf.SpoolDir, info.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// spool writes a message, which could not be published to rconf, to disk.
+func spool(rconf *RabbitConf, pub amqp.Publishing) error {
+	max := conf.SpoolMaxTasks
+	if max <= 0 {
+		max = defaultSpoolMaxTasks
+	}
+	msg := spooledMsg{Exchange: rconf.Exchange, RoutingKey: rconf.RoutingKey, Body: pub.Body, CorrelationId: pub.CorrelationId, ReplyTo: pub.ReplyTo, Headers: pub.Headers}
+	if pub.Expiration != "" {
+		ttl, err := strconv.ParseInt(pub.Expiration, 10, 64)
+		if err != nil {
+			return err
+		}
+		expires := timeNow().Add(time.Duration(ttl) * time.Millisecond)
+		msg.Expires = &expires
+	}
+	x, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	spoolMutex.Lock()
+	defer spoolMutex.Unlock()
+	if spoolCount >= max {
+		return errSpoolFull
+	}
+	spoolSeq++
+	// zero-padded, so the lexical order of the names is the spool order
+	name := filepath.Join(conf.SpoolDir, fmt.Sprintf("%020d-%010d", time.Now().UnixNano(), spoolSeq))
+	// write to a temporary file first, so a crash leaves no partial task
+	if err := ioutil.WriteFile(name+".tmp", x, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name+spoolExt); err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	spoolCount++
+	return nil
+}
+
+// drainSpool republishes the spooled tasks, oldest first, and returns the
+// number of tasks that were published. It stops at the first failure and
+// restores the connection for the next attempt.
+func drainSpool() (int, error) {
+	return drainSpoolUntil(nil)
+}
+
+// drainSpoolUntil drains the spool like drainSpool, but stops before the
+// next task once stop is closed. Drains are serialized by drainMutex, so
+// no task is republished twice.
+func drainSpoolUntil(stop <-chan struct{}) (int, error) {
+	drainMutex.Lock()
+	defer drainMutex.Unlock()
+	files, err := spoolFiles()
+	if err != nil {
+		return 0, err
+	}
+	drained := 0
+	for _, file := range files {
+		select {
+		case <-stop:
+			return drained, nil
+		default:
+		}
+		x, err := ioutil.ReadFile(file)
+		if err != nil {
+			return drained, err
+		}
+		var msg spooledMsg
+		if err := json.Unmarshal(x, &msg); err != nil {
+			log.Printf("Dropping corrupt spool file %s: %s", file, err)
+		} else if msg.Expires != nil && !timeNow().Before(*msg.Expires) {
+			log.Printf("Dropping spooled task for %s with routing key %s: expired at %s", msg.Exchange, msg.RoutingKey, msg.Expires.Format(time.RFC3339))
+		} else {
+			pub := amqp.Publishing{DeliveryMode: amqp.Persistent, ContentType: "text/plain", Body: msg.Body, CorrelationId: msg.CorrelationId, ReplyTo: msg.ReplyTo, Headers: msg.Headers}
+			if msg.Expires != nil {
+				pub.Expiration = messageTTL(*msg.Expires)
+			}
+			generation, err := publishWithTimeout(&RabbitConf{Exchange: msg.Exchange, RoutingKey: msg.RoutingKey}, pub)
+			if err == errUnroutable || err == errPublishNacked {
+				// retrying would block the spool forever
+				log.Printf("Dropping spooled task for %s with routing key %s: %s", msg.Exchange, msg.RoutingKey, err)
+			} else if err != nil {
+				if err != errPublishTimeout {
+					reconnectRabbit(generation)
+				}
+				return drained, err
+			} else {
+				drained++
+			}
+		}
+		if err := os.Remove(file); err != nil {
+			return drained, err
+		}
+		spoolMutex.Lock()
+		spoolCount--
+		spoolMutex.Unlock()
+	}
+	return drained, nil
+}
+
+// drainSpoolForever periodically drains the spool.
+func drainSpoolForever() {
+	interval := time.Duration(conf.SpoolDrainInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for range time.Tick(interval) {
+		spoolMutex.Lock()
+		empty := spoolCount == 0
+		spoolMutex.Unlock()
+		if empty {
+			continue
+		}
+		drained, err := drainSpool()
+		if drained != 0 {
+			log.Printf("Republished %d spooled tasks", drained)
+		}
+		if err != nil {
+			log.Println("Error while draining the spool: ", err)
+		}
+	}
+}
+
+// drainSpoolOnShutdown republishes the spooled tasks for at most
+// conf.SpoolShutdownTimeout seconds, when the gateway shuts down. The
+// tasks which could not be published in time stay in the spool for the
+// next start. It returns the numbers of flushed and of remaining tasks.
+func drainSpoolOnShutdown() (int, int) {
+	timeout := time.Duration(conf.SpoolShutdownTimeout) * time.Second
+	spoolMutex.Lock()
+	before := spoolCount
+	spoolMutex.Unlock()
+	if timeout <= 0 || before == 0 {
+		return 0, before
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := drainSpoolUntil(stop)
+		done <- err
+	}()
+	timer := time.NewTimer(timeout)
+	select {
+	case err := <-done:
+		timer.Stop()
+		if err != nil {
+			log.Println("Error while draining the spool on shutdown: ", err)
+		}
+	case <-timer.C:
+		// a publish in progress can't be aborted, so it is abandoned
+		close(stop)
+	}
+
+	spoolMutex.Lock()
+	left := spoolCount
+	spoolMutex.Unlock()
+	log.Printf("Flushed %d spooled tasks on shutdown, %d left for the next start", before-left, left)
+	return before - left, left
+}
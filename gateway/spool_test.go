@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSpoolDuringOutage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		SpoolDir:      dir,
+		SpoolMaxTasks: 2,
+	}
+	ch := setupGateway(t, c)
+	if err := initSpool(); err != nil {
+		t.Fatal(err)
+	}
+
+	// outage: publishing fails and the connection can't be restored
+	ch.publishErr = errors.New("connection reset")
+	dialRabbit = func() (amqpChannel, error) {
+		return nil, errors.New("connection refused")
+	}
+	for i := 0; i < 3; i++ {
+		answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+		if i < 2 && len(answer.TskErrors) != 0 {
+			t.Fatalf("task should have been spooled: %+v", answer.TskErrors)
+		}
+		if i == 2 && len(answer.TskErrors) != 1 {
+			t.Fatalf("task beyond the spool limit should fail")
+		}
+	}
+	files, _ := spoolFiles()
+	if len(files) != 2 {
+		t.Fatalf("expected 2 spooled tasks, got %d", len(files))
+	}
+
+	// the spool survives a restart
+	spoolCount = 0
+	if err := initSpool(); err != nil {
+		t.Fatal(err)
+	}
+	if spoolCount != 2 {
+		t.Errorf("expected 2 spooled tasks after restart, got %d", spoolCount)
+	}
+
+	// draining while the broker is still down keeps the tasks
+	if drained, err := drainSpool(); err == nil || drained != 0 {
+		t.Errorf("drain should fail during the outage")
+	}
+
+	// the broker recovers
+	dialed := fakeDialer()
+	if drained, err := drainSpool(); err == nil || drained != 0 {
+		t.Errorf("first drain should fail on the broken channel and reconnect")
+	}
+	if drained, err := drainSpool(); err != nil || drained != 2 {
+		t.Fatalf("expected 2 drained tasks, got %d (%v)", drained, err)
+	}
+	msgs := (*dialed)[0].messages()
+	if len(msgs) != 2 || msgs[0].Exchange != "totem" || len(msgs[0].Task.Tasks) != 1 {
+		t.Errorf("spooled tasks not republished correctly: %+v", msgs)
+	}
+	if files, _ := spoolFiles(); len(files) != 0 || spoolCount != 0 {
+		t.Errorf("drained tasks left in the spool")
+	}
+}
+
+// stallingChannel publishes the first n messages and blocks afterwards,
+// until release is closed.
+type stallingChannel struct {
+	*fakeChannel
+	n       int
+	release chan struct{}
+}
+
+func (s *stallingChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if len(s.messages()) >= s.n {
+		<-s.release
+	}
+	return s.fakeChannel.Publish(exchange, key, mandatory, immediate, msg)
+}
+
+func TestSpoolDrainOnShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setupGateway(t, &config{
+		RabbitDefault:        RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		SpoolDir:             dir,
+		SpoolShutdownTimeout: 1,
+	})
+	if err := initSpool(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := spool(&conf.RabbitDefault, amqp.Publishing{Body: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broker := &stallingChannel{fakeChannel: &fakeChannel{}, n: 2, release: make(chan struct{})}
+	rabbitChannel = broker
+
+	start := time.Now()
+	flushed, left := drainSpoolOnShutdown()
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("shutdown drain took %s", elapsed)
+	}
+	if flushed != 2 || left != 2 {
+		t.Errorf("expected 2 flushed and 2 left, got %d and %d", flushed, left)
+	}
+	// the abandoned publish finishes, but the last task stays
+	close(broker.release)
+	drainMutex.Lock()
+	drainMutex.Unlock()
+	if files, _ := spoolFiles(); len(files) != 1 {
+		t.Errorf("expected 1 task left in the spool, got %d", len(files))
+	}
+
+	// without a timeout, the spool is left as it is
+	conf.SpoolShutdownTimeout = 0
+	if flushed, left := drainSpoolOnShutdown(); flushed != 0 || left != 1 {
+		t.Errorf("spool drained without a timeout: %d flushed, %d left", flushed, left)
+	}
+}
+
+func TestSpoolExpiration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setupGateway(t, &config{
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		SpoolDir:      dir,
+	})
+	if err := initSpool(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	for _, pub := range []amqp.Publishing{
+		{Body: []byte("{}"), Expiration: "60000", CorrelationId: "trace-1", ReplyTo: "results"},
+		{Body: []byte("{}"), Expiration: "1000"},
+		{Body: []byte("{}")},
+	} {
+		if err := spool(&conf.RabbitDefault, pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the tasks waited in the spool for half a minute
+	now = now.Add(30 * time.Second)
+	ch := &fakeChannel{}
+	rabbitChannel = ch
+	if drained, err := drainSpool(); err != nil || drained != 2 {
+		t.Fatalf("expected 2 drained tasks, got %d (%v)", drained, err)
+	}
+	msgs := ch.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected the expired task to be dropped, got %+v", msgs)
+	}
+	if msgs[0].Publishing.Expiration != "30000" {
+		t.Errorf("expected the remaining TTL, got %q", msgs[0].Publishing.Expiration)
+	}
+	if msgs[0].Publishing.ReplyTo != "results" || msgs[0].Publishing.CorrelationId != "trace-1" {
+		t.Errorf("result routing of the spooled task lost: %+v", msgs[0].Publishing)
+	}
+	if msgs[1].Publishing.Expiration != "" {
+		t.Errorf("task without expiration got %q", msgs[1].Publishing.Expiration)
+	}
+	if files, _ := spoolFiles(); len(files) != 0 || spoolCount != 0 {
+		t.Errorf("tasks left in the spool")
+	}
+}
@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The counters of the tickets are passed to the metrics backend, and are
+// additionally kept in memory, so administrators can fetch a snapshot
+// from /admin/stats regardless of the backend in use.
+
+// OrganizationStats counts the tickets of an organization.
+type OrganizationStats struct {
+	Processed int64
+	Rejected  int64
+}
+
+// StatsSnapshot is the answer of /admin/stats. Tickets are counted once
+// they are decrypted; replays answered from the idempotency cache and
+// dry runs are not counted. Organizations are only known for tickets
+// with a valid signature.
+type StatsSnapshot struct {
+	Since            time.Time
+	TicketsProcessed int64
+	TicketsRejected  int64
+	PublishFailures  int64
+	Organizations    map[string]OrganizationStats
+}
+
+type gatewayStats struct {
+	sync.Mutex
+	since           time.Time
+	processed       int64
+	rejected        int64
+	publishFailures int64
+	orgs            map[string]*OrganizationStats
+}
+
+var stats = newGatewayStats()
+
+func newGatewayStats() *gatewayStats {
+	return &gatewayStats{since: time.Now().UTC(), orgs: make(map[string]*OrganizationStats)}
+}
+
+// countTicket counts a ticket of org, which is empty if the ticket wasn't
+// verified.
+func countTicket(org string, rejected bool) {
+	key := metricTicketsProcessed
+	if rejected {
+		key = metricTicketsRejected
+	}
+	metrics.Count(metricGroupTickets, key, 1)
+	if org != "" {
+		metrics.Count(metricGroupTickets, key+"_"+org, 1)
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+	var o *OrganizationStats
+	if org != "" {
+		if o = stats.orgs[org]; o == nil {
+			o = &OrganizationStats{}
+			stats.orgs[org] = o
+		}
+	}
+	if rejected {
+		stats.rejected++
+		if o != nil {
+			o.Rejected++
+		}
+	} else {
+		stats.processed++
+		if o != nil {
+			o.Processed++
+		}
+	}
+}
+
+// countPublishFailure counts a task which couldn't be published.
+func countPublishFailure() {
+	metrics.Count(metricGroupRabbit, metricPublishFailed, 1)
+	stats.Lock()
+	stats.publishFailures++
+	stats.Unlock()
+}
+
+// snapshot returns a copy of the counters.
+func (s *gatewayStats) snapshot() StatsSnapshot {
+	s.Lock()
+	defer s.Unlock()
+	snap := StatsSnapshot{
+		Since:            s.since,
+		TicketsProcessed: s.processed,
+		TicketsRejected:  s.rejected,
+		PublishFailures:  s.publishFailures,
+		Organizations:    make(map[string]OrganizationStats, len(s.orgs)),
+	}
+	for org, o := range s.orgs {
+		snap.Organizations[org] = *o
+	}
+	return snap
+}
+
+// httpRequestStats answers with a JSON-encoded StatsSnapshot for an
+// administrative organization authenticated by orgAuthMiddleware.
+func httpRequestStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	org := orgFromContext(r)
+	if !isAdmin(tenantFor(r), org) {
+		log.Printf("Request to %s denied: %s is no administrator", r.URL.Path, org)
+		http.Error(w, "Not allowed", http.StatusForbidden)
+		return
+	}
+	x, _ := json.Marshal(stats.snapshot())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(x)
+}
@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	setupGateway(t, &config{
+		AdminOrganizations: []string{"org1"},
+		AllowedTasks:       map[string][]string{"org1": []string{"*"}},
+		RabbitDefault:      RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit:             map[string]RabbitConf{"YARA": {Webhook: server.URL}},
+	})
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	snapshot := func(org string) (int, StatsSnapshot) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, signedNonceRequest(t, "GET", "/admin/stats", org, time.Now()))
+		var snap StatsSnapshot
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil {
+				t.Fatalf("%s: %s", err, w.Body.String())
+			}
+		}
+		return w.Code, snap
+	}
+
+	status, snap := snapshot("org1")
+	if status != http.StatusOK || snap.TicketsProcessed != 0 || snap.TicketsRejected != 0 || len(snap.Organizations) != 0 {
+		t.Fatalf("expected empty stats: %d %+v", status, snap)
+	}
+
+	handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	// the webhook answers 404
+	handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA")))
+	handleDecrypted(signTicket(t, "org1", time.Now().Add(-time.Hour), newTask("PEINFO")))
+	// not verified, so not counted for an organization
+	handleDecrypted("{}")
+	// dry runs are not counted
+	handleTicket(nil, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")), true, false, nil)
+
+	status, snap = snapshot("org1")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if snap.TicketsProcessed != 3 || snap.TicketsRejected != 2 || snap.PublishFailures != 1 {
+		t.Errorf("wrong counters: %+v", snap)
+	}
+	if len(snap.Organizations) != 1 || snap.Organizations["org1"] != (OrganizationStats{Processed: 3, Rejected: 1}) {
+		t.Errorf("wrong counters per organization: %+v", snap.Organizations)
+	}
+	if snap.Since.IsZero() {
+		t.Errorf("start of the counters missing")
+	}
+
+	conf.AdminOrganizations = nil
+	if status, _ = snapshot("org1"); status != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-administrator, got %d", status)
+	}
+}
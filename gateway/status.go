@@ -0,0 +1,195 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// If conf.ResultQueue is set, asynchronously dispatched tasks are
+// published with the result ID of their ticket (see ticketRef.resultID)
+// as correlation ID and the result queue as reply-to. The results the services send back are
+// aggregated per ticket, and the submitting organization can query them
+// with "GET /task/status/<TraceID>". Since a ticket can be fanned out to
+// several exchanges, the number of publishes is counted as the number
+// of expected results.
+
+// ticketResults collects the results for a ticket.
+type ticketResults struct {
+	expected    int
+	results     []string
+	dispatching bool                   // more tasks of the ticket may still be published
+	answer      *tasking.GatewayAnswer // of dispatching an asynchronous ticket
+	at          time.Time
+}
+
+var (
+	ticketStatuses = make(map[string]*ticketResults) // result ID -> results
+	statusMutex    = &sync.Mutex{}
+)
+
+// statusWindow returns the time the results of a ticket are kept.
+func statusWindow() time.Duration {
+	if conf.StatusWindow <= 0 {
+		return time.Hour
+	}
+	return time.Duration(conf.StatusWindow) * time.Second
+}
+
+// startStatus starts collecting the results for the ticket ref, if
+// results are enabled. It must be called before the tasks of the ticket
+// are published.
+func startStatus(ref ticketRef) {
+	if conf.ResultQueue == "" {
+		return
+	}
+	now := timeNow()
+	window := statusWindow()
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	for id, s := range ticketStatuses {
+		if !s.dispatching && now.Sub(s.at) >= window {
+			delete(ticketStatuses, id)
+		}
+	}
+	ticketStatuses[ref.resultID()] = &ticketResults{dispatching: true, at: now}
+}
+
+// expectResult increments the number of results expected for resultID.
+func expectResult(resultID string) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	if s, exists := ticketStatuses[resultID]; exists {
+		s.expected++
+	}
+}
+
+// finishStatus marks all tasks of the ticket ref as published. If nothing
+// was published, no result is expected and the ticket is forgotten.
+func finishStatus(ref ticketRef) {
+	id := ref.resultID()
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	s, exists := ticketStatuses[id]
+	if !exists {
+		return
+	}
+	if s.expected == 0 && s.answer == nil {
+		delete(ticketStatuses, id)
+		return
+	}
+	s.dispatching = false
+}
+
+// finishAsyncStatus finishes the status of the ticket ref, whose tasks
+// were dispatched in the background with the result answer. The answer is
+// kept even if nothing was published, so the client can learn about it.
+func finishAsyncStatus(ref ticketRef, answer *tasking.GatewayAnswer) {
+	statusMutex.Lock()
+	if s, exists := ticketStatuses[ref.resultID()]; exists {
+		s.answer = answer
+	}
+	statusMutex.Unlock()
+	finishStatus(ref)
+}
+
+// recordResult adds result to the results of the ticket with resultID.
+func recordResult(resultID string, result []byte) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	s, exists := ticketStatuses[resultID]
+	if !exists {
+		log.Println("Dropping result for unknown or expired ticket ", resultID)
+		return
+	}
+	s.results = append(s.results, string(result))
+}
+
+var errUnknownStatus = errors.New("Unknown trace ID")
+
+// ticketStatus returns the aggregated results of the ticket ref.
+func ticketStatus(ref ticketRef) (*tasking.TicketStatus, error) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	s, exists := ticketStatuses[ref.resultID()]
+	if !exists {
+		return nil, errUnknownStatus
+	}
+	status := &tasking.TicketStatus{
+		TraceID:  ref.traceID,
+		Status:   tasking.STATUS_PARTIAL,
+		Expected: s.expected,
+		Received: len(s.results),
+		Results:  append([]string{}, s.results...),
+		Answer:   s.answer}
+	if !s.dispatching && len(s.results) >= s.expected {
+		status.Status = tasking.STATUS_COMPLETE
+	} else if len(s.results) == 0 {
+		status.Status = tasking.STATUS_PENDING
+	}
+	return status, nil
+}
+
+// startResultConsumer declares conf.ResultQueue on channel and records
+// the results arriving on it. Once the channel is lost, the management
+// connection is restored.
+func startResultConsumer(channel amqpChannel) error {
+	_, err := channel.QueueDeclare(
+		conf.ResultQueue, // name
+		true,             // durable
+		false,            // delete when unused
+		false,            // exclusive
+		false,            // no-wait
+		nil,              // arguments
+	)
+	if err != nil {
+		return errors.New("Failed to declare the result queue: " + err.Error())
+	}
+	deliveries, err := channel.Consume(
+		conf.ResultQueue, // queue
+		"",               // consumer
+		true,             // auto-ack
+		false,            // exclusive
+		false,            // no-local
+		false,            // no-wait
+		nil,              // arguments
+	)
+	if err != nil {
+		return errors.New("Failed to consume the result queue: " + err.Error())
+	}
+	go func() {
+		for d := range deliveries {
+			recordResult(d.CorrelationId, d.Body)
+		}
+		restoreManagement(channel)
+	}()
+	return nil
+}
+
+// httpRequestStatus answers the aggregated results of the ticket named
+// in the path for the organization authenticated by orgAuthMiddleware at
+// the tenant addressed by r.
+func httpRequestStatus(w http.ResponseWriter, r *http.Request) {
+	if conf.ResultQueue == "" {
+		http.Error(w, "Results not supported", http.StatusNotImplemented)
+		return
+	}
+	traceID := strings.TrimPrefix(r.URL.Path, "/task/status/")
+	if traceID == "" || !stringPrintable(traceID) {
+		http.Error(w, "Invalid trace ID", http.StatusBadRequest)
+		return
+	}
+	status, err := ticketStatus(newTicketRef(tenantFor(r), orgFromContext(r), traceID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	x, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(x)
+}
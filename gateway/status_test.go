@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"github.com/streadway/amqp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func statusRequest(t *testing.T, org, traceID string) (int, tasking.TicketStatus) {
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, signedNonceRequest(t, "GET", "/task/status/"+traceID, org, time.Now()))
+	var status tasking.TicketStatus
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, status
+}
+
+// waitForResults waits until n results with resultID were recorded.
+func waitForResults(t *testing.T, resultID string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		statusMutex.Lock()
+		received := len(ticketStatuses[resultID].results)
+		statusMutex.Unlock()
+		if received >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d results for %s", n, resultID)
+}
+
+func TestTicketStatusAggregatesResults(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}, "org2": []string{"*"}},
+		ResultQueue:   "holmes_results",
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit:        map[string]RabbitConf{"YARA": RabbitConf{Exchange: "yara", RoutingKey: "work.yara"}},
+	})
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+	results := &fakeChannel{}
+	if err := startResultConsumer(results); err != nil {
+		t.Fatal(err)
+	}
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA")))
+	if answer.Error != nil || len(answer.Accepted) != 2 {
+		t.Fatalf("unexpected answer: %+v", answer)
+	}
+	resultID := newTicketRef(nil, "org1", answer.TraceID).resultID()
+	for _, msg := range ch.messages() {
+		if msg.Publishing.CorrelationId != resultID || msg.Publishing.ReplyTo != "holmes_results" {
+			t.Errorf("task to %s not correlated: %q, reply-to %q", msg.Exchange, msg.Publishing.CorrelationId, msg.Publishing.ReplyTo)
+		}
+	}
+
+	code, status := statusRequest(t, "org1", answer.TraceID)
+	if code != http.StatusOK || status.Status != tasking.STATUS_PENDING || status.Expected != 2 {
+		t.Fatalf("expected a pending status expecting 2 results, got %d %+v", code, status)
+	}
+	if code, _ := statusRequest(t, "org2", answer.TraceID); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a ticket of another organization, got %d", code)
+	}
+
+	results.deliveries <- amqp.Delivery{CorrelationId: resultID, Body: []byte(`{"peinfo":1}`)}
+	waitForResults(t, resultID, 1)
+	_, status = statusRequest(t, "org1", answer.TraceID)
+	if status.Status != tasking.STATUS_PARTIAL || status.Received != 1 {
+		t.Errorf("expected a partial status, got %+v", status)
+	}
+
+	results.deliveries <- amqp.Delivery{CorrelationId: resultID, Body: []byte(`{"yara":2}`)}
+	waitForResults(t, resultID, 2)
+	_, status = statusRequest(t, "org1", answer.TraceID)
+	if status.Status != tasking.STATUS_COMPLETE || len(status.Results) != 2 || status.Results[1] != `{"yara":2}` {
+		t.Errorf("expected a complete status, got %+v", status)
+	}
+}
+
+func TestTicketStatusDisabled(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if msgs := ch.messages(); len(msgs) != 1 || msgs[0].Publishing.ReplyTo != "" {
+		t.Errorf("expected an uncorrelated task, got %+v", msgs)
+	}
+	if code, _ := statusRequest(t, "org1", answer.TraceID); code != http.StatusNotImplemented {
+		t.Errorf("expected 501, got %d", code)
+	}
+}
+
+func TestAsyncTickets(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"PEINFO"}},
+		ResultQueue:   "holmes_results",
+		AsyncTickets:  true,
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	submit := func(expiration time.Time, prefer string) (*httptest.ResponseRecorder, tasking.GatewayAnswer) {
+		enc, symKey := encryptTicket(t, signTicket(t, "org1", expiration, newTask("PEINFO", "YARA")))
+		r := taskRequest(enc)
+		if prefer != "" {
+			r.Header.Set("Prefer", prefer)
+		}
+		w := httptest.NewRecorder()
+		httpRequestIncoming(w, r)
+		return w, decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+	}
+
+	w, answer := submit(time.Now().Add(time.Hour), "wait=10, respond-async")
+	if w.Code != http.StatusAccepted || w.Header().Get("Preference-Applied") != "respond-async" {
+		t.Fatalf("expected 202, got %d %v", w.Code, w.Header())
+	}
+	if answer.Error != nil || !answer.Async || answer.TraceID == "" || len(answer.Accepted) != 0 {
+		t.Fatalf("unexpected answer: %+v", answer)
+	}
+	var status tasking.TicketStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for status.Answer == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		_, status = statusRequest(t, "org1", answer.TraceID)
+	}
+	if status.Answer == nil || len(status.Answer.Accepted) != 1 || len(status.Answer.TskErrors) != 1 {
+		t.Fatalf("expected the answer of dispatching in the status, got %+v", status)
+	}
+	if status.Status != tasking.STATUS_PENDING || status.Expected != 1 || len(ch.messages()) != 1 {
+		t.Errorf("expected one pending result, got %+v", status)
+	}
+
+	// validation failures are still answered synchronously
+	w, answer = submit(time.Now().Add(-time.Hour), "respond-async")
+	if w.Code != http.StatusOK || answer.Async || answer.Error == nil {
+		t.Errorf("expired ticket not rejected synchronously: %d %+v", w.Code, answer)
+	}
+
+	// without the preference, tickets are dispatched synchronously
+	w, answer = submit(time.Now().Add(time.Hour), "")
+	if w.Code != http.StatusOK || answer.Async || len(answer.Accepted) != 1 {
+		t.Errorf("ticket not dispatched synchronously: %d %+v", w.Code, answer)
+	}
+}
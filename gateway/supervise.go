@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// If RabbitMQ is gone permanently, every request fails, but the gateway
+// keeps running. With conf.MaxRabbitDowntime set, the gateway keeps trying
+// to reconnect and exits once RabbitMQ was unreachable for longer, so an
+// orchestrator can restart or reschedule it.
+
+var (
+	rabbitDownSince time.Time // zero while RabbitMQ is reachable
+	rabbitDownMutex = &sync.Mutex{}
+)
+
+// exitProcess terminates the gateway. It is replaced by tests.
+var exitProcess = os.Exit
+
+// markRabbitDown records that the connection to RabbitMQ could not be
+// restored.
+func markRabbitDown() {
+	rabbitDownMutex.Lock()
+	if rabbitDownSince.IsZero() {
+		rabbitDownSince = timeNow()
+	}
+	rabbitDownMutex.Unlock()
+}
+
+// markRabbitUp records that the connection to RabbitMQ was restored.
+func markRabbitUp() {
+	rabbitDownMutex.Lock()
+	rabbitDownSince = time.Time{}
+	rabbitDownMutex.Unlock()
+}
+
+// superviseRabbitOnce tries to restore a lost connection to RabbitMQ and
+// exits the gateway, if it is down for longer than conf.MaxRabbitDowntime.
+func superviseRabbitOnce() {
+	rabbitDownMutex.Lock()
+	since := rabbitDownSince
+	rabbitDownMutex.Unlock()
+	if since.IsZero() {
+		return
+	}
+	if err := connectRabbit(); err == nil {
+		return
+	}
+	downtime := timeNow().Sub(since)
+	if downtime >= time.Duration(conf.MaxRabbitDowntime)*time.Second {
+		log.Printf("RabbitMQ unreachable for %s, exiting", downtime)
+		exitProcess(1)
+	}
+}
+
+// superviseRabbit runs superviseRabbitOnce forever.
+func superviseRabbit() {
+	for range time.Tick(rabbitReconnectDelay) {
+		superviseRabbitOnce()
+	}
+}
@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// brokerGone makes every publish and reconnect fail and returns a function
+// restoring the broker.
+func brokerGone(ch *fakeChannel) func() {
+	ch.publishErr = errors.New("channel closed")
+	savedDial := dialRabbit
+	dialRabbit = func() (amqpChannel, error) {
+		return nil, errors.New("connection refused")
+	}
+	return func() { dialRabbit = savedDial }
+}
+
+func TestMaxRabbitDowntime(t *testing.T) {
+	ch := setupGateway(t, &config{
+		MaxRabbitDowntime: 60,
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	defer brokerGone(ch)()
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	exited := -1
+	savedExit := exitProcess
+	exitProcess = func(code int) { exited = code }
+	defer func() { exitProcess = savedExit }()
+
+	task := newTask("PEINFO")
+	if err := pushToAMQP(&task, &conf.RabbitDefault); err == nil {
+		t.Fatal("publish succeeded without broker")
+	}
+
+	now = now.Add(59 * time.Second)
+	superviseRabbitOnce()
+	if exited != -1 {
+		t.Fatalf("exited before the maximum downtime")
+	}
+
+	now = now.Add(time.Second)
+	superviseRabbitOnce()
+	if exited != 1 {
+		t.Errorf("expected exit code 1, got %d", exited)
+	}
+}
+
+func TestMaxRabbitDowntimeRecovered(t *testing.T) {
+	ch := setupGateway(t, &config{
+		MaxRabbitDowntime: 60,
+		RabbitDefault:     RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	restore := brokerGone(ch)
+	defer restore()
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	exited := -1
+	savedExit := exitProcess
+	exitProcess = func(code int) { exited = code }
+	defer func() { exitProcess = savedExit }()
+
+	task := newTask("PEINFO")
+	pushToAMQP(&task, &conf.RabbitDefault)
+
+	// the broker is back before the maximum downtime
+	now = now.Add(30 * time.Second)
+	fakeDialer()
+	superviseRabbitOnce()
+	now = now.Add(time.Hour)
+	superviseRabbitOnce()
+	if exited != -1 {
+		t.Errorf("exited although the connection was restored")
+	}
+}
@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+	"time"
+)
+
+// Services listed in conf.SyncTasks are answered synchronously: they are
+// published with a reply-to queue and the gateway waits for the result
+// before it answers the request. The management connection consumes an
+// exclusive reply queue, which is declared again whenever the connection
+// is restored; the results are matched to the waiting requests by their
+// correlation ID.
+
+var replyQueue string // guarded by rabbitMgmtMutex
+
+var pendingReplies = make(map[string]chan []byte)
+var pendingMutex = &sync.Mutex{}
+
+// startReplyConsumer declares an exclusive reply queue on channel and
+// delivers the replies arriving on it to the waiting requests. Once the
+// channel is lost, the management connection is restored.
+func startReplyConsumer(channel amqpChannel) (string, error) {
+	queue, err := channel.QueueDeclare(
+		"",    // name, chosen by the server
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return "", errors.New("Failed to declare the reply queue: " + err.Error())
+	}
+	deliveries, err := channel.Consume(
+		queue.Name, // queue
+		"",         // consumer
+		true,       // auto-ack
+		true,       // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		return "", errors.New("Failed to consume the reply queue: " + err.Error())
+	}
+	go func() {
+		for d := range deliveries {
+			pendingMutex.Lock()
+			waiting, exists := pendingReplies[d.CorrelationId]
+			delete(pendingReplies, d.CorrelationId)
+			pendingMutex.Unlock()
+			if !exists {
+				log.Println("Dropping reply for unknown or expired request ", d.CorrelationId)
+				continue
+			}
+			waiting <- d.Body
+		}
+		restoreManagement(channel)
+	}()
+	return queue.Name, nil
+}
+
+// isSyncTask reports whether the service t is answered synchronously.
+func isSyncTask(t string) bool {
+	for _, s := range conf.SyncTasks {
+		if canonicalTaskName(s) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// pushSync publishes task to rconf and waits for its result. If no result
+// arrives in time, the task is still dispatched, but no result is returned.
+func pushSync(task *tasking.Task, rconf *RabbitConf, correlationID string) (string, *tasking.MyError) {
+	msgBody, err := json.Marshal(task)
+	if err != nil {
+		return "", &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+	}
+	correlationId := newTraceID()
+	waiting := make(chan []byte, 1)
+	pendingMutex.Lock()
+	pendingReplies[correlationId] = waiting
+	pendingMutex.Unlock()
+	defer func() {
+		pendingMutex.Lock()
+		delete(pendingReplies, correlationId)
+		pendingMutex.Unlock()
+	}()
+
+	rabbitMgmtMutex.Lock()
+	replyTo := replyQueue
+	rabbitMgmtMutex.Unlock()
+	pub := amqp.Publishing{
+		DeliveryMode:  amqp.Persistent,
+		ContentType:   "text/plain",
+		CorrelationId: correlationId,
+		ReplyTo:       replyTo,
+		Body:          msgBody}
+	tagCorrelation(&pub, correlationID)
+	log.Printf("Pushing to %s and waiting for the result: \x1b[0;32m%s\x1b[0m\n", rconf.Exchange, msgBody)
+	if myerr := publishReliably(rconf, pub); myerr != nil {
+		return "", myerr
+	}
+
+	timeout := time.Duration(conf.SyncTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	select {
+	case result := <-waiting:
+		return string(result), nil
+	case <-time.After(timeout):
+		log.Println("Timeout while waiting for the result of ", correlationId)
+		return "", nil
+	}
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyncTasks(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		SyncTasks:     []string{"PEINFO", "SLOW"},
+		SyncTimeout:   50,
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	dialed := fakeDialer()
+	if err := connectRabbitManagement(); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectRabbit(); err != nil {
+		t.Fatal(err)
+	}
+	mgmt, ch := (*dialed)[0], (*dialed)[1]
+	// the replies are consumed on the management connection
+	ch.replies = mgmt
+	// the mock service answers PEINFO, but never SLOW
+	ch.respond = func(msg publishedMsg) []byte {
+		if _, ok := msg.Task.Tasks["PEINFO"]; ok {
+			return []byte(`{"sections": 4}`)
+		}
+		return nil
+	}
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO", "YARA", "SLOW")))
+	if answer.Error != nil || len(answer.TskErrors) != 0 {
+		t.Fatalf("unexpected errors: %+v", answer)
+	}
+	results := make(map[string]string)
+	for _, a := range answer.Accepted {
+		results[a.Task] = a.Result
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 accepted services, got %+v", answer.Accepted)
+	}
+	if results["PEINFO"] != `{"sections": 4}` {
+		t.Errorf("result of PEINFO not returned inline: %q", results["PEINFO"])
+	}
+	if results["SLOW"] != "" || results["YARA"] != "" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	// synchronous services are published separately with a reply-to queue
+	for _, msg := range ch.messages() {
+		_, async := msg.Task.Tasks["YARA"]
+		if async != (msg.Publishing.ReplyTo == "") || (!async && len(msg.Task.Tasks) != 1) {
+			t.Errorf("wrong publishing for %v: reply-to %q", msg.Task.Tasks, msg.Publishing.ReplyTo)
+		}
+	}
+	if len(pendingReplies) != 0 {
+		t.Errorf("pending replies leaked: %d", len(pendingReplies))
+	}
+}
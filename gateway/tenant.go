@@ -0,0 +1,199 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rsa"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A single listener can serve several logical gateways (tenants), which
+// are told apart by the hostname the client requested via TLS SNI, or by
+// the path prefix "/tenants/<hostname>" of a request. Each
+// tenant has its own source keys, ticket keys and ACL. All other options
+// are shared. Requests for an unknown hostname, or without TLS, are
+// handled by the default gateway, which is represented by a nil *tenant.
+
+// TenantConf configures a tenant.
+type TenantConf struct {
+	SourcesKeysPath string
+	TicketKeysPath  string
+	AllowedTasks    map[string][]string
+}
+
+type tenant struct {
+	name         string
+	keys         map[string]*rsa.PrivateKey // guarded by keysMutex
+	ticketKeys   map[string]*rsa.PublicKey  // guarded by keysMutex
+	allowedTasks map[string](map[string]struct{})
+	knownTasks   map[string]struct{}
+}
+
+var tenants map[string]*tenant // hostname -> tenant
+
+// newTenant returns the tenant name configured by tc, without any keys.
+func newTenant(name string, tc TenantConf) *tenant {
+	allowed := buildAllowedTasks(&config{AllowedTasks: tc.AllowedTasks, TaskAliases: conf.TaskAliases})
+	return &tenant{
+		name:         name,
+		keys:         make(map[string]*rsa.PrivateKey),
+		ticketKeys:   make(map[string]*rsa.PublicKey),
+		allowedTasks: allowed,
+		knownTasks:   buildKnownTasks(conf, allowed),
+	}
+}
+
+// readTenantKeys loads the keys of all configured tenants and watches
+// their directories.
+func readTenantKeys() {
+	tenants = make(map[string]*tenant, len(conf.Tenants))
+	for name, tc := range conf.Tenants {
+		tn := newTenant(name, tc)
+		tenants[strings.ToLower(name)] = tn
+		tasking.LoadKeysFromAndWatch(keySource, tc.SourcesKeysPath, ".priv",
+			func(name string) {
+				keysMutex.Lock()
+				delete(tn.keys, name)
+				keysMutex.Unlock()
+			},
+			func(name string) {
+				key, name, err := tasking.LoadPrivateKeyFrom(keySource, name)
+				if err != nil {
+					log.Printf("Error reading key (%s):%s\n", name, err)
+					return
+				}
+				keysMutex.Lock()
+				tn.keys[name] = key
+				keysMutex.Unlock()
+			})
+		tasking.LoadKeysFromAndWatch(keySource, tc.TicketKeysPath, ".pub",
+			func(name string) {
+				keysMutex.Lock()
+				delete(tn.ticketKeys, name)
+				keysMutex.Unlock()
+			},
+			func(name string) {
+				key, name, err := tasking.LoadPublicKeyFrom(keySource, name)
+				if err != nil {
+					log.Printf("Error reading key (%s):%s\n", name, err)
+					return
+				}
+				keysMutex.Lock()
+				tn.ticketKeys[name] = key
+				keysMutex.Unlock()
+			})
+	}
+}
+
+// tenantFor returns the tenant addressed by r, or nil for the default
+// gateway.
+func tenantFor(r *http.Request) *tenant {
+	if tn, ok := r.Context().Value(tenantContextKey).(*tenant); ok {
+		return tn
+	}
+	return sniTenant(r)
+}
+
+// requestedPath returns the path of r as requested by the client, i.e.
+// including the prefix of a tenant addressed by the path.
+func requestedPath(r *http.Request) string {
+	if prefix, ok := r.Context().Value(tenantPrefixContextKey).(string); ok {
+		return prefix + r.URL.Path
+	}
+	return r.URL.Path
+}
+
+// sniTenant returns the tenant addressed by the TLS server name of r.
+func sniTenant(r *http.Request) *tenant {
+	if r.TLS == nil || len(tenants) == 0 {
+		return nil
+	}
+	return tenants[strings.ToLower(r.TLS.ServerName)]
+}
+
+// tenantPath reports whether the endpoint path can be addressed to a
+// tenant by the path prefix "/tenants/<hostname>". These are all
+// endpoints of the organizations, i.e. the submission, cancellation and
+// status of tickets, and the capabilities.
+func tenantPath(path string) bool {
+	return strings.HasPrefix(path, "/task/") || path == "/capabilities"
+}
+
+// tenantPathHandler handles the requests to "/tenants/<hostname>/..." for
+// the named tenant by passing them to next without the prefix. Unknown
+// tenants are answered with 404. If the request also names a tenant by
+// SNI, both must agree, so a ticket can't be checked against the keys of
+// another tenant than the connection was made for.
+func tenantPathHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/tenants/")
+		i := strings.Index(rest, "/")
+		if i < 0 || !tenantPath(rest[i:]) {
+			http.NotFound(w, r)
+			return
+		}
+		tn, exists := tenants[strings.ToLower(rest[:i])]
+		if !exists {
+			http.Error(w, "Unknown tenant", http.StatusNotFound)
+			return
+		}
+		if sni := sniTenant(r); sni != nil && sni != tn {
+			log.Printf("Request to %s over a connection for tenant %s rejected", r.URL.Path, sni)
+			http.Error(w, "Tenant does not match the TLS server name", http.StatusBadRequest)
+			return
+		}
+		ctx := context.WithValue(r.Context(), tenantContextKey, tn)
+		ctx = context.WithValue(ctx, tenantPrefixContextKey, strings.TrimSuffix(r.URL.Path, rest[i:]))
+		r2 := r.WithContext(ctx)
+		u := *r.URL
+		u.Path = rest[i:]
+		u.RawPath = ""
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// sourceKey returns the source key name of the tenant.
+func (tn *tenant) sourceKey(name string) (*rsa.PrivateKey, bool) {
+	if tn == nil {
+		return lookupSourceKey(name)
+	}
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	key, exists := tn.keys[name]
+	return key, exists
+}
+
+// ticketKey returns the ticket key of the organization org of the tenant.
+func (tn *tenant) ticketKey(org string) (*rsa.PublicKey, bool) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	if tn == nil {
+		key, exists := ticketKeys[org]
+		return key, exists
+	}
+	key, exists := tn.ticketKeys[org]
+	return key, exists
+}
+
+// policy returns the ACL of the tenant, the task types known to it (see
+// buildKnownTasks) and the globally disabled tasks. Only the ACL of the
+// default gateway can be reloaded.
+func (tn *tenant) policy() (map[string](map[string]struct{}), map[string]struct{}, map[string]struct{}) {
+	policyMutex.RLock()
+	defer policyMutex.RUnlock()
+	if tn == nil {
+		return allowedTasks, knownTasks, disabledTasks
+	}
+	return tn.allowedTasks, tn.knownTasks, disabledTasks
+}
+
+// String returns the name of the tenant for logging.
+func (tn *tenant) String() string {
+	if tn == nil {
+		return "default"
+	}
+	return tn.name
+}
@@ -0,0 +1,245 @@
+package gateway
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tlsTaskRequest submits a ticket requesting PEINFO to srv, connecting
+// with the TLS server name sni, and returns the decrypted answer.
+func tlsTaskRequest(t *testing.T, srv *httptest.Server, sni string) (int, []string) {
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	r := taskRequest(enc)
+	r.URL, _ = url.Parse(srv.URL + "/task/")
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: sni, InsecureSkipVerify: true},
+	}}
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	answer := decryptAnswer(t, body, enc, symKey)
+	if answer.Error != nil {
+		t.Fatalf("%s: %s", sni, answer.Error.Error)
+	}
+	reasons := make([]string, 0)
+	for _, e := range answer.TskErrors {
+		reasons = append(reasons, e.Reason)
+	}
+	return len(answer.Accepted), reasons
+}
+
+func TestTenantSelectedBySNI(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"YARA"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	tenants = make(map[string]*tenant)
+	for host, allowed := range map[string]string{"a.example": "PEINFO", "b.example": "YARA"} {
+		tn := newTenant(host, TenantConf{AllowedTasks: map[string][]string{"org1": []string{allowed}}})
+		tn.keys["src1"] = sourceKey(t)
+		tn.ticketKeys = map[string]*rsa.PublicKey{"org1": &ticketKey(t).PublicKey}
+		tenants[host] = tn
+	}
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	if accepted, reasons := tlsTaskRequest(t, srv, "A.example"); accepted != 1 || len(reasons) != 0 {
+		t.Errorf("a.example should allow PEINFO, got %d accepted, errors %v", accepted, reasons)
+	}
+	if accepted, _ := tlsTaskRequest(t, srv, "b.example"); accepted != 0 {
+		t.Errorf("b.example should reject PEINFO, got %d accepted", accepted)
+	}
+	// unknown server names use the top-level configuration
+	if accepted, _ := tlsTaskRequest(t, srv, "c.example"); accepted != 0 {
+		t.Errorf("c.example should reject PEINFO, got %d accepted", accepted)
+	}
+	if len(ch.messages()) != 1 {
+		t.Errorf("expected 1 published task, got %d", len(ch.messages()))
+	}
+}
+
+func TestTenantKeysAreSeparate(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	// the tenant doesn't trust the ticket key of org1
+	tn := newTenant("a.example", TenantConf{AllowedTasks: map[string][]string{"org1": []string{"*"}}})
+	tn.keys["src1"] = sourceKey(t)
+
+	enc, _ := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	if answer, _ := handleIncoming(tn, enc, "", false, false, nil); answer.Error == nil {
+		t.Errorf("expected the ticket to be rejected by the tenant")
+	}
+	if answer, _ := handleIncoming(nil, enc, "", false, false, nil); answer.Error != nil {
+		t.Errorf("expected the ticket to be accepted by default: %s", answer.Error.Error)
+	}
+}
+
+func TestTenantSelectedByPath(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	tenants = make(map[string]*tenant)
+	for _, host := range []string{"a.example", "b.example"} {
+		tn := newTenant(host, TenantConf{AllowedTasks: map[string][]string{"org1": []string{"*"}}})
+		tn.keys["src1"] = sourceKey(t)
+		tenants[host] = tn
+	}
+	// only a.example trusts the ticket key of org1
+	tenants["a.example"].ticketKeys["org1"] = &ticketKey(t).PublicKey
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	submit := func(path string) (int, *tasking.GatewayAnswer) {
+		enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+		r := taskRequest(enc)
+		r.URL.Path = path
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+		return w.Code, &answer
+	}
+
+	if _, answer := submit("/tenants/A.example/task/"); answer == nil || answer.Error != nil || len(answer.Accepted) != 1 {
+		t.Errorf("expected a.example to accept the ticket, got %+v", answer)
+	}
+	if _, answer := submit("/tenants/b.example/task/"); answer == nil || answer.Error == nil {
+		t.Errorf("expected b.example to reject the ticket signed with a key it doesn't trust, got %+v", answer)
+	}
+	if code, _ := submit("/tenants/c.example/task/"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown tenant, got %d", code)
+	}
+	if code, _ := submit("/tenants/a.example/admin/stats"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an endpoint not served per tenant, got %d", code)
+	}
+}
+
+func TestTenantPathEndpoints(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:   map[string][]string{"org1": []string{"*"}},
+		ResultQueue:    "holmes_results",
+		CancelExchange: "holmes_control",
+		RabbitDefault:  RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	tn := newTenant("a.example", TenantConf{AllowedTasks: map[string][]string{"org1": []string{"PEINFO"}}})
+	tn.keys["src1"] = sourceKey(t)
+	tn.ticketKeys["org1"] = &ticketKey(t).PublicKey
+	tenants = map[string]*tenant{"a.example": tn}
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	request := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request(signedNonceRequest(t, "GET", "/tenants/a.example/capabilities", "org1", time.Now()))
+	var caps tasking.Capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &caps); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("expected the capabilities of the tenant, got %d: %s", w.Code, w.Body.String())
+	}
+	if !reflect.DeepEqual(caps.AllowedTasks, []string{"PEINFO"}) {
+		t.Errorf("capabilities do not match the ACL of the tenant: %v", caps.AllowedTasks)
+	}
+	// the prefix is covered by the signature
+	r := signedNonceRequest(t, "GET", "/capabilities", "org1", time.Now())
+	r.URL.Path = "/tenants/a.example/capabilities"
+	if w := request(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a signature without the prefix to be rejected, got %d", w.Code)
+	}
+
+	enc, symKey := encryptTicket(t, signTicket(t, "org1", time.Now().Add(time.Hour), newTask("PEINFO")))
+	r = taskRequest(enc)
+	r.URL.Path = "/tenants/a.example/task/"
+	w = request(r)
+	answer := decryptAnswer(t, w.Body.Bytes(), enc, symKey)
+	if answer.Error != nil || len(answer.Accepted) != 1 {
+		t.Fatalf("ticket not accepted by the tenant: %+v", answer)
+	}
+
+	w = request(signedNonceRequest(t, "GET", "/tenants/a.example/task/status/"+answer.TraceID, "org1", time.Now()))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the status of the ticket, got %d: %s", w.Code, w.Body.String())
+	}
+	// the ticket is unknown to the default gateway
+	if w := request(signedNonceRequest(t, "GET", "/task/status/"+answer.TraceID, "org1", time.Now())); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for the ticket of a tenant, got %d", w.Code)
+	}
+	if w := request(signedNonceRequest(t, "DELETE", "/task/"+answer.TraceID, "org1", time.Now())); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for cancelling the ticket of a tenant, got %d", w.Code)
+	}
+	w = request(signedNonceRequest(t, "DELETE", "/tenants/a.example/task/"+answer.TraceID, "org1", time.Now()))
+	var cancellation tasking.Cancellation
+	if err := json.Unmarshal(w.Body.Bytes(), &cancellation); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("expected the ticket to be cancelled, got %d: %s", w.Code, w.Body.String())
+	}
+	if cancellation.Tenant != "a.example" || cancellation.TraceID != answer.TraceID {
+		t.Errorf("unexpected cancellation: %+v", cancellation)
+	}
+}
+
+func TestTenantAuthentication(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:       map[string][]string{"org1": []string{"YARA"}},
+		AdminOrganizations: []string{"org1"},
+	})
+	tenants = make(map[string]*tenant)
+	for _, host := range []string{"a.example", "b.example"} {
+		tenants[host] = newTenant(host, TenantConf{AllowedTasks: map[string][]string{"org1": []string{"PEINFO"}}})
+	}
+	// only a.example trusts the ticket key of org1
+	tenants["a.example"].ticketKeys["org1"] = &ticketKey(t).PublicKey
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	get := func(path, sni string) *httptest.ResponseRecorder {
+		r := signedNonceRequest(t, "GET", path, "org1", time.Now())
+		if sni != "" {
+			r.TLS = &tls.ConnectionState{ServerName: sni}
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/capabilities", "a.example")
+	var caps tasking.Capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &caps); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("expected the capabilities at a.example, got %d: %s", w.Code, w.Body.String())
+	}
+	if !reflect.DeepEqual(caps.AllowedTasks, []string{"PEINFO"}) {
+		t.Errorf("capabilities do not match the ACL of the tenant: %v", caps.AllowedTasks)
+	}
+	if w := get("/capabilities", "b.example"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected b.example to reject the signature of a key it doesn't trust, got %d", w.Code)
+	}
+	// the administrators of the default gateway are no administrators
+	// of a tenant with an organization of the same name
+	if w := get("/admin/stats", "a.example"); w.Code != http.StatusForbidden {
+		t.Errorf("expected the organization of a tenant to be denied, got %d", w.Code)
+	}
+	if w := get("/admin/stats", ""); w.Code != http.StatusOK {
+		t.Errorf("expected the administrator to be allowed, got %d", w.Code)
+	}
+}
@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// If a queue is deleted on the broker while the gateway runs, tasks are
+// still published to its exchange, but RabbitMQ drops them silently, as
+// no queue is bound anymore. The topology is therefore verified
+// periodically and declared again, if a queue is missing.
+
+// topologyDestinations returns all configured destinations.
+func topologyDestinations() []RabbitConf {
+	destinations := []RabbitConf{defaultBinding()}
+	for _, r := range conf.Rabbit {
+		destinations = append(destinations, r)
+	}
+	if conf.QuarantineRabbit != nil {
+		destinations = append(destinations, *conf.QuarantineRabbit)
+	}
+	return destinations
+}
+
+// checkTopology verifies on a new connection to the broker, that the
+// destinations of c exist, if c is passive. Otherwise, they would be
+// declared, which can't fail on a missing exchange. The running channels
+// are not used, since a failed passive declaration closes the channel.
+func checkTopology(c *config) error {
+	if !c.RabbitPassive {
+		return nil
+	}
+	destinations := []RabbitConf{c.RabbitDefault}
+	for _, r := range c.Rabbit {
+		destinations = append(destinations, r)
+	}
+	if c.QuarantineRabbit != nil {
+		destinations = append(destinations, *c.QuarantineRabbit)
+	}
+	if err := fetchRabbitPassword(); err != nil {
+		return err
+	}
+	channel, err := dialRabbit()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+	for _, r := range destinations {
+		if err := assertRabbitConf(channel, r); err != nil {
+			return err
+		}
+	}
+	if c.CancelExchange != "" {
+		if err := channel.ExchangeDeclarePassive(c.CancelExchange, "topic", true, false, false, false, nil); err != nil {
+			return errors.New("Exchange " + c.CancelExchange + " does not exist: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// missingQueue returns the name of the first configured queue that does
+// not exist on the broker, or "" if all of them exist. A failed passive
+// declaration closes the channel, so the queues are probed on a throwaway
+// connection, leaving the consumers of the management connection alone.
+func missingQueue() (string, error) {
+	if err := fetchRabbitPassword(); err != nil {
+		return "", err
+	}
+	channel, err := dialRabbit()
+	if err != nil {
+		return "", err
+	}
+	defer channel.Close()
+
+	for _, r := range topologyDestinations() {
+		if r.Queue == "" || r.Webhook != "" {
+			continue
+		}
+		_, err := channel.QueueDeclarePassive(
+			r.Queue, //name
+			true,    // durable
+			false,   // delete when unused
+			false,   // exclusive
+			false,   // no-wait
+			nil,     // arguments
+		)
+		if err != nil {
+			log.Printf("Queue %s is missing: %s", r.Queue, err)
+			return r.Queue, nil
+		}
+	}
+	return "", nil
+}
+
+// verifyTopology checks that all configured queues exist. If one is
+// missing, the topology is declared again on a new management connection.
+// Bindings can't be checked, but they are restored together with the
+// queues.
+func verifyTopology() error {
+	metrics.Count(metricGroupRabbit, metricTopologyChecks, 1)
+	missing, err := missingQueue()
+	if err == nil && missing == "" {
+		return nil
+	}
+	if err == nil {
+		err = connectRabbitManagement()
+	}
+	if err != nil {
+		metrics.Count(metricGroupRabbit, metricTopologyFailed, 1)
+		return err
+	}
+	metrics.Count(metricGroupRabbit, metricTopologyReasserted, 1)
+	log.Println("Declared the RabbitMQ topology again")
+	return nil
+}
+
+// verifyTopologyForever verifies the topology every
+// conf.TopologyCheckInterval seconds.
+func verifyTopologyForever() {
+	for range time.Tick(time.Duration(conf.TopologyCheckInterval) * time.Second) {
+		if err := verifyTopology(); err != nil {
+			log.Println("Couldn't restore the RabbitMQ topology: ", err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package gateway
+
+import (
+	"testing"
+)
+
+// brokerDialer is fakeDialer for a broker on which the existing queues
+// and exchanges are declared.
+func brokerDialer(existing map[string]bool) *[]*fakeChannel {
+	dialed := fakeDialer()
+	dial := dialRabbit
+	dialRabbit = func() (amqpChannel, error) {
+		channel, err := dial()
+		channel.(*fakeChannel).existing = existing
+		return channel, err
+	}
+	return dialed
+}
+
+func TestVerifyTopologyIntact(t *testing.T) {
+	setupGateway(t, &config{
+		RabbitDefault: RabbitConf{Queue: "totem_input", Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	mgmt := &fakeChannel{}
+	rabbitMgmtChannel = mgmt
+	dialed := brokerDialer(map[string]bool{"totem_input": true})
+	reasserted := metricValue(rabbitMetrics, metricTopologyReasserted)
+
+	if err := verifyTopology(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*dialed) != 1 || !(*dialed)[0].closed {
+		t.Errorf("queues should be probed on a throwaway connection")
+	}
+	if len((*dialed)[0].queues) != 0 || rabbitMgmtChannel != mgmt || mgmt.closed {
+		t.Errorf("intact topology was declared again")
+	}
+	if metricValue(rabbitMetrics, metricTopologyReasserted) != reasserted {
+		t.Errorf("intact topology counted as reasserted")
+	}
+}
+
+func TestVerifyTopologyMissingQueue(t *testing.T) {
+	setupGateway(t, &config{
+		RabbitDefault: RabbitConf{Queue: "totem_input", Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit: map[string]RabbitConf{
+			"CUCKOO": RabbitConf{Queue: "totem_dynamic_input", Exchange: "totem_dynamic", RoutingKey: "work.dynamic.totem"}},
+	})
+	// the queue of CUCKOO was deleted on the broker
+	old := &fakeChannel{}
+	rabbitMgmtChannel = old
+	dialed := brokerDialer(map[string]bool{"totem_input": true})
+	reasserted := metricValue(rabbitMetrics, metricTopologyReasserted)
+
+	if err := verifyTopology(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*dialed) != 2 || !(*dialed)[0].closed {
+		t.Fatalf("expected a probe and a new management connection, got %d", len(*dialed))
+	}
+	mgmt := (*dialed)[1]
+	declared := map[string]bool{}
+	for _, q := range mgmt.queues {
+		declared[q] = true
+	}
+	if !declared["totem_input"] || !declared["totem_dynamic_input"] {
+		t.Errorf("topology not declared again: %v", mgmt.queues)
+	}
+	if mgmt.bindings != 2 {
+		t.Errorf("expected 2 bindings, got %d", mgmt.bindings)
+	}
+	if !old.closed {
+		t.Errorf("old management channel not closed")
+	}
+	if metricValue(rabbitMetrics, metricTopologyReasserted) != reasserted+1 {
+		t.Errorf("reassertion not counted")
+	}
+}
+
+func TestVerifyTopologyPassive(t *testing.T) {
+	setupGateway(t, &config{
+		RabbitPassive: true,
+		RabbitDefault: RabbitConf{Queue: "totem_input", Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	rabbitMgmtChannel = &fakeChannel{}
+	fakeDialer()
+	failed := metricValue(rabbitMetrics, metricTopologyFailed)
+
+	if err := verifyTopology(); err == nil {
+		t.Fatal("missing queue can't be restored in passive mode")
+	}
+	if metricValue(rabbitMetrics, metricTopologyFailed) != failed+1 {
+		t.Errorf("failure not counted")
+	}
+}
@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"sync"
+	"time"
+)
+
+// Clients can supply the trace ID of a ticket in its TraceID field, e.g.
+// to correlate it with their own logs. If a buggy client reuses a trace
+// ID, cancellations and status queries become ambiguous. With
+// conf.UniqueTraceIDs, a trace ID that was already used for an accepted
+// ticket within conf.TraceIDWindow seconds is rejected. Unlike an
+// Idempotency-Key, this never returns the previous answer.
+//
+// Since clients choose trace IDs freely, a trace ID only names a ticket
+// along with the organization and the tenant that submitted it.
+
+// ticketRef identifies the ticket traceID of org at a tenant.
+type ticketRef struct {
+	tenant  string // empty for the default gateway
+	org     string
+	traceID string
+}
+
+// newTicketRef returns the reference to the ticket traceID of org at the
+// tenant tn.
+func newTicketRef(tn *tenant, org, traceID string) ticketRef {
+	ref := ticketRef{org: org, traceID: traceID}
+	if tn != nil {
+		ref.tenant = tn.name
+	}
+	return ref
+}
+
+// resultID returns the correlation ID the results of the ticket are
+// received by. It is derived from the whole reference, so tickets of
+// different organizations with the same trace ID don't share results.
+func (ref ticketRef) resultID() string {
+	digest := sha256.Sum256([]byte(ref.tenant + "\n" + ref.org + "\n" + ref.traceID))
+	return hex.EncodeToString(digest[:])
+}
+
+var (
+	seenTraceIDs = make(map[ticketRef]time.Time) // -> time of use
+	traceMutex   = &sync.Mutex{}
+)
+
+var errTraceIDReused = errors.New("Trace ID was already used for another ticket")
+
+// maxTraceIDLength is the maximum length of client-supplied trace IDs.
+const maxTraceIDLength = 64
+
+// validTraceID reports whether id can be used as a trace ID. It has to be
+// usable in the path of a URL and in logs.
+func validTraceID(id string) bool {
+	if id == "" || len(id) > maxTraceIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// maxCorrelationIDLength limits client-supplied correlation IDs, which
+// must fit into an AMQP short string.
+const maxCorrelationIDLength = 128
+
+// validCorrelationID reports whether the client-supplied correlation ID
+// id consists of at most maxCorrelationIDLength printable ASCII
+// characters. An empty id is valid, since the trace ID is used then.
+func validCorrelationID(id string) bool {
+	if len(id) > maxCorrelationIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x20 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// ticketTraceID returns the trace ID supplied with ticket, or a new one.
+func ticketTraceID(ticket *tasking.Ticket) (string, *tasking.MyError) {
+	if ticket.TraceID == "" {
+		return newTraceID(), nil
+	}
+	if !validTraceID(ticket.TraceID) {
+		return "", &tasking.MyError{Error: errors.New("Ticket malformed (Invalid trace ID)"), Code: tasking.ERR_TASK_INVALID}
+	}
+	return ticket.TraceID, nil
+}
+
+// traceIDWindow returns the time a used trace ID is remembered.
+func traceIDWindow() time.Duration {
+	if conf.TraceIDWindow <= 0 {
+		return time.Hour
+	}
+	return time.Duration(conf.TraceIDWindow) * time.Second
+}
+
+// claimTraceID records the use of the trace ID of ref. If it was already
+// used by the organization within the window, false is returned. With
+// claim unset, it is only checked.
+func claimTraceID(ref ticketRef, claim bool) bool {
+	now := timeNow()
+	window := traceIDWindow()
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	for seen, at := range seenTraceIDs {
+		if now.Sub(at) >= window {
+			delete(seenTraceIDs, seen)
+		}
+	}
+	if _, exists := seenTraceIDs[ref]; exists {
+		return false
+	}
+	if claim {
+		seenTraceIDs[ref] = now
+	}
+	return true
+}
+
+// releaseTraceID forgets the use of the trace ID of ref, e.g. because
+// nothing was dispatched for its ticket, so the client can retry.
+func releaseTraceID(ref ticketRef) {
+	traceMutex.Lock()
+	delete(seenTraceIDs, ref)
+	traceMutex.Unlock()
+}
@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"github.com/streadway/amqp"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signTracedTicket returns a ticket of org with the client-supplied trace
+// ID traceID.
+func signTracedTicket(t *testing.T, org, traceID string, tasks ...tasking.Task) string {
+	ticket := tasking.Ticket{
+		Expiration:  time.Now().Add(time.Hour),
+		Tasks:       tasks,
+		SignerKeyId: org,
+		TraceID:     traceID}
+	if err := tasking.SignTicket(&ticket, ticketKey(t), ""); err != nil {
+		t.Fatal(err)
+	}
+	x, err := json.Marshal(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(x)
+}
+
+func TestUniqueTraceIDs(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:   map[string][]string{"org1": []string{"PEINFO", "YARA"}},
+		UniqueTraceIDs: true,
+		TraceIDWindow:  60,
+		RabbitDefault:  RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	// a rejected ticket doesn't use up its trace ID
+	answer := handleDecrypted(signTracedTicket(t, "org1", "client-1", newTask("CUCKOO")))
+	if answer.Error != nil || len(answer.Accepted) != 0 {
+		t.Fatalf("unexpected answer: %+v", answer)
+	}
+
+	answer = handleDecrypted(signTracedTicket(t, "org1", "client-1", newTask("PEINFO")))
+	if answer.Error != nil || answer.TraceID != "client-1" {
+		t.Fatalf("expected the client-supplied trace ID to be used: %+v", answer)
+	}
+	answer = handleDecrypted(signTracedTicket(t, "org1", "client-1", newTask("YARA")))
+	if answer.Error == nil || answer.Error.Error != errTraceIDReused {
+		t.Errorf("expected the reused trace ID to be rejected, got %+v", answer)
+	}
+
+	// generated trace IDs are not affected
+	for i := 0; i < 2; i++ {
+		if answer := handleDecrypted(signTracedTicket(t, "org1", "", newTask("YARA"))); answer.Error != nil {
+			t.Errorf("ticket without trace ID rejected: %s", answer.Error.Error)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if answer := handleDecrypted(signTracedTicket(t, "org1", "client-1", newTask("YARA"))); answer.Error != nil {
+		t.Errorf("trace ID rejected after the window: %s", answer.Error.Error)
+	}
+}
+
+func TestTraceIDsAllowedToRepeat(t *testing.T) {
+	setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	for i := 0; i < 2; i++ {
+		answer := handleDecrypted(signTracedTicket(t, "org1", "client-1", newTask("PEINFO")))
+		if answer.Error != nil || answer.TraceID != "client-1" {
+			t.Errorf("unexpected answer without enforcement: %+v", answer)
+		}
+	}
+
+	if answer := handleDecrypted(signTracedTicket(t, "org1", "../x", newTask("PEINFO"))); answer.Error == nil {
+		t.Errorf("expected an invalid trace ID to be rejected")
+	}
+}
+
+func TestTraceIDsScopedByOrganization(t *testing.T) {
+	ch := setupGateway(t, &config{
+		AllowedTasks:   map[string][]string{"org1": []string{"*"}, "org2": []string{"*"}},
+		UniqueTraceIDs: true,
+		ResultQueue:    "holmes_results",
+		CancelExchange: "holmes_control",
+		RabbitDefault:  RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	})
+	ticketKeys["org2"] = &ticketKey(t).PublicKey
+	results := &fakeChannel{}
+	if err := startResultConsumer(results); err != nil {
+		t.Fatal(err)
+	}
+
+	// another organization can use the same trace ID
+	for _, org := range []string{"org1", "org2"} {
+		answer := handleDecrypted(signTracedTicket(t, org, "shared-1", newTask("PEINFO")))
+		if answer.Error != nil || len(answer.Accepted) != 1 {
+			t.Fatalf("ticket of %s rejected: %+v", org, answer)
+		}
+	}
+	msgs := ch.messages()
+	if len(msgs) != 2 || msgs[0].Publishing.CorrelationId == msgs[1].Publishing.CorrelationId {
+		t.Fatalf("expected the tasks to be published with different result IDs, got %+v", msgs)
+	}
+
+	// the result for org1 is not reported to org2
+	results.deliveries <- amqp.Delivery{CorrelationId: msgs[0].Publishing.CorrelationId, Body: []byte(`{"peinfo":1}`)}
+	waitForResults(t, msgs[0].Publishing.CorrelationId, 1)
+	if _, status := statusRequest(t, "org1", "shared-1"); status.Received != 1 {
+		t.Errorf("expected the result for org1, got %+v", status)
+	}
+	if _, status := statusRequest(t, "org2", "shared-1"); status.Received != 0 {
+		t.Errorf("expected no result for org2, got %+v", status)
+	}
+
+	// cancelling the ticket of org2 leaves the one of org1
+	if w := cancelRequest(t, "org2", "shared-1"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := cancelRequest(t, "org1", "shared-1"); w.Code != http.StatusOK {
+		t.Errorf("expected the ticket of org1 to be cancellable, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	c := &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+	}
+	ch := setupGateway(t, c)
+	signCorrelated := func(correlationID string) string {
+		ticket := tasking.Ticket{
+			Expiration:    time.Now().Add(time.Hour),
+			Tasks:         []tasking.Task{newTask("PEINFO")},
+			SignerKeyId:   "org1",
+			CorrelationId: correlationID}
+		if err := tasking.SignTicket(&ticket, ticketKey(t), ""); err != nil {
+			t.Fatal(err)
+		}
+		x, _ := json.Marshal(ticket)
+		return string(x)
+	}
+	last := func() publishedMsg {
+		msgs := ch.messages()
+		if len(msgs) == 0 {
+			t.Fatal("nothing published")
+		}
+		return msgs[len(msgs)-1]
+	}
+
+	answer := handleDecrypted(signCorrelated("client-42"))
+	if answer.Error != nil {
+		t.Fatal(answer.Error.Error)
+	}
+	if id := last().Publishing.CorrelationId; id != "client-42" {
+		t.Errorf("expected the client's correlation ID, got %q", id)
+	}
+
+	// without one, the trace ID is used
+	answer = handleDecrypted(signCorrelated(""))
+	if id := last().Publishing.CorrelationId; id != answer.TraceID {
+		t.Errorf("expected the trace ID %s, got %q", answer.TraceID, id)
+	}
+
+	// the results are still received by the result ID
+	c.ResultQueue = "holmes_results"
+	answer = handleDecrypted(signCorrelated("client-43"))
+	msg := last()
+	if msg.Publishing.CorrelationId != newTicketRef(nil, "org1", answer.TraceID).resultID() || msg.Publishing.Headers["CorrelationId"] != "client-43" {
+		t.Errorf("expected the result ID and the client's correlation ID in a header, got %q and %v", msg.Publishing.CorrelationId, msg.Publishing.Headers)
+	}
+
+	for _, invalid := range []string{"line\nbreak", strings.Repeat("a", maxCorrelationIDLength+1)} {
+		published := len(ch.messages())
+		answer := handleDecrypted(signCorrelated(invalid))
+		if answer.Error == nil || answer.Error.Code != tasking.ERR_TASK_INVALID || len(ch.messages()) != published {
+			t.Errorf("invalid correlation ID %q accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// A destination with a Webhook is not published to RabbitMQ. Instead, the
+// task is POSTed as JSON to the URL, e.g. to a local service of a
+// lightweight deployment. Setting it in RabbitDefault sends all tasks
+// there, setting it in an entry of Rabbit only the tasks of that service.
+
+var (
+	webhookClient     = &http.Client{}
+	webhookRetryDelay = time.Second // replaced by tests
+)
+
+// validateWebhooks checks that the webhooks of all destinations of c are
+// absolute http(s) URLs.
+func validateWebhooks(c *config) error {
+	destinations := []RabbitConf{c.RabbitDefault}
+	for _, r := range c.Rabbit {
+		destinations = append(destinations, r)
+	}
+	if c.QuarantineRabbit != nil {
+		destinations = append(destinations, *c.QuarantineRabbit)
+	}
+	for _, r := range destinations {
+		if r.Webhook == "" {
+			continue
+		}
+		u, err := url.Parse(r.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Invalid Webhook '" + r.Webhook + "'")
+		}
+	}
+	return nil
+}
+
+// webhookAttempts returns how often a task is POSTed at most.
+func webhookAttempts() int {
+	if conf.WebhookRetries < 0 {
+		return 1
+	}
+	if conf.WebhookRetries == 0 {
+		return 4
+	}
+	return conf.WebhookRetries + 1
+}
+
+// postWebhookOnce POSTs body to url. The returned bool reports whether an
+// error may go away on retrying.
+func postWebhookOnce(url string, body []byte, correlationID string) (bool, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if correlationID != "" {
+		req.Header.Set("X-Correlation-Id", correlationID)
+	}
+	timeout := 5000
+	if conf.WebhookTimeout > 0 {
+		timeout = conf.WebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	resp, err := webhookClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	// drain the body, so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("Webhook answered %s", resp.Status)
+	// other client errors won't change on retrying
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// postWebhook POSTs the marshalled task body to the webhook of rconf. Failed
+// attempts are retried after webhookRetryDelay, as long as the error is
+// temporary.
+func postWebhook(rconf *RabbitConf, body []byte, correlationID string) *tasking.MyError {
+	attempts := webhookAttempts()
+	for attempt := 1; ; attempt++ {
+		temporary, err := postWebhookOnce(rconf.Webhook, body, correlationID)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Error while posting to webhook %s (attempt %d of %d): %s", rconf.Webhook, attempt, attempts, err)
+		if !temporary {
+			return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_UNRECOVERABLE}
+		}
+		if attempt >= attempts {
+			return &tasking.MyError{Error: err, Code: tasking.ERR_OTHER_RECOVERABLE}
+		}
+		time.Sleep(webhookRetryDelay)
+	}
+}
@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/HolmesProcessing/Holmes-Gateway/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer records the tasks POSTed to it. The first failures requests
+// are answered with status.
+type webhookServer struct {
+	sync.Mutex
+	failures int
+	status   int
+	attempts int
+	tasks    []tasking.Task
+	headers  []http.Header
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.attempts++
+	if s.attempts <= s.failures {
+		w.WriteHeader(s.status)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var task tasking.Task
+	if err := json.Unmarshal(body, &task); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.tasks = append(s.tasks, task)
+	s.headers = append(s.headers, r.Header)
+}
+
+func TestWebhookTransport(t *testing.T) {
+	hook := &webhookServer{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	ch := setupGateway(t, &config{
+		AllowedTasks:  map[string][]string{"org1": []string{"*"}},
+		RabbitDefault: RabbitConf{Exchange: "totem", RoutingKey: "work.static.totem"},
+		Rabbit:        map[string]RabbitConf{"YARA": {Webhook: server.URL}},
+	})
+	defer func(d time.Duration) { webhookRetryDelay = d }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	answer := handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA", "PEINFO")))
+	if answer.Error != nil || len(answer.TskErrors) != 0 || len(answer.Accepted) != 2 {
+		t.Fatalf("expected both services accepted: %+v", answer)
+	}
+	if len(hook.tasks) != 1 || len(hook.tasks[0].Tasks) != 1 {
+		t.Fatalf("expected YARA posted to the webhook, got %+v", hook.tasks)
+	}
+	if _, yara := hook.tasks[0].Tasks["YARA"]; !yara || hook.tasks[0].PrimaryURI != newTask().PrimaryURI {
+		t.Errorf("wrong payload posted: %+v", hook.tasks[0])
+	}
+	if h := hook.headers[0]; h.Get("Content-Type") != "application/json" || h.Get("X-Correlation-Id") != answer.TraceID {
+		t.Errorf("wrong headers posted: %v", h)
+	}
+	if msgs := ch.messages(); len(msgs) != 1 {
+		t.Errorf("expected only PEINFO published to RabbitMQ, got %d messages", len(msgs))
+	}
+
+	// temporary failures are retried
+	hook.attempts, hook.failures, hook.status = 0, 2, http.StatusServiceUnavailable
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA")))
+	if answer.Error != nil || len(answer.TskErrors) != 0 || hook.attempts != 3 {
+		t.Errorf("expected the third attempt to succeed, got %d attempts: %+v", hook.attempts, answer)
+	}
+
+	// until the retries are exhausted
+	hook.attempts, hook.failures = 0, 10
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_OTHER_RECOVERABLE {
+		t.Fatalf("expected a recoverable error: %+v", answer)
+	}
+	if hook.attempts != 4 {
+		t.Errorf("expected 4 attempts, got %d", hook.attempts)
+	}
+
+	// other client errors are not
+	hook.attempts, hook.status = 0, http.StatusNotFound
+	answer = handleDecrypted(signTicket(t, "org1", time.Now().Add(time.Hour), newTask("YARA")))
+	if len(answer.TskErrors) != 1 || answer.TskErrors[0].Error.Code != tasking.ERR_OTHER_UNRECOVERABLE || hook.attempts != 1 {
+		t.Errorf("expected an unrecoverable error after 1 attempt, got %d attempts: %+v", hook.attempts, answer)
+	}
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	for webhook, valid := range map[string]bool{
+		"http://localhost:8080/tasks": true,
+		"https://example.com/tasks":   true,
+		"localhost:8080/tasks":        false,
+		"ftp://example.com/tasks":     false,
+		"http://":                     false,
+	} {
+		c := &config{Rabbit: map[string]RabbitConf{"YARA": {Webhook: webhook}}}
+		if err := validateWebhooks(c); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", webhook, valid, err)
+		}
+	}
+}
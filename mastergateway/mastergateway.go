@@ -2,6 +2,7 @@ package mastergateway
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -35,6 +36,7 @@ type config struct {
 	CertificatePath    string
 	CertificateKeyPath string
 	AllowedUsers       []tasking.User
+	Canonicalization   string // Serialization of signed tickets: "legacy" (default) or "canonical"
 }
 
 var (
@@ -56,11 +58,7 @@ func createTicket(tasks []tasking.Task) (tasking.Ticket, error) {
 		Tasks:       tasks,
 		SignerKeyId: ticketSignKeyName,
 		Signature:   nil}
-	msg, err := json.Marshal(t)
-	if err != nil {
-		return t, err
-	}
-	t.Signature, err = tasking.Sign(msg, ticketSignKey)
+	err := tasking.SignTicket(&t, ticketSignKey, conf.Canonicalization)
 	return t, err
 }
 
@@ -108,6 +106,8 @@ func requestTaskList(uri string, encryptedTicket *tasking.Encrypted, symKey []by
 	q.Add("IV", base64.StdEncoding.EncodeToString(encryptedTicket.IV))
 	q.Add("Encrypted", base64.StdEncoding.EncodeToString(encryptedTicket.Encrypted))
 	req.URL.RawQuery = q.Encode()
+	req.Header.Set(tasking.AcceptEncryptionHeader, tasking.ENCRYPTION_AES_CBC)
+	req.Header.Set(tasking.AcceptCompressionHeader, tasking.COMPRESSION_GZIP+", "+tasking.COMPRESSION_IDENTITY)
 	log.Println(req.URL)
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -115,8 +115,23 @@ func requestTaskList(uri string, encryptedTicket *tasking.Encrypted, symKey []by
 		return err, nil
 	}
 	answer, _ := ioutil.ReadAll(resp.Body)
+	if resp.Header.Get(tasking.EncryptedHeader) == "false" {
+		// the gateway failed before it knew the symmetric key
+		log.Printf("Plain: %+v\n", string(answer))
+		return err, answer
+	}
 	encryptedTicket.IV[0] ^= 1
 	answerDec, _ := tasking.AesDecrypt(answer, symKey, encryptedTicket.IV)
+	if resp.Header.Get(tasking.CompressionHeader) == tasking.COMPRESSION_GZIP {
+		zr, err := gzip.NewReader(bytes.NewReader(answerDec))
+		if err != nil {
+			return err, nil
+		}
+		answerDec, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return err, nil
+		}
+	}
 	log.Printf("Decrypted: %+v\n", string(answerDec))
 	return err, answerDec
 }
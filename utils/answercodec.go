@@ -0,0 +1,353 @@
+package tasking
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+)
+
+// The binary format of a GatewayAnswer is a compact alternative to JSON
+// for clients receiving large answers. It starts with a version byte,
+// followed by the fields of the answer in the order of their declaration.
+// Strings and byte slices are prefixed with their length, integers are
+// varints, and booleans are a single byte. Slices, maps and pointers are
+// prefixed with a uvarint which is 0 for nil and otherwise the length plus
+// one (1 for a pointer), so nil and empty values survive the round trip
+// like with JSON. Times use their MarshalBinary encoding.
+
+const answerBinaryVersion = 1
+
+var errAnswerTruncated = errors.New("Binary answer truncated")
+
+// answerWriter appends the fields of an answer to buf.
+type answerWriter struct {
+	buf []byte
+}
+
+func (w *answerWriter) uvarint(x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutUvarint(b[:], x)]...)
+}
+
+func (w *answerWriter) varint(x int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf = append(w.buf, b[:binary.PutVarint(b[:], x)]...)
+}
+
+func (w *answerWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *answerWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *answerWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+// length writes the prefix of a slice, map or pointer of length n.
+func (w *answerWriter) length(isNil bool, n int) {
+	if isNil {
+		w.uvarint(0)
+	} else {
+		w.uvarint(uint64(n) + 1)
+	}
+}
+
+func (w *answerWriter) time(t time.Time) error {
+	b, err := t.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.bytes(b)
+	return nil
+}
+
+func (w *answerWriter) strings(s []string) {
+	w.length(s == nil, len(s))
+	for _, x := range s {
+		w.string(x)
+	}
+}
+
+func (w *answerWriter) myError(e MyError) {
+	msg := ""
+	if e.Error != nil {
+		msg = e.Error.Error()
+	}
+	w.string(msg)
+	w.varint(int64(e.Code))
+}
+
+func (w *answerWriter) task(t Task) {
+	w.string(t.PrimaryURI)
+	w.string(t.SecondaryURI)
+	w.string(t.Filename)
+	// sorted, so equal answers are encoded equally
+	names := make([]string, 0, len(t.Tasks))
+	for name := range t.Tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.length(t.Tasks == nil, len(names))
+	for _, name := range names {
+		w.string(name)
+		w.strings(t.Tasks[name])
+	}
+	w.strings(t.Tags)
+	w.varint(int64(t.Attempts))
+	w.string(t.Source)
+	w.bool(t.Download)
+	w.string(t.Comment)
+}
+
+// EncodeAnswerBinary encodes answer in the binary format.
+func EncodeAnswerBinary(answer *GatewayAnswer) ([]byte, error) {
+	w := &answerWriter{buf: []byte{answerBinaryVersion}}
+	w.string(answer.TraceID)
+	w.length(answer.Error == nil, 0)
+	if answer.Error != nil {
+		w.myError(*answer.Error)
+	}
+	w.length(answer.TskErrors == nil, len(answer.TskErrors))
+	for _, e := range answer.TskErrors {
+		w.task(e.TaskStruct)
+		w.myError(e.Error)
+		w.string(e.Reason)
+	}
+	w.length(answer.Accepted == nil, len(answer.Accepted))
+	for _, s := range answer.Accepted {
+		w.string(s.PrimaryURI)
+		w.string(s.Task)
+		w.string(s.Exchange)
+		w.string(s.RoutingKey)
+		w.string(s.Result)
+		w.string(s.MatchedRule)
+	}
+	w.length(answer.Receipt == nil, 0)
+	if r := answer.Receipt; r != nil {
+		w.string(r.TraceID)
+		if err := w.time(r.Timestamp); err != nil {
+			return nil, err
+		}
+		w.string(r.Organization)
+		w.bytes(r.TaskDigest)
+		w.string(r.KeyId)
+		w.bytes(r.Signature)
+	}
+	w.bool(answer.DryRun)
+	w.bool(answer.Async)
+	if err := w.time(answer.ServerTime); err != nil {
+		return nil, err
+	}
+	w.length(answer.Rejections == nil, len(answer.Rejections))
+	for _, r := range answer.Rejections {
+		w.string(r.Reason)
+		w.varint(int64(r.Errors))
+		w.varint(int64(r.Services))
+		w.strings(r.Examples)
+	}
+	w.bool(answer.TskErrorsTruncated)
+	return w.buf, nil
+}
+
+// answerReader reads the fields of an answer from buf. After the first
+// error, all reads return zero values and err is kept.
+type answerReader struct {
+	buf []byte
+	err error
+}
+
+func (r *answerReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errAnswerTruncated
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+func (r *answerReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errAnswerTruncated
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+func (r *answerReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = errAnswerTruncated
+		return nil
+	}
+	b := append([]byte(nil), r.buf[:n]...)
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *answerReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *answerReader) bool() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.buf) == 0 {
+		r.err = errAnswerTruncated
+		return false
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b != 0
+}
+
+// length reads the prefix of a slice, map or pointer. Every element takes
+// at least a byte, so a length beyond the rest of the buffer is rejected
+// before allocating it.
+func (r *answerReader) length() (bool, int) {
+	n := r.uvarint()
+	if r.err != nil || n == 0 {
+		return true, 0
+	}
+	if n-1 > uint64(len(r.buf)) {
+		r.err = errAnswerTruncated
+		return true, 0
+	}
+	return false, int(n - 1)
+}
+
+func (r *answerReader) time() time.Time {
+	var t time.Time
+	b := r.bytes()
+	if r.err != nil {
+		return t
+	}
+	if err := t.UnmarshalBinary(b); err != nil {
+		r.err = err
+	}
+	return t
+}
+
+func (r *answerReader) strings() []string {
+	isNil, n := r.length()
+	if isNil {
+		return nil
+	}
+	s := make([]string, n)
+	for i := range s {
+		s[i] = r.string()
+	}
+	return s
+}
+
+func (r *answerReader) myError() MyError {
+	msg := r.string()
+	return MyError{Error: errors.New(msg), Code: ErrCode(r.varint())}
+}
+
+func (r *answerReader) task() Task {
+	var t Task
+	t.PrimaryURI = r.string()
+	t.SecondaryURI = r.string()
+	t.Filename = r.string()
+	if isNil, n := r.length(); !isNil {
+		t.Tasks = make(map[string][]string, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			name := r.string()
+			t.Tasks[name] = r.strings()
+		}
+	}
+	t.Tags = r.strings()
+	t.Attempts = int(r.varint())
+	t.Source = r.string()
+	t.Download = r.bool()
+	t.Comment = r.string()
+	return t
+}
+
+// DecodeAnswerBinary decodes an answer encoded by EncodeAnswerBinary.
+func DecodeAnswerBinary(data []byte) (*GatewayAnswer, error) {
+	if len(data) == 0 || data[0] != answerBinaryVersion {
+		return nil, errors.New("Unknown version of the binary answer")
+	}
+	r := &answerReader{buf: data[1:]}
+	answer := &GatewayAnswer{}
+	answer.TraceID = r.string()
+	if isNil, _ := r.length(); !isNil {
+		e := r.myError()
+		answer.Error = &e
+	}
+	if isNil, n := r.length(); !isNil {
+		answer.TskErrors = make([]TaskError, n)
+		for i := range answer.TskErrors {
+			e := &answer.TskErrors[i]
+			e.TaskStruct = r.task()
+			e.Error = r.myError()
+			e.Reason = r.string()
+		}
+	}
+	if isNil, n := r.length(); !isNil {
+		answer.Accepted = make([]TaskSummary, n)
+		for i := range answer.Accepted {
+			s := &answer.Accepted[i]
+			s.PrimaryURI = r.string()
+			s.Task = r.string()
+			s.Exchange = r.string()
+			s.RoutingKey = r.string()
+			s.Result = r.string()
+			s.MatchedRule = r.string()
+		}
+	}
+	if isNil, _ := r.length(); !isNil {
+		answer.Receipt = &Receipt{
+			TraceID:      r.string(),
+			Timestamp:    r.time(),
+			Organization: r.string(),
+			TaskDigest:   r.bytes(),
+			KeyId:        r.string(),
+			Signature:    r.bytes()}
+	}
+	answer.DryRun = r.bool()
+	answer.Async = r.bool()
+	answer.ServerTime = r.time()
+	if isNil, n := r.length(); !isNil {
+		answer.Rejections = make([]RejectionSummary, n)
+		for i := range answer.Rejections {
+			s := &answer.Rejections[i]
+			s.Reason = r.string()
+			s.Errors = int(r.varint())
+			s.Services = int(r.varint())
+			s.Examples = r.strings()
+		}
+	}
+	answer.TskErrorsTruncated = r.bool()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.buf) != 0 {
+		return nil, errors.New("Trailing data after the binary answer")
+	}
+	return answer, nil
+}
@@ -0,0 +1,95 @@
+package tasking
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testAnswer() *GatewayAnswer {
+	task := Task{
+		PrimaryURI: "3a12f43eeb0c45d241a8f447d4661d9746d6ea35990953334f5ec675f60e36c5",
+		Filename:   "myfile",
+		Tasks:      map[string][]string{"PEINFO": []string{}, "YARA": []string{"-r", "rules"}},
+		Tags:       []string{"test1"},
+		Attempts:   2,
+		Source:     "src1",
+		Download:   true,
+		Comment:    "ünïcode"}
+	return &GatewayAnswer{
+		TraceID: "trace1",
+		TskErrors: []TaskError{
+			{TaskStruct: task, Error: MyError{Error: errors.New("Task not allowed"), Code: ERR_NOT_ALLOWED}, Reason: REASON_TASK_NOT_ALLOWED},
+			{TaskStruct: Task{}, Error: MyError{Error: errors.New("Invalid Task"), Code: ERR_TASK_INVALID}, Reason: REASON_NO_TASKS},
+		},
+		Accepted: []TaskSummary{{PrimaryURI: task.PrimaryURI, Task: "PEINFO", Exchange: "totem", RoutingKey: "work.static.totem", MatchedRule: "*"}},
+		Receipt: &Receipt{
+			TraceID:      "trace1",
+			Timestamp:    time.Date(2017, 3, 1, 12, 0, 0, 5, time.UTC),
+			Organization: "org1",
+			TaskDigest:   []byte{1, 2, 3},
+			KeyId:        "gateway",
+			Signature:    []byte{4, 5, 6}},
+		Async:              true,
+		ServerTime:         time.Date(2017, 3, 1, 12, 0, 1, 0, time.UTC),
+		Rejections:         []RejectionSummary{{Reason: REASON_TASK_NOT_ALLOWED, Errors: 1, Services: 2, Examples: []string{"PEINFO", "YARA"}}},
+		TskErrorsTruncated: true,
+	}
+}
+
+// TestAnswerBinaryRoundTrip checks that an answer decoded from the binary
+// format equals the one decoded from JSON.
+func TestAnswerBinaryRoundTrip(t *testing.T) {
+	withError := &GatewayAnswer{Error: &MyError{Error: errors.New("Ticket expired"), Code: ERR_OTHER_RECOVERABLE}, Accepted: []TaskSummary{}}
+	for _, answer := range []*GatewayAnswer{testAnswer(), withError, &GatewayAnswer{}} {
+		x, err := json.Marshal(answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fromJSON GatewayAnswer
+		if err := json.Unmarshal(x, &fromJSON); err != nil {
+			t.Fatal(err)
+		}
+		b, err := EncodeAnswerBinary(answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromBinary, err := DecodeAnswerBinary(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := json.Marshal(fromJSON)
+		got, _ := json.Marshal(fromBinary)
+		if string(got) != string(expected) {
+			t.Errorf("binary round trip differs:\n%s\n%s", got, expected)
+		}
+	}
+}
+
+func TestAnswerBinaryCompact(t *testing.T) {
+	answer := testAnswer()
+	for i := 0; i < 100; i++ {
+		answer.TskErrors = append(answer.TskErrors, answer.TskErrors[0])
+	}
+	x, _ := json.Marshal(answer)
+	b, _ := EncodeAnswerBinary(answer)
+	if len(b) >= len(x)/2 {
+		t.Errorf("binary answer not compact: %d bytes, JSON %d bytes", len(b), len(x))
+	}
+}
+
+func TestAnswerBinaryTruncated(t *testing.T) {
+	b, err := EncodeAnswerBinary(testAnswer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(b); n++ {
+		if _, err := DecodeAnswerBinary(b[:n]); err == nil {
+			t.Fatalf("truncated answer of %d bytes decoded", n)
+		}
+	}
+	if _, err := DecodeAnswerBinary(append(b, 0)); err == nil {
+		t.Errorf("trailing data accepted")
+	}
+}
@@ -0,0 +1,38 @@
+//go:build go1.16
+// +build go1.16
+
+package tasking
+
+import (
+	"io/fs"
+	"path"
+)
+
+// fsKeys is the KeySource of an fs.FS. Paths are slash-separated and
+// relative to the root of the FS, as usual for an fs.FS.
+type fsKeys struct {
+	fsys fs.FS
+}
+
+// KeysFromFS returns a KeySource reading the key files from fsys, e.g.
+// from an embed.FS for single-binary deployments or from a fixture in
+// tests. An fs.FS can't be watched, so changes are not detected.
+func KeysFromFS(fsys fs.FS) KeySource {
+	return fsKeys{fsys}
+}
+
+func (k fsKeys) ReadKey(name string) ([]byte, error) {
+	return fs.ReadFile(k.fsys, name)
+}
+
+func (k fsKeys) WalkKeys(dir string, ext string, onAdd func(string)) error {
+	return fs.WalkDir(k.fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && path.Ext(name) == ext {
+			onAdd(name)
+		}
+		return nil
+	})
+}
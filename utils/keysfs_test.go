@@ -0,0 +1,63 @@
+//go:build go1.16
+// +build go1.16
+
+package tasking
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestLoadKeysFromFS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := KeysFromFS(fstest.MapFS{
+		"keys/org1.priv": {Data: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})},
+		"keys/org1.pub":  {Data: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})},
+		"keys/README":    {Data: []byte("not a key")},
+	})
+	removed := func(name string) { t.Errorf("%s removed", name) }
+
+	privateKeys := make(map[string]*rsa.PrivateKey)
+	LoadKeysFromAndWatch(src, "keys", ".priv", removed, func(name string) {
+		k, name, err := LoadPrivateKeyFrom(src, name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		privateKeys[name] = k
+	})
+	publicKeys := make(map[string]*rsa.PublicKey)
+	LoadKeysFromAndWatch(src, "keys", ".pub", removed, func(name string) {
+		k, name, err := LoadPublicKeyFrom(src, name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		publicKeys[name] = k
+	})
+	if len(privateKeys) != 1 || privateKeys["org1"] == nil || len(publicKeys) != 1 || publicKeys["org1"] == nil {
+		t.Fatalf("unexpected keys: %v, %v", privateKeys, publicKeys)
+	}
+
+	ticket := Ticket{Expiration: time.Now().Add(time.Hour), SignerKeyId: "org1"}
+	if err := SignTicket(&ticket, privateKeys["org1"], CANONICALIZATION_LEGACY); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyTicket(ticket, publicKeys["org1"]); err != nil {
+		t.Errorf("ticket signed with the loaded key not verified: %s", err)
+	}
+
+	if _, _, err := LoadPublicKeyFrom(src, "keys/missing.pub"); err == nil {
+		t.Errorf("expected a missing key to fail")
+	}
+}
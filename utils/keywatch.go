@@ -0,0 +1,146 @@
+package tasking
+
+import (
+	"errors"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// ForceKeyPolling makes DirWatcher poll the key directories instead
+	// of watching them with inotify.
+	ForceKeyPolling bool
+	// KeyPollInterval is the time between two polls of a key directory.
+	KeyPollInterval = 10 * time.Second
+	// MaxKeyWatchers limits the number of key directories watched with
+	// inotify. Further directories are polled. 0 means no limit.
+	MaxKeyWatchers int
+	// KeyEventWorkers is the number of goroutines loading and removing
+	// the keys of a directory concurrently, e.g. during a bulk rotation.
+	// The changes of the same file are always handled in order.
+	KeyEventWorkers = 1
+
+	keyWatchers      int
+	keyWatchersMutex = &sync.Mutex{}
+
+	// watchDir is replaced in tests to simulate failing watchers
+	watchDir = limitedWatcher
+)
+
+// limitedWatcher watches dir with inotify, unless MaxKeyWatchers
+// directories are already watched.
+func limitedWatcher(dir string, ext string, onRemove func(string), onAdd func(string)) error {
+	keyWatchersMutex.Lock()
+	defer keyWatchersMutex.Unlock()
+	if MaxKeyWatchers > 0 && keyWatchers >= MaxKeyWatchers {
+		return errors.New("MaxKeyWatchers reached")
+	}
+	err := startWatcher(dir, ext, onRemove, onAdd)
+	if err == nil {
+		keyWatchers++
+	}
+	return err
+}
+
+// keyFiles returns the modification times of all keys with the
+// extension ext in dir.
+func keyFiles(dir string, ext string) map[string]time.Time {
+	files := make(map[string]time.Time)
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || filepath.Ext(path) != ext {
+			return nil
+		}
+		files[path] = fi.ModTime()
+		return nil
+	})
+	return files
+}
+
+// pollDir detects added, removed, and modified keys in dir by comparing
+// its content to the known keys every interval. It never returns.
+func pollDir(dir string, ext string, interval time.Duration, queue *keyEventQueue, known map[string]time.Time, onRemove func(string), onAdd func(string)) {
+	for {
+		time.Sleep(interval)
+		known = pollDirOnce(dir, ext, queue, known, onRemove, onAdd)
+	}
+}
+
+// pollDirOnce compares the keys in dir to the known ones, calls onRemove
+// and onAdd on queue for every difference, and returns the current keys
+// once all differences are handled.
+func pollDirOnce(dir string, ext string, queue *keyEventQueue, known map[string]time.Time, onRemove func(string), onAdd func(string)) map[string]time.Time {
+	current := keyFiles(dir, ext)
+	for path := range known {
+		if _, exists := current[path]; !exists {
+			name := filepath.Base(path)
+			queue.run(path, func() { onRemove(name[:len(name)-len(ext)]) })
+		}
+	}
+	for path, modTime := range current {
+		previous, exists := known[path]
+		if exists && previous.Equal(modTime) {
+			continue
+		}
+		path := path
+		queue.run(path, func() {
+			if exists {
+				name := filepath.Base(path)
+				onRemove(name[:len(name)-len(ext)])
+			}
+			onAdd(path)
+		})
+	}
+	queue.wait()
+	return current
+}
+
+// keyEventQueue runs the handlers of changed keys on a fixed number of
+// goroutines. The handlers of the same path run on the same goroutine,
+// in the order they were queued.
+type keyEventQueue struct {
+	workers []chan func()
+	pending sync.WaitGroup
+}
+
+// newKeyEventQueue starts a queue with the given number of goroutines,
+// at least one.
+func newKeyEventQueue(workers int) *keyEventQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &keyEventQueue{workers: make([]chan func(), workers)}
+	for i := range q.workers {
+		q.workers[i] = make(chan func(), 64)
+		go func(handlers chan func()) {
+			for f := range handlers {
+				f()
+				q.pending.Done()
+			}
+		}(q.workers[i])
+	}
+	return q
+}
+
+// run queues the handler f of a change of path.
+func (q *keyEventQueue) run(path string, f func()) {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	q.pending.Add(1)
+	q.workers[h.Sum32()%uint32(len(q.workers))] <- f
+}
+
+// wait waits until all queued handlers returned.
+func (q *keyEventQueue) wait() {
+	q.pending.Wait()
+}
+
+// close stops the goroutines of the queue after they handled the queued
+// changes. Nothing may be queued afterwards.
+func (q *keyEventQueue) close() {
+	for _, handlers := range q.workers {
+		close(handlers)
+	}
+}
@@ -0,0 +1,186 @@
+package tasking
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keyEvents records the calls of onAdd and onRemove.
+type keyEvents struct {
+	sync.Mutex
+	added   []string
+	removed []string
+}
+
+func (e *keyEvents) onAdd(path string) {
+	e.Lock()
+	e.added = append(e.added, filepath.Base(path))
+	e.Unlock()
+}
+
+func (e *keyEvents) onRemove(name string) {
+	e.Lock()
+	e.removed = append(e.removed, name)
+	e.Unlock()
+}
+
+// loaded returns the number of different keys added to e, since keys
+// written while polling are added again once they are complete.
+func (e *keyEvents) loaded() int {
+	e.Lock()
+	defer e.Unlock()
+	keys := make(map[string]bool)
+	for _, key := range e.added {
+		keys[key] = true
+	}
+	return len(keys)
+}
+
+func (e *keyEvents) counts() (int, int) {
+	e.Lock()
+	defer e.Unlock()
+	return len(e.added), len(e.removed)
+}
+
+func TestDirWatcherFallsBackToPolling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(w func(string, string, func(string), func(string)) error, i time.Duration) {
+		watchDir, KeyPollInterval = w, i
+	}(watchDir, KeyPollInterval)
+	watchDir = func(string, string, func(string), func(string)) error {
+		return errors.New("no space left on device")
+	}
+	KeyPollInterval = 10 * time.Millisecond
+
+	events := &keyEvents{}
+	LoadKeysAndWatch(dir, ".pub", events.onRemove, events.onAdd)
+	ioutil.WriteFile(filepath.Join(dir, "org1.pub"), []byte("key"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "org1.txt"), []byte("other"), 0600)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if added, _ := events.counts(); added > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	events.Lock()
+	defer events.Unlock()
+	if len(events.added) != 1 || events.added[0] != "org1.pub" {
+		t.Errorf("expected the new key to be found by polling, got %v", events.added)
+	}
+}
+
+func TestPollDirOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "old.pub"), []byte("key"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "changed.pub"), []byte("key"), 0600)
+	known := keyFiles(dir, ".pub")
+
+	os.Remove(filepath.Join(dir, "old.pub"))
+	ioutil.WriteFile(filepath.Join(dir, "new.pub"), []byte("key"), 0600)
+	os.Chtimes(filepath.Join(dir, "changed.pub"), time.Now(), time.Now().Add(time.Hour))
+
+	events := &keyEvents{}
+	queue := newKeyEventQueue(1)
+	defer queue.close()
+	known = pollDirOnce(dir, ".pub", queue, known, events.onRemove, events.onAdd)
+	if added, removed := events.counts(); added != 2 || removed != 2 {
+		t.Errorf("expected 2 added and 2 removed keys, got %v and %v", events.added, events.removed)
+	}
+	if len(known) != 2 {
+		t.Errorf("expected 2 known keys, got %d", len(known))
+	}
+
+	// nothing changed
+	events = &keyEvents{}
+	pollDirOnce(dir, ".pub", queue, known, events.onRemove, events.onAdd)
+	if added, removed := events.counts(); added != 0 || removed != 0 {
+		t.Errorf("expected no changes, got %v and %v", events.added, events.removed)
+	}
+}
+
+func TestMaxKeyWatchers(t *testing.T) {
+	defer func(m int) { MaxKeyWatchers = m }(MaxKeyWatchers)
+	MaxKeyWatchers = 1
+	keyWatchersMutex.Lock()
+	keyWatchers = 1
+	keyWatchersMutex.Unlock()
+	defer func() { keyWatchers = 0 }()
+
+	if err := limitedWatcher(os.TempDir(), ".pub", func(string) {}, func(string) {}); err == nil {
+		t.Errorf("expected the watcher to be refused beyond MaxKeyWatchers")
+	}
+}
+
+func TestKeyEventWorkersLoadBurst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(w func(string, string, func(string), func(string)) error, i time.Duration, n int) {
+		watchDir, KeyPollInterval, KeyEventWorkers = w, i, n
+	}(watchDir, KeyPollInterval, KeyEventWorkers)
+	watchDir = func(string, string, func(string), func(string)) error {
+		return errors.New("no space left on device")
+	}
+	KeyPollInterval = 10 * time.Millisecond
+	KeyEventWorkers = 20
+
+	// loading a key takes 10ms, so loading all of them one by one would
+	// take 2s
+	const deployed = 200
+	events := &keyEvents{}
+	LoadKeysAndWatch(dir, ".pub", events.onRemove, func(path string) {
+		time.Sleep(10 * time.Millisecond)
+		events.onAdd(path)
+	})
+	start := time.Now()
+	for i := 0; i < deployed; i++ {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("org%d.pub", i)), []byte("key"), 0600)
+	}
+
+	for time.Since(start) < time.Second {
+		if events.loaded() == deployed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected %d keys to be loaded within 1s, got %d", deployed, events.loaded())
+}
+
+func TestKeyEventQueueKeepsOrderPerPath(t *testing.T) {
+	queue := newKeyEventQueue(4)
+	defer queue.close()
+	var order []int
+	for i := 0; i < 100; i++ {
+		i := i
+		queue.run("org1.pub", func() { order = append(order, i) })
+	}
+	queue.wait()
+	for i, n := range order {
+		if n != i {
+			t.Fatalf("handlers of the same path ran out of order: %v", order)
+		}
+	}
+	if len(order) != 100 {
+		t.Errorf("expected 100 handlers to run, got %d", len(order))
+	}
+}
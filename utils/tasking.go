@@ -24,7 +24,16 @@ type Ticket struct {
 	Expiration  time.Time
 	Tasks       []Task
 	SignerKeyId string
+	TraceID     string `json:",omitempty"` // Chosen by the gateway, if empty
 	Signature   []byte
+	// Published as the AMQP correlation ID of the tasks, instead of the
+	// trace ID, so clients can use the IDs of their own tracking systems
+	CorrelationId string `json:",omitempty"`
+	// Incremented by the organization for every ticket, if the gateway
+	// requires sequences for replay protection
+	Sequence uint64 `json:",omitempty"`
+	// Nothing is dispatched, if any of the services would be rejected
+	AllOrNothing bool `json:",omitempty"`
 }
 
 // Tasks are encrypted with a symmetric key (EncryptedKey), which is
@@ -33,7 +42,18 @@ type Encrypted struct {
 	KeyFingerprint string
 	EncryptedKey   []byte
 	Encrypted      []byte
-	IV             []byte
+	IV             []byte // 16 bytes, or AES_GCM_NONCE_SIZE with ENCRYPTION_AES_GCM
+	Encryption     string // ENCRYPTION_AES_CBC (if empty) or ENCRYPTION_AES_GCM
+	// If the symmetric key is encrypted for several asymmetric keys, all
+	// of them, including KeyFingerprint and EncryptedKey
+	Recipients []Recipient
+}
+
+// Recipient is the symmetric key of a ticket, encrypted with the
+// asymmetric key in KeyFingerprint.
+type Recipient struct {
+	KeyFingerprint string
+	EncryptedKey   []byte
 }
 
 type Task struct {
@@ -60,6 +80,14 @@ type User struct {
 	PasswordHash string `json:"pw"`
 }
 
+// Capabilities describes what a gateway accepts from an organization.
+type Capabilities struct {
+	Organization        string
+	AllowedTasks        []string
+	EncryptionModes     []string
+	SignatureAlgorithms []string
+}
+
 type ErrCode int
 
 const (
@@ -70,6 +98,7 @@ const (
 	ERR_NOT_ALLOWED                 = iota
 	ERR_OTHER_UNRECOVERABLE         = iota
 	ERR_OTHER_RECOVERABLE           = iota
+	ERR_BUSY                        = iota
 )
 
 type MyError struct {
@@ -77,14 +106,145 @@ type MyError struct {
 	Code  ErrCode
 }
 
+// Reasons for which the gateway rejects (parts of) a task. Unlike the
+// error message, the reason of a TaskError is stable and meant to be
+// evaluated by clients.
+const (
+	REASON_PRIMARY_URI_INVALID    = "primary_uri_invalid"
+	REASON_SECONDARY_URI_INVALID  = "secondary_uri_invalid"
+	REASON_FILENAME_INVALID       = "filename_invalid"
+	REASON_FILENAME_MISMATCH      = "filename_mismatch"
+	REASON_NO_TASKS               = "no_tasks"
+	REASON_TASK_NAME_INVALID      = "task_name_invalid"
+	REASON_ARGUMENT_TOO_LONG      = "argument_too_long"
+	REASON_ARGUMENTS_TOO_LONG     = "arguments_too_long"
+	REASON_TAG_INVALID            = "tag_invalid"
+	REASON_NEGATIVE_ATTEMPTS      = "negative_attempts"
+	REASON_ATTEMPTS_OUT_OF_RANGE  = "attempts_out_of_range"
+	REASON_COMMENT_INVALID        = "comment_invalid"
+	REASON_ENRICHMENT_FAILED      = "enrichment_failed"
+	REASON_DISPATCH_FAILED        = "dispatch_failed"
+	REASON_TASK_DISABLED          = "task_disabled"
+	REASON_SECONDARY_URI_REQUIRED = "secondary_uri_required"
+	REASON_TASK_NOT_ALLOWED       = "task_not_allowed"
+	REASON_TASK_UNKNOWN           = "task_unknown"
+	REASON_DOWNLOAD_NOT_ALLOWED   = "download_not_allowed"
+	REASON_URI_SCHEME_NOT_ALLOWED = "uri_scheme_not_allowed"
+	REASON_TASK_RATE_LIMITED      = "task_rate_limited"
+	REASON_ARGUMENTS_REQUIRED     = "arguments_required"
+	REASON_SOURCE_REQUIRED        = "source_required"
+	REASON_URI_REWRITE_FAILED     = "uri_rewrite_failed"
+	REASON_NO_PERMITTED_TASKS     = "no_permitted_tasks"
+	REASON_SAMPLE_NOT_FOUND       = "sample_not_found"
+)
+
 type TaskError struct {
 	TaskStruct Task
 	Error      MyError
+	Reason     string // One of the REASON_* constants
+}
+
+// TaskSummary describes a service that was dispatched for a task and
+// the destination it was sent to.
+type TaskSummary struct {
+	PrimaryURI string
+	Task       string
+	Exchange   string
+	RoutingKey string
+	Result     string // Result of a synchronous task, empty if it is asynchronous or timed out
+	// The ACL rule allowing the service (its name or "*"), only set if
+	// the gateway is configured to explain its ACL
+	MatchedRule string `json:",omitempty"`
+}
+
+// Receipt proves that a gateway accepted tasks of an organization at a
+// given time. It is signed with the private key of the gateway.
+type Receipt struct {
+	TraceID      string
+	Timestamp    time.Time
+	Organization string
+	TaskDigest   []byte // SHA256 over the JSON-encoded accepted TaskSummaries
+	KeyId        string // Name of the gateway's key that signed the receipt
+	Signature    []byte
 }
 
+// GatewayAnswer is the answer to a ticket. Problems of the ticket as a
+// whole (e.g. its decryption, signature, expiration, or quota) are
+// reported in Error. Then nothing was dispatched, and TskErrors, Accepted
+// and Withheld are empty. Otherwise, Error is nil, and the tasks rejected
+// in whole or in part (e.g. by the ACL or their validation) are listed in
+// TskErrors. If the ticket is dispatched all or nothing and TskErrors is
+// not empty, the services which would have been accepted are listed in
+// Withheld instead of Accepted.
 type GatewayAnswer struct {
+	TraceID   string // Identifies the ticket, e.g. for cancelling it
 	Error     *MyError
 	TskErrors []TaskError
+	Accepted  []TaskSummary
+	Withheld  []TaskSummary `json:",omitempty"`
+	Receipt   *Receipt
+	DryRun    bool // The accepted tasks were only routed, but not dispatched
+	Async     bool // The tasks are dispatched in the background, see the status of the ticket
+	// The time of the gateway when it answered, to help clients
+	// detecting a drift of their clock
+	ServerTime time.Time
+	// TskErrors grouped by their reason, if the gateway is configured to
+	// summarize rejections, or if TskErrors was truncated
+	Rejections []RejectionSummary
+	// TskErrors lists only the first rejections, since the answer would be
+	// too large otherwise. Rejections counts all of them.
+	TskErrorsTruncated bool
+}
+
+// RejectionSummary counts the entries of TskErrors with the same Reason.
+type RejectionSummary struct {
+	Reason   string
+	Errors   int      // Number of entries of TskErrors
+	Services int      // Number of services they contain
+	Examples []string // Some of these services
+}
+
+// EncryptedHeader is set by the gateway on every answer to a task request.
+// It is "true", if the body is the encrypted GatewayAnswer, and "false",
+// if the body is a PlainAnswer, or the unencrypted answer of a diagnostic
+// endpoint configured to answer in plaintext.
+const EncryptedHeader = "X-Holmes-Encrypted"
+
+// Clients list the encryptions, compressions and formats of answers they
+// support in the AcceptEncryptionHeader (e.g. "aes-cbc"), the
+// AcceptCompressionHeader (e.g. "gzip, identity") and the
+// AcceptFormatHeader (e.g. "binary, json"). The gateway picks the most
+// preferred supported option of each and names them in the
+// EncryptionHeader, the CompressionHeader and the FormatHeader of its
+// answer. A client not sending these headers is assumed to support
+// aes-cbc, identity and json.
+const (
+	AcceptEncryptionHeader  = "X-Holmes-Accept-Encryption"
+	AcceptCompressionHeader = "X-Holmes-Accept-Compression"
+	AcceptFormatHeader      = "X-Holmes-Accept-Format"
+	EncryptionHeader        = "X-Holmes-Encryption"
+	CompressionHeader       = "X-Holmes-Compression"
+	FormatHeader            = "X-Holmes-Format"
+)
+
+// The encryptions, compressions and formats of answers. FORMAT_BINARY is
+// the encoding of EncodeAnswerBinary. It is only used for a GatewayAnswer,
+// other answers are always JSON. Tickets can also be encrypted with
+// ENCRYPTION_AES_GCM, which their answers then are, too.
+const (
+	ENCRYPTION_AES_CBC   = "aes-cbc"
+	ENCRYPTION_AES_GCM   = "aes-gcm"
+	COMPRESSION_GZIP     = "gzip"
+	COMPRESSION_IDENTITY = "identity"
+	FORMAT_JSON          = "json"
+	FORMAT_BINARY        = "binary"
+)
+
+// PlainAnswer is returned unencrypted by the gateway, if the request failed
+// before the symmetric key of the ticket was known.
+type PlainAnswer struct {
+	Encrypted bool // always false
+	Error     *MyError
 }
 
 func (me MyError) MarshalJSON() ([]byte, error) {
@@ -151,11 +311,194 @@ func VerifyTicket(ticket Ticket, key *rsa.PublicKey) error {
 	return Verify(sign, msg, key)
 }
 
+// The signature of a ticket covers its JSON serialization without the
+// Signature field. With CANONICALIZATION_LEGACY, this is the result of
+// json.Marshal of the decoded Ticket, which only works for signers
+// serializing exactly like Go, and ignores fields unknown to the Ticket
+// struct. With CANONICALIZATION_CANONICAL, the ticket as it was received
+// is brought into its canonical form (see CanonicalJSON).
+const (
+	CANONICALIZATION_LEGACY    = "legacy"
+	CANONICALIZATION_CANONICAL = "canonical"
+)
+
+// CanonicalJSON returns the canonical serialization of the JSON document
+// raw: the keys of all objects are sorted by their UTF-8 bytes, there is
+// no whitespace outside of strings, strings are escaped like json.Marshal
+// does without HTML-escaping, and numbers are kept as written.
+func CanonicalJSON(raw []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("Unexpected data after the JSON document")
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// canonicalTicketMessage returns the canonical serialization of the
+// ticket raw without its Signature, i.e. the signed message.
+func canonicalTicketMessage(raw []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "Signature")
+	msg, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return CanonicalJSON(msg)
+}
+
+// SignTicket signs the ticket with key, using the given canonicalization.
+func SignTicket(ticket *Ticket, key *rsa.PrivateKey, canonicalization string) error {
+	ticket.Signature = nil
+	msg, err := json.Marshal(ticket)
+	if err != nil {
+		return err
+	}
+	if canonicalization == CANONICALIZATION_CANONICAL {
+		if msg, err = canonicalTicketMessage(msg); err != nil {
+			return err
+		}
+	}
+	ticket.Signature, err = Sign(msg, key)
+	return err
+}
+
+// VerifyCanonicalTicket verifies the signature of the ticket raw, which
+// was signed with CANONICALIZATION_CANONICAL. Every field of raw is
+// covered by the signature, including fields unknown to Ticket.
+func VerifyCanonicalTicket(raw []byte, signature []byte, key *rsa.PublicKey) error {
+	msg, err := canonicalTicketMessage(raw)
+	if err != nil {
+		return err
+	}
+	return Verify(signature, msg, key)
+}
+
+const (
+	STATUS_PENDING  = "pending"  // No result was received yet
+	STATUS_PARTIAL  = "partial"  // Some, but not all results were received
+	STATUS_COMPLETE = "complete" // All expected results were received
+)
+
+// TicketStatus aggregates the results downstream services sent back for
+// the tasks of a ticket. Every exchange the ticket was dispatched to is
+// expected to send one result.
+type TicketStatus struct {
+	TraceID  string
+	Status   string
+	Expected int
+	Received int
+	Results  []string
+	// The answer of dispatching the tasks of a ticket submitted
+	// asynchronously, once they are dispatched
+	Answer *GatewayAnswer `json:",omitempty"`
+}
+
+// Cancellation is published by the gateway, if an organization cancels a
+// ticket it submitted. It lists the services dispatched for the ticket, so
+// consumers can abort their work.
+type Cancellation struct {
+	TraceID      string
+	Organization string
+	// The tenant the ticket was submitted to, empty for the default
+	// gateway
+	Tenant    string `json:",omitempty"`
+	Tasks     []TaskSummary
+	Timestamp time.Time
+}
+
+// ControlCommand is broadcast to all gateways of a deployment via their
+// control exchange, e.g. to reload the keys of every node at once. It is
+// signed by an administrative organization with its ticket key, and only
+// accepted shortly after it was issued.
+type ControlCommand struct {
+	Command     string // One of the CONTROL_* constants
+	Issued      time.Time
+	SignerKeyId string
+	Signature   []byte
+}
+
+// The commands of a ControlCommand.
+const (
+	CONTROL_RELOAD_KEYS       = "reload-keys"
+	CONTROL_FLUSH_CACHES      = "flush-caches"
+	CONTROL_ENTER_MAINTENANCE = "enter-maintenance"
+	CONTROL_LEAVE_MAINTENANCE = "leave-maintenance"
+)
+
+// EchoAnswer is returned by the echo endpoint of the gateway. It names the
+// organization that signed the ticket and the task types it requested.
+type EchoAnswer struct {
+	Error        *MyError
+	Organization string
+	Tasks        []string
+}
+
+func SignReceipt(receipt *Receipt, key *rsa.PrivateKey) error {
+	receipt.Signature = nil
+	msg, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	receipt.Signature, err = Sign(msg, key)
+	return err
+}
+
+func VerifyReceipt(receipt Receipt, key *rsa.PublicKey) error {
+	sign := receipt.Signature
+	receipt.Signature = nil
+	msg, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	return Verify(sign, msg, key)
+}
+
+func SignControlCommand(command *ControlCommand, key *rsa.PrivateKey) error {
+	command.Signature = nil
+	msg, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	command.Signature, err = Sign(msg, key)
+	return err
+}
+
+func VerifyControlCommand(command ControlCommand, key *rsa.PublicKey) error {
+	sign := command.Signature
+	command.Signature = nil
+	msg, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	return Verify(sign, msg, key)
+}
+
 func AesDecrypt(ciphertext []byte, key []byte, iv []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return []byte(""), err
 	}
+	// CBC panics on partial blocks and IVs of the wrong size
+	if len(iv) != block.BlockSize() {
+		return []byte(""), errors.New("Invalid IV size")
+	}
+	if len(ciphertext)%block.BlockSize() != 0 {
+		return []byte(""), errors.New("Ciphertext is not a multiple of the block size")
+	}
 	mode := cipher.NewCBCDecrypter(block, iv)
 	plaintext := make([]byte, len(ciphertext))
 	mode.CryptBlocks(plaintext, ciphertext)
@@ -170,6 +513,47 @@ func AesDecrypt(ciphertext []byte, key []byte, iv []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// AES_GCM_NONCE_SIZE is the length of the nonce of AES-GCM, which is sent
+// as the IV of a ticket encrypted with ENCRYPTION_AES_GCM.
+const AES_GCM_NONCE_SIZE = 12
+
+// AesGcmEncrypt encrypts and authenticates plaintext with AES-GCM. The
+// nonce must be AES_GCM_NONCE_SIZE bytes long and must never be reused
+// with the same key.
+func AesGcmEncrypt(plaintext []byte, key []byte, nonce []byte) ([]byte, error) {
+	gcm, err := newGCM(key, nonce)
+	if err != nil {
+		return []byte(""), err
+	}
+	return gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+// AesGcmDecrypt decrypts ciphertext encrypted by AesGcmEncrypt. It fails,
+// if the ciphertext was modified.
+func AesGcmDecrypt(ciphertext []byte, key []byte, nonce []byte) ([]byte, error) {
+	gcm, err := newGCM(key, nonce)
+	if err != nil {
+		return []byte(""), err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return []byte(""), err
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte, nonce []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	// Seal and Open panic on nonces of the wrong size
+	if len(nonce) != AES_GCM_NONCE_SIZE {
+		return nil, errors.New("Invalid IV size")
+	}
+	return cipher.NewGCM(block)
+}
+
 func RsaEncrypt(plaintext []byte, key *rsa.PublicKey) ([]byte, error) {
 	label := []byte("")
 	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, plaintext, label)
@@ -182,12 +566,50 @@ func RsaDecrypt(ciphertext []byte, key *rsa.PrivateKey) ([]byte, error) {
 	return plaintext, err
 }
 
+// A KeySource provides the key files loaded by LoadKeysFromAndWatch.
+// OSKeys reads them from the filesystem of the OS. Since Go 1.16,
+// KeysFromFS reads them from an fs.FS, e.g. an embed.FS.
+type KeySource interface {
+	// ReadKey returns the contents of the key file path.
+	ReadKey(path string) ([]byte, error)
+	// WalkKeys calls onAdd with the path of every key file with the
+	// extension ext in dir.
+	WalkKeys(dir string, ext string, onAdd func(string)) error
+}
+
+type osKeys struct{}
+
+func (osKeys) ReadKey(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (osKeys) WalkKeys(dir string, ext string, onAdd func(string)) error {
+	return filepath.Walk(dir,
+		func(path string, fi os.FileInfo, err error) error {
+			return keyWalkFn(ext, onAdd, path, fi, err)
+		})
+}
+
+// OSKeys is the KeySource reading the filesystem of the OS.
+var OSKeys KeySource = osKeys{}
+
 func LoadPrivateKey(path string) (*rsa.PrivateKey, string, error) {
+	return LoadPrivateKeyFrom(OSKeys, path)
+}
+
+// LoadPrivateKeyFrom is LoadPrivateKey for a key file of src.
+func LoadPrivateKeyFrom(src KeySource, path string) (*rsa.PrivateKey, string, error) {
 	log.Println(path)
-	f, err := ioutil.ReadFile(path)
+	f, err := src.ReadKey(path)
 	if err != nil {
 		return nil, "Read", err
 	}
+	return ParsePrivateKey(f, filepath.Base(path))
+}
+
+// ParsePrivateKey parses the PEM-encoded private key f read from the file
+// name and returns it with the name of the key.
+func ParsePrivateKey(f []byte, name string) (*rsa.PrivateKey, string, error) {
 	priv, rem := pem.Decode(f)
 	if len(rem) != 0 || priv == nil {
 		return nil, "Decode", errors.New("Key not in pem-format")
@@ -197,18 +619,28 @@ func LoadPrivateKey(path string) (*rsa.PrivateKey, string, error) {
 		return nil, "Parse", err
 	}
 
-	// strip the path from its directory and ".priv"-extension
-	path = filepath.Base(path)
-	path = path[:len(path)-5]
-	return (*rsa.PrivateKey)(key), path, nil
+	// strip the ".priv"-extension
+	name = name[:len(name)-5]
+	return (*rsa.PrivateKey)(key), name, nil
 }
 
 func LoadPublicKey(path string) (*rsa.PublicKey, string, error) {
+	return LoadPublicKeyFrom(OSKeys, path)
+}
+
+// LoadPublicKeyFrom is LoadPublicKey for a key file of src.
+func LoadPublicKeyFrom(src KeySource, path string) (*rsa.PublicKey, string, error) {
 	log.Println(path)
-	f, err := ioutil.ReadFile(path)
+	f, err := src.ReadKey(path)
 	if err != nil {
 		return nil, "Read", err
 	}
+	return ParsePublicKey(f, filepath.Base(path))
+}
+
+// ParsePublicKey parses the PEM-encoded public key f read from the file
+// name and returns it with the name of the key.
+func ParsePublicKey(f []byte, name string) (*rsa.PublicKey, string, error) {
 	pub, rem := pem.Decode(f)
 	if len(rem) != 0 || pub == nil {
 		return nil, "Decode", errors.New("Key not in pem-format")
@@ -218,13 +650,12 @@ func LoadPublicKey(path string) (*rsa.PublicKey, string, error) {
 		return nil, "Parse", err
 	}
 
-	// strip the path from its directory and ".pub"-extension
-	path = filepath.Base(path)
-	path = path[:len(path)-4]
-	return key.(*rsa.PublicKey), path, nil
+	// strip the ".pub"-extension
+	name = name[:len(name)-4]
+	return key.(*rsa.PublicKey), name, nil
 }
 
-func dirWatcherFunc(watcher *fsnotify.Watcher, ext string, onRemove func(string), onAdd func(string)) {
+func dirWatcherFunc(watcher *fsnotify.Watcher, ext string, queue *keyEventQueue, onRemove func(string), onAdd func(string)) {
 	for {
 		select {
 		case ev := <-watcher.Event:
@@ -232,19 +663,22 @@ func dirWatcherFunc(watcher *fsnotify.Watcher, ext string, onRemove func(string)
 				continue
 			}
 			log.Println("event:", ev)
+			path := ev.Name
 			if ev.IsCreate() {
-				log.Println("New key", ev.Name)
-				onAdd(ev.Name)
+				log.Println("New key", path)
+				queue.run(path, func() { onAdd(path) })
 			} else if ev.IsDelete() || ev.IsRename() {
 				// For renamed keys, there is a CREATE-event afterwards so it is just removed here
-				log.Println("Removed key", ev.Name)
-				name := filepath.Base(ev.Name)
+				log.Println("Removed key", path)
+				name := filepath.Base(path)
 				name = name[:len(name)-len(ext)]
-				onRemove(name)
+				queue.run(path, func() { onRemove(name) })
 			} else if ev.IsModify() {
-				log.Println("Modified key", ev.Name)
-				onRemove(ev.Name)
-				onAdd(ev.Name)
+				log.Println("Modified key", path)
+				queue.run(path, func() {
+					onRemove(path)
+					onAdd(path)
+				})
 			}
 			//log.Println(keys)
 
@@ -254,18 +688,43 @@ func dirWatcherFunc(watcher *fsnotify.Watcher, ext string, onRemove func(string)
 	}
 }
 
+// DirWatcher calls onAdd and onRemove, when keys with the extension ext
+// are added to or removed from dir. If the directory can't be watched,
+// e.g. because the inotify limit of the system was reached, or if
+// polling is forced, the directory is polled instead.
 func DirWatcher(dir string, ext string, onRemove func(string), onAdd func(string)) {
-	// Setup directory watcher
+	if ForceKeyPolling {
+		go pollDir(dir, ext, KeyPollInterval, newKeyEventQueue(KeyEventWorkers), keyFiles(dir, ext), onRemove, onAdd)
+		return
+	}
+	err := watchDir(dir, ext, onRemove, onAdd)
+	if err != nil {
+		log.Printf("Couldn't watch %s (%s), polling it every %s instead. If the inotify limit was reached, raise fs.inotify.max_user_watches or fs.inotify.max_user_instances", dir, err, KeyPollInterval)
+		go pollDir(dir, ext, KeyPollInterval, newKeyEventQueue(KeyEventWorkers), keyFiles(dir, ext), onRemove, onAdd)
+	}
+}
+
+// startWatcher watches dir using inotify.
+func startWatcher(dir string, ext string, onRemove func(string), onAdd func(string)) error {
 	watcher, err := fsnotify.NewWatcher()
-	FailOnError(err, "Error setting up directory-watcher")
+	if err != nil {
+		return err
+	}
+	err = watcher.Watch(dir)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
 
 	// Process events
-	go dirWatcherFunc(watcher, ext, onRemove, onAdd)
-	err = watcher.Watch(dir)
-	FailOnError(err, "Error setting up directory-watcher")
+	go dirWatcherFunc(watcher, ext, newKeyEventQueue(KeyEventWorkers), onRemove, onAdd)
+	return nil
 }
 
 func keyWalkFn(ext string, onAdd func(string), path string, fi os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
 	if fi.IsDir() {
 		return nil
 	}
@@ -277,11 +736,18 @@ func keyWalkFn(ext string, onAdd func(string), path string, fi os.FileInfo, err
 }
 
 func LoadKeysAndWatch(dir string, ext string, onRemove func(string), onAdd func(string)) {
-	err := filepath.Walk(dir,
-		func(path string, fi os.FileInfo, err error) error {
-			return keyWalkFn(ext, onAdd, path, fi, err)
-		})
+	LoadKeysFromAndWatch(OSKeys, dir, ext, onRemove, onAdd)
+}
+
+// LoadKeysFromAndWatch calls onAdd with the path of every key file with
+// the extension ext in dir of src, and watches dir for changes like
+// DirWatcher. Only the directories of OSKeys can be watched, the keys of
+// other sources are loaded once.
+func LoadKeysFromAndWatch(src KeySource, dir string, ext string, onRemove func(string), onAdd func(string)) {
+	err := src.WalkKeys(dir, ext, onAdd)
 	FailOnError(err, "Error loading keys ")
 
-	DirWatcher(dir, ext, onRemove, onAdd)
+	if src == OSKeys {
+		DirWatcher(dir, ext, onRemove, onAdd)
+	}
 }
@@ -0,0 +1,62 @@
+package tasking
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	a, err := CanonicalJSON([]byte(`{"b": [1, 2.50, "<x>"], "a": {"d": null, "c": true}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := CanonicalJSON([]byte("{\"a\":{\"c\":true,\"d\":null},\n\"b\":[1,2.50,\"<x>\"]}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"a":{"c":true,"d":null},"b":[1,2.50,"<x>"]}`
+	if string(a) != expected || string(b) != expected {
+		t.Errorf("expected %s, got %s and %s", expected, a, b)
+	}
+	if _, err := CanonicalJSON([]byte(`{} {}`)); err == nil {
+		t.Errorf("expected trailing data to be rejected")
+	}
+}
+
+func TestSignTicketCanonical(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := Ticket{
+		Expiration:  time.Now().Add(time.Hour),
+		Tasks:       []Task{{PrimaryURI: "abc", Tasks: map[string][]string{"YARA": {}, "PEINFO": {}}}},
+		SignerKeyId: "org1"}
+	if err := SignTicket(&ticket, key, CANONICALIZATION_CANONICAL); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(ticket)
+	if err := VerifyCanonicalTicket(raw, ticket.Signature, &key.PublicKey); err != nil {
+		t.Errorf("canonically signed ticket not verified: %s", err)
+	}
+
+	// the same ticket with a different field order and formatting
+	var fields map[string]json.RawMessage
+	json.Unmarshal(raw, &fields)
+	reordered := []byte(`{"SignerKeyId": ` + string(fields["SignerKeyId"]) +
+		`, "Signature": ` + string(fields["Signature"]) +
+		`, "Tasks": ` + string(fields["Tasks"]) +
+		`, "Expiration": ` + string(fields["Expiration"]) + `}`)
+	if err := VerifyCanonicalTicket(reordered, ticket.Signature, &key.PublicKey); err != nil {
+		t.Errorf("reordered ticket not verified: %s", err)
+	}
+
+	// fields unknown to Ticket are covered by the signature as well
+	tampered := append(append([]byte{}, raw[:len(raw)-1]...), []byte(`,"Extra":1}`)...)
+	if err := VerifyCanonicalTicket(tampered, ticket.Signature, &key.PublicKey); err == nil {
+		t.Errorf("expected an added field to invalidate the signature")
+	}
+}